@@ -0,0 +1,288 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package classifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/CrawX/go-imap-assassin/domain"
+	"github.com/CrawX/go-imap-assassin/log"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// UnhealthyAfterFailures is the number of consecutive failures after which an endpoint is taken out of rotation
+	UnhealthyAfterFailures = 3
+	// ProbeInterval is the minimum time between two pings to an unhealthy endpoint
+	ProbeInterval = 30 * time.Second
+)
+
+type BalanceStrategy string
+
+const (
+	RoundRobin  = BalanceStrategy("roundrobin")
+	LeastLoaded = BalanceStrategy("leastloaded")
+)
+
+type endpoint struct {
+	name       string
+	classifier domain.SpamClassifier
+
+	inFlight  int
+	failures  int
+	unhealthy bool
+	lastProbe time.Time
+}
+
+// BalancingSpamClassifier spreads Check and Learn calls over multiple endpoints of the same classifier. Failed calls
+// are transparently retried on the other endpoints, endpoints that fail repeatedly are only used again after a
+// successful Ping. Learning on any endpoint assumes that all endpoints share their statistics, e.g. via redis.
+type BalancingSpamClassifier struct {
+	endpoints []*endpoint
+	strategy  BalanceStrategy
+
+	unhealthyAfter int
+	probeInterval  time.Duration
+	now            func() time.Time
+
+	next  int
+	mutex sync.Mutex
+
+	l *logrus.Logger
+}
+
+// NewBalancingSpamClassifier creates a balancer over classifiers, names are used for logging and must have the same
+// length as classifiers.
+func NewBalancingSpamClassifier(strategy BalanceStrategy, names []string, classifiers []domain.SpamClassifier) (*BalancingSpamClassifier, error) {
+	if strategy != RoundRobin && strategy != LeastLoaded {
+		return nil, fmt.Errorf("unsupported balance strategy %v", strategy)
+	}
+	if len(classifiers) == 0 {
+		return nil, fmt.Errorf("at least one classifier is required")
+	}
+	if len(names) != len(classifiers) {
+		return nil, fmt.Errorf("expected %d names, got %d", len(classifiers), len(names))
+	}
+
+	endpoints := make([]*endpoint, len(classifiers))
+	for i := range classifiers {
+		endpoints[i] = &endpoint{name: names[i], classifier: classifiers[i]}
+	}
+
+	return &BalancingSpamClassifier{
+		endpoints:      endpoints,
+		strategy:       strategy,
+		unhealthyAfter: UnhealthyAfterFailures,
+		probeInterval:  ProbeInterval,
+		now:            time.Now,
+		l:              log.Logger(log.LOG_CLASSIFIER),
+	}, nil
+}
+
+// MarkUnhealthy takes the endpoint at index, in the order passed to NewBalancingSpamClassifier, out of rotation until
+// it answers a probe, e.g. because it was unreachable on startup. The first probe is due after the probe interval.
+func (b *BalancingSpamClassifier) MarkUnhealthy(index int) error {
+	if index < 0 || index >= len(b.endpoints) {
+		return fmt.Errorf("no endpoint at index %d", index)
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	e := b.endpoints[index]
+	e.unhealthy = true
+	e.lastProbe = b.now()
+	return nil
+}
+
+func (b *BalancingSpamClassifier) Check(ctx context.Context, rawMail []byte) *domain.SpamResult {
+	var result *domain.SpamResult
+	err := b.do(ctx, func(c domain.SpamClassifier) error {
+		result = c.Check(ctx, rawMail)
+		return result.Error
+	})
+	if err != nil {
+		return &domain.SpamResult{Error: err}
+	}
+
+	return result
+}
+
+func (b *BalancingSpamClassifier) Learn(ctx context.Context, learnType domain.LearnType, rawMail []byte) error {
+	return b.do(ctx, func(c domain.SpamClassifier) error {
+		return c.Learn(ctx, learnType, rawMail)
+	})
+}
+
+// Ping succeeds if at least one endpoint is reachable.
+func (b *BalancingSpamClassifier) Ping(ctx context.Context) error {
+	var err error
+	for _, e := range b.endpoints {
+		err = e.classifier.Ping(ctx)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no endpoint reachable: %w", err)
+}
+
+// Info reports the infos of all endpoints along with their health in the balancer. It only fails if no endpoint is
+// reachable.
+func (b *BalancingSpamClassifier) Info(ctx context.Context) *domain.ClassifierInfo {
+	info := &domain.ClassifierInfo{Name: "balancer " + string(b.strategy)}
+
+	reachable := 0
+	var err error
+	for _, e := range b.endpoints {
+		endpointInfo := e.classifier.Info(ctx)
+		if endpointInfo.Error == nil {
+			reachable++
+		} else {
+			err = endpointInfo.Error
+		}
+
+		b.mutex.Lock()
+		health := "healthy"
+		if e.unhealthy {
+			health = "unhealthy"
+		}
+		if endpointInfo.Stats == nil {
+			endpointInfo.Stats = map[string]string{}
+		}
+		endpointInfo.Stats["balancer health"] = health
+		endpointInfo.Stats["balancer failures"] = strconv.Itoa(e.failures)
+		b.mutex.Unlock()
+
+		info.Endpoints = append(info.Endpoints, endpointInfo)
+	}
+
+	info.Stats = map[string]string{"reachable endpoints": fmt.Sprintf("%d/%d", reachable, len(b.endpoints))}
+	if reachable == 0 {
+		info.Error = fmt.Errorf("no endpoint reachable: %w", err)
+	}
+
+	return info
+}
+
+func (b *BalancingSpamClassifier) do(ctx context.Context, f func(c domain.SpamClassifier) error) error {
+	tried := map[*endpoint]bool{}
+	var lastErr error
+	for len(tried) < len(b.endpoints) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		e := b.acquire(ctx, tried)
+		if e == nil {
+			break
+		}
+
+		err := f(e.classifier)
+		if errors.Is(err, domain.ErrPermanent) || (err != nil && ctx.Err() != nil) {
+			// the endpoint is fine, the other endpoints would fail just the same
+			b.release(e, nil)
+			return err
+		}
+		b.release(e, err)
+		if err == nil {
+			return nil
+		}
+
+		tried[e] = true
+		lastErr = err
+		b.l.WithFields(logrus.Fields{"endpoint": e.name, "error": err}).Debug("Classifier endpoint failed, failing over")
+	}
+
+	if lastErr == nil {
+		return fmt.Errorf("no healthy classifier endpoint available")
+	}
+
+	return fmt.Errorf("all %d tried classifier endpoints failed, last error: %w", len(tried), lastErr)
+}
+
+// acquire picks the next endpoint according to the strategy from all healthy endpoints that haven't been tried.
+func (b *BalancingSpamClassifier) acquire(ctx context.Context, tried map[*endpoint]bool) *endpoint {
+	b.probe(ctx, tried)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var picked *endpoint
+	for i := 0; i < len(b.endpoints); i++ {
+		index := (b.next + i) % len(b.endpoints)
+		e := b.endpoints[index]
+		if e.unhealthy || tried[e] {
+			continue
+		}
+
+		if b.strategy == RoundRobin {
+			picked = e
+			b.next = index + 1
+			break
+		}
+
+		if picked == nil || e.inFlight < picked.inFlight {
+			picked = e
+		}
+	}
+
+	if picked != nil {
+		picked.inFlight++
+	}
+
+	return picked
+}
+
+// probe pings all unhealthy endpoints whose last probe is older than the probe interval and brings them back into
+// rotation if the ping succeeds.
+func (b *BalancingSpamClassifier) probe(ctx context.Context, tried map[*endpoint]bool) {
+	due := []*endpoint{}
+
+	b.mutex.Lock()
+	now := b.now()
+	for _, e := range b.endpoints {
+		if e.unhealthy && !tried[e] && now.Sub(e.lastProbe) >= b.probeInterval {
+			e.lastProbe = now
+			due = append(due, e)
+		}
+	}
+	b.mutex.Unlock()
+
+	for _, e := range due {
+		err := e.classifier.Ping(ctx)
+
+		b.mutex.Lock()
+		if err == nil {
+			e.unhealthy = false
+			e.failures = 0
+			b.l.WithFields(logrus.Fields{"endpoint": e.name}).Info("Classifier endpoint is healthy again")
+		} else {
+			b.l.WithFields(logrus.Fields{"endpoint": e.name, "error": err}).Debug("Classifier endpoint is still unhealthy")
+		}
+		b.mutex.Unlock()
+	}
+}
+
+func (b *BalancingSpamClassifier) release(e *endpoint, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	e.inFlight--
+	if err == nil {
+		e.failures = 0
+		return
+	}
+
+	e.failures++
+	if !e.unhealthy && e.failures >= b.unhealthyAfter {
+		e.unhealthy = true
+		e.lastProbe = b.now()
+		b.l.WithFields(logrus.Fields{"endpoint": e.name, "failures": e.failures, "error": err}).Warn("Classifier endpoint marked as unhealthy")
+	}
+}
@@ -0,0 +1,187 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package classifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/CrawX/go-imap-assassin/domain"
+	"github.com/CrawX/go-imap-assassin/domain/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupBalancer(t *testing.T, strategy BalanceStrategy, count int) (*gomock.Controller, *BalancingSpamClassifier, []*mocks.MockSpamClassifier) {
+	ctrl := gomock.NewController(t)
+
+	endpointMocks := []*mocks.MockSpamClassifier{}
+	endpoints := []*endpoint{}
+	for i := 0; i < count; i++ {
+		m := mocks.NewMockSpamClassifier(ctrl)
+		endpointMocks = append(endpointMocks, m)
+		endpoints = append(endpoints, &endpoint{name: fmt.Sprintf("endpoint%d", i), classifier: m})
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	return ctrl, &BalancingSpamClassifier{
+		endpoints:      endpoints,
+		strategy:       strategy,
+		unhealthyAfter: 2,
+		probeInterval:  time.Minute,
+		now:            time.Now,
+		l:              logger,
+	}, endpointMocks
+}
+
+func TestBalancingSpamClassifier_RoundRobin(t *testing.T) {
+	ctrl, balancer, endpointMocks := setupBalancer(t, RoundRobin, 2)
+	defer ctrl.Finish()
+
+	mail1, mail2, mail3 := []byte{0}, []byte{1}, []byte{2}
+	gomock.InOrder(
+		endpointMocks[0].EXPECT().Check(gomock.Any(), gomock.Eq(mail1)).Return(&domain.SpamResult{Score: 1}),
+		endpointMocks[0].EXPECT().Check(gomock.Any(), gomock.Eq(mail3)).Return(&domain.SpamResult{Score: 3}),
+	)
+	endpointMocks[1].EXPECT().Check(gomock.Any(), gomock.Eq(mail2)).Return(&domain.SpamResult{Score: 2})
+
+	assert.Equal(t, 1.0, balancer.Check(context.Background(), mail1).Score)
+	assert.Equal(t, 2.0, balancer.Check(context.Background(), mail2).Score)
+	assert.Equal(t, 3.0, balancer.Check(context.Background(), mail3).Score)
+}
+
+func TestBalancingSpamClassifier_LeastLoaded(t *testing.T) {
+	ctrl, balancer, endpointMocks := setupBalancer(t, LeastLoaded, 2)
+	defer ctrl.Finish()
+
+	balancer.endpoints[0].inFlight = 3
+	balancer.endpoints[1].inFlight = 1
+
+	endpointMocks[1].EXPECT().Learn(gomock.Any(), gomock.Eq(domain.LearnSpam), gomock.Any()).Return(nil)
+
+	assert.NoError(t, balancer.Learn(context.Background(), domain.LearnSpam, []byte{0}))
+	assert.Equal(t, 1, balancer.endpoints[1].inFlight, "in-flight counter should be released")
+}
+
+func TestBalancingSpamClassifier_Failover(t *testing.T) {
+	ctrl, balancer, endpointMocks := setupBalancer(t, RoundRobin, 2)
+	defer ctrl.Finish()
+
+	err := errors.New("error")
+	endpointMocks[0].EXPECT().Check(gomock.Any(), gomock.Any()).Return(&domain.SpamResult{Error: err}).Times(2)
+	endpointMocks[1].EXPECT().Check(gomock.Any(), gomock.Any()).Return(&domain.SpamResult{Score: 1}).Times(3)
+
+	// first call fails over to the second endpoint
+	assert.NoError(t, balancer.Check(context.Background(), []byte{0}).Error)
+	assert.False(t, balancer.endpoints[0].unhealthy)
+	// second call starts at endpoint 0 again, fails over and marks endpoint 0 as unhealthy
+	balancer.next = 0
+	assert.NoError(t, balancer.Check(context.Background(), []byte{0}).Error)
+	assert.True(t, balancer.endpoints[0].unhealthy)
+	// unhealthy endpoints are skipped without probing within the probe interval
+	balancer.next = 0
+	assert.NoError(t, balancer.Check(context.Background(), []byte{0}).Error)
+}
+
+func TestBalancingSpamClassifier_Probe(t *testing.T) {
+	ctrl, balancer, endpointMocks := setupBalancer(t, RoundRobin, 1)
+	defer ctrl.Finish()
+
+	now := time.Now()
+	balancer.now = func() time.Time { return now }
+	balancer.endpoints[0].unhealthy = true
+	balancer.endpoints[0].failures = 2
+	balancer.endpoints[0].lastProbe = now
+
+	// within the probe interval
+	assert.EqualError(t, balancer.Learn(context.Background(), domain.LearnHam, []byte{0}), "no healthy classifier endpoint available")
+
+	// probe fails
+	now = now.Add(time.Minute)
+	endpointMocks[0].EXPECT().Ping(gomock.Any()).Return(errors.New("down"))
+	assert.EqualError(t, balancer.Check(context.Background(), []byte{0}).Error, "no healthy classifier endpoint available")
+
+	// probe succeeds
+	now = now.Add(time.Minute)
+	endpointMocks[0].EXPECT().Ping(gomock.Any()).Return(nil)
+	endpointMocks[0].EXPECT().Learn(gomock.Any(), gomock.Eq(domain.LearnHam), gomock.Any()).Return(nil)
+	assert.NoError(t, balancer.Learn(context.Background(), domain.LearnHam, []byte{0}))
+	assert.False(t, balancer.endpoints[0].unhealthy)
+}
+
+func TestBalancingSpamClassifier_MarkUnhealthy(t *testing.T) {
+	ctrl, balancer, endpointMocks := setupBalancer(t, RoundRobin, 2)
+	defer ctrl.Finish()
+
+	now := time.Now()
+	balancer.now = func() time.Time { return now }
+	require.NoError(t, balancer.MarkUnhealthy(0))
+	assert.EqualError(t, balancer.MarkUnhealthy(2), "no endpoint at index 2")
+
+	// within the probe interval only the healthy endpoint is used
+	endpointMocks[1].EXPECT().Learn(gomock.Any(), domain.LearnHam, gomock.Any()).Return(nil)
+	assert.NoError(t, balancer.Learn(context.Background(), domain.LearnHam, []byte{0}))
+
+	// the endpoint is back once it answers a probe
+	now = now.Add(time.Minute)
+	balancer.next = 0
+	endpointMocks[0].EXPECT().Ping(gomock.Any()).Return(nil)
+	endpointMocks[0].EXPECT().Learn(gomock.Any(), domain.LearnHam, gomock.Any()).Return(nil)
+	assert.NoError(t, balancer.Learn(context.Background(), domain.LearnHam, []byte{0}))
+	assert.False(t, balancer.endpoints[0].unhealthy)
+}
+
+func TestBalancingSpamClassifier_AllFailed(t *testing.T) {
+	ctrl, balancer, endpointMocks := setupBalancer(t, RoundRobin, 2)
+	defer ctrl.Finish()
+
+	endpointMocks[0].EXPECT().Learn(gomock.Any(), gomock.Any(), gomock.Any()).Return(errors.New("error 0"))
+	endpointMocks[1].EXPECT().Learn(gomock.Any(), gomock.Any(), gomock.Any()).Return(errors.New("error 1"))
+
+	assert.EqualError(t, balancer.Learn(context.Background(), domain.LearnSpam, []byte{0}), "all 2 tried classifier endpoints failed, last error: error 1")
+}
+
+func TestBalancingSpamClassifier_PermanentError(t *testing.T) {
+	ctrl, balancer, endpointMocks := setupBalancer(t, RoundRobin, 2)
+	defer ctrl.Finish()
+
+	permanent := domain.Permanent(errors.New("could not parse mail"))
+	endpointMocks[0].EXPECT().Learn(gomock.Any(), domain.LearnHam, gomock.Any()).Return(permanent).Times(2)
+
+	// no failover to the second endpoint and the first one stays healthy
+	assert.Equal(t, permanent, balancer.Learn(context.Background(), domain.LearnHam, []byte{0}))
+	balancer.next = 0
+	assert.Equal(t, permanent, balancer.Learn(context.Background(), domain.LearnHam, []byte{0}))
+	assert.False(t, balancer.endpoints[0].unhealthy)
+}
+
+func TestBalancingSpamClassifier_Info(t *testing.T) {
+	ctrl, balancer, endpointMocks := setupBalancer(t, LeastLoaded, 2)
+	defer ctrl.Finish()
+
+	balancer.endpoints[1].unhealthy = true
+	balancer.endpoints[1].failures = 2
+	down := errors.New("down")
+	endpointMocks[0].EXPECT().Info(gomock.Any()).Return(&domain.ClassifierInfo{Name: "first", Version: "1.0"})
+	endpointMocks[1].EXPECT().Info(gomock.Any()).Return(&domain.ClassifierInfo{Name: "second", Error: down})
+
+	assert.Equal(t, &domain.ClassifierInfo{
+		Name:  "balancer leastloaded",
+		Stats: map[string]string{"reachable endpoints": "1/2"},
+		Endpoints: []*domain.ClassifierInfo{
+			{Name: "first", Version: "1.0", Stats: map[string]string{"balancer health": "healthy", "balancer failures": "0"}},
+			{Name: "second", Error: down, Stats: map[string]string{"balancer health": "unhealthy", "balancer failures": "2"}},
+		},
+	}, balancer.Info(context.Background()))
+
+	endpointMocks[0].EXPECT().Info(gomock.Any()).Return(&domain.ClassifierInfo{Name: "first", Error: down})
+	endpointMocks[1].EXPECT().Info(gomock.Any()).Return(&domain.ClassifierInfo{Name: "second", Error: down})
+	assert.EqualError(t, balancer.Info(context.Background()).Error, "no endpoint reachable: down")
+}
@@ -0,0 +1,327 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package bayes
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/CrawX/go-imap-assassin/domain"
+	"github.com/CrawX/go-imap-assassin/log"
+	"github.com/CrawX/go-imap-assassin/mail"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultThreshold    = 0.9
+	DefaultMinTraining  = 20
+	DefaultReportTokens = 15
+
+	// unknownWordStrength and unknownWordProb are Robinson's s and x: a token seen n times gets a probability
+	// of (s*x + n*p) / (s + n), so rare tokens stay close to neutral
+	unknownWordStrength = 0.45
+	unknownWordProb     = 0.5
+	// minDeviation ignores tokens that are too close to neutral to say anything about the mail
+	minDeviation = 0.1
+	// maxClues limits the number of most significant tokens combined into the mail's probability
+	maxClues = 150
+)
+
+// Bayes is a naive Bayes classifier that combines token probabilities with Fisher's method (chi-squared), as done
+// by SpamBayes and bogofilter. Token counts are kept in the TokenStore.
+type Bayes struct {
+	store domain.TokenStore
+
+	threshold    float64
+	minSpam      int64
+	minHam       int64
+	reportTokens int
+
+	untrainedOnce sync.Once
+	l             *logrus.Logger
+}
+
+type ConfigFunc func(b *Bayes) error
+
+// Threshold sets the spam probability between 0 and 1 from which mails are classified as spam.
+func Threshold(threshold float64) ConfigFunc {
+	return func(b *Bayes) error {
+		if threshold <= 0 || threshold > 1 {
+			return fmt.Errorf("Threshold must be within (0, 1]")
+		}
+
+		b.threshold = threshold
+		return nil
+	}
+}
+
+// MinTraining sets the number of learned spam and ham mails required before mails are classified.
+func MinTraining(spam, ham int) ConfigFunc {
+	return func(b *Bayes) error {
+		if spam < 1 || ham < 1 {
+			return fmt.Errorf("MinTraining requires at least one spam and one ham mail")
+		}
+
+		b.minSpam = int64(spam)
+		b.minHam = int64(ham)
+		return nil
+	}
+}
+
+// ReportTokens sets the number of most significant tokens listed in spam reports.
+func ReportTokens(tokens int) ConfigFunc {
+	return func(b *Bayes) error {
+		if tokens < 0 {
+			return fmt.Errorf("ReportTokens cannot be negative")
+		}
+
+		b.reportTokens = tokens
+		return nil
+	}
+}
+
+func NewBayes(store domain.TokenStore, configFunc ...ConfigFunc) (*Bayes, error) {
+	bayes := &Bayes{
+		store:        store,
+		threshold:    DefaultThreshold,
+		minSpam:      DefaultMinTraining,
+		minHam:       DefaultMinTraining,
+		reportTokens: DefaultReportTokens,
+		l:            log.Logger(log.LOG_CLASSIFIER),
+	}
+	for _, f := range configFunc {
+		err := f(bayes)
+		if err != nil {
+			return nil, fmt.Errorf("error applying configuration: %w", err)
+		}
+	}
+
+	return bayes, nil
+}
+
+func (b *Bayes) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	_, _, err := b.store.TrainingCounts()
+	if err != nil {
+		return fmt.Errorf("could not read training counts: %w", err)
+	}
+
+	return nil
+}
+
+// Info reports the number of learned mails and whether enough have been learned to classify.
+func (b *Bayes) Info(ctx context.Context) *domain.ClassifierInfo {
+	info := &domain.ClassifierInfo{Name: "bayes"}
+	if err := ctx.Err(); err != nil {
+		info.Error = err
+		return info
+	}
+
+	nspam, nham, err := b.store.TrainingCounts()
+	if err != nil {
+		info.Error = fmt.Errorf("could not read training counts: %w", err)
+		return info
+	}
+
+	info.Stats = map[string]string{
+		"learned spam": strconv.FormatInt(nspam, 10),
+		"learned ham":  strconv.FormatInt(nham, 10),
+		"trained":      strconv.FormatBool(nspam >= b.minSpam && nham >= b.minHam),
+	}
+	return info
+}
+
+type clue struct {
+	token       string
+	probability float64
+	spam        int64
+	ham         int64
+}
+
+// Check classifies rawMail. Until enough mails have been learned there is no verdict yet, so mails are reported as unsure
+// instead of failing the run that is meant to learn them, they are checked again once the classifier is trained.
+func (b *Bayes) Check(ctx context.Context, rawMail []byte) *domain.SpamResult {
+	if err := ctx.Err(); err != nil {
+		return errResult(err)
+	}
+
+	nspam, nham, err := b.store.TrainingCounts()
+	if err != nil {
+		return errResult(fmt.Errorf("could not read training counts: %w", err))
+	}
+
+	if nspam < b.minSpam || nham < b.minHam {
+		fields := logrus.Fields{"spam": nspam, "ham": nham, "minspam": b.minSpam, "minham": b.minHam}
+		b.untrainedOnce.Do(func() {
+			b.l.WithFields(fields).Info("Not enough mails learned yet, leaving mails unchecked")
+		})
+		b.l.WithFields(fields).Debug("Not enough mails learned yet, skipping mail")
+		return &domain.SpamResult{Unsure: true}
+	}
+
+	tokens, err := mail.Tokens(rawMail)
+	if err != nil {
+		return errResult(domain.Permanent(fmt.Errorf("could not tokenize mail: %w", err)))
+	}
+
+	counts, err := b.store.TokenCounts(tokens)
+	if err != nil {
+		return errResult(fmt.Errorf("could not read token counts: %w", err))
+	}
+
+	clues := significantClues(counts, nspam, nham)
+	probability := chi2Probability(clues)
+
+	result := &domain.SpamResult{
+		IsSpam: probability >= b.threshold,
+		Score:  probability,
+	}
+
+	if result.IsSpam {
+		result.Body, err = b.report(rawMail, probability, clues, nspam, nham)
+		if err != nil {
+			return errResult(domain.Permanent(fmt.Errorf("could not create report: %w", err)))
+		}
+	}
+
+	return result
+}
+
+func (b *Bayes) Learn(ctx context.Context, learnType domain.LearnType, rawMail []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if learnType != domain.LearnSpam && learnType != domain.LearnHam {
+		return domain.Permanent(fmt.Errorf("unsupported learn type %v", learnType))
+	}
+
+	unwrapped, err := mail.UnwrapSpamassassinReport(rawMail)
+	if err != nil {
+		return domain.Permanent(fmt.Errorf("could not unwrap SpamAssassin-style report: %w", err))
+	}
+
+	tokens, err := mail.Tokens(unwrapped)
+	if err != nil {
+		return domain.Permanent(fmt.Errorf("could not tokenize mail: %w", err))
+	}
+
+	err = b.store.LearnTokens(learnType, tokens)
+	if err != nil {
+		return fmt.Errorf("could not save tokens: %w", err)
+	}
+
+	return nil
+}
+
+// significantClues calculates Robinson's token probabilities and returns the tokens deviating most from neutral,
+// most significant first.
+func significantClues(counts map[string]*domain.TokenCount, nspam, nham int64) []*clue {
+	clues := []*clue{}
+	for token, count := range counts {
+		if count.Spam+count.Ham == 0 {
+			continue
+		}
+
+		spamRatio := float64(count.Spam) / float64(nspam)
+		hamRatio := float64(count.Ham) / float64(nham)
+		p := spamRatio / (spamRatio + hamRatio)
+
+		n := float64(count.Spam + count.Ham)
+		probability := (unknownWordStrength*unknownWordProb + n*p) / (unknownWordStrength + n)
+
+		if math.Abs(probability-0.5) < minDeviation {
+			continue
+		}
+
+		clues = append(clues, &clue{token: token, probability: probability, spam: count.Spam, ham: count.Ham})
+	}
+
+	sort.Slice(clues, func(i, j int) bool {
+		di, dj := math.Abs(clues[i].probability-0.5), math.Abs(clues[j].probability-0.5)
+		if di == dj {
+			return clues[i].token < clues[j].token
+		}
+		return di > dj
+	})
+
+	if len(clues) > maxClues {
+		clues = clues[:maxClues]
+	}
+
+	return clues
+}
+
+// chi2Probability combines the clues' probabilities using Fisher's method. Without any clues, the mail is neutral.
+func chi2Probability(clues []*clue) float64 {
+	if len(clues) == 0 {
+		return 0.5
+	}
+
+	var hamEvidence, spamEvidence float64
+	for _, c := range clues {
+		p := math.Min(math.Max(c.probability, 0.01), 0.99)
+		hamEvidence += math.Log(p)
+		spamEvidence += math.Log(1 - p)
+	}
+
+	n := 2 * len(clues)
+	spamness := 1 - chi2Q(-2*spamEvidence, n)
+	hamness := 1 - chi2Q(-2*hamEvidence, n)
+
+	return (spamness - hamness + 1) / 2
+}
+
+// chi2Q is the probability that a chi-squared distributed value with v (even) degrees of freedom is >= x2.
+func chi2Q(x2 float64, v int) float64 {
+	m := x2 / 2
+	term := math.Exp(-m)
+	sum := term
+	for i := 1; i < v/2; i++ {
+		term *= m / float64(i)
+		sum += term
+	}
+
+	return math.Min(sum, 1)
+}
+
+func (b *Bayes) report(rawMail []byte, probability float64, clues []*clue, nspam, nham int64) ([]byte, error) {
+	text := &bytes.Buffer{}
+	fmt.Fprintf(text, "The built-in bayes classifier rated the attached mail with a spam probability of %.4f.\n", probability)
+	fmt.Fprintf(text, "Mails with a probability of %.4f or more are classified as spam.\n", b.threshold)
+	fmt.Fprintf(text, "Learned mails: %d spam, %d ham. Significant tokens: %d.\n\n", nspam, nham, len(clues))
+
+	count := b.reportTokens
+	if count > len(clues) {
+		count = len(clues)
+	}
+	fmt.Fprintf(text, "The %d most significant tokens:\n\n", count)
+	fmt.Fprintf(text, "%-11s  %6s  %6s  %s\n", "probability", "spam", "ham", "token")
+	fmt.Fprintf(text, "%-11s  %6s  %6s  %s\n", "-----------", "------", "------", "-----")
+	for _, c := range clues[:count] {
+		fmt.Fprintf(text, "%11.4f  %6d  %6d  %s\n", c.probability, c.spam, c.ham, c.token)
+	}
+
+	return mail.Report(
+		rawMail,
+		"go-imap-assassin bayes",
+		map[string]string{
+			"X-Spam-Checker-Version": "go-imap-assassin bayes",
+			"X-Spam-Flag":            "YES",
+			"X-Spam-Status":          fmt.Sprintf("Yes, probability=%.4f required=%.4f", probability, b.threshold),
+		},
+		text.Bytes(),
+	)
+}
+
+func errResult(err error) *domain.SpamResult {
+	return &domain.SpamResult{Error: err}
+}
@@ -0,0 +1,158 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package bayes
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	stdmail "net/mail"
+	"testing"
+
+	"github.com/CrawX/go-imap-assassin/domain"
+	"github.com/CrawX/go-imap-assassin/log"
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryStore struct {
+	spam, ham int64
+	tokens    map[string]*domain.TokenCount
+}
+
+func (m *memoryStore) TrainingCounts() (int64, int64, error) {
+	return m.spam, m.ham, nil
+}
+
+func (m *memoryStore) TokenCounts(tokens []string) (map[string]*domain.TokenCount, error) {
+	counts := map[string]*domain.TokenCount{}
+	for _, t := range tokens {
+		if c, ok := m.tokens[t]; ok {
+			counts[t] = c
+		}
+	}
+	return counts, nil
+}
+
+func (m *memoryStore) LearnTokens(learnType domain.LearnType, tokens []string) error {
+	for _, t := range tokens {
+		if _, ok := m.tokens[t]; !ok {
+			m.tokens[t] = &domain.TokenCount{Token: t}
+		}
+		if learnType == domain.LearnSpam {
+			m.tokens[t].Spam++
+		} else {
+			m.tokens[t].Ham++
+		}
+	}
+	if learnType == domain.LearnSpam {
+		m.spam++
+	} else {
+		m.ham++
+	}
+	return nil
+}
+
+func testMail(from, subject, body string) []byte {
+	return []byte(fmt.Sprintf("From: %s\r\nTo: me@example.net\r\nSubject: %s\r\nMessage-Id: <%s@example.com>\r\n\r\n%s", from, subject, subject, body))
+}
+
+func setupTrained(t *testing.T, configFunc ...ConfigFunc) *Bayes {
+	log.InitLogging("error")
+	store := &memoryStore{tokens: map[string]*domain.TokenCount{}}
+	b, err := NewBayes(store, append([]ConfigFunc{MinTraining(2, 2)}, configFunc...)...)
+	assert.NoError(t, err)
+
+	for i, m := range [][]byte{
+		testMail("winner@lottery.biz", "You won the lottery", "Claim your prize money now, click here for free cash"),
+		testMail("deals@pharmacy.biz", "Cheap pills", "Free pills, cheap prices, click here now for cash back"),
+	} {
+		assert.NoError(t, b.Learn(context.Background(), domain.LearnSpam, m), "spam %d", i)
+	}
+	for i, m := range [][]byte{
+		testMail("alice@example.net", "Meeting tomorrow", "Hi, let's discuss the project schedule in tomorrow's meeting"),
+		testMail("bob@example.net", "Project schedule", "The project schedule for the meeting is attached, regards Bob"),
+	} {
+		assert.NoError(t, b.Learn(context.Background(), domain.LearnHam, m), "ham %d", i)
+	}
+
+	return b
+}
+
+func TestBayes_Check(t *testing.T) {
+	b := setupTrained(t, ReportTokens(3))
+
+	spam := b.Check(context.Background(), testMail("prizes@lottery.biz", "Free cash prize", "Click here now to claim your free cash"))
+	assert.NoError(t, spam.Error)
+	assert.True(t, spam.IsSpam)
+	assert.Greater(t, spam.Score, 0.9)
+
+	report, err := stdmail.ReadMessage(bytes.NewReader(spam.Body))
+	assert.NoError(t, err, "report should be parsable")
+	assert.Equal(t, "YES", report.Header.Get("X-Spam-Flag"))
+	assert.Contains(t, string(spam.Body), "The 3 most significant tokens")
+
+	ham := b.Check(context.Background(), testMail("alice@example.net", "Project meeting", "Let's move the project meeting, regards"))
+	assert.NoError(t, ham.Error)
+	assert.False(t, ham.IsSpam)
+	assert.Less(t, ham.Score, 0.1)
+	assert.Nil(t, ham.Body)
+
+	unknown := b.Check(context.Background(), testMail("someone@unknown.org", "Unrelated", "Nothing known"))
+	assert.NoError(t, unknown.Error)
+	assert.False(t, unknown.IsSpam)
+	assert.Equal(t, 0.5, unknown.Score)
+}
+
+func TestBayes_CheckUntrained(t *testing.T) {
+	log.InitLogging("error")
+	b, err := NewBayes(&memoryStore{spam: 5, ham: 1})
+	assert.NoError(t, err)
+
+	// no verdict yet, the mail is left for a later run instead of failing this one
+	result := b.Check(context.Background(), testMail("a@example.net", "Test", "Test"))
+	assert.Equal(t, &domain.SpamResult{Unsure: true}, result)
+}
+
+func TestBayes_Info(t *testing.T) {
+	b := setupTrained(t)
+
+	assert.NoError(t, b.Ping(context.Background()))
+	assert.Equal(t, &domain.ClassifierInfo{
+		Name:  "bayes",
+		Stats: map[string]string{"learned spam": "2", "learned ham": "2", "trained": "true"},
+	}, b.Info(context.Background()))
+
+	b.minHam = 3
+	assert.Equal(t, "false", b.Info(context.Background()).Stats["trained"])
+}
+
+func TestNewBayes(t *testing.T) {
+	tests := []struct {
+		name string
+		cfgs []ConfigFunc
+		err  string
+	}{
+		{"ok", []ConfigFunc{Threshold(0.8), MinTraining(1, 1), ReportTokens(0)}, ""},
+		{"threshold", []ConfigFunc{Threshold(1.5)}, "error applying configuration: Threshold must be within (0, 1]"},
+		{"mintraining", []ConfigFunc{MinTraining(0, 5)}, "error applying configuration: MinTraining requires at least one spam and one ham mail"},
+		{"reporttokens", []ConfigFunc{ReportTokens(-1)}, "error applying configuration: ReportTokens cannot be negative"},
+	}
+	log.InitLogging("error")
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := NewBayes(nil, tc.cfgs...)
+			if len(tc.err) == 0 {
+				assert.NotNil(t, b)
+				assert.NoError(t, err)
+			} else {
+				assert.Nil(t, b)
+				assert.EqualError(t, err, tc.err)
+			}
+		})
+	}
+}
+
+func Test_chi2Q(t *testing.T) {
+	assert.Equal(t, 1.0, chi2Q(0, 4))
+	assert.InDelta(t, 0.0, chi2Q(100, 4), 1e-10)
+	assert.InDelta(t, 0.5578, chi2Q(3, 4), 1e-4)
+}
@@ -0,0 +1,113 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package classifier
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/CrawX/go-imap-assassin/domain"
+	"github.com/CrawX/go-imap-assassin/log"
+	"github.com/CrawX/go-imap-assassin/mail"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CachingSpamClassifier remembers the results of successful checks by the mail's content hash, so the same mail in
+// another folder or after a uidvalidity change isn't checked again within the ttl. Unsure results are not cached and
+// learning a mail removes its cached result. Cache errors are logged and the classifier is used instead.
+type CachingSpamClassifier struct {
+	domain.SpamClassifier
+
+	cache domain.ResultCache
+	ttl   time.Duration
+	now   func() time.Time
+
+	l *logrus.Logger
+}
+
+// NewCachingSpamClassifier wraps classifier and deletes all expired results from cache.
+func NewCachingSpamClassifier(classifier domain.SpamClassifier, cache domain.ResultCache, ttl time.Duration) (*CachingSpamClassifier, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("cache ttl must be positive")
+	}
+
+	c := &CachingSpamClassifier{
+		SpamClassifier: classifier,
+		cache:          cache,
+		ttl:            ttl,
+		now:            time.Now,
+		l:              log.Logger(log.LOG_CLASSIFIER),
+	}
+
+	purged, err := cache.PurgeResults(c.now().Add(-ttl))
+	if err != nil {
+		return nil, fmt.Errorf("could not purge expired results: %w", err)
+	}
+	c.l.WithFields(logrus.Fields{"purged": purged, "ttl": ttl}).Debug("Purged expired cached results")
+
+	return c, nil
+}
+
+func (c *CachingSpamClassifier) Check(ctx context.Context, rawMail []byte) *domain.SpamResult {
+	hash := mail.ContentHash(rawMail)
+
+	cached, err := c.cache.CachedResult(hash, c.now().Add(-c.ttl))
+	if err != nil {
+		c.l.WithFields(logrus.Fields{"hash": hash, "error": err}).Warn("Could not read cached result")
+	}
+	if cached != nil {
+		c.l.WithFields(logrus.Fields{"hash": hash, "checkedat": cached.CheckedAt}).Debug("Using cached result")
+		return &domain.SpamResult{
+			IsSpam:  cached.IsSpam,
+			Score:   cached.Score,
+			Symbols: cached.Symbols,
+			Subject: cached.Subject,
+			Body:    cached.Body,
+		}
+	}
+
+	result := c.SpamClassifier.Check(ctx, rawMail)
+	if result.Error != nil || result.Unsure {
+		return result
+	}
+
+	err = c.cache.SaveResult(&domain.CachedResult{
+		Hash:      hash,
+		IsSpam:    result.IsSpam,
+		Score:     result.Score,
+		Symbols:   result.Symbols,
+		Subject:   result.Subject,
+		Body:      result.Body,
+		CheckedAt: c.now(),
+	})
+	if err != nil {
+		c.l.WithFields(logrus.Fields{"hash": hash, "error": err}).Warn("Could not cache result")
+	}
+
+	return result
+}
+
+// Learn passes the mail to the classifier and removes the cached results of the mail and, for reports, of the
+// original mail. This happens even if learning failed because the classifier may have learned it partially. If the
+// cached results can't be removed, an error is returned so that the mail is learned again next time.
+func (c *CachingSpamClassifier) Learn(ctx context.Context, learnType domain.LearnType, rawMail []byte) error {
+	learnErr := c.SpamClassifier.Learn(ctx, learnType, rawMail)
+
+	hashes := []string{mail.ContentHash(rawMail)}
+	unwrapped, err := mail.UnwrapSpamassassinReport(rawMail)
+	if err == nil && !bytes.Equal(unwrapped, rawMail) {
+		hashes = append(hashes, mail.ContentHash(unwrapped))
+	}
+
+	err = c.cache.DeleteResults(hashes)
+	if err != nil {
+		if learnErr != nil {
+			return fmt.Errorf("%s, could not remove cached results: %w", learnErr.Error(), err)
+		}
+		return fmt.Errorf("could not remove cached results: %w", err)
+	}
+
+	return learnErr
+}
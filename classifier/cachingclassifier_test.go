@@ -0,0 +1,92 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package classifier
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/CrawX/go-imap-assassin/domain"
+	"github.com/CrawX/go-imap-assassin/domain/mocks"
+	"github.com/CrawX/go-imap-assassin/mail"
+	"github.com/golang/mock/gomock"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupCaching(t *testing.T) (*gomock.Controller, *CachingSpamClassifier, *mocks.MockSpamClassifier, *mocks.MockResultCache, time.Time) {
+	ctrl := gomock.NewController(t)
+	classifier := mocks.NewMockSpamClassifier(ctrl)
+	cache := mocks.NewMockResultCache(ctrl)
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	return ctrl, &CachingSpamClassifier{
+		SpamClassifier: classifier,
+		cache:          cache,
+		ttl:            time.Hour,
+		now:            func() time.Time { return now },
+		l:              logger,
+	}, classifier, cache, now
+}
+
+func TestCachingSpamClassifier_Check(t *testing.T) {
+	ctrl, caching, classifier, cache, now := setupCaching(t)
+	defer ctrl.Finish()
+
+	cachedMail, newMail, failingMail := []byte("cached"), []byte("new"), []byte("failing")
+	cached := &domain.CachedResult{Hash: mail.ContentHash(cachedMail), IsSpam: true, Score: 10, Symbols: map[string]float64{"BAYES_SPAM": 5}, Subject: "[SPAM] test", Body: []byte("report")}
+	newResult := &domain.SpamResult{Score: 1, Symbols: map[string]float64{"BAYES_HAM": -3}}
+	failedResult := &domain.SpamResult{Error: errors.New("timeout")}
+
+	cache.EXPECT().CachedResult(mail.ContentHash(cachedMail), now.Add(-time.Hour)).Return(cached, nil)
+	cache.EXPECT().CachedResult(mail.ContentHash(newMail), now.Add(-time.Hour)).Return(nil, nil)
+	cache.EXPECT().CachedResult(mail.ContentHash(failingMail), now.Add(-time.Hour)).Return(nil, errors.New("db locked"))
+
+	classifier.EXPECT().Check(gomock.Any(), newMail).Return(newResult)
+	classifier.EXPECT().Check(gomock.Any(), failingMail).Return(failedResult)
+
+	// only successful checks are cached
+	cache.EXPECT().SaveResult(&domain.CachedResult{Hash: mail.ContentHash(newMail), Score: 1, Symbols: newResult.Symbols, CheckedAt: now}).Return(nil)
+
+	assert.Equal(t, &domain.SpamResult{IsSpam: true, Score: 10, Symbols: cached.Symbols, Subject: "[SPAM] test", Body: []byte("report")}, caching.Check(context.Background(), cachedMail))
+	assert.Equal(t, newResult, caching.Check(context.Background(), newMail))
+	assert.Equal(t, failedResult, caching.Check(context.Background(), failingMail), "cache errors should fall back to the classifier")
+}
+
+func TestCachingSpamClassifier_CheckUnsure(t *testing.T) {
+	ctrl, caching, classifier, cache, now := setupCaching(t)
+	defer ctrl.Finish()
+
+	rawMail := []byte("untrained")
+	unsure := &domain.SpamResult{Unsure: true}
+
+	cache.EXPECT().CachedResult(mail.ContentHash(rawMail), now.Add(-time.Hour)).Return(nil, nil)
+	classifier.EXPECT().Check(gomock.Any(), rawMail).Return(unsure)
+
+	// no SaveResult, the mail is classified again once the classifier has a verdict
+	assert.Equal(t, unsure, caching.Check(context.Background(), rawMail))
+}
+
+func TestCachingSpamClassifier_Learn(t *testing.T) {
+	ctrl, caching, classifier, cache, _ := setupCaching(t)
+	defer ctrl.Finish()
+
+	original := []byte("Subject: test\r\nMessage-Id: <test@example.com>\r\n\r\ntest\r\n")
+	report, err := mail.Report(original, "test", map[string]string{"X-Spam-Flag": "YES", "X-Spam-Status": "Yes"}, []byte("report"))
+	assert.NoError(t, err)
+
+	// a learned report invalidates the report's and the original mail's result
+	classifier.EXPECT().Learn(gomock.Any(), domain.LearnSpam, report).Return(nil)
+	cache.EXPECT().DeleteResults([]string{mail.ContentHash(report), mail.ContentHash(original)}).Return(nil)
+	assert.NoError(t, caching.Learn(context.Background(), domain.LearnSpam, report))
+
+	// failed learns are invalidated as well
+	classifier.EXPECT().Learn(gomock.Any(), domain.LearnHam, original).Return(errors.New("timeout"))
+	cache.EXPECT().DeleteResults([]string{mail.ContentHash(original)}).Return(errors.New("db locked"))
+	assert.EqualError(t, caching.Learn(context.Background(), domain.LearnHam, original), "timeout, could not remove cached results: db locked")
+}
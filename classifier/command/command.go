@@ -0,0 +1,279 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package command implements a classifier that runs external programs like bogofilter, spamprobe or custom scripts.
+//
+// The raw mail is piped to the program's stdin. The check command's result is determined as follows:
+//
+//   - Verdict: if the first line of stdout contains a verdict word, it decides whether the mail is spam
+//     ("spam", "yes", "s") or ham ("ham", "good", "no", "h"). Otherwise the exit code decides using the spam and
+//     ham exit codes. Exit codes in neither list are errors.
+//   - Score: the first number on the first line of stdout, 0 if there is none.
+//   - Report: all further lines of stdout. If the mail is spam, they are used as the text of the report mail.
+//
+// Examples for the first line are "spam 7.5", "S 0.9999" (bogofilter -T) or "SPAM 0.99 digest" (spamprobe).
+// Learn commands succeed with exit code 0.
+package command
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CrawX/go-imap-assassin/domain"
+	"github.com/CrawX/go-imap-assassin/mail"
+)
+
+const DefaultTimeout = 20 * time.Second
+
+var (
+	spamVerdicts = map[string]bool{"spam": true, "yes": true, "s": true}
+	hamVerdicts  = map[string]bool{"ham": true, "good": true, "no": true, "h": true}
+)
+
+type Command struct {
+	check     []string
+	learnSpam []string
+	learnHam  []string
+
+	spamExitCodes map[int]bool
+	hamExitCodes  map[int]bool
+	timeout       time.Duration
+}
+
+type ConfigFunc func(c *Command) error
+
+// Learn sets the commands run to learn spam and ham. Either can be empty if that learn type is not used.
+func Learn(learnSpam, learnHam []string) ConfigFunc {
+	return func(c *Command) error {
+		c.learnSpam = learnSpam
+		c.learnHam = learnHam
+		return nil
+	}
+}
+
+// ExitCodes sets the exit codes of the check command that mean spam or ham if stdout contains no verdict.
+func ExitCodes(spam, ham []int) ConfigFunc {
+	return func(c *Command) error {
+		if len(spam) == 0 || len(ham) == 0 {
+			return fmt.Errorf("at least one spam and one ham exit code is required")
+		}
+
+		c.spamExitCodes = map[int]bool{}
+		for _, code := range spam {
+			c.spamExitCodes[code] = true
+		}
+		c.hamExitCodes = map[int]bool{}
+		for _, code := range ham {
+			if c.spamExitCodes[code] {
+				return fmt.Errorf("exit code %d cannot mean spam and ham", code)
+			}
+			c.hamExitCodes[code] = true
+		}
+
+		return nil
+	}
+}
+
+// Timeout sets the time after which a single command is killed.
+func Timeout(timeout time.Duration) ConfigFunc {
+	return func(c *Command) error {
+		if timeout <= 0 {
+			return fmt.Errorf("Timeout must be positive")
+		}
+
+		c.timeout = timeout
+		return nil
+	}
+}
+
+// NewCommand creates a classifier running check, the first element is the program, the rest are its arguments.
+func NewCommand(check []string, configFunc ...ConfigFunc) (*Command, error) {
+	if len(check) == 0 {
+		return nil, fmt.Errorf("check command cannot be empty")
+	}
+
+	command := &Command{
+		check:         check,
+		spamExitCodes: map[int]bool{1: true},
+		hamExitCodes:  map[int]bool{0: true},
+		timeout:       DefaultTimeout,
+	}
+	for _, f := range configFunc {
+		err := f(command)
+		if err != nil {
+			return nil, fmt.Errorf("error applying configuration: %w", err)
+		}
+	}
+
+	err := command.Ping(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	return command, nil
+}
+
+// Ping checks that all configured commands can be found.
+func (c *Command) Ping(ctx context.Context) error {
+	_, err := c.paths()
+	return err
+}
+
+// Info reports the paths the configured commands resolve to. The commands' versions are unknown.
+func (c *Command) Info(ctx context.Context) *domain.ClassifierInfo {
+	info := &domain.ClassifierInfo{Name: "command " + c.check[0]}
+
+	info.Stats, info.Error = c.paths()
+	return info
+}
+
+// paths looks up the configured commands, keyed by check, learn spam and learn ham.
+func (c *Command) paths() (map[string]string, error) {
+	paths := map[string]string{}
+	names := []string{"check", "learn spam", "learn ham"}
+	for i, cmd := range [][]string{c.check, c.learnSpam, c.learnHam} {
+		if len(cmd) == 0 {
+			continue
+		}
+		path, err := exec.LookPath(cmd[0])
+		if err != nil {
+			return nil, fmt.Errorf("could not find command %s: %w", cmd[0], err)
+		}
+		paths[names[i]] = path
+	}
+
+	return paths, nil
+}
+
+func (c *Command) Check(ctx context.Context, rawMail []byte) *domain.SpamResult {
+	stdout, stderr, exitCode, err := c.run(ctx, c.check, rawMail)
+	if err != nil {
+		return errResult(fmt.Errorf("could not run check command: %w", err))
+	}
+
+	lines := strings.SplitN(string(stdout), "\n", 2)
+	firstLine := strings.TrimSpace(lines[0])
+	report := ""
+	if len(lines) > 1 {
+		report = strings.TrimSpace(lines[1])
+	}
+
+	result := &domain.SpamResult{}
+	verdictFound := false
+	scoreFound := false
+	for _, field := range strings.Fields(firstLine) {
+		field = strings.ToLower(strings.Trim(field, ",;:"))
+		if !verdictFound && (spamVerdicts[field] || hamVerdicts[field]) {
+			result.IsSpam = spamVerdicts[field]
+			verdictFound = true
+			continue
+		}
+
+		if !scoreFound {
+			field = strings.TrimPrefix(field, "score=")
+			if score, err := strconv.ParseFloat(field, 64); err == nil {
+				result.Score = score
+				scoreFound = true
+			}
+		}
+	}
+
+	if !c.spamExitCodes[exitCode] && !c.hamExitCodes[exitCode] {
+		return errResult(fmt.Errorf("unexpected exit code %d from check command: %s", exitCode, stderr))
+	}
+	if !verdictFound {
+		result.IsSpam = c.spamExitCodes[exitCode]
+	}
+
+	if result.IsSpam {
+		if len(report) == 0 {
+			report = firstLine
+		}
+		result.Body, err = mail.Report(
+			rawMail,
+			c.check[0],
+			map[string]string{
+				"X-Spam-Checker-Version": c.check[0],
+				"X-Spam-Flag":            "YES",
+				"X-Spam-Status":          fmt.Sprintf("Yes, score=%.2f", result.Score),
+			},
+			[]byte(report+"\n"),
+		)
+		if err != nil {
+			return errResult(domain.Permanent(fmt.Errorf("could not create report: %w", err)))
+		}
+	}
+
+	return result
+}
+
+func (c *Command) Learn(ctx context.Context, learnType domain.LearnType, rawMail []byte) error {
+	var cmd []string
+	switch learnType {
+	case domain.LearnSpam:
+		cmd = c.learnSpam
+	case domain.LearnHam:
+		cmd = c.learnHam
+	default:
+		return domain.Permanent(fmt.Errorf("unsupported learn type %v", learnType))
+	}
+
+	if len(cmd) == 0 {
+		return domain.Permanent(fmt.Errorf("no command configured to learn %v", learnType))
+	}
+
+	unwrapped, err := mail.UnwrapSpamassassinReport(rawMail)
+	if err != nil {
+		return domain.Permanent(fmt.Errorf("could not unwrap SpamAssassin-style report: %w", err))
+	}
+
+	_, stderr, exitCode, err := c.run(ctx, cmd, unwrapped)
+	if err != nil {
+		return fmt.Errorf("could not run learn command: %w", err)
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("unexpected exit code %d from learn command: %s", exitCode, stderr)
+	}
+
+	return nil
+}
+
+// run pipes rawMail to cmd and returns stdout, stderr and the exit code. Failing to start, a timeout or cancelling
+// parent are errors, a non-zero exit code is not.
+func (c *Command) run(parent context.Context, cmd []string, rawMail []byte) ([]byte, string, int, error) {
+	ctx, cancel := context.WithTimeout(parent, c.timeout)
+	defer cancel()
+
+	execCmd := exec.CommandContext(ctx, cmd[0], cmd[1:]...)
+	execCmd.Stdin = bytes.NewReader(rawMail)
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	execCmd.Stdout = stdout
+	execCmd.Stderr = stderr
+
+	err := execCmd.Run()
+	if parent.Err() != nil {
+		return nil, "", 0, parent.Err()
+	}
+	if ctx.Err() != nil {
+		return nil, "", 0, fmt.Errorf("%s timed out after %v", cmd[0], c.timeout)
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return stdout.Bytes(), strings.TrimSpace(stderr.String()), exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return nil, "", 0, fmt.Errorf("could not run %s: %w", cmd[0], err)
+	}
+
+	return stdout.Bytes(), strings.TrimSpace(stderr.String()), 0, nil
+}
+
+func errResult(err error) *domain.SpamResult {
+	return &domain.SpamResult{Error: err}
+}
@@ -0,0 +1,117 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package command
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/CrawX/go-imap-assassin/domain"
+	"github.com/stretchr/testify/assert"
+)
+
+const MAIL = "From: someone@example.com\r\nMessage-Id: <1@example.com>\r\nSubject: Test\r\n\r\nTest"
+
+func sh(script string) []string {
+	return []string{"sh", "-c", script}
+}
+
+func TestCommand_Check(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		cfgs   []ConfigFunc
+		isSpam bool
+		score  float64
+		report string
+		err    string
+	}{
+		{"exitcodespam", "cat > /dev/null; exit 1", nil, true, 0, "", ""},
+		{"exitcodeham", "cat > /dev/null; echo 1.5", nil, false, 1.5, "", ""},
+		{"verdict", "cat > /dev/null; echo 'SPAM 0.99 digest'", nil, true, 0.99, "SPAM 0.99 digest", ""},
+		{"verdictoverridesexitcode", "cat > /dev/null; echo 'ham score=-2'; exit 1", nil, false, -2, "", ""},
+		{"report", "cat > /dev/null; printf 'spam 7.5\\nmatched rule A\\nmatched rule B\\n'", nil, true, 7.5, "matched rule A\r\nmatched rule B", ""},
+		{"bogofilter", "cat > /dev/null; echo 'U 0.5'; exit 2", []ConfigFunc{ExitCodes([]int{0}, []int{1, 2})}, false, 0.5, "", ""},
+		{"unexpectedexitcode", "cat > /dev/null; echo broken >&2; exit 3", nil, false, 0, "", "unexpected exit code 3 from check command: broken"},
+		{"timeout", "exec sleep 5", []ConfigFunc{Timeout(50 * time.Millisecond)}, false, 0, "", "could not run check command: sh timed out after 50ms"},
+		{"stdin", `grep -q "^Subject: Test" && echo spam`, nil, true, 0, "spam", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := NewCommand(sh(tc.script), tc.cfgs...)
+			assert.NoError(t, err)
+
+			result := c.Check(context.Background(), []byte(MAIL))
+			if len(tc.err) > 0 {
+				assert.EqualError(t, result.Error, tc.err)
+				return
+			}
+
+			assert.NoError(t, result.Error)
+			assert.Equal(t, tc.isSpam, result.IsSpam)
+			assert.Equal(t, tc.score, result.Score)
+			if tc.isSpam {
+				assert.Contains(t, string(result.Body), tc.report)
+				assert.Contains(t, string(result.Body), MAIL)
+			} else {
+				assert.Nil(t, result.Body)
+			}
+		})
+	}
+}
+
+func TestCommand_Learn(t *testing.T) {
+	c, err := NewCommand(sh("exit 0"), Learn(sh(`grep -q "^Subject: Test"`), sh("echo failed >&2; exit 1")))
+	assert.NoError(t, err)
+
+	assert.NoError(t, c.Learn(context.Background(), domain.LearnSpam, []byte(MAIL)))
+	assert.EqualError(t, c.Learn(context.Background(), domain.LearnHam, []byte(MAIL)), "unexpected exit code 1 from learn command: failed")
+
+	c, err = NewCommand(sh("exit 0"))
+	assert.NoError(t, err)
+	assert.EqualError(t, c.Learn(context.Background(), domain.LearnSpam, []byte(MAIL)), "no command configured to learn spam")
+}
+
+func TestCommand_Info(t *testing.T) {
+	c, err := NewCommand([]string{"sh", "-c", "exit 0"}, Learn(nil, []string{"true"}))
+	assert.NoError(t, err)
+
+	info := c.Info(context.Background())
+	assert.NoError(t, info.Error)
+	assert.Equal(t, "command sh", info.Name)
+	assert.Len(t, info.Stats, 2)
+	assert.True(t, filepath.IsAbs(info.Stats["check"]))
+	assert.True(t, filepath.IsAbs(info.Stats["learn ham"]))
+
+	c.learnSpam = []string{"go-imap-assassin-does-not-exist"}
+	assert.Error(t, c.Ping(context.Background()))
+	assert.Error(t, c.Info(context.Background()).Error)
+}
+
+func TestNewCommand(t *testing.T) {
+	tests := []struct {
+		name  string
+		check []string
+		cfgs  []ConfigFunc
+		err   string
+	}{
+		{"ok", sh("true"), []ConfigFunc{ExitCodes([]int{0}, []int{1, 2}), Timeout(time.Second)}, ""},
+		{"empty", nil, nil, "check command cannot be empty"},
+		{"notfound", []string{"go-imap-assassin-does-not-exist"}, nil, `could not find command go-imap-assassin-does-not-exist: exec: "go-imap-assassin-does-not-exist": executable file not found in $PATH`},
+		{"exitcodeconflict", sh("true"), []ConfigFunc{ExitCodes([]int{1}, []int{1})}, "error applying configuration: exit code 1 cannot mean spam and ham"},
+		{"timeout", sh("true"), []ConfigFunc{Timeout(0)}, "error applying configuration: Timeout must be positive"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := NewCommand(tc.check, tc.cfgs...)
+			if len(tc.err) == 0 {
+				assert.NotNil(t, c)
+				assert.NoError(t, err)
+			} else {
+				assert.Nil(t, c)
+				assert.EqualError(t, err, tc.err)
+			}
+		})
+	}
+}
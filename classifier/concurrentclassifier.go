@@ -1,21 +1,242 @@
 // SPDX-License-Identifier: GPL-3.0-or-later
 package classifier
 
-import "github.com/CrawX/go-imap-assassin/domain"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
 
+	"github.com/CrawX/go-imap-assassin/domain"
+	"github.com/CrawX/go-imap-assassin/log"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultMaxAttempts    = 3
+	DefaultInitialBackoff = 500 * time.Millisecond
+	DefaultMaxBackoff     = 10 * time.Second
+	DefaultBackoffFactor  = 2
+	DefaultJitter         = 0.2
+
+	DefaultBreakerFailures = 5
+	DefaultBreakerOpen     = 30 * time.Second
+)
+
+// RetryPolicy decides how often and how fast failed Check and Learn calls are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of calls per mail, 1 disables retries
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry, it's multiplied by BackoffFactor for each further retry up to
+	// MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	BackoffFactor  float64
+	// Jitter randomizes each backoff by up to +/- this fraction so concurrent retries don't hit the classifier at once
+	Jitter float64
+	// Retryable decides whether a failed call is retried
+	Retryable func(err error) bool
+}
+
+// DefaultRetryable retries all errors except those marked with domain.Permanent.
+func DefaultRetryable(err error) bool {
+	return !errors.Is(err, domain.ErrPermanent)
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    DefaultMaxAttempts,
+		InitialBackoff: DefaultInitialBackoff,
+		MaxBackoff:     DefaultMaxBackoff,
+		BackoffFactor:  DefaultBackoffFactor,
+		Jitter:         DefaultJitter,
+		Retryable:      DefaultRetryable,
+	}
+}
+
+// backoff returns the wait after the given failed attempt (starting at 1). random must be within [0, 1).
+func (rp *RetryPolicy) backoff(attempt int, random float64) time.Duration {
+	backoff := float64(rp.InitialBackoff) * math.Pow(rp.BackoffFactor, float64(attempt-1))
+	backoff = math.Min(backoff, float64(rp.MaxBackoff))
+	backoff *= 1 + rp.Jitter*(2*random-1)
+
+	return time.Duration(backoff)
+}
+
+// CircuitOpenError is returned without calling the classifier while the circuit breaker is open.
+type CircuitOpenError struct {
+	Failures  int
+	OpenUntil time.Time
+	LastError error
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("classifier unavailable, circuit breaker open until %s after %d consecutive failures, last error: %v", e.OpenUntil.Format(time.RFC3339), e.Failures, e.LastError)
+}
+
+func (e *CircuitOpenError) Unwrap() error {
+	return e.LastError
+}
+
+// circuitBreaker opens after threshold consecutive failed calls and rejects all calls for openDuration. Afterwards, a
+// single trial call is let through: if it succeeds, the breaker closes again, otherwise it stays open for another
+// openDuration.
+type circuitBreaker struct {
+	threshold    int
+	openDuration time.Duration
+	now          func() time.Time
+
+	failures  int
+	lastError error
+	openUntil time.Time
+	trial     bool
+	mutex     sync.Mutex
+}
+
+func (cb *circuitBreaker) allow() error {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if cb.failures < cb.threshold {
+		return nil
+	}
+	if cb.trial || cb.now().Before(cb.openUntil) {
+		return &CircuitOpenError{Failures: cb.failures, OpenUntil: cb.openUntil, LastError: cb.lastError}
+	}
+
+	cb.trial = true
+	return nil
+}
+
+func (cb *circuitBreaker) success() {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	cb.failures = 0
+	cb.lastError = nil
+	cb.trial = false
+}
+
+// failure records a failed call and reports whether the breaker just opened.
+func (cb *circuitBreaker) failure(err error) bool {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	cb.failures++
+	cb.lastError = err
+	if cb.failures < cb.threshold {
+		return false
+	}
+
+	opened := cb.failures == cb.threshold || cb.trial
+	cb.openUntil = cb.now().Add(cb.openDuration)
+	cb.trial = false
+	return opened
+}
+
+// GoRoutineSpamClassifier calls the SpamClassifier concurrently. Failed calls are retried according to the
+// RetryPolicy, the circuit breaker stops calling a classifier that keeps failing.
 type GoRoutineSpamClassifier struct {
 	domain.SpamClassifier
+
+	retry   RetryPolicy
+	breaker *circuitBreaker
+
+	sleep      func(ctx context.Context, d time.Duration) error
+	random     func() float64
+	randomLock sync.Mutex
+
+	l *logrus.Logger
+}
+
+type ConfigFunc func(grsc *GoRoutineSpamClassifier) error
+
+// Retry replaces the DefaultRetryPolicy. A nil Retryable uses DefaultRetryable.
+func Retry(policy RetryPolicy) ConfigFunc {
+	return func(grsc *GoRoutineSpamClassifier) error {
+		if policy.MaxAttempts < 1 {
+			return fmt.Errorf("MaxAttempts must be at least 1")
+		}
+		if policy.InitialBackoff < 0 || policy.MaxBackoff < policy.InitialBackoff {
+			return fmt.Errorf("backoffs cannot be negative and MaxBackoff must not be smaller than InitialBackoff")
+		}
+		if policy.BackoffFactor < 1 {
+			return fmt.Errorf("BackoffFactor must be at least 1")
+		}
+		if policy.Jitter < 0 || policy.Jitter > 1 {
+			return fmt.Errorf("Jitter must be within [0, 1]")
+		}
+		if policy.Retryable == nil {
+			policy.Retryable = DefaultRetryable
+		}
+
+		grsc.retry = policy
+		return nil
+	}
+}
+
+// CircuitBreaker opens the circuit after failures consecutive failed calls, no calls are made for openDuration then.
+// failures of 0 disables the circuit breaker.
+func CircuitBreaker(failures int, openDuration time.Duration) ConfigFunc {
+	return func(grsc *GoRoutineSpamClassifier) error {
+		if failures < 0 {
+			return fmt.Errorf("CircuitBreaker failures cannot be negative")
+		}
+		if failures == 0 {
+			grsc.breaker = nil
+			return nil
+		}
+		if openDuration <= 0 {
+			return fmt.Errorf("CircuitBreaker open duration must be positive")
+		}
+
+		grsc.breaker = &circuitBreaker{threshold: failures, openDuration: openDuration, now: time.Now}
+		return nil
+	}
 }
 
-func (grsc *GoRoutineSpamClassifier) CheckAll(mails [][]byte, concurrency int) []*domain.SpamResult {
+func NewGoRoutineSpamClassifier(spamClassifier domain.SpamClassifier, configFunc ...ConfigFunc) (*GoRoutineSpamClassifier, error) {
+	grsc := &GoRoutineSpamClassifier{
+		SpamClassifier: spamClassifier,
+		retry:          DefaultRetryPolicy(),
+		breaker:        &circuitBreaker{threshold: DefaultBreakerFailures, openDuration: DefaultBreakerOpen, now: time.Now},
+		sleep:          sleep,
+		random:         rand.New(rand.NewSource(time.Now().UnixNano())).Float64,
+		l:              log.Logger(log.LOG_CLASSIFIER),
+	}
+	for _, f := range configFunc {
+		err := f(grsc)
+		if err != nil {
+			return nil, fmt.Errorf("error applying configuration: %w", err)
+		}
+	}
+
+	return grsc, nil
+}
+
+func (grsc *GoRoutineSpamClassifier) CheckAll(ctx context.Context, mails [][]byte, concurrency int) []*domain.SpamResult {
 	semaphore := make(chan bool, concurrency)
 	results := make([]*domain.SpamResult, len(mails))
 	for i := 0; i < len(mails); i++ {
 		semaphore <- true
+		if err := ctx.Err(); err != nil {
+			results[i] = &domain.SpamResult{Error: err}
+			<-semaphore
+			continue
+		}
+
 		go func(index int) {
-			results[index] = grsc.Check(mails[index])
-			if results[index].Error != nil {
-				results[index] = grsc.Check(mails[index])
+			err := grsc.call(ctx, func() error {
+				results[index] = grsc.Check(ctx, mails[index])
+				return results[index].Error
+			})
+			var circuitErr *CircuitOpenError
+			if errors.As(err, &circuitErr) || results[index] == nil {
+				results[index] = &domain.SpamResult{Error: err}
 			}
 			<-semaphore
 		}(i)
@@ -28,16 +249,21 @@ func (grsc *GoRoutineSpamClassifier) CheckAll(mails [][]byte, concurrency int) [
 	return results
 }
 
-func (grsc *GoRoutineSpamClassifier) LearnAll(learnType domain.LearnType, mails [][]byte, concurrency int) []error {
+func (grsc *GoRoutineSpamClassifier) LearnAll(ctx context.Context, learnType domain.LearnType, mails [][]byte, concurrency int) []error {
 	semaphore := make(chan bool, concurrency)
 	results := make([]error, len(mails))
 	for i := 0; i < len(mails); i++ {
 		semaphore <- true
+		if err := ctx.Err(); err != nil {
+			results[i] = err
+			<-semaphore
+			continue
+		}
+
 		go func(index int) {
-			results[index] = grsc.Learn(learnType, mails[index])
-			if results[index] != nil {
-				results[index] = grsc.Learn(learnType, mails[index])
-			}
+			results[index] = grsc.call(ctx, func() error {
+				return grsc.Learn(ctx, learnType, mails[index])
+			})
 			<-semaphore
 		}(i)
 	}
@@ -48,3 +274,59 @@ func (grsc *GoRoutineSpamClassifier) LearnAll(learnType domain.LearnType, mails
 
 	return results
 }
+
+// call runs f until it succeeds, fails with an error that is not retryable, the attempts are used up or ctx is
+// cancelled. The error of the last attempt is returned, or a *CircuitOpenError if the circuit breaker rejected the call.
+func (grsc *GoRoutineSpamClassifier) call(ctx context.Context, f func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if grsc.breaker != nil {
+			if circuitErr := grsc.breaker.allow(); circuitErr != nil {
+				return circuitErr
+			}
+		}
+
+		err = f()
+		if err != nil && ctx.Err() != nil {
+			// cancelled, this says nothing about the classifier's health
+			return err
+		}
+		if err == nil || !grsc.retry.Retryable(err) {
+			// the classifier answered, a permanent error is caused by the mail itself
+			if grsc.breaker != nil {
+				grsc.breaker.success()
+			}
+			return err
+		}
+
+		if grsc.breaker != nil && grsc.breaker.failure(err) {
+			grsc.l.WithFields(logrus.Fields{"error": err, "failures": grsc.breaker.threshold, "open": grsc.breaker.openDuration}).Warn("Too many classifier failures, opening circuit breaker")
+		}
+
+		if attempt >= grsc.retry.MaxAttempts {
+			return err
+		}
+
+		grsc.randomLock.Lock()
+		backoff := grsc.retry.backoff(attempt, grsc.random())
+		grsc.randomLock.Unlock()
+
+		grsc.l.WithFields(logrus.Fields{"error": err, "attempt": attempt, "backoff": backoff}).Debug("Classifier call failed, retrying")
+		if grsc.sleep(ctx, backoff) != nil {
+			return err
+		}
+	}
+}
+
+// sleep waits for d or until ctx is cancelled, in which case ctx's error is returned.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
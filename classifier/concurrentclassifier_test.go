@@ -2,6 +2,7 @@
 package classifier
 
 import (
+	"context"
 	"errors"
 	"sync"
 	"testing"
@@ -9,10 +10,19 @@ import (
 
 	"github.com/CrawX/go-imap-assassin/domain"
 	"github.com/CrawX/go-imap-assassin/domain/mocks"
+	"github.com/CrawX/go-imap-assassin/log"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 )
 
+// newImmediateRetry retries each failed call once without waiting
+func newImmediateRetry(t *testing.T, classifier domain.SpamClassifier) *GoRoutineSpamClassifier {
+	log.InitLogging("error")
+	grsc, err := NewGoRoutineSpamClassifier(classifier, Retry(RetryPolicy{MaxAttempts: 2, BackoffFactor: 1}))
+	assert.NoError(t, err)
+	return grsc
+}
+
 func Test_CheckAllConcurrent(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -27,37 +37,37 @@ func Test_CheckAllConcurrent(t *testing.T) {
 	wg.Add(3)
 
 	// Mail1 is OK (no error)
-	classifier.EXPECT().Check(gomock.Eq(mail1)).DoAndReturn(func(_ []byte) *domain.SpamResult {
+	classifier.EXPECT().Check(gomock.Any(), gomock.Eq(mail1)).DoAndReturn(func(_ context.Context, _ []byte) *domain.SpamResult {
 		wg.Done()
 		wg.Wait()
 		return result1
 	})
 
 	// Mail2 returns an error, the retry still returns the error
-	classifier.EXPECT().Check(gomock.Eq(mail2)).DoAndReturn(func(_ []byte) *domain.SpamResult {
+	classifier.EXPECT().Check(gomock.Any(), gomock.Eq(mail2)).DoAndReturn(func(_ context.Context, _ []byte) *domain.SpamResult {
 		wg.Done()
 		wg.Wait()
 		return errResult
 	})
-	classifier.EXPECT().Check(gomock.Eq(mail2)).DoAndReturn(func(_ []byte) *domain.SpamResult {
+	classifier.EXPECT().Check(gomock.Any(), gomock.Eq(mail2)).DoAndReturn(func(_ context.Context, _ []byte) *domain.SpamResult {
 		return errResult
 	})
 
 	// Mail3 returns an error, the retry is ok
-	classifier.EXPECT().Check(gomock.Eq(mail3)).DoAndReturn(func(_ []byte) *domain.SpamResult {
+	classifier.EXPECT().Check(gomock.Any(), gomock.Eq(mail3)).DoAndReturn(func(_ context.Context, _ []byte) *domain.SpamResult {
 		wg.Done()
 		wg.Wait()
 		return errResult
 	})
-	classifier.EXPECT().Check(gomock.Eq(mail3)).DoAndReturn(func(_ []byte) *domain.SpamResult {
+	classifier.EXPECT().Check(gomock.Any(), gomock.Eq(mail3)).DoAndReturn(func(_ context.Context, _ []byte) *domain.SpamResult {
 		return result3
 	})
 
-	goRoutineSpamClassifier := GoRoutineSpamClassifier{classifier}
+	goRoutineSpamClassifier := newImmediateRetry(t, classifier)
 
 	resultsChan := make(chan []*domain.SpamResult)
 	go func() {
-		resultsChan <- goRoutineSpamClassifier.CheckAll([][]byte{mail1, mail2, mail3}, 3)
+		resultsChan <- goRoutineSpamClassifier.CheckAll(context.Background(), [][]byte{mail1, mail2, mail3}, 3)
 	}()
 
 	timeoutChan := time.After(time.Millisecond * 50)
@@ -87,7 +97,7 @@ func Test_LearnAllConcurrent(t *testing.T) {
 			wg.Add(3)
 
 			// Mail1 is OK (no error)
-			classifier.EXPECT().Learn(gomock.Eq(learnType), gomock.Eq(mail1)).DoAndReturn(func(_ domain.LearnType, _ []byte) error {
+			classifier.EXPECT().Learn(gomock.Any(), gomock.Eq(learnType), gomock.Eq(mail1)).DoAndReturn(func(_ context.Context, _ domain.LearnType, _ []byte) error {
 				wg.Done()
 				wg.Wait()
 				return nil
@@ -95,30 +105,30 @@ func Test_LearnAllConcurrent(t *testing.T) {
 
 			// Mail2 returns an error, the retry still returns the error
 			err := errors.New("error")
-			classifier.EXPECT().Learn(gomock.Eq(learnType), gomock.Eq(mail2)).DoAndReturn(func(_ domain.LearnType, _ []byte) error {
+			classifier.EXPECT().Learn(gomock.Any(), gomock.Eq(learnType), gomock.Eq(mail2)).DoAndReturn(func(_ context.Context, _ domain.LearnType, _ []byte) error {
 				wg.Done()
 				wg.Wait()
 				return err
 			})
-			classifier.EXPECT().Learn(gomock.Eq(learnType), gomock.Eq(mail2)).DoAndReturn(func(_ domain.LearnType, _ []byte) error {
+			classifier.EXPECT().Learn(gomock.Any(), gomock.Eq(learnType), gomock.Eq(mail2)).DoAndReturn(func(_ context.Context, _ domain.LearnType, _ []byte) error {
 				return err
 			})
 
 			// Mail3 returns an error, the retry is ok
-			classifier.EXPECT().Learn(gomock.Eq(learnType), gomock.Eq(mail3)).DoAndReturn(func(_ domain.LearnType, _ []byte) error {
+			classifier.EXPECT().Learn(gomock.Any(), gomock.Eq(learnType), gomock.Eq(mail3)).DoAndReturn(func(_ context.Context, _ domain.LearnType, _ []byte) error {
 				wg.Done()
 				wg.Wait()
 				return err
 			})
-			classifier.EXPECT().Learn(gomock.Eq(learnType), gomock.Eq(mail3)).DoAndReturn(func(_ domain.LearnType, _ []byte) error {
+			classifier.EXPECT().Learn(gomock.Any(), gomock.Eq(learnType), gomock.Eq(mail3)).DoAndReturn(func(_ context.Context, _ domain.LearnType, _ []byte) error {
 				return nil
 			})
 
-			goRoutineSpamClassifier := GoRoutineSpamClassifier{classifier}
+			goRoutineSpamClassifier := newImmediateRetry(t, classifier)
 
 			resultsChan := make(chan []error)
 			go func() {
-				resultsChan <- goRoutineSpamClassifier.LearnAll(learnType, [][]byte{mail1, mail2, mail3}, 3)
+				resultsChan <- goRoutineSpamClassifier.LearnAll(context.Background(), learnType, [][]byte{mail1, mail2, mail3}, 3)
 			}()
 
 			timeoutChan := time.After(time.Millisecond * 50)
@@ -134,3 +144,135 @@ func Test_LearnAllConcurrent(t *testing.T) {
 		})
 	}
 }
+
+func TestRetryPolicy_backoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second, BackoffFactor: 2, Jitter: 0.5}
+
+	tests := []struct {
+		name     string
+		attempt  int
+		random   float64
+		expected time.Duration
+	}{
+		{"first", 1, 0.5, time.Second},
+		{"second", 2, 0.5, 2 * time.Second},
+		{"third", 3, 0.5, 4 * time.Second},
+		{"capped", 10, 0.5, 5 * time.Second},
+		{"jitterlow", 2, 0, time.Second},
+		{"jitterhigh", 2, 1, 3 * time.Second},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, policy.backoff(tc.attempt, tc.random))
+		})
+	}
+}
+
+func Test_CheckAllBackoffAndPermanent(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	classifier := mocks.NewMockSpamClassifier(ctrl)
+	grsc := newImmediateRetry(t, classifier)
+	assert.NoError(t, Retry(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: time.Minute, BackoffFactor: 3})(grsc))
+	sleeps := []time.Duration{}
+	grsc.sleep = func(_ context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		return nil
+	}
+
+	temporary := &domain.SpamResult{Error: errors.New("timeout")}
+	permanent := &domain.SpamResult{Error: domain.Permanent(errors.New("could not parse mail"))}
+	ok := &domain.SpamResult{}
+	gomock.InOrder(
+		classifier.EXPECT().Check(gomock.Any(), gomock.Eq([]byte{0})).Return(temporary),
+		classifier.EXPECT().Check(gomock.Any(), gomock.Eq([]byte{0})).Return(temporary),
+		classifier.EXPECT().Check(gomock.Any(), gomock.Eq([]byte{0})).Return(ok),
+		classifier.EXPECT().Check(gomock.Any(), gomock.Eq([]byte{1})).Return(permanent),
+	)
+
+	results := grsc.CheckAll(context.Background(), [][]byte{{0}, {1}}, 1)
+	assert.Equal(t, ok, results[0], "mail should be ok after two retries")
+	assert.Equal(t, permanent, results[1], "permanent errors should not be retried")
+	assert.Equal(t, []time.Duration{time.Second, 3 * time.Second}, sleeps)
+}
+
+func Test_LearnAllCircuitBreaker(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	classifier := mocks.NewMockSpamClassifier(ctrl)
+	grsc := newImmediateRetry(t, classifier)
+	assert.NoError(t, CircuitBreaker(3, time.Minute)(grsc))
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	grsc.breaker.now = func() time.Time {
+		return now
+	}
+
+	down := errors.New("connection refused")
+	// mail 0 and the first attempt of mail 1 open the circuit, mail 2 isn't tried at all
+	classifier.EXPECT().Learn(gomock.Any(), domain.LearnSpam, gomock.Any()).Return(down).Times(3)
+
+	results := grsc.LearnAll(context.Background(), domain.LearnSpam, [][]byte{{0}, {1}, {2}}, 1)
+	assert.Equal(t, down, results[0])
+	for _, err := range results[1:] {
+		var circuitErr *CircuitOpenError
+		assert.True(t, errors.As(err, &circuitErr))
+		assert.True(t, errors.Is(err, down), "circuit error should wrap the last error")
+		assert.EqualError(t, err, "classifier unavailable, circuit breaker open until 2021-01-01T00:01:00Z after 3 consecutive failures, last error: connection refused")
+	}
+
+	// after the open duration, a successful trial closes the circuit
+	now = now.Add(time.Minute)
+	classifier.EXPECT().Learn(gomock.Any(), domain.LearnSpam, gomock.Any()).Return(nil).Times(2)
+	assert.Equal(t, []error{nil, nil}, grsc.LearnAll(context.Background(), domain.LearnSpam, [][]byte{{0}, {1}}, 1))
+}
+
+func TestNewGoRoutineSpamClassifier(t *testing.T) {
+	log.InitLogging("error")
+
+	tests := []struct {
+		name string
+		cfgs []ConfigFunc
+		err  string
+	}{
+		{"ok", []ConfigFunc{Retry(DefaultRetryPolicy()), CircuitBreaker(0, 0)}, ""},
+		{"attempts", []ConfigFunc{Retry(RetryPolicy{BackoffFactor: 1})}, "error applying configuration: MaxAttempts must be at least 1"},
+		{"backoff", []ConfigFunc{Retry(RetryPolicy{MaxAttempts: 1, InitialBackoff: time.Second, BackoffFactor: 1})}, "error applying configuration: backoffs cannot be negative and MaxBackoff must not be smaller than InitialBackoff"},
+		{"jitter", []ConfigFunc{Retry(RetryPolicy{MaxAttempts: 1, BackoffFactor: 1, Jitter: 2})}, "error applying configuration: Jitter must be within [0, 1]"},
+		{"breaker", []ConfigFunc{CircuitBreaker(3, 0)}, "error applying configuration: CircuitBreaker open duration must be positive"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			grsc, err := NewGoRoutineSpamClassifier(nil, tc.cfgs...)
+			if len(tc.err) == 0 {
+				assert.NotNil(t, grsc)
+				assert.NoError(t, err)
+			} else {
+				assert.Nil(t, grsc)
+				assert.EqualError(t, err, tc.err)
+			}
+		})
+	}
+}
+
+func Test_CheckAllCancelled(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	classifier := mocks.NewMockSpamClassifier(ctrl)
+	grsc := newImmediateRetry(t, classifier)
+	assert.NoError(t, Retry(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Hour, MaxBackoff: time.Hour, BackoffFactor: 1})(grsc))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	// the first mail fails after the cancellation and is not retried, the second mail isn't checked at all
+	classifier.EXPECT().Check(gomock.Any(), gomock.Eq([]byte{0})).DoAndReturn(func(_ context.Context, _ []byte) *domain.SpamResult {
+		cancel()
+		return &domain.SpamResult{Error: errors.New("timeout")}
+	})
+
+	results := grsc.CheckAll(ctx, [][]byte{{0}, {1}}, 1)
+	assert.EqualError(t, results[0].Error, "timeout")
+	assert.Equal(t, context.Canceled, results[1].Error)
+	assert.Nil(t, grsc.breaker.lastError, "a cancelled call shouldn't count as classifier failure")
+}
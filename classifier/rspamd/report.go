@@ -4,90 +4,101 @@ package rspamd
 import (
 	"bytes"
 	"fmt"
-	"io"
 	"math"
+	"sort"
 	"strings"
-	"time"
 
 	mailutil "github.com/CrawX/go-imap-assassin/mail"
-	"github.com/emersion/go-message/mail"
 )
 
-// Report creates a report similar to SpamAssassin's report but based on rspamd's data.
-func report(rawMail []byte, response []byte, score float64) ([]byte, error) {
-	subject, _, err := mailutil.MailHeaderInfos(rawMail)
-	if err != nil {
-		return nil, fmt.Errorf("could not read mail: %w", err)
-	}
-
-	buffer := &bytes.Buffer{}
+// maxLevel limits the number of stars in X-Spam-Level for mails with huge scores
+const maxLevel = 50
 
-	from := []*mail.Address{{Name: "go-imap-assassin", Address: "go-imap-assassin@localhost"}}
-	to := []*mail.Address{{Name: "go-imap-assassin", Address: "go-imap-assassin@localhost"}}
+// report creates a report similar to SpamAssassin's report but based on rspamd's check response: the symbols sorted
+// by score with their descriptions, the action and the thresholds. rawResponse is attached as rspamd.json if set.
+func report(rawMail []byte, response *checkResponse, rawResponse []byte) ([]byte, error) {
+	symbols := make([]string, 0, len(response.Symbols))
+	for name := range response.Symbols {
+		symbols = append(symbols, name)
+	}
+	sort.Strings(symbols)
 
-	header := mail.Header{}
-	header.SetDate(time.Now())
-	header.SetAddressList("From", from)
-	header.SetAddressList("To", to)
-	header.SetSubject(subject)
-	header.Set("X-Spam-Checker-Version", "rspamd")
-	header.Set("X-Spam-Flag", strings.Repeat("*", int(math.Round(score))))
-	header.Set("X-Spam-Status", fmt.Sprintf("X-Spam-Status: Yes, score=%.1f", score))
+	required := requiredScore(response)
 
-	mailWriter, err := mail.CreateWriter(buffer, header)
-	if err != nil {
-		return nil, fmt.Errorf("could not create mail writer: %w", err)
+	text := &bytes.Buffer{}
+	text.WriteString("rspamd has identified the attached mail as spam.\n\n")
+	fmt.Fprintf(text, "Action: %s\n", response.Action)
+	if thresholds := formatThresholds(response.Thresholds); len(thresholds) > 0 {
+		fmt.Fprintf(text, "Thresholds: %s\n", thresholds)
 	}
+	fmt.Fprintf(text, "\nContent analysis details:   (%.1f points, %.1f required)\n\n", response.Score, required)
+	text.WriteString(" pts rule name              description\n")
+	text.WriteString("---- ---------------------- --------------------------------------------------\n")
 
-	textPart, err := mailWriter.CreateInline()
-	if err != nil {
-		return nil, fmt.Errorf("could not create mail text part: %w", err)
-	}
-	inlineHeader := mail.InlineHeader{}
-	inlineHeader.Set("Content-Type", "text/plain")
-	textPartWriter, err := textPart.CreatePart(inlineHeader)
-	if err != nil {
-		return nil, fmt.Errorf("could not create text part: %w", err)
-	}
-	_, err = io.WriteString(textPartWriter, "rspamd has created the following report for the attached spam mail:\n\n")
-	if err != nil {
-		return nil, fmt.Errorf("could not write text part: %w", err)
-	}
-	_, err = textPartWriter.Write(response)
-	if err != nil {
-		return nil, fmt.Errorf("could not write json response to text part: %w", err)
-	}
-	err = textPartWriter.Close()
-	if err != nil {
-		return nil, fmt.Errorf("could not close text part writer: %w", err)
-	}
-	err = textPart.Close()
-	if err != nil {
-		return nil, fmt.Errorf("could not close text part: %w", err)
+	bySeverity := append([]string{}, symbols...)
+	sort.SliceStable(bySeverity, func(i, j int) bool {
+		return response.Symbols[bySeverity[i]].Score > response.Symbols[bySeverity[j]].Score
+	})
+	for _, name := range bySeverity {
+		symbol := response.Symbols[name]
+		description := strings.TrimSpace(symbol.Description)
+		if len(symbol.Options) > 0 {
+			description = strings.TrimSpace(description + " [" + strings.Join(symbol.Options, ", ") + "]")
+		}
+		line := fmt.Sprintf("%4.1f %-22s %s", symbol.Score, name, description)
+		text.WriteString(strings.TrimRight(line, " ") + "\n")
 	}
 
-	attachmentHeader := mail.AttachmentHeader{}
-	attachmentHeader.Set("Content-Type", "message/rfc822; x-spam-type=original")
-	attachmentHeader.Set("Content-Description", "original message before rspamd")
-	attachmentHeader.Set("Content-Transfer-Encoding", "binary")
-	attachmentHeader.SetFilename("original-mail.eml")
-	attachmentWriter, err := mailWriter.CreateAttachment(attachmentHeader)
-	if err != nil {
-		return nil, fmt.Errorf("could not create attachment part: %w", err)
+	attachments := []mailutil.Attachment{}
+	if rawResponse != nil {
+		attachments = append(attachments, mailutil.Attachment{Filename: "rspamd.json", ContentType: "application/json", Data: rawResponse})
 	}
-	_, err = attachmentWriter.Write(rawMail)
-	if err != nil {
-		return nil, fmt.Errorf("could not write attachment: %w", err)
+
+	return mailutil.Report(
+		rawMail,
+		"rspamd",
+		map[string]string{
+			"X-Spam-Checker-Version": "rspamd",
+			"X-Spam-Flag":            "YES",
+			"X-Spam-Level":           strings.Repeat("*", level(response.Score)),
+			"X-Spam-Status":          fmt.Sprintf("Yes, score=%.1f required=%.1f tests=%s action=%s", response.Score, required, strings.Join(symbols, ","), response.Action),
+		},
+		text.Bytes(),
+		attachments...,
+	)
+}
+
+// requiredScore returns the lowest threshold of an action other than "no action", since rspamd's mails are spam as
+// soon as any action applies. Older rspamd versions only report the reject threshold as required_score.
+func requiredScore(response *checkResponse) float64 {
+	required := response.RequiredScore
+	for action, threshold := range response.Thresholds {
+		if action != "no action" && (required == 0 || threshold < required) {
+			required = threshold
+		}
 	}
-	err = attachmentWriter.Close()
-	if err != nil {
-		return nil, fmt.Errorf("could not close attachment writer: %w", err)
+
+	return required
+}
+
+func formatThresholds(thresholds map[string]float64) string {
+	actions := make([]string, 0, len(thresholds))
+	for action := range thresholds {
+		actions = append(actions, action)
 	}
+	sort.Slice(actions, func(i, j int) bool {
+		return thresholds[actions[i]] > thresholds[actions[j]]
+	})
 
-	err = mailWriter.Close()
-	if err != nil {
-		return nil, fmt.Errorf("could not close mail writer: %w", err)
+	formatted := make([]string, len(actions))
+	for i, action := range actions {
+		formatted[i] = fmt.Sprintf("%s %.1f", action, thresholds[action])
 	}
 
-	return buffer.Bytes(), nil
+	return strings.Join(formatted, ", ")
+}
+
+// level returns the number of stars for X-Spam-Level, one per full point just like SpamAssassin.
+func level(score float64) int {
+	return int(math.Max(0, math.Min(maxLevel, score)))
 }
@@ -3,9 +3,15 @@ package rspamd
 
 import (
 	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
 	stdmail "net/mail"
+	"strings"
 	"testing"
 
+	"github.com/CrawX/go-imap-assassin/mail"
+	"github.com/emersion/go-message"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -30,20 +36,116 @@ X-Spam-Flag: NO
 
 Testmail`
 
-func Test_report(t *testing.T) {
-	r, err := report([]byte(MAIL), []byte("{resp}"), 3.0)
+const RESPONSE = `{"score": 9.3, "required_score": 15, "action": "add header",
+	"thresholds": {"reject": 15, "add header": 6, "greylist": 4},
+	"symbols": {
+		"FORGED_SENDER": {"name": "FORGED_SENDER", "score": 0.3, "description": "Sender is forged"},
+		"BAYES_SPAM": {"name": "BAYES_SPAM", "score": 5.1, "description": "Message probably spam, probability: ", "options": ["99.99%"]},
+		"R_SPF_FAIL": {"name": "R_SPF_FAIL", "score": 4, "description": "SPF verification failed"},
+		"ARC_NA": {"name": "ARC_NA", "score": 0}
+	}}`
+
+func parseResponse(t *testing.T) *checkResponse {
+	response := &checkResponse{}
+	assert.NoError(t, json.Unmarshal([]byte(RESPONSE), response))
+	return response
+}
+
+// reportParts returns the decoded leaf parts of a report by their content type.
+func reportParts(t *testing.T, r []byte) map[string]string {
+	parts := map[string]string{}
+
+	var walk func(e *message.Entity)
+	walk = func(e *message.Entity) {
+		if mr := e.MultipartReader(); mr != nil {
+			for {
+				p, err := mr.NextPart()
+				if err == io.EOF {
+					return
+				}
+				assert.NoError(t, err)
+				walk(p)
+			}
+		}
+
+		mediaType, _, err := e.Header.ContentType()
+		assert.NoError(t, err)
+		body, err := ioutil.ReadAll(e.Body)
+		assert.NoError(t, err)
+		parts[mediaType] = string(body)
+	}
 
+	e, err := message.Read(bytes.NewReader(r))
 	assert.NoError(t, err)
-	assert.Contains(t, string(r), MAIL)
-	assert.Contains(t, string(r), "{resp}")
+	walk(e)
+
+	return parts
+}
+
+func Test_report(t *testing.T) {
+	r, err := report([]byte(MAIL), parseResponse(t), nil)
+	assert.NoError(t, err)
+
+	parts := reportParts(t, r)
+	assert.Len(t, parts, 2)
+	assert.Equal(t, MAIL, parts["message/rfc822"])
+	assert.Equal(t, "rspamd has identified the attached mail as spam.\n\n"+
+		"Action: add header\n"+
+		"Thresholds: reject 15.0, add header 6.0, greylist 4.0\n\n"+
+		"Content analysis details:   (9.3 points, 4.0 required)\n\n"+
+		" pts rule name              description\n"+
+		"---- ---------------------- --------------------------------------------------\n"+
+		" 5.1 BAYES_SPAM             Message probably spam, probability: [99.99%]\n"+
+		" 4.0 R_SPF_FAIL             SPF verification failed\n"+
+		" 0.3 FORGED_SENDER          Sender is forged\n"+
+		" 0.0 ARC_NA\n", strings.ReplaceAll(parts["text/plain"], "\r\n", "\n"))
 
 	msg, err := stdmail.ReadMessage(bytes.NewReader(r))
 	assert.NoError(t, err, "report should be parsable")
 
-	assert.Len(t, msg.Header["X-Spam-Status"], 1)
-	assert.Equal(t, "X-Spam-Status: Yes, score=3.0", msg.Header["X-Spam-Status"][0])
-	assert.Len(t, msg.Header["X-Spam-Flag"], 1)
-	assert.Equal(t, "***", msg.Header["X-Spam-Flag"][0])
-	assert.Len(t, msg.Header["X-Spam-Checker-Version"], 1)
-	assert.Equal(t, "rspamd", msg.Header["X-Spam-Checker-Version"][0])
+	assert.Equal(t, []string{"Yes, score=9.3 required=4.0 tests=ARC_NA,BAYES_SPAM,FORGED_SENDER,R_SPF_FAIL action=add header"}, msg.Header["X-Spam-Status"])
+	assert.Equal(t, []string{"YES"}, msg.Header["X-Spam-Flag"])
+	assert.Equal(t, []string{"*********"}, msg.Header["X-Spam-Level"])
+	assert.Equal(t, []string{"rspamd"}, msg.Header["X-Spam-Checker-Version"])
+
+	unwrapped, err := mail.UnwrapSpamassassinReport(r)
+	assert.NoError(t, err)
+	assert.Equal(t, MAIL, string(unwrapped))
+}
+
+func Test_reportJson(t *testing.T) {
+	r, err := report([]byte(MAIL), parseResponse(t), []byte(RESPONSE))
+	assert.NoError(t, err)
+
+	parts := reportParts(t, r)
+	assert.Len(t, parts, 3)
+	assert.Equal(t, RESPONSE, parts["application/json"])
+	assert.Contains(t, string(r), "filename=rspamd.json")
+
+	unwrapped, err := mail.UnwrapSpamassassinReport(r)
+	assert.NoError(t, err)
+	assert.Equal(t, MAIL, string(unwrapped), "the json attachment should not interfere with unwrapping")
+}
+
+func Test_requiredScore(t *testing.T) {
+	tests := []struct {
+		name     string
+		response *checkResponse
+		required float64
+	}{
+		{"thresholds", &checkResponse{RequiredScore: 15, Thresholds: map[string]float64{"reject": 15, "add header": 6}}, 6},
+		{"noaction", &checkResponse{RequiredScore: 15, Thresholds: map[string]float64{"reject": 15, "no action": -10}}, 15},
+		{"old", &checkResponse{RequiredScore: 15}, 15},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.required, requiredScore(tc.response))
+		})
+	}
+}
+
+func Test_level(t *testing.T) {
+	assert.Equal(t, 0, level(-3.5))
+	assert.Equal(t, 9, level(9.9))
+	assert.Equal(t, maxLevel, level(1000))
 }
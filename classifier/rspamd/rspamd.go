@@ -3,16 +3,21 @@ package rspamd
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/CrawX/go-imap-assassin/domain"
+	"github.com/CrawX/go-imap-assassin/log"
 	"github.com/CrawX/go-imap-assassin/mail"
+
+	"github.com/sirupsen/logrus"
 )
 
 const RspamdTimeout = 20 * time.Second
@@ -25,17 +30,119 @@ type Rspamd struct {
 	client   *http.Client
 	host     string
 	password string
+
+	// checks go to the scanner, which is the controller unless a normal or proxy worker is configured
+	scannerClient   *http.Client
+	scanner         string
+	scannerPassword string
+
+	trustedHops int
+	user        string
+	classifier  string
+	reportJson  bool
+	skipPing    bool
+
+	l *logrus.Logger
+}
+
+type ConfigFunc func(rs *Rspamd) error
+
+// TrustedHops sets the number of Received headers added by trusted servers. The envelope (client ip, helo, sender
+// and recipient) recorded by the last trusted server is passed to rspamd with each check.
+func TrustedHops(hops int) ConfigFunc {
+	return func(rs *Rspamd) error {
+		if hops < 0 {
+			return fmt.Errorf("TrustedHops cannot be negative")
+		}
+
+		rs.trustedHops = hops
+		return nil
+	}
+}
+
+// User sets the Deliver-To header for checks and learns to user. With per_user enabled in rspamd's Bayes classifier
+// configuration, each user is checked against and trained into separate statistics.
+func User(user string) ConfigFunc {
+	return func(rs *Rspamd) error {
+		rs.user = user
+		return nil
+	}
+}
+
+// Classifier sets the name of the rspamd classifier used for learning, e.g. to train a dedicated Bayes classifier.
+func Classifier(classifier string) ConfigFunc {
+	return func(rs *Rspamd) error {
+		rs.classifier = classifier
+		return nil
+	}
+}
+
+// ReportJson attaches rspamd's raw check response as rspamd.json to spam reports.
+func ReportJson(attach bool) ConfigFunc {
+	return func(rs *Rspamd) error {
+		rs.reportJson = attach
+		return nil
+	}
+}
+
+// SkipPing doesn't ping rspamd on creation, e.g. to keep an endpoint that is down on startup and probe it later.
+func SkipPing() ConfigFunc {
+	return func(rs *Rspamd) error {
+		rs.skipPing = true
+		return nil
+	}
 }
 
-func NewRspamd(host, password string) (*Rspamd, error) {
+// Scanner sends checks to rspamd's normal or proxy worker at scanner (e.g. http://localhost:11333) instead of the
+// controller, which is then only used for learning. password is optional and only sent if set. A timeout of 0 uses
+// RspamdTimeout.
+func Scanner(scanner, password string, timeout time.Duration) ConfigFunc {
+	return func(rs *Rspamd) error {
+		if len(scanner) == 0 {
+			return fmt.Errorf("Scanner cannot be empty")
+		}
+		if timeout < 0 {
+			return fmt.Errorf("Scanner timeout cannot be negative")
+		}
+		if timeout == 0 {
+			timeout = RspamdTimeout
+		}
+
+		rs.scanner = strings.TrimRight(scanner, "/")
+		rs.scannerPassword = password
+		rs.scannerClient = &http.Client{
+			Timeout: timeout,
+		}
+		return nil
+	}
+}
+
+// NewRspamd connects to the rspamd controller at host.
+func NewRspamd(host, password string, configFunc ...ConfigFunc) (*Rspamd, error) {
+	client := &http.Client{
+		Timeout: RspamdTimeout,
+	}
 	rspamd := &Rspamd{
-		client: &http.Client{
-			Timeout: RspamdTimeout,
-		},
-		host:     host,
-		password: password,
+		client:          client,
+		host:            host,
+		password:        password,
+		scannerClient:   client,
+		scanner:         host,
+		scannerPassword: password,
+		l:               log.Logger(log.LOG_CLASSIFIER),
+	}
+	for _, f := range configFunc {
+		err := f(rspamd)
+		if err != nil {
+			return nil, fmt.Errorf("error applying configuration: %w", err)
+		}
+	}
+
+	if rspamd.skipPing {
+		return rspamd, nil
 	}
-	err := rspamd.Ping()
+
+	err := rspamd.Ping(context.Background())
 	if err != nil {
 		return nil, fmt.Errorf("could not ping rspamd: %w", err)
 	}
@@ -43,44 +150,149 @@ func NewRspamd(host, password string) (*Rspamd, error) {
 	return rspamd, nil
 }
 
-func (rs *Rspamd) Ping() error {
-	resp, err := rs.client.Get(rs.host + "/ping")
+// Ping checks that the controller and, if configured, the scanner answer.
+func (rs *Rspamd) Ping(ctx context.Context) error {
+	err := ping(ctx, rs.client, rs.host)
+	if err != nil {
+		return err
+	}
+
+	if rs.scanner != rs.host {
+		err = ping(ctx, rs.scannerClient, rs.scanner)
+		if err != nil {
+			return fmt.Errorf("could not ping scanner: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func ping(ctx context.Context, client *http.Client, host string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, host+"/ping", nil)
+	if err != nil {
+		return fmt.Errorf("could not create ping request: %w", err)
+	}
+
+	resp, err := client.Do(req)
 	if err != nil {
 		return fmt.Errorf("could not ping rspamd: %w", err)
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status %d from rspamd, expected 200", resp.StatusCode)
+		return statusError(resp.StatusCode, "200")
 	}
-	defer resp.Body.Close()
 
 	return nil
 }
 
+type statResponse struct {
+	Version     string           `json:"version"`
+	Scanned     int64            `json:"scanned"`
+	Learned     int64            `json:"learned"`
+	SpamCount   int64            `json:"spam_count"`
+	HamCount    int64            `json:"ham_count"`
+	TotalLearns int64            `json:"total_learns"`
+	Actions     map[string]int64 `json:"actions"`
+	Statfiles   []struct {
+		Symbol   string `json:"symbol"`
+		Revision int64  `json:"revision"`
+		Users    int64  `json:"users"`
+	} `json:"statfiles"`
+}
+
+// Info pings rspamd and reports its version and statistics from the controller's /stat endpoint. The Bayes learn
+// counts are the revisions of the statfiles, e.g. "BAYES_SPAM learned".
+func (rs *Rspamd) Info(ctx context.Context) *domain.ClassifierInfo {
+	info := &domain.ClassifierInfo{Name: "rspamd " + rs.host}
+
+	info.Error = rs.Ping(ctx)
+	if info.Error != nil {
+		return info
+	}
+
+	stat, err := rs.stat(ctx)
+	if err != nil {
+		info.Error = err
+		return info
+	}
+
+	info.Version = stat.Version
+	info.Stats = map[string]string{
+		"scanned":      strconv.FormatInt(stat.Scanned, 10),
+		"learned":      strconv.FormatInt(stat.Learned, 10),
+		"spam count":   strconv.FormatInt(stat.SpamCount, 10),
+		"ham count":    strconv.FormatInt(stat.HamCount, 10),
+		"total learns": strconv.FormatInt(stat.TotalLearns, 10),
+	}
+	for action, count := range stat.Actions {
+		info.Stats["action "+action] = strconv.FormatInt(count, 10)
+	}
+	for _, statfile := range stat.Statfiles {
+		info.Stats[statfile.Symbol+" learned"] = strconv.FormatInt(statfile.Revision, 10)
+		info.Stats[statfile.Symbol+" users"] = strconv.FormatInt(statfile.Users, 10)
+	}
+
+	return info
+}
+
+func (rs *Rspamd) stat(ctx context.Context) (*statResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rs.host+"/stat", nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create stat request: %w", err)
+	}
+
+	resp, err := rs.doAuthenticated(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not perform stat request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp.StatusCode, "200")
+	}
+
+	stat := &statResponse{}
+	err = json.NewDecoder(resp.Body).Decode(stat)
+	if err != nil {
+		return nil, fmt.Errorf("could not deserialize rspamd stat response: %w", err)
+	}
+
+	return stat, nil
+}
+
 type checkResponse struct {
-	IsSkipped bool    `json:"is_skipped"`
-	Score     float64 `json:"score"`
-	Symbols   map[string]struct {
-		Name  string
-		Score float64
+	IsSkipped     bool               `json:"is_skipped"`
+	Score         float64            `json:"score"`
+	RequiredScore float64            `json:"required_score"`
+	Thresholds    map[string]float64 `json:"thresholds"`
+	Symbols       map[string]struct {
+		Name        string   `json:"name"`
+		Score       float64  `json:"score"`
+		Description string   `json:"description"`
+		Options     []string `json:"options"`
 	} `json:"symbols"`
 	Action string `json:"action"`
+	// Subject is only set by the rewrite subject action
+	Subject string `json:"subject"`
 }
 
-func (rs *Rspamd) Check(rawMail []byte) *domain.SpamResult {
-	req, err := http.NewRequest(http.MethodPost, rs.host+"/checkv2", bytes.NewReader(rawMail))
+func (rs *Rspamd) Check(ctx context.Context, rawMail []byte) *domain.SpamResult {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rs.scanner+"/checkv2", bytes.NewReader(rawMail))
 	if err != nil {
 		return errResult(fmt.Errorf("could not create check request: %w", err))
 	}
 
-	resp, err := rs.doAuthenticated(req)
+	rs.setEnvelopeHeaders(req, rawMail)
+
+	resp, err := rs.doScan(req)
 	if err != nil {
 		return errResult(fmt.Errorf("could not perform check request: %w", err))
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return errResult(fmt.Errorf("unexpected status %d from rspamd, expected 200", resp.StatusCode))
+		return errResult(statusError(resp.StatusCode, "200"))
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
@@ -105,21 +317,30 @@ func (rs *Rspamd) Check(rawMail []byte) *domain.SpamResult {
 	}
 
 	result := &domain.SpamResult{
-		IsSpam: checkResponse.Action != "no action",
-		Score:  checkResponse.Score,
+		IsSpam:  checkResponse.Action != "no action",
+		Score:   checkResponse.Score,
+		Symbols: map[string]float64{},
+		Subject: checkResponse.Subject,
+	}
+	for symbol, details := range checkResponse.Symbols {
+		result.Symbols[symbol] = details.Score
 	}
 
 	if result.IsSpam {
-		result.Body, err = report(rawMail, body, result.Score)
+		var rawResponse []byte
+		if rs.reportJson {
+			rawResponse = body
+		}
+		result.Body, err = report(rawMail, checkResponse, rawResponse)
 		if err != nil {
-			return errResult(fmt.Errorf("could not create report: %w", err))
+			return errResult(domain.Permanent(fmt.Errorf("could not create report: %w", err)))
 		}
 	}
 
 	return result
 }
 
-func (rs *Rspamd) Learn(learnType domain.LearnType, rawMail []byte) error {
+func (rs *Rspamd) Learn(ctx context.Context, learnType domain.LearnType, rawMail []byte) error {
 	suffix := ""
 	switch learnType {
 	case domain.LearnSpam:
@@ -127,18 +348,24 @@ func (rs *Rspamd) Learn(learnType domain.LearnType, rawMail []byte) error {
 	case domain.LearnHam:
 		suffix = "learnham"
 	default:
-		return fmt.Errorf("unsupported learn type %v", learnType)
+		return domain.Permanent(fmt.Errorf("unsupported learn type %v", learnType))
 	}
 
 	unwrapped, err := mail.UnwrapSpamassassinReport(rawMail)
 	if err != nil {
-		return fmt.Errorf("could not unwrap SpamAssassin-style report: %w", err)
+		return domain.Permanent(fmt.Errorf("could not unwrap SpamAssassin-style report: %w", err))
 	}
 
-	req, err := http.NewRequest(http.MethodPost, rs.host+"/"+suffix, bytes.NewReader(unwrapped))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rs.host+"/"+suffix, bytes.NewReader(unwrapped))
 	if err != nil {
 		return fmt.Errorf("could not create learn request: %w", err)
 	}
+	if len(rs.user) > 0 {
+		req.Header.Set("Deliver-To", rs.user)
+	}
+	if len(rs.classifier) > 0 {
+		req.Header.Set("Classifier", rs.classifier)
+	}
 
 	resp, err := rs.doAuthenticated(req)
 	if err != nil {
@@ -147,12 +374,39 @@ func (rs *Rspamd) Learn(learnType domain.LearnType, rawMail []byte) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAlreadyReported && resp.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("unexpected status %d from rspamd, expected 200/204/208", resp.StatusCode)
+		return statusError(resp.StatusCode, "200/204/208")
 	}
 
 	return nil
 }
 
+// setEnvelopeHeaders passes the envelope of rawMail to rspamd, just like an MTA would when scanning during delivery.
+// The envelope only improves the check, so mails it can't be read from are checked without it.
+func (rs *Rspamd) setEnvelopeHeaders(req *http.Request, rawMail []byte) {
+	envelope, err := mail.MailEnvelope(rawMail, rs.trustedHops)
+	if err != nil {
+		rs.l.WithField("error", err).Debug("Could not read envelope, checking mail without it")
+		envelope = &mail.Envelope{}
+	}
+
+	for header, value := range map[string]string{
+		"IP":         envelope.Ip,
+		"Helo":       envelope.Helo,
+		"Hostname":   envelope.Hostname,
+		"From":       envelope.From,
+		"Rcpt":       envelope.Rcpt,
+		"Deliver-To": envelope.DeliverTo,
+	} {
+		if len(value) > 0 {
+			req.Header.Set(header, value)
+		}
+	}
+
+	if len(rs.user) > 0 {
+		req.Header.Set("Deliver-To", rs.user)
+	}
+}
+
 func (rs *Rspamd) doAuthenticated(req *http.Request) (*http.Response, error) {
 	req.Header.Set("Password", rs.password)
 	resp, err := rs.client.Do(req)
@@ -164,6 +418,29 @@ func (rs *Rspamd) doAuthenticated(req *http.Request) (*http.Response, error) {
 	return resp, nil
 }
 
+func (rs *Rspamd) doScan(req *http.Request) (*http.Response, error) {
+	if len(rs.scannerPassword) > 0 {
+		req.Header.Set("Password", rs.scannerPassword)
+	}
+	resp, err := rs.scannerClient.Do(req)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not send request to rspamd: %w", err)
+	}
+
+	return resp, nil
+}
+
+// statusError reports an unexpected http status, client errors except 429 Too Many Requests are permanent.
+func statusError(status int, expected string) error {
+	err := fmt.Errorf("unexpected status %d from rspamd, expected %s", status, expected)
+	if status >= 400 && status < 500 && status != http.StatusTooManyRequests {
+		return domain.Permanent(err)
+	}
+
+	return err
+}
+
 func errResult(err error) *domain.SpamResult {
 	return &domain.SpamResult{Error: err}
 }
@@ -0,0 +1,157 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package rspamd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/CrawX/go-imap-assassin/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRspamd_setEnvelopeHeaders(t *testing.T) {
+	log.InitLogging("error")
+	tests := []struct {
+		name        string
+		trustedHops int
+		user        string
+		expected    http.Header
+	}{
+		{"firsthop", 1, "", http.Header{
+			"Ip":         {"123.123.123.123"},
+			"Helo":       {"ddx.blubb.xyz"},
+			"From":       {"bounce@chefkoch.de"},
+			"Rcpt":       {"crawx@crawx.crawx"},
+			"Deliver-To": {"crawx@crawx.crawx"},
+		}},
+		{"noreceivedparsing", 0, "", http.Header{
+			"From":       {"bounce@chefkoch.de"},
+			"Rcpt":       {"crawx@crawx.crawx"},
+			"Deliver-To": {"crawx@crawx.crawx"},
+		}},
+		{"user", 0, "someone", http.Header{
+			"From":       {"bounce@chefkoch.de"},
+			"Rcpt":       {"crawx@crawx.crawx"},
+			"Deliver-To": {"someone"},
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rs := &Rspamd{trustedHops: tc.trustedHops, user: tc.user, l: log.Logger(log.LOG_CLASSIFIER)}
+			req, err := http.NewRequest(http.MethodPost, "http://localhost/checkv2", nil)
+			assert.NoError(t, err)
+
+			rs.setEnvelopeHeaders(req, []byte(MAIL))
+			assert.Equal(t, tc.expected, req.Header)
+		})
+	}
+}
+
+func TestRspamd_CheckBrokenEnvelope(t *testing.T) {
+	log.InitLogging("error")
+	scanner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// only the configured user is passed
+		assert.Equal(t, "", r.Header.Get("From"))
+		assert.Equal(t, "someone", r.Header.Get("Deliver-To"))
+		_, err := w.Write([]byte(`{"score": 1.5, "action": "no action", "symbols": {"ARC_NA": {"name": "ARC_NA", "score": 0}}}`))
+		assert.NoError(t, err)
+	}))
+	defer scanner.Close()
+
+	rs, err := NewRspamd(scanner.URL, "secret", TrustedHops(1), User("someone"), SkipPing())
+	require.NoError(t, err)
+
+	result := rs.Check(context.Background(), []byte("Broken header\r\n\r\nbody"))
+	assert.NoError(t, result.Error)
+	assert.Equal(t, 1.5, result.Score)
+}
+
+func TestRspamd_CheckScanner(t *testing.T) {
+	log.InitLogging("error")
+	controller := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/ping", r.URL.Path, "controller should only be pinged")
+		assert.Equal(t, "", r.Header.Get("Password"), "ping doesn't need authentication")
+	}))
+	defer controller.Close()
+
+	scanned := false
+	scanner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "", r.Header.Get("Password"), "scanner password should not be sent if empty")
+		if r.URL.Path == "/checkv2" {
+			scanned = true
+			_, err := w.Write([]byte(`{"score": 1.5, "action": "no action", "symbols": {"ARC_NA": {"name": "ARC_NA", "score": 0}}}`))
+			assert.NoError(t, err)
+		}
+	}))
+	defer scanner.Close()
+
+	rs, err := NewRspamd(controller.URL, "secret", Scanner(scanner.URL+"/", "", time.Second))
+	assert.NoError(t, err)
+
+	result := rs.Check(context.Background(), []byte(MAIL))
+	assert.NoError(t, result.Error)
+	assert.True(t, scanned)
+	assert.False(t, result.IsSpam)
+	assert.Equal(t, 1.5, result.Score)
+}
+
+func TestNewRspamdUnreachable(t *testing.T) {
+	log.InitLogging("error")
+	controller := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer controller.Close()
+
+	rs, err := NewRspamd(controller.URL, "secret")
+	assert.Error(t, err)
+	assert.Nil(t, rs)
+
+	// kept to be probed later
+	rs, err = NewRspamd(controller.URL, "secret", SkipPing())
+	assert.NoError(t, err)
+	assert.Error(t, rs.Ping(context.Background()))
+}
+
+func TestRspamd_Info(t *testing.T) {
+	log.InitLogging("error")
+	controller := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stat" {
+			assert.Equal(t, "secret", r.Header.Get("Password"))
+			_, err := w.Write([]byte(`{"version": "3.4", "scanned": 120, "learned": 30, "spam_count": 20, "ham_count": 100,
+				"total_learns": 30, "actions": {"reject": 5}, "statfiles": [
+				{"symbol": "BAYES_SPAM", "revision": 12, "users": 1},
+				{"symbol": "BAYES_HAM", "revision": 18, "users": 1}]}`))
+			assert.NoError(t, err)
+		}
+	}))
+	defer controller.Close()
+
+	rs, err := NewRspamd(controller.URL, "secret")
+	assert.NoError(t, err)
+
+	info := rs.Info(context.Background())
+	assert.NoError(t, info.Error)
+	assert.Equal(t, "rspamd "+controller.URL, info.Name)
+	assert.Equal(t, "3.4", info.Version)
+	assert.Equal(t, map[string]string{
+		"scanned":            "120",
+		"learned":            "30",
+		"spam count":         "20",
+		"ham count":          "100",
+		"total learns":       "30",
+		"action reject":      "5",
+		"BAYES_SPAM learned": "12",
+		"BAYES_SPAM users":   "1",
+		"BAYES_HAM learned":  "18",
+		"BAYES_HAM users":    "1",
+	}, info.Stats)
+
+	controller.Close()
+	info = rs.Info(context.Background())
+	assert.Error(t, info.Error)
+	assert.Equal(t, "", info.Version)
+}
@@ -0,0 +1,63 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package spamassassin
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const unixPrefix = "unix://"
+
+// dialer connects to spamd via tcp, tls or a unix socket. spamc always dials "tcp" to the address it was created with,
+// so network and address are taken from the dialer itself.
+type dialer struct {
+	network   string
+	address   string
+	timeout   time.Duration
+	tlsConfig *tls.Config
+}
+
+func newDialer(host string, timeout time.Duration) *dialer {
+	if strings.HasPrefix(host, unixPrefix) {
+		return &dialer{
+			network: "unix",
+			address: strings.TrimPrefix(host, unixPrefix),
+			timeout: timeout,
+		}
+	}
+
+	return &dialer{
+		network: "tcp",
+		address: host,
+		timeout: timeout,
+	}
+}
+
+func (d *dialer) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	netDialer := &net.Dialer{Timeout: d.timeout}
+
+	var conn net.Conn
+	var err error
+	if d.tlsConfig != nil {
+		tlsDialer := &tls.Dialer{NetDialer: netDialer, Config: d.tlsConfig}
+		conn, err = tlsDialer.DialContext(ctx, d.network, d.address)
+	} else {
+		conn, err = netDialer.DialContext(ctx, d.network, d.address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// spamc only sets the deadline for *net.Dialer
+	err = conn.SetDeadline(time.Now().Add(d.timeout))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not set deadline: %w", err)
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,66 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package spamassassin
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newDialer(t *testing.T) {
+	tests := []struct {
+		name    string
+		host    string
+		network string
+		address string
+	}{
+		{"tcp", "127.0.0.1:783", "tcp", "127.0.0.1:783"},
+		{"unix", "unix:///var/run/spamd.sock", "unix", "/var/run/spamd.sock"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newDialer(tc.host, time.Second)
+			assert.Equal(t, tc.network, d.network)
+			assert.Equal(t, tc.address, d.address)
+		})
+	}
+}
+
+func Test_dialerUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spamd")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	socket := path.Join(dir, "spamd.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	// network and address passed by spamc are ignored
+	conn, err := newDialer("unix://"+socket, time.Second).DialContext(context.Background(), "tcp", "ignored")
+	assert.NoError(t, err)
+	assert.IsType(t, &net.UnixConn{}, conn)
+	conn.Close()
+}
+
+func TestTLS(t *testing.T) {
+	sa := &SpamAssassin{dialer: newDialer("unix:///var/run/spamd.sock", time.Second)}
+	assert.EqualError(t, TLS("", "", "")(sa), "TLS cannot be used with unix sockets")
+
+	sa = &SpamAssassin{dialer: newDialer("spamd.example.com:783", time.Second)}
+	assert.NoError(t, TLS("", "", "")(sa))
+	assert.Equal(t, "spamd.example.com", sa.dialer.tlsConfig.ServerName)
+}
@@ -2,16 +2,23 @@
 package spamassassin
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"fmt"
 	"io/ioutil"
 	"net"
+	stdmail "net/mail"
+	"net/textproto"
+	"strings"
 	"time"
 
+	"github.com/CrawX/go-imap-assassin/classifier"
 	"github.com/CrawX/go-imap-assassin/domain"
+	"github.com/CrawX/go-imap-assassin/log"
 	"github.com/CrawX/go-imap-assassin/mail"
 
+	"github.com/sirupsen/logrus"
 	"github.com/teamwork/spamc"
 )
 
@@ -19,22 +26,158 @@ const SpamAssassinTimeout = 20 * time.Second
 
 type SpamAssassin struct {
 	client *spamc.Client
+	dialer *dialer
+
+	trustedHops int
+	user        string
+	skipPing    bool
+
+	l *logrus.Logger
+}
+
+type ConfigFunc func(sa *SpamAssassin) error
+
+// TrustedHops sets the number of Received headers added by trusted servers. spamd has no way to receive the envelope
+// next to the mail, so the sender and recipient recorded by the last trusted server are added as X-Envelope-From and
+// X-Envelope-To headers if the mail doesn't contain them already. Client ip and helo are determined by SpamAssassin
+// itself, configure trusted_networks and internal_networks in SpamAssassin accordingly.
+func TrustedHops(hops int) ConfigFunc {
+	return func(sa *SpamAssassin) error {
+		if hops < 0 {
+			return fmt.Errorf("TrustedHops cannot be negative")
+		}
+
+		sa.trustedHops = hops
+		return nil
+	}
+}
+
+// User sets the spamd User header for checks and learns so spamd uses the user's own preferences and Bayes database.
+func User(user string) ConfigFunc {
+	return func(sa *SpamAssassin) error {
+		sa.user = user
+		return nil
+	}
+}
+
+// SkipPing doesn't ping spamd on creation, e.g. to keep an endpoint that is down on startup and probe it later.
+func SkipPing() ConfigFunc {
+	return func(sa *SpamAssassin) error {
+		sa.skipPing = true
+		return nil
+	}
+}
+
+// TLS connects to spamd started with --ssl. caFile verifies the server certificate instead of the system roots,
+// certFile and keyFile authenticate the client. All files are optional.
+func TLS(caFile, certFile, keyFile string) ConfigFunc {
+	return func(sa *SpamAssassin) error {
+		if sa.dialer.network == "unix" {
+			return fmt.Errorf("TLS cannot be used with unix sockets")
+		}
+
+		serverName, _, err := net.SplitHostPort(sa.dialer.address)
+		if err != nil {
+			return fmt.Errorf("could not determine server name: %w", err)
+		}
+
+		config, err := classifier.ClientTLSConfig(caFile, certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		config.ServerName = serverName
+
+		sa.dialer.tlsConfig = config
+		return nil
+	}
 }
 
-func NewSpamassassin(host string) (*SpamAssassin, error) {
-	client := spamc.New(host, &net.Dialer{
-		Timeout: SpamAssassinTimeout,
-	})
-	err := client.Ping(context.TODO())
+// NewSpamassassin connects to spamd at host, which is either host:port or unix:///path/to/spamd.sock.
+func NewSpamassassin(host string, configFunc ...ConfigFunc) (*SpamAssassin, error) {
+	sa := &SpamAssassin{dialer: newDialer(host, SpamAssassinTimeout), l: log.Logger(log.LOG_SPAMASSASSIN)}
+	for _, f := range configFunc {
+		err := f(sa)
+		if err != nil {
+			return nil, fmt.Errorf("error applying configuration: %w", err)
+		}
+	}
+
+	sa.client = spamc.New(sa.dialer.address, sa.dialer)
+	sa.client.DefaultUser = sa.user
+
+	if sa.skipPing {
+		return sa, nil
+	}
+
+	err := sa.Ping(context.Background())
 	if err != nil {
-		return nil, fmt.Errorf("could not ping SpamAssassin: %w", err)
+		return nil, err
 	}
 
-	return &SpamAssassin{client: client}, nil
+	return sa, nil
 }
 
-func (sa *SpamAssassin) Check(rawMail []byte) *domain.SpamResult {
-	out, err := sa.client.Process(context.TODO(), bytes.NewReader(rawMail), nil)
+func (sa *SpamAssassin) Ping(ctx context.Context) error {
+	err := sa.client.Ping(ctx)
+	if err != nil {
+		return fmt.Errorf("could not ping SpamAssassin: %w", err)
+	}
+
+	return nil
+}
+
+// Info pings spamd and reports the protocol version of its response, e.g. SPAMD/1.5. spamd has no command to report
+// the SpamAssassin version or Bayes statistics without checking a mail, use spamd --version and sa-learn --dump magic
+// on the spamd host instead.
+func (sa *SpamAssassin) Info(ctx context.Context) *domain.ClassifierInfo {
+	info := &domain.ClassifierInfo{Name: "spamassassin " + sa.dialer.address}
+
+	version, err := sa.protocolVersion(ctx)
+	if err != nil {
+		info.Error = fmt.Errorf("could not ping SpamAssassin: %w", err)
+		return info
+	}
+	info.Version = version
+
+	return info
+}
+
+// protocolVersion sends a PING to spamd and returns the SPAMD/x.y part of its response line, which spamc doesn't expose.
+func (sa *SpamAssassin) protocolVersion(ctx context.Context) (string, error) {
+	conn, err := sa.dialer.DialContext(ctx, "", "")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("PING SPAMC/1.5\r\n\r\n"))
+	if err != nil {
+		return "", fmt.Errorf("could not send ping: %w", err)
+	}
+
+	line, err := textproto.NewReader(bufio.NewReader(conn)).ReadLine()
+	if err != nil {
+		return "", fmt.Errorf("could not read ping response: %w", err)
+	}
+
+	// SPAMD/1.5 0 PONG
+	fields := strings.Fields(line)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "SPAMD/") || fields[1] != "0" {
+		return "", fmt.Errorf("unexpected ping response %q", line)
+	}
+
+	return fields[0], nil
+}
+
+func (sa *SpamAssassin) Check(ctx context.Context, rawMail []byte) *domain.SpamResult {
+	withEnvelope, err := sa.addEnvelopeHeaders(rawMail)
+	if err != nil {
+		// the envelope only improves the check
+		sa.l.WithField("error", err).Debug("Could not add envelope headers, checking mail without them")
+		withEnvelope = rawMail
+	}
+
+	out, err := sa.client.Process(ctx, bytes.NewReader(withEnvelope), nil)
 	if err != nil {
 		return errResult(fmt.Errorf("could not check SpamAssassin: %w", err))
 	}
@@ -52,14 +195,41 @@ func (sa *SpamAssassin) Check(rawMail []byte) *domain.SpamResult {
 		return errResult(fmt.Errorf("could not close response: %w", err))
 	}
 
-	return &domain.SpamResult{
+	result := &domain.SpamResult{
 		IsSpam: out.IsSpam,
 		Score:  out.Score,
 		Body:   body,
 	}
+
+	if out.IsSpam {
+		result.Subject, err = rewrittenSubject(rawMail, body)
+		if err != nil {
+			// the verdict stands, the subject just isn't rewritten
+			sa.l.WithField("error", err).Debug("Could not read rewritten subject, keeping the original")
+		}
+	}
+
+	return result
 }
 
-func (sa *SpamAssassin) Learn(learnType domain.LearnType, rawMail []byte) error {
+// rewrittenSubject returns the subject of spamd's processed mail if rewrite_header Subject changed it, empty otherwise.
+func rewrittenSubject(rawMail, processed []byte) (string, error) {
+	original, err := mail.Subject(rawMail)
+	if err != nil {
+		return "", fmt.Errorf("could not read subject: %w", err)
+	}
+	subject, err := mail.Subject(processed)
+	if err != nil {
+		return "", fmt.Errorf("could not read subject of processed mail: %w", err)
+	}
+
+	if subject == original {
+		return "", nil
+	}
+	return subject, nil
+}
+
+func (sa *SpamAssassin) Learn(ctx context.Context, learnType domain.LearnType, rawMail []byte) error {
 	header := spamc.Header{}.Set("Set", "local")
 	switch learnType {
 	case domain.LearnSpam:
@@ -67,20 +237,56 @@ func (sa *SpamAssassin) Learn(learnType domain.LearnType, rawMail []byte) error
 	case domain.LearnHam:
 		header = header.Set("Message-class", "ham")
 	default:
-		return fmt.Errorf("unsupported learn type %v", learnType)
+		return domain.Permanent(fmt.Errorf("unsupported learn type %v", learnType))
 	}
 
 	unwrapped, err := mail.UnwrapSpamassassinReport(rawMail)
 	if err != nil {
-		return fmt.Errorf("could not unwrap SpamAssassin-style report: %w", err)
+		return domain.Permanent(fmt.Errorf("could not unwrap SpamAssassin-style report: %w", err))
 	}
-	_, err = sa.client.Tell(context.TODO(), bytes.NewReader(unwrapped), header)
+	_, err = sa.client.Tell(ctx, bytes.NewReader(unwrapped), header)
 	if err != nil {
 		return fmt.Errorf("could not learn SpamAssassin: %w", err)
 	}
 	return nil
 }
 
+// addEnvelopeHeaders prepends the envelope sender and recipient headers SpamAssassin looks for by default.
+func (sa *SpamAssassin) addEnvelopeHeaders(rawMail []byte) ([]byte, error) {
+	if sa.trustedHops == 0 {
+		return rawMail, nil
+	}
+
+	envelope, err := mail.MailEnvelope(rawMail, sa.trustedHops)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := stdmail.ReadMessage(bytes.NewReader(rawMail))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse mail: %w", err)
+	}
+
+	newline := "\n"
+	if i := bytes.IndexByte(rawMail, '\n'); i > 0 && rawMail[i-1] == '\r' {
+		newline = "\r\n"
+	}
+
+	headers := &bytes.Buffer{}
+	if len(envelope.From) > 0 && len(msg.Header.Get("X-Envelope-From")) == 0 {
+		headers.WriteString("X-Envelope-From: <" + envelope.From + ">" + newline)
+	}
+	if len(envelope.Rcpt) > 0 && len(msg.Header.Get("X-Envelope-To")) == 0 {
+		headers.WriteString("X-Envelope-To: <" + envelope.Rcpt + ">" + newline)
+	}
+
+	if headers.Len() == 0 {
+		return rawMail, nil
+	}
+
+	return append(headers.Bytes(), rawMail...), nil
+}
+
 func errResult(err error) *domain.SpamResult {
 	return &domain.SpamResult{Error: err}
 }
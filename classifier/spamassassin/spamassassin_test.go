@@ -0,0 +1,141 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package spamassassin
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/CrawX/go-imap-assassin/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_rewrittenSubject(t *testing.T) {
+	tests := []struct {
+		name      string
+		processed string
+		subject   string
+	}{
+		{"rewritten", "Subject: *****SPAM***** Hello\r\n\r\nreport", "*****SPAM***** Hello"},
+		{"unchanged", "Subject: Hello\r\nX-Spam-Flag: YES\r\n\r\nreport", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			subject, err := rewrittenSubject([]byte("Subject: Hello\r\n\r\nbody"), []byte(tc.processed))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.subject, subject)
+		})
+	}
+}
+
+func TestSpamAssassin_Info(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		version  string
+		err      string
+	}{
+		{"pong", "SPAMD/1.5 0 PONG\r\n", "SPAMD/1.5", ""},
+		{"error", "SPAMD/1.5 76 Bad header line\r\n", "", `could not ping SpamAssassin: unexpected ping response "SPAMD/1.5 76 Bad header line"`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			defer listener.Close()
+
+			received := make(chan string, 1)
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+
+				line, _ := textproto.NewReader(bufio.NewReader(conn)).ReadLine()
+				received <- line
+				_, _ = conn.Write([]byte(tc.response))
+			}()
+
+			sa := &SpamAssassin{dialer: newDialer(listener.Addr().String(), time.Second)}
+			info := sa.Info(context.Background())
+
+			// only a ping, no mail is scanned
+			assert.Equal(t, "PING SPAMC/1.5", <-received)
+			assert.Equal(t, tc.version, info.Version)
+			if len(tc.err) == 0 {
+				assert.NoError(t, info.Error)
+			} else {
+				assert.EqualError(t, info.Error, tc.err)
+			}
+		})
+	}
+}
+
+// fakeSpamd answers the first request with response and passes the mail it received to the returned channel.
+func fakeSpamd(t *testing.T, response string) (string, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// PROCESS SPAMC/1.5, headers, mail
+		reader := textproto.NewReader(bufio.NewReader(conn))
+		_, _ = reader.ReadLine()
+		header, _ := reader.ReadMIMEHeader()
+		length, _ := strconv.Atoi(header.Get("Content-length"))
+		body := make([]byte, length)
+		_, _ = io.ReadFull(reader.R, body)
+		received <- string(body)
+		_, _ = conn.Write([]byte(response))
+	}()
+
+	return listener.Addr().String(), received
+}
+
+func TestSpamAssassin_CheckBrokenEnvelope(t *testing.T) {
+	log.InitLogging("error")
+	address, received := fakeSpamd(t, "SPAMD/1.1 0 EX_OK\r\nSpam: False ; 1.5 / 5.0\r\nContent-length: 0\r\n\r\n")
+
+	sa, err := NewSpamassassin(address, TrustedHops(1), SkipPing())
+	require.NoError(t, err)
+
+	// the mail is checked without envelope headers
+	rawMail := "Broken header\r\n\r\nbody"
+	result := sa.Check(context.Background(), []byte(rawMail))
+	assert.Equal(t, rawMail, <-received)
+	assert.NoError(t, result.Error)
+	assert.False(t, result.IsSpam)
+	assert.Equal(t, 1.5, result.Score)
+}
+
+func TestSpamAssassin_CheckUndecodableSubject(t *testing.T) {
+	log.InitLogging("error")
+	processed := "Subject: =?x-unknown?Q?SPAM?=\r\n\r\nreport"
+	address, _ := fakeSpamd(t, fmt.Sprintf("SPAMD/1.1 0 EX_OK\r\nSpam: True ; 8.5 / 5.0\r\nContent-length: %d\r\n\r\n%s", len(processed), processed))
+
+	sa, err := NewSpamassassin(address, SkipPing())
+	require.NoError(t, err)
+
+	// the verdict stands without a rewritten subject
+	result := sa.Check(context.Background(), []byte("Subject: Hello\r\n\r\nbody"))
+	assert.NoError(t, result.Error)
+	assert.True(t, result.IsSpam)
+	assert.Equal(t, 8.5, result.Score)
+	assert.Equal(t, "", result.Subject)
+	assert.Equal(t, []byte(processed), result.Body)
+}
@@ -0,0 +1,43 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package classifier
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	empty := path.Join(dir, "empty.pem")
+	assert.NoError(t, ioutil.WriteFile(empty, []byte("no certificate"), 0600))
+
+	tests := []struct {
+		name                     string
+		caFile, certFile, keyFile string
+		err                      string
+	}{
+		{"system roots", "", "", "", ""},
+		{"missing ca", "/nonexistent", "", "", "could not read CA file: open /nonexistent: no such file or directory"},
+		{"empty ca", empty, "", "", "no certificates found in CA file " + empty},
+		{"missing key", "", empty, "", "could not load client certificate: open : no such file or directory"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := ClientTLSConfig(tc.caFile, tc.certFile, tc.keyFile)
+			if len(tc.err) > 0 {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Nil(t, config.RootCAs)
+			assert.Empty(t, config.Certificates)
+		})
+	}
+}
@@ -0,0 +1,427 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package webhook implements a classifier that calls an arbitrary HTTP service, e.g. an in-house scoring service.
+//
+// Checks are POSTed to the check URL, learns to the learn URL. Depending on the format, the request body is either
+//
+//   - raw: the mail itself with Content-Type message/rfc822. Learns carry the learn type in the X-Learn-Type header.
+//   - json: a request object with Content-Type application/json:
+//     {"mail": "<base64 encoded raw mail>", "headers": {"Subject": ["..."], ...},
+//     "envelope": {"ip": "...", "helo": "...", "hostname": "...", "from": "...", "rcpt": "...", "deliver_to": "..."},
+//     "user": "...", "learn": "spam|ham"}
+//     where learn is only set when learning and user only if configured.
+//
+// Checks must be answered with 200 and a JSON response:
+//
+//	{"spam": true, "score": 7.5, "report": "human-readable text", "error": ""}
+//
+// A non-empty error fails the check. The report is optional and used as the text of the report mail for spam. Learns
+// must be answered with any 2xx status.
+//
+// Health checks send a GET request to the check URL, any status below 500 means the service is reachable. Services may
+// answer it with 200 and {"version": "...", "stats": {"name": "value", ...}}, which is shown by the status command.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	stdmail "net/mail"
+	"time"
+
+	"github.com/CrawX/go-imap-assassin/classifier"
+	"github.com/CrawX/go-imap-assassin/domain"
+	"github.com/CrawX/go-imap-assassin/mail"
+)
+
+const (
+	DefaultTimeout = 20 * time.Second
+
+	FormatRaw  = "raw"
+	FormatJson = "json"
+
+	// maxResponseSize protects against services sending huge responses, reports are not expected to be large
+	maxResponseSize = 1 << 20
+)
+
+type Webhook struct {
+	client   *http.Client
+	checkUrl string
+	learnUrl string
+	headers  map[string]string
+
+	format      string
+	trustedHops int
+	user        string
+}
+
+type ConfigFunc func(w *Webhook) error
+
+// LearnURL sets the URL learn events are POSTed to. Without it, learning is not supported.
+func LearnURL(learnUrl string) ConfigFunc {
+	return func(w *Webhook) error {
+		w.learnUrl = learnUrl
+		return nil
+	}
+}
+
+// Headers sets additional headers sent with every request, e.g. Authorization or an API key.
+func Headers(headers map[string]string) ConfigFunc {
+	return func(w *Webhook) error {
+		w.headers = headers
+		return nil
+	}
+}
+
+// Format sets the request body format, either FormatRaw or FormatJson.
+func Format(format string) ConfigFunc {
+	return func(w *Webhook) error {
+		if format != FormatRaw && format != FormatJson {
+			return fmt.Errorf("Format must be %s or %s", FormatRaw, FormatJson)
+		}
+
+		w.format = format
+		return nil
+	}
+}
+
+// TrustedHops sets the number of Received headers added by trusted servers, the reconstructed envelope is included
+// in json requests.
+func TrustedHops(hops int) ConfigFunc {
+	return func(w *Webhook) error {
+		if hops < 0 {
+			return fmt.Errorf("TrustedHops cannot be negative")
+		}
+
+		w.trustedHops = hops
+		return nil
+	}
+}
+
+// User is included in json requests so the service can keep separate statistics per user.
+func User(user string) ConfigFunc {
+	return func(w *Webhook) error {
+		w.user = user
+		return nil
+	}
+}
+
+// Timeout sets the timeout of a single request.
+func Timeout(timeout time.Duration) ConfigFunc {
+	return func(w *Webhook) error {
+		if timeout <= 0 {
+			return fmt.Errorf("Timeout must be positive")
+		}
+
+		w.client.Timeout = timeout
+		return nil
+	}
+}
+
+// TLS configures https connections: caFile verifies the server certificate instead of the system roots, certFile
+// and keyFile are used for client certificate authentication. All of them are optional. insecure skips server
+// certificate verification and is only meant for testing.
+func TLS(caFile, certFile, keyFile string, insecure bool) ConfigFunc {
+	return func(w *Webhook) error {
+		config, err := classifier.ClientTLSConfig(caFile, certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		config.InsecureSkipVerify = insecure
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = config
+		w.client.Transport = transport
+		return nil
+	}
+}
+
+func NewWebhook(checkUrl string, configFunc ...ConfigFunc) (*Webhook, error) {
+	if len(checkUrl) == 0 {
+		return nil, fmt.Errorf("check URL cannot be empty")
+	}
+
+	webhook := &Webhook{
+		client: &http.Client{
+			Timeout: DefaultTimeout,
+		},
+		checkUrl: checkUrl,
+		format:   FormatRaw,
+	}
+	for _, f := range configFunc {
+		err := f(webhook)
+		if err != nil {
+			return nil, fmt.Errorf("error applying configuration: %w", err)
+		}
+	}
+
+	return webhook, nil
+}
+
+type envelope struct {
+	Ip        string `json:"ip,omitempty"`
+	Helo      string `json:"helo,omitempty"`
+	Hostname  string `json:"hostname,omitempty"`
+	From      string `json:"from,omitempty"`
+	Rcpt      string `json:"rcpt,omitempty"`
+	DeliverTo string `json:"deliver_to,omitempty"`
+}
+
+type request struct {
+	Mail     []byte              `json:"mail"`
+	Headers  map[string][]string `json:"headers"`
+	Envelope envelope            `json:"envelope"`
+	User     string              `json:"user,omitempty"`
+	Learn    domain.LearnType    `json:"learn,omitempty"`
+}
+
+type infoResponse struct {
+	Version string            `json:"version"`
+	Stats   map[string]string `json:"stats"`
+}
+
+// Ping sends a GET request to the check URL, the service is reachable if it answers with a status below 500.
+func (w *Webhook) Ping(ctx context.Context) error {
+	resp, err := w.get(ctx)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// Info pings the service and reads the optional version and stats from a 200 response.
+func (w *Webhook) Info(ctx context.Context) *domain.ClassifierInfo {
+	info := &domain.ClassifierInfo{Name: "webhook " + w.checkUrl}
+
+	resp, err := w.get(ctx)
+	if err != nil {
+		info.Error = err
+		return info
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return info
+	}
+	body, err := readResponse(resp.Body)
+	if err != nil {
+		return info
+	}
+	infoResponse := &infoResponse{}
+	if json.Unmarshal(body, infoResponse) == nil {
+		info.Version = infoResponse.Version
+		info.Stats = infoResponse.Stats
+	}
+
+	return info
+}
+
+func (w *Webhook) get(ctx context.Context) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, w.checkUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create ping request: %w", err)
+	}
+	for name, value := range w.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not ping webhook: %w", err)
+	}
+
+	if resp.StatusCode >= 500 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %d from webhook ping, expected < 500", resp.StatusCode)
+	}
+
+	return resp, nil
+}
+
+// readResponse reads a response body of at most maxResponseSize bytes.
+func readResponse(body io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(body, maxResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxResponseSize {
+		return nil, fmt.Errorf("response exceeds %d bytes", maxResponseSize)
+	}
+
+	return data, nil
+}
+
+type checkResponse struct {
+	Spam   bool    `json:"spam"`
+	Score  float64 `json:"score"`
+	Report string  `json:"report"`
+	Error  string  `json:"error"`
+}
+
+func (w *Webhook) Check(ctx context.Context, rawMail []byte) *domain.SpamResult {
+	req, err := w.newRequest(ctx, w.checkUrl, rawMail, "")
+	if err != nil {
+		return errResult(fmt.Errorf("could not create check request: %w", err))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return errResult(fmt.Errorf("could not perform check request: %w", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errResult(statusError(resp.StatusCode, "200"))
+	}
+
+	body, err := readResponse(resp.Body)
+	if err != nil {
+		return errResult(fmt.Errorf("could not read webhook response: %w", err))
+	}
+
+	checkResponse := &checkResponse{}
+	err = json.Unmarshal(body, checkResponse)
+	if err != nil {
+		return errResult(fmt.Errorf("could not deserialize webhook response: %w", err))
+	}
+
+	if len(checkResponse.Error) > 0 {
+		return errResult(fmt.Errorf("webhook reported an error: %s", checkResponse.Error))
+	}
+
+	result := &domain.SpamResult{
+		IsSpam: checkResponse.Spam,
+		Score:  checkResponse.Score,
+	}
+
+	if result.IsSpam {
+		text := checkResponse.Report
+		if len(text) == 0 {
+			text = fmt.Sprintf("The webhook classified the attached mail as spam with a score of %.2f.", result.Score)
+		}
+		result.Body, err = mail.Report(
+			rawMail,
+			"webhook",
+			map[string]string{
+				"X-Spam-Checker-Version": "webhook",
+				"X-Spam-Flag":            "YES",
+				"X-Spam-Status":          fmt.Sprintf("Yes, score=%.2f", result.Score),
+			},
+			[]byte(text+"\n"),
+		)
+		if err != nil {
+			return errResult(domain.Permanent(fmt.Errorf("could not create report: %w", err)))
+		}
+	}
+
+	return result
+}
+
+func (w *Webhook) Learn(ctx context.Context, learnType domain.LearnType, rawMail []byte) error {
+	if learnType != domain.LearnSpam && learnType != domain.LearnHam {
+		return domain.Permanent(fmt.Errorf("unsupported learn type %v", learnType))
+	}
+	if len(w.learnUrl) == 0 {
+		return domain.Permanent(fmt.Errorf("no learn URL configured"))
+	}
+
+	unwrapped, err := mail.UnwrapSpamassassinReport(rawMail)
+	if err != nil {
+		return domain.Permanent(fmt.Errorf("could not unwrap SpamAssassin-style report: %w", err))
+	}
+
+	req, err := w.newRequest(ctx, w.learnUrl, unwrapped, learnType)
+	if err != nil {
+		return fmt.Errorf("could not create learn request: %w", err)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not perform learn request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return statusError(resp.StatusCode, "2xx")
+	}
+
+	return nil
+}
+
+// newRequest creates the POST request in the configured format. learnType is empty for checks.
+func (w *Webhook) newRequest(ctx context.Context, url string, rawMail []byte, learnType domain.LearnType) (*http.Request, error) {
+	var body []byte
+	var contentType string
+	switch w.format {
+	case FormatJson:
+		var err error
+		body, err = w.jsonBody(rawMail, learnType)
+		if err != nil {
+			return nil, err
+		}
+		contentType = "application/json"
+	default:
+		body = rawMail
+		contentType = "message/rfc822"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for header, value := range w.headers {
+		req.Header.Set(header, value)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if w.format == FormatRaw && len(learnType) > 0 {
+		req.Header.Set("X-Learn-Type", string(learnType))
+	}
+
+	return req, nil
+}
+
+func (w *Webhook) jsonBody(rawMail []byte, learnType domain.LearnType) ([]byte, error) {
+	msg, err := stdmail.ReadMessage(bytes.NewReader(rawMail))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse mail: %w", err)
+	}
+
+	mailEnvelope, err := mail.MailEnvelope(rawMail, w.trustedHops)
+	if err != nil {
+		return nil, fmt.Errorf("could not read envelope: %w", err)
+	}
+
+	body, err := json.Marshal(&request{
+		Mail:     rawMail,
+		Headers:  msg.Header,
+		Envelope: envelope(*mailEnvelope),
+		User:     w.user,
+		Learn:    learnType,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not serialize request: %w", err)
+	}
+
+	return body, nil
+}
+
+// statusError reports an unexpected http status, client errors except 429 Too Many Requests are permanent.
+func statusError(status int, expected string) error {
+	err := fmt.Errorf("unexpected status %d from webhook, expected %s", status, expected)
+	if status >= 400 && status < 500 && status != http.StatusTooManyRequests {
+		return domain.Permanent(err)
+	}
+
+	return err
+}
+
+func errResult(err error) *domain.SpamResult {
+	return &domain.SpamResult{Error: err}
+}
@@ -0,0 +1,187 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CrawX/go-imap-assassin/domain"
+	"github.com/stretchr/testify/assert"
+)
+
+const MAIL = "Received: from mail.example.com (mail.example.com [192.0.2.1])\r\n" +
+	"\tby mx.example.net with ESMTP for <me@example.net>; Mon, 1 Feb 2021 10:00:00 +0000\r\n" +
+	"Return-Path: <sender@example.com>\r\n" +
+	"From: sender@example.com\r\n" +
+	"To: me@example.net\r\n" +
+	"Subject: Test\r\n" +
+	"Message-Id: <test@example.com>\r\n" +
+	"\r\n" +
+	"Test\r\n"
+
+func TestWebhook_Check(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		status   int
+		isSpam   bool
+		score    float64
+		err      string
+	}{
+		{"ham", `{"spam": false, "score": -1.5}`, http.StatusOK, false, -1.5, ""},
+		{"spam", `{"spam": true, "score": 9, "report": "looks bad"}`, http.StatusOK, true, 9, ""},
+		{"error", `{"error": "model not loaded"}`, http.StatusOK, false, 0, "webhook reported an error: model not loaded"},
+		{"status", ``, http.StatusInternalServerError, false, 0, "unexpected status 500 from webhook, expected 200"},
+		{"invalid", `{`, http.StatusOK, false, 0, "could not deserialize webhook response: unexpected end of JSON input"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+				assert.Equal(t, "message/rfc822", r.Header.Get("Content-Type"))
+				body, err := ioutil.ReadAll(r.Body)
+				assert.NoError(t, err)
+				assert.Equal(t, MAIL, string(body))
+
+				w.WriteHeader(tc.status)
+				_, err = w.Write([]byte(tc.response))
+				assert.NoError(t, err)
+			}))
+			defer server.Close()
+
+			wh, err := NewWebhook(server.URL, Headers(map[string]string{"Authorization": "Bearer secret"}), Timeout(time.Second))
+			assert.NoError(t, err)
+
+			result := wh.Check(context.Background(), []byte(MAIL))
+			if len(tc.err) > 0 {
+				assert.EqualError(t, result.Error, tc.err)
+				return
+			}
+			assert.NoError(t, result.Error)
+			assert.Equal(t, tc.isSpam, result.IsSpam)
+			assert.Equal(t, tc.score, result.Score)
+			if tc.isSpam {
+				assert.Contains(t, string(result.Body), "looks bad")
+			} else {
+				assert.Nil(t, result.Body)
+			}
+		})
+	}
+}
+
+func Test_readResponse(t *testing.T) {
+	body, err := readResponse(strings.NewReader(strings.Repeat("a", maxResponseSize)))
+	assert.NoError(t, err)
+	assert.Len(t, body, maxResponseSize)
+
+	_, err = readResponse(strings.NewReader(strings.Repeat("a", maxResponseSize+1)))
+	assert.EqualError(t, err, "response exceeds 1048576 bytes")
+}
+
+func TestWebhook_LearnJson(t *testing.T) {
+	learned := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/learn", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+		req := &request{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(req))
+		assert.Equal(t, MAIL, string(req.Mail))
+		assert.Equal(t, []string{"Test"}, req.Headers["Subject"])
+		assert.Equal(t, envelope{
+			Ip:        "192.0.2.1",
+			Helo:      "mail.example.com",
+			Hostname:  "mail.example.com",
+			From:      "sender@example.com",
+			Rcpt:      "me@example.net",
+			DeliverTo: "me@example.net",
+		}, req.Envelope)
+		assert.Equal(t, "someone", req.User)
+		assert.Equal(t, domain.LearnSpam, req.Learn)
+
+		learned = true
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	wh, err := NewWebhook(server.URL+"/check", LearnURL(server.URL+"/learn"), Format(FormatJson), TrustedHops(1), User("someone"))
+	assert.NoError(t, err)
+
+	assert.NoError(t, wh.Learn(context.Background(), domain.LearnSpam, []byte(MAIL)))
+	assert.True(t, learned)
+}
+
+func TestWebhook_Info(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		status   int
+		info     *domain.ClassifierInfo
+		err      string
+	}{
+		{"info", `{"version": "1.2", "stats": {"model": "2024-01"}}`, http.StatusOK, &domain.ClassifierInfo{Version: "1.2", Stats: map[string]string{"model": "2024-01"}}, ""},
+		{"notjson", `ok`, http.StatusOK, &domain.ClassifierInfo{}, ""},
+		{"methodnotallowed", ``, http.StatusMethodNotAllowed, &domain.ClassifierInfo{}, ""},
+		{"down", ``, http.StatusServiceUnavailable, nil, "unexpected status 503 from webhook ping, expected < 500"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, http.MethodGet, r.Method)
+				assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+				w.WriteHeader(tc.status)
+				_, err := w.Write([]byte(tc.response))
+				assert.NoError(t, err)
+			}))
+			defer server.Close()
+
+			wh, err := NewWebhook(server.URL, Headers(map[string]string{"Authorization": "Bearer secret"}))
+			assert.NoError(t, err)
+
+			info := wh.Info(context.Background())
+			assert.Equal(t, "webhook "+server.URL, info.Name)
+			if len(tc.err) > 0 {
+				assert.EqualError(t, info.Error, tc.err)
+				assert.EqualError(t, wh.Ping(context.Background()), tc.err)
+				return
+			}
+			assert.NoError(t, info.Error)
+			assert.NoError(t, wh.Ping(context.Background()))
+			assert.Equal(t, tc.info.Version, info.Version)
+			assert.Equal(t, tc.info.Stats, info.Stats)
+		})
+	}
+}
+
+func TestNewWebhook(t *testing.T) {
+	tests := []struct {
+		name     string
+		checkUrl string
+		cfgs     []ConfigFunc
+		err      string
+	}{
+		{"ok", "http://localhost", []ConfigFunc{Format(FormatJson), TrustedHops(2), Timeout(time.Second), TLS("", "", "", false)}, ""},
+		{"url", "", nil, "check URL cannot be empty"},
+		{"format", "http://localhost", []ConfigFunc{Format("xml")}, "error applying configuration: Format must be raw or json"},
+		{"timeout", "http://localhost", []ConfigFunc{Timeout(0)}, "error applying configuration: Timeout must be positive"},
+		{"ca", "http://localhost", []ConfigFunc{TLS("/nonexistent", "", "", false)}, "error applying configuration: could not read CA file: open /nonexistent: no such file or directory"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			wh, err := NewWebhook(tc.checkUrl, tc.cfgs...)
+			if len(tc.err) == 0 {
+				assert.NotNil(t, wh)
+				assert.NoError(t, err)
+			} else {
+				assert.Nil(t, wh)
+				assert.EqualError(t, err, tc.err)
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ package config
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/BurntSushi/toml"
@@ -16,33 +17,150 @@ type Config struct {
 	User     string
 	Password string
 
-	SpamassassinHost string
+	SpamassassinHost       string
+	SpamassassinHosts      []string
+	SpamassassinTLS        bool
+	SpamassassinCA         string
+	SpamassassinClientCert string
+	SpamassassinClientKey  string
 
-	RspamdController string
-	RspamdPassword   string
+	RspamdController  string
+	RspamdControllers []string
+	RspamdPassword    string
+	RspamdClassifier  string
+	RspamdReportJson  bool
+
+	RspamdScanner         string
+	RspamdScanners        []string
+	RspamdScannerPassword string
+	RspamdScannerTimeout  int
+
+	BayesClassifier   bool
+	BayesThreshold    float64
+	BayesMinSpam      int
+	BayesMinHam       int
+	BayesReportTokens int
+
+	CommandCheck         []string
+	CommandLearnSpam     []string
+	CommandLearnHam      []string
+	CommandSpamExitCodes []int
+	CommandHamExitCodes  []int
+	CommandTimeout       int
+
+	WebhookCheckUrl   string
+	WebhookLearnUrl   string
+	WebhookFormat     string
+	WebhookHeaders    map[string]string
+	WebhookTimeout    int
+	WebhookCA         string
+	WebhookClientCert string
+	WebhookClientKey  string
+	WebhookInsecure   bool
+
+	ClassifierUser string
+
+	BalanceStrategy string
+
+	TrustedHops int
+
+	ResultCache    bool
+	ResultCacheTTL int
+
+	RetryAttempts          int
+	RetryBackoff           int
+	RetryMaxBackoff        int
+	CircuitBreakerFailures int
+	CircuitBreakerOpen     int
 
 	DryRun bool
 
-	MoveSpam      bool
-	DeleteSpam    bool
-	SpamFolder    string
-	AppendReports bool
-	ReportFolder  string
+	MoveSpam          bool
+	DeleteSpam        bool
+	SpamFolder        string
+	TagSpam           bool
+	SpamSubjectPrefix string
+	AppendReports     bool
+	ReportFolder      string
+
+	SpamGraceDays        int
+	ExpungeConfirmedSpam bool
+
+	Retention []Retention
 
 	CheckFolders []string
 
+	RuleLists
+	RulesFile string
+
+	SentFolders                []string
+	CorrespondentMode          string
+	CorrespondentScoreOffset   float64
+	CorrespondentRequiredScore float64
+
 	SpamLearnFolders []string
 	HamLearnFolders  []string
 	DeleteLearned    bool
+	LearnRescued     bool
 
 	Loglevel *string
 }
 
+// RuleLists are the allow and block lists of senders, domains, List-Ids and "Name: regex" header rules. They can be set
+// in the config file or in RulesFile, in which case both are combined.
+type RuleLists struct {
+	AllowSenders []string
+	AllowDomains []string
+	AllowListIds []string
+	AllowHeaders []string
+
+	BlockSenders []string
+	BlockDomains []string
+	BlockListIds []string
+	BlockHeaders []string
+}
+
+// Retention limits the mails kept in Folder to those younger than MaxAgeDays and to the newest MaxMails, 0 disables a
+// limit.
+type Retention struct {
+	Folder     string
+	MaxAgeDays int
+	MaxMails   int
+}
+
 func ReadConfig(filename string) (*Config, error) {
 	config := &Config{
 		Database:     "persistence.db",
 		CheckFolders: []string{"INBOX"},
 		DryRun:       true,
+		TrustedHops:  1,
+		LearnRescued: true,
+
+		BalanceStrategy: "roundrobin",
+
+		ResultCacheTTL: 24,
+
+		RetryAttempts:          3,
+		RetryBackoff:           500,
+		RetryMaxBackoff:        10000,
+		CircuitBreakerFailures: 5,
+		CircuitBreakerOpen:     30,
+
+		BayesThreshold:    0.9,
+		BayesMinSpam:      20,
+		BayesMinHam:       20,
+		BayesReportTokens: 15,
+
+		CommandSpamExitCodes: []int{1},
+		CommandHamExitCodes:  []int{0},
+		CommandTimeout:       20,
+
+		WebhookFormat:  "raw",
+		WebhookTimeout: 20,
+
+		CorrespondentMode:          "allow",
+		CorrespondentScoreOffset:   5,
+		CorrespondentRequiredScore: 5,
 	}
 
 	_, err := toml.DecodeFile(filename, config)
@@ -50,6 +168,13 @@ func ReadConfig(filename string) (*Config, error) {
 		return nil, fmt.Errorf("could not read config file: %w", err)
 	}
 
+	if len(config.RulesFile) > 0 {
+		err = config.readRulesFile()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	err = config.validate()
 	if err != nil {
 		return nil, err
@@ -75,24 +200,196 @@ func (c *Config) validate() error {
 		return err
 	}
 
-	spamassassinSet := len(strings.TrimSpace(c.SpamassassinHost)) > 0
-	rspamdSet := len(strings.TrimSpace(c.RspamdController)) > 0
-	if rspamdSet && spamassassinSet {
-		return fmt.Errorf("SpamassassinHost and RspamdController cannot be set at the same time")
+	spamassassinSet := len(c.SpamassassinEndpoints()) > 0
+	rspamdSet := len(c.RspamdEndpoints()) > 0
+	classifiers := []string{}
+	for name, set := range map[string]bool{
+		"SpamassassinHost(s)": spamassassinSet,
+		"RspamdController(s)": rspamdSet,
+		"BayesClassifier":     c.BayesClassifier,
+		"CommandCheck":        len(c.CommandCheck) > 0,
+		"WebhookCheckUrl":     len(c.WebhookCheckUrl) > 0,
+	} {
+		if set {
+			classifiers = append(classifiers, name)
+		}
+	}
+	sort.Strings(classifiers)
+	if len(classifiers) > 1 {
+		return fmt.Errorf("%s cannot be set at the same time", strings.Join(classifiers, " and "))
+	}
+	if len(classifiers) == 0 {
+		return fmt.Errorf("set either SpamassassinHost(s), RspamdController(s), BayesClassifier, CommandCheck or WebhookCheckUrl to use one classifier")
+	}
+
+	if len(c.CommandCheck) > 0 {
+		if len(c.CommandSpamExitCodes) == 0 || len(c.CommandHamExitCodes) == 0 {
+			return fmt.Errorf("CommandSpamExitCodes and CommandHamExitCodes must not be empty")
+		}
+		if c.CommandTimeout <= 0 {
+			return fmt.Errorf("CommandTimeout must be positive")
+		}
+	}
+
+	if len(c.WebhookCheckUrl) > 0 {
+		if c.WebhookFormat != "raw" && c.WebhookFormat != "json" {
+			return fmt.Errorf("WebhookFormat must be raw or json")
+		}
+		if c.WebhookTimeout <= 0 {
+			return fmt.Errorf("WebhookTimeout must be positive")
+		}
+		if (len(c.WebhookClientCert) > 0) != (len(c.WebhookClientKey) > 0) {
+			return fmt.Errorf("WebhookClientCert and WebhookClientKey must be set together")
+		}
+	}
+
+	if c.BayesClassifier {
+		if c.BayesThreshold <= 0 || c.BayesThreshold > 1 {
+			return fmt.Errorf("BayesThreshold must be greater than 0 and at most 1")
+		}
+		if c.BayesMinSpam < 1 || c.BayesMinHam < 1 {
+			return fmt.Errorf("BayesMinSpam and BayesMinHam must be at least 1")
+		}
+		if c.BayesReportTokens < 0 {
+			return fmt.Errorf("BayesReportTokens must not be negative")
+		}
+	}
+
+	for _, host := range c.SpamassassinEndpoints() {
+		if c.SpamassassinTLS && strings.HasPrefix(host, "unix://") {
+			return fmt.Errorf("SpamassassinTLS cannot be used with a unix socket SpamassassinHost")
+		}
 	}
-	if !spamassassinSet && !rspamdSet {
-		return fmt.Errorf("set either SpamassassinHost or RspamdController to use either classifier")
+	if (len(c.SpamassassinClientCert) > 0) != (len(c.SpamassassinClientKey) > 0) {
+		return fmt.Errorf("SpamassassinClientCert and SpamassassinClientKey must be set together")
 	}
 
 	if rspamdSet {
 		if err := validateNonEmptyStringField(c.RspamdPassword, "RspamdPassword must be set if RspamdController is set"); err != nil {
 			return err
 		}
+
+		scanners := c.RspamdScannerEndpoints()
+		if len(scanners) > 0 && len(scanners) != len(c.RspamdEndpoints()) {
+			return fmt.Errorf("RspamdScanner(s) must contain one scanner per RspamdController(s)")
+		}
+		if c.RspamdScannerTimeout < 0 {
+			return fmt.Errorf("RspamdScannerTimeout must not be negative")
+		}
+	}
+
+	if c.BalanceStrategy != "roundrobin" && c.BalanceStrategy != "leastloaded" {
+		return fmt.Errorf("BalanceStrategy must be either roundrobin or leastloaded")
+	}
+
+	if c.TrustedHops < 0 {
+		return fmt.Errorf("TrustedHops must not be negative, set to 0 to disable envelope detection")
+	}
+
+	if c.ResultCache && c.ResultCacheTTL <= 0 {
+		return fmt.Errorf("ResultCacheTTL must be positive")
+	}
+
+	if c.SpamGraceDays < 0 {
+		return fmt.Errorf("SpamGraceDays must not be negative, set to 0 to disable spam confirmation")
+	}
+	if c.SpamGraceDays > 0 && !c.MoveSpam {
+		return fmt.Errorf("SpamGraceDays requires MoveSpam")
+	}
+
+	for _, r := range c.Retention {
+		if err := validateNonEmptyStringField(r.Folder, "Retention Folder must not be empty"); err != nil {
+			return err
+		}
+		if r.MaxAgeDays < 0 || r.MaxMails < 0 {
+			return fmt.Errorf("Retention MaxAgeDays and MaxMails of %s must not be negative", r.Folder)
+		}
+		if r.MaxAgeDays == 0 && r.MaxMails == 0 {
+			return fmt.Errorf("Retention of %s must set MaxAgeDays or MaxMails", r.Folder)
+		}
+	}
+
+	if len(c.SentFolders) > 0 {
+		if c.CorrespondentMode != "allow" && c.CorrespondentMode != "offset" {
+			return fmt.Errorf("CorrespondentMode must be either allow or offset")
+		}
+		if c.CorrespondentMode == "offset" && c.CorrespondentScoreOffset <= 0 {
+			return fmt.Errorf("CorrespondentScoreOffset must be positive")
+		}
+	}
+
+	if c.RetryAttempts < 1 {
+		return fmt.Errorf("RetryAttempts must be at least 1, set to 1 to disable retries")
+	}
+	if c.RetryBackoff < 0 || c.RetryMaxBackoff < c.RetryBackoff {
+		return fmt.Errorf("RetryBackoff must not be negative and RetryMaxBackoff must not be smaller than RetryBackoff")
 	}
+	if c.CircuitBreakerFailures < 0 {
+		return fmt.Errorf("CircuitBreakerFailures must not be negative, set to 0 to disable the circuit breaker")
+	}
+	if c.CircuitBreakerFailures > 0 && c.CircuitBreakerOpen <= 0 {
+		return fmt.Errorf("CircuitBreakerOpen must be positive")
+	}
+
+	return nil
+}
+
+// readRulesFile adds the lists of RulesFile to the lists set in the config file.
+func (c *Config) readRulesFile() error {
+	rules := &RuleLists{}
+	_, err := toml.DecodeFile(c.RulesFile, rules)
+	if err != nil {
+		return fmt.Errorf("could not read rules file: %w", err)
+	}
+
+	c.AllowSenders = append(c.AllowSenders, rules.AllowSenders...)
+	c.AllowDomains = append(c.AllowDomains, rules.AllowDomains...)
+	c.AllowListIds = append(c.AllowListIds, rules.AllowListIds...)
+	c.AllowHeaders = append(c.AllowHeaders, rules.AllowHeaders...)
+	c.BlockSenders = append(c.BlockSenders, rules.BlockSenders...)
+	c.BlockDomains = append(c.BlockDomains, rules.BlockDomains...)
+	c.BlockListIds = append(c.BlockListIds, rules.BlockListIds...)
+	c.BlockHeaders = append(c.BlockHeaders, rules.BlockHeaders...)
 
 	return nil
 }
 
+// SpamassassinEndpoints returns SpamassassinHost and SpamassassinHosts combined.
+func (c *Config) SpamassassinEndpoints() []string {
+	return endpoints(c.SpamassassinHost, c.SpamassassinHosts)
+}
+
+// RspamdEndpoints returns RspamdController and RspamdControllers combined, without trailing slashes.
+func (c *Config) RspamdEndpoints() []string {
+	controllers := endpoints(c.RspamdController, c.RspamdControllers)
+	for i := range controllers {
+		controllers[i] = strings.TrimRight(controllers[i], "/")
+	}
+
+	return controllers
+}
+
+// RspamdScannerEndpoints returns RspamdScanner and RspamdScanners combined, without trailing slashes.
+func (c *Config) RspamdScannerEndpoints() []string {
+	scanners := endpoints(c.RspamdScanner, c.RspamdScanners)
+	for i := range scanners {
+		scanners[i] = strings.TrimRight(scanners[i], "/")
+	}
+
+	return scanners
+}
+
+func endpoints(single string, multiple []string) []string {
+	result := []string{}
+	for _, e := range append([]string{single}, multiple...) {
+		if len(strings.TrimSpace(e)) > 0 {
+			result = append(result, strings.TrimSpace(e))
+		}
+	}
+
+	return result
+}
+
 func validateNonEmptyStringField(field string, err string) error {
 	if len(strings.TrimSpace(field)) == 0 {
 		return errors.New(err)
@@ -0,0 +1,46 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package domain
+
+import "time"
+
+//go:generate mockgen -destination=mocks/audit.go -package=mocks . ActionLog
+
+// MailboxActionType is a kind of mailbox mutation. Flags are only changed to delete mails, so deletions cover them.
+type MailboxActionType string
+
+const (
+	MailboxMove   = MailboxActionType("move")
+	MailboxDelete = MailboxActionType("delete")
+	MailboxAppend = MailboxActionType("append")
+	// MailboxRestore moves mails back when a move is undone, restores are not undone themselves
+	MailboxRestore = MailboxActionType("restore")
+)
+
+// MailboxAction records a mutation of Uids in Folder. Appends record the uid of the mail the appended one belongs to,
+// e.g. the original of a tagged copy. ResultUids are the uids of the moved or appended mails in Destination at
+// DestinationUidValidity, in the order of Uids. They're empty or 0 if the server didn't report them, which requires
+// UIDPLUS.
+type MailboxAction struct {
+	RunId                  string
+	Type                   MailboxActionType
+	Folder                 string
+	Uids                   []uint32
+	Destination            string
+	DestinationUidValidity uint32
+	ResultUids             []uint32
+}
+
+type SavedMailboxAction struct {
+	Id int64
+	MailboxAction
+	CreatedAt time.Time
+	Undone    bool
+}
+
+type ActionLog interface {
+	SaveAction(action *MailboxAction) error
+	// FindActions returns the actions that weren't undone yet, newest first. An empty runId matches all runs, zero
+	// times don't limit the time range.
+	FindActions(runId string, from, to time.Time) ([]*SavedMailboxAction, error)
+	MarkUndone(id int64) error
+}
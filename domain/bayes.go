@@ -0,0 +1,15 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package domain
+
+//go:generate mockgen -destination=mocks/bayes.go -package=mocks . TokenStore
+type TokenCount struct {
+	Token string
+	Spam  int64
+	Ham   int64
+}
+
+type TokenStore interface {
+	TrainingCounts() (spam int64, ham int64, err error)
+	TokenCounts(tokens []string) (map[string]*TokenCount, error)
+	LearnTokens(learnType LearnType, tokens []string) error
+}
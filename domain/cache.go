@@ -0,0 +1,25 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package domain
+
+import "time"
+
+//go:generate mockgen -destination=mocks/cache.go -package=mocks . ResultCache
+type CachedResult struct {
+	// Hash is the mail's content hash
+	Hash      string
+	IsSpam    bool
+	Score     float64
+	Symbols   map[string]float64
+	Subject   string
+	Body      []byte
+	CheckedAt time.Time
+}
+
+type ResultCache interface {
+	// CachedResult returns the result cached for hash if it was checked after checkedAfter, nil otherwise.
+	CachedResult(hash string, checkedAfter time.Time) (*CachedResult, error)
+	SaveResult(result *CachedResult) error
+	DeleteResults(hashes []string) error
+	// PurgeResults deletes all results checked before checkedBefore and returns their number.
+	PurgeResults(checkedBefore time.Time) (int64, error)
+}
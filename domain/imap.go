@@ -1,30 +1,66 @@
 // SPDX-License-Identifier: GPL-3.0-or-later
 package domain
 
+import (
+	"context"
+	"time"
+)
+
 //go:generate mockgen -destination=mocks/imap.go -package=mocks . ImapConnector
 type RawImapMail struct {
 	Uid        uint32
 	Subject    string
 	MailIdHash string
-	RawMail    []byte
+	// HashStrategy names what MailIdHash was calculated from, see mail.HashStrategy
+	HashStrategy string
+	// ServerId is the permanent id the server assigns to the mail, see ImapIdInfo
+	ServerId string
+	RawMail  []byte
+	// Flags and InternalDate are kept when the mail is replaced by a tagged copy
+	Flags        []string
+	InternalDate time.Time
+	// Sender is the address of the From header and Date the parsed Date header, empty or zero if missing
+	Sender string
+	Date   time.Time
+	Size   int
 }
 
 type ImapIdInfo struct {
-	Uid        uint32
-	Subject    string
-	MailIdHash string
+	Uid          uint32
+	Subject      string
+	MailIdHash   string
+	HashStrategy string
+	// ServerId is the EMAILID (RFC 8474 OBJECTID) or X-GM-MSGID of the mail, which survives UIDVALIDITY changes and
+	// moves to other folders. It's empty if the server supports neither.
+	ServerId string
+}
+
+// MovedUids maps the uids of moved mails to their uids in the destination folder at UidValidity. Uids is empty if the
+// server didn't report them, which requires UIDPLUS.
+type MovedUids struct {
+	UidValidity uint32
+	Uids        map[uint32]uint32
 }
 
+// ImapConnector executes IMAP commands. A cancelled ctx prevents further commands, but a command that was already sent
+// to the server always completes.
 type ImapConnector interface {
-	Select(folder string) (uint32, error)
-	ListUids() ([]uint32, error)
-	FetchMails(uids []uint32) ([]*RawImapMail, error)
-	FetchIdHeaders(uids []uint32) ([]*ImapIdInfo, error)
-	Put(body []byte, folder string) error
-	DeleteReady() (error, error)
-	Delete(uids []uint32) error
-	MoveReady() (error, error)
-	Move(uids []uint32, folder string) error
+	Select(ctx context.Context, folder string) (uint32, error)
+	ListUids(ctx context.Context) ([]uint32, error)
+	// ListUidsBefore lists the mails with an internal date before the day of before
+	ListUidsBefore(ctx context.Context, before time.Time) ([]uint32, error)
+	FetchMails(ctx context.Context, uids []uint32) ([]*RawImapMail, error)
+	// FetchIdHeaders fetches what is needed to calculate the MailIdHash, usually only the headers
+	FetchIdHeaders(ctx context.Context, uids []uint32) ([]*ImapIdInfo, error)
+	FetchInternalDates(ctx context.Context, uids []uint32) (map[uint32]time.Time, error)
+	// Put and Append return the uid of the appended mail, or 0 if the server didn't report it
+	Put(ctx context.Context, body []byte, folder string) (uint32, error)
+	// Append adds body to folder with the given flags and internal date
+	Append(ctx context.Context, body []byte, folder string, flags []string, date time.Time) (uint32, error)
+	DeleteReady(ctx context.Context) (error, error)
+	Delete(ctx context.Context, uids []uint32) error
+	MoveReady(ctx context.Context) (error, error)
+	Move(ctx context.Context, uids []uint32, folder string) (*MovedUids, error)
 
 	Close() error
 }
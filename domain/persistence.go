@@ -1,6 +1,8 @@
 // SPDX-License-Identifier: GPL-3.0-or-later
 package domain
 
+import "time"
+
 //go:generate mockgen -destination=mocks/persistence.go -package=mocks . Persistence
 type ImapFolder struct {
 	Name        string
@@ -13,8 +15,35 @@ const (
 	Checked     = MailClass(0)
 	LearnedSpam = MailClass(10)
 	LearnedHam  = MailClass(11)
+	// Sent mails are scanned for correspondents
+	Sent = MailClass(20)
+)
+
+// MailAction is what was done to a mail after it was checked or learned
+type MailAction string
+
+const (
+	ActionNone    = MailAction("none")
+	ActionMoved   = MailAction("moved")
+	ActionDeleted = MailAction("deleted")
+	// ActionFlagged replaced spam by a copy tagged with X-Spam-* headers in its folder
+	ActionFlagged = MailAction("flagged")
 )
 
+// MailMetadata describes a mail and what was done to it. Fields of mails recorded before they were stored stay empty.
+type MailMetadata struct {
+	Sender       string
+	Date         time.Time
+	InternalDate time.Time
+	Size         int
+	// Classifier and ClassifierVersion name the classifier that checked or learned the mail, empty if a rule decided
+	Classifier        string
+	ClassifierVersion string
+	Action            MailAction
+	// Destination is the folder the mail was moved or appended to
+	Destination string
+}
+
 type SavedImapMail struct {
 	Id         int64
 	Class      MailClass
@@ -24,16 +53,29 @@ type SavedImapMail struct {
 	Subject    string
 	IsSpam     bool
 	Score      float64
+	// Rule is the allow or block rule that decided the mail, empty if it was classified
+	Rule string
+	// HashStrategy names what MailIdHash was calculated from, empty for mails recorded before it was stored
+	HashStrategy string
+	// ServerId is the permanent id the server assigned to the mail, empty if unsupported or recorded before it was stored
+	ServerId string
+	MailMetadata
+	// ProcessedAt is when the mail was saved
+	ProcessedAt time.Time
 }
 
 type SaveMail struct {
-	Class      MailClass
-	Uid        uint32
-	MailIdHash string
-	FolderName string
-	Subject    string
-	IsSpam     *bool
-	Score      *float64
+	Class        MailClass
+	Uid          uint32
+	MailIdHash   string
+	FolderName   string
+	Subject      string
+	IsSpam       *bool
+	Score        *float64
+	Rule         string
+	HashStrategy string
+	ServerId     string
+	MailMetadata
 }
 
 type Persistence interface {
@@ -42,6 +84,17 @@ type Persistence interface {
 	SaveFolder(name string, uidValidity uint32) error
 	GetMailsInFolder(class MailClass, folder string) ([]*SavedImapMail, error)
 	FindMailByHash(class MailClass, folder string, mailIdHash string) (*SavedImapMail, error)
+	FindMailByServerId(class MailClass, folder string, serverId string) (*SavedImapMail, error)
+	// FindMailsByHashes and FindMailsByServerIds look up many mails at once, keyed by the hash or server id
+	FindMailsByHashes(class MailClass, folder string, mailIdHashes []string) (map[string]*SavedImapMail, error)
+	FindMailsByServerIds(class MailClass, folder string, serverIds []string) (map[string]*SavedImapMail, error)
 	UpdateUid(id int64, uid uint32) error
+	// UpdateUids sets the uids of many mails, keyed by their id, in a single transaction
+	UpdateUids(uids map[int64]uint32) error
+	// CorrectMail marks a mail checked as spam as ham at its new uid after it was moved back by the user
+	CorrectMail(id int64, uid uint32) error
 	SaveMails(mails []SaveMail) error
+	// SaveCorrespondents records that mail was sent to addresses
+	SaveCorrespondents(addresses []string) error
+	IsCorrespondent(address string) (bool, error)
 }
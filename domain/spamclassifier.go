@@ -3,6 +3,11 @@
 //go:generate mockgen -destination=mocks/spamclassifier.go -package=mocks . SpamClassifier,ConcurrentSpamClassifier
 package domain
 
+import (
+	"context"
+	"errors"
+)
+
 type LearnType string
 
 const (
@@ -13,16 +18,68 @@ const (
 type SpamResult struct {
 	IsSpam bool
 	Score  float64
-	Body   []byte
+	// Symbols are the names and scores of the rules that matched, if the classifier reports them
+	Symbols map[string]float64
+	// Subject is the subject the classifier rewrote the mail's subject to, e.g. by rspamd's rewrite subject action,
+	// empty if it wasn't rewritten
+	Subject string
+	Body    []byte
+	// Unsure is set if the classifier has no verdict yet, e.g. an untrained bayes classifier. The mail is left in place
+	// as ham, checked again on the next run and its result isn't cached.
+	Unsure bool
 	Error  error
 }
 
+// ClassifierInfo describes a classifier's state for status output. Fields the classifier can't report stay empty.
+type ClassifierInfo struct {
+	Name    string
+	Version string
+	// Stats are classifier specific counters, e.g. the number of learned spam and ham mails
+	Stats map[string]string
+	// Endpoints are the infos of the individual endpoints if the classifier balances over several of them
+	Endpoints []*ClassifierInfo
+	// Error is set if the classifier is not reachable
+	Error error
+}
+
+// SpamClassifier checks and learns single mails. Calls return early with an error once ctx is cancelled.
 type SpamClassifier interface {
-	Check(rawMail []byte) *SpamResult
-	Learn(learnType LearnType, rawMail []byte) error
+	Check(ctx context.Context, rawMail []byte) *SpamResult
+	Learn(ctx context.Context, learnType LearnType, rawMail []byte) error
+	// Ping returns an error if the classifier can't be reached
+	Ping(ctx context.Context) error
+	Info(ctx context.Context) *ClassifierInfo
 }
 
+// ConcurrentSpamClassifier checks and learns many mails at once. Once ctx is cancelled, no further mails are passed to
+// the classifier and their results contain ctx's error.
 type ConcurrentSpamClassifier interface {
-	CheckAll(mails [][]byte, concurrency int) []*SpamResult
-	LearnAll(learnType LearnType, mails [][]byte, concurrency int) []error
+	CheckAll(ctx context.Context, mails [][]byte, concurrency int) []*SpamResult
+	LearnAll(ctx context.Context, learnType LearnType, mails [][]byte, concurrency int) []error
+	// Ping returns an error if the classifier can't be reached
+	Ping(ctx context.Context) error
+}
+
+// ErrPermanent marks classifier errors that will not go away by retrying, e.g. unparsable mails or rejected requests.
+var ErrPermanent = errors.New("permanent classifier error")
+
+type permanentError struct {
+	error
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.error
+}
+
+func (e *permanentError) Is(target error) bool {
+	return target == ErrPermanent
+}
+
+// Permanent marks err as permanent without changing its message, errors.Is(err, ErrPermanent) is true afterwards.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &permanentError{err}
 }
@@ -0,0 +1,272 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package imapassassin
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/CrawX/go-imap-assassin/domain"
+	"github.com/CrawX/go-imap-assassin/mail"
+
+	"github.com/sirupsen/logrus"
+)
+
+// UndoReport lists what Undo restored and which mails it could not restore
+type UndoReport struct {
+	// Restored counts the mails moved back to the folder they were moved from
+	Restored int
+	Failed   []*UndoFailure
+}
+
+// UndoFailure describes the Uids of Action that were not restored, in the folder the action moved them to if known
+type UndoFailure struct {
+	Action *domain.SavedMailboxAction
+	Uids   []uint32
+	Reason string
+}
+
+func (r *UndoReport) fail(action *domain.SavedMailboxAction, uids []uint32, reason string) {
+	r.Failed = append(r.Failed, &UndoFailure{Action: action, Uids: uids, Reason: reason})
+}
+
+// recordAction adds action to the action log if AuditLog is configured
+func (ia *ImapAssassin) recordAction(action domain.MailboxAction) error {
+	if ia.configuration.ActionLog == nil {
+		return nil
+	}
+
+	action.RunId = ia.configuration.RunId
+	err := ia.configuration.ActionLog.SaveAction(&action)
+	if err != nil {
+		return fmt.Errorf("could not record %s of %d mails in %s: %w", action.Type, len(action.Uids), action.Folder, err)
+	}
+
+	return nil
+}
+
+// moveMails moves uids from the selected folder to destination and records the move as actionType
+func (ia *ImapAssassin) moveMails(ctx context.Context, actionType domain.MailboxActionType, folder string, uids []uint32, destination string) (*domain.MovedUids, error) {
+	moved, err := ia.imapConnection.Move(ctx, uids, destination)
+	if err != nil {
+		return nil, err
+	}
+	if moved == nil {
+		moved = &domain.MovedUids{}
+	}
+
+	resultUids := make([]uint32, len(uids))
+	for i, uid := range uids {
+		resultUids[i] = moved.Uids[uid]
+	}
+
+	return moved, ia.recordAction(domain.MailboxAction{
+		Type:                   actionType,
+		Folder:                 folder,
+		Uids:                   uids,
+		Destination:            destination,
+		DestinationUidValidity: moved.UidValidity,
+		ResultUids:             resultUids,
+	})
+}
+
+// deleteMails deletes uids from the selected folder and records the deletion
+func (ia *ImapAssassin) deleteMails(ctx context.Context, folder string, uids []uint32) error {
+	err := ia.imapConnection.Delete(ctx, uids)
+	if err != nil {
+		return err
+	}
+
+	return ia.recordAction(domain.MailboxAction{
+		Type:   domain.MailboxDelete,
+		Folder: folder,
+		Uids:   uids,
+	})
+}
+
+// putMail appends body to destination and records it as an append for the mail uid in folder it was created for
+func (ia *ImapAssassin) putMail(ctx context.Context, folder string, uid uint32, body []byte, destination string) error {
+	appendedUid, err := ia.imapConnection.Put(ctx, body, destination)
+	if err != nil {
+		return err
+	}
+
+	return ia.recordAppend(folder, uid, destination, appendedUid)
+}
+
+// appendMail is putMail with flags and internal date of the appended mail
+func (ia *ImapAssassin) appendMail(ctx context.Context, folder string, uid uint32, body []byte, destination string, flags []string, date time.Time) error {
+	appendedUid, err := ia.imapConnection.Append(ctx, body, destination, flags, date)
+	if err != nil {
+		return err
+	}
+
+	return ia.recordAppend(folder, uid, destination, appendedUid)
+}
+
+func (ia *ImapAssassin) recordAppend(folder string, uid uint32, destination string, appendedUid uint32) error {
+	return ia.recordAction(domain.MailboxAction{
+		Type:        domain.MailboxAppend,
+		Folder:      folder,
+		Uids:        []uint32{uid},
+		Destination: destination,
+		ResultUids:  []uint32{appendedUid},
+	})
+}
+
+// Undo moves the mails moved by the actions of runId between from and to back to the folder they were moved from,
+// newest action first. An empty runId undoes all runs, zero times don't limit the range. Restored mails are recorded as
+// corrected ham under their new uid, with learnHam they are also learned as ham before they are moved back. Deleted
+// mails can't be restored and appended mails are left in place, they are reported as failures like moved mails that
+// are gone from their destination. Once ctx is cancelled, no more actions are undone and the cancellation is returned
+// as error along with the report so far.
+func (ia *ImapAssassin) Undo(ctx context.Context, runId string, from, to time.Time, learnHam bool) (*UndoReport, error) {
+	if ia.configuration.ActionLog == nil {
+		return nil, fmt.Errorf("undo requires an action log")
+	}
+
+	actions, err := ia.configuration.ActionLog.FindActions(runId, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("could not find actions to undo: %w", err)
+	}
+
+	report := &UndoReport{}
+	for _, action := range actions {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		switch action.Type {
+		case domain.MailboxMove:
+			err = ia.undoMove(ctx, action, learnHam, report)
+			if err != nil {
+				return report, err
+			}
+		case domain.MailboxDelete:
+			report.fail(action, action.Uids, "mails were deleted from the server")
+		case domain.MailboxAppend:
+			report.fail(action, action.ResultUids, "appended mails are not removed")
+		}
+	}
+
+	return report, nil
+}
+
+func (ia *ImapAssassin) undoMove(ctx context.Context, action *domain.SavedMailboxAction, learnHam bool, report *UndoReport) error {
+	baseLogger := ia.l.WithFields(logrus.Fields{"runid": action.RunId, "folder": action.Destination, "destination": action.Folder})
+
+	movedUids := []uint32{}
+	unknown := []uint32{}
+	for i, uid := range action.Uids {
+		if i < len(action.ResultUids) && action.ResultUids[i] != 0 {
+			movedUids = append(movedUids, action.ResultUids[i])
+		} else {
+			unknown = append(unknown, uid)
+		}
+	}
+	if len(unknown) > 0 {
+		report.fail(action, unknown, "uids in destination unknown, the server does not support UIDPLUS")
+	}
+	if len(movedUids) == 0 {
+		return nil
+	}
+
+	uidValidity, err := ia.imapConnection.Select(ctx, action.Destination)
+	if err != nil {
+		return fmt.Errorf("could not select folder %s: %w", action.Destination, err)
+	}
+	if uidValidity != action.DestinationUidValidity {
+		report.fail(action, movedUids, "uid validity of destination changed")
+		return nil
+	}
+
+	uids, err := ia.imapConnection.ListUids(ctx)
+	if err != nil {
+		return fmt.Errorf("could not list uids of %s: %w", action.Destination, err)
+	}
+	existing := map[uint32]bool{}
+	for _, uid := range uids {
+		existing[uid] = true
+	}
+	present := []uint32{}
+	missing := []uint32{}
+	for _, uid := range movedUids {
+		if existing[uid] {
+			present = append(present, uid)
+		} else {
+			missing = append(missing, uid)
+		}
+	}
+	if len(missing) > 0 {
+		report.fail(action, missing, "mails are no longer in destination")
+	}
+	if len(present) == 0 {
+		return nil
+	}
+
+	if ia.configuration.DryRun {
+		baseLogger.WithField("mails", len(present)).Info("Not moving mails back due to dry-run")
+		return nil
+	}
+
+	// the records are looked up before the move, the destination is selected and the uids are still valid
+	idInfos, err := ia.imapConnection.FetchIdHeaders(ctx, present)
+	if err != nil {
+		return fmt.Errorf("could not fetch ids of mails to restore: %w", err)
+	}
+	knownMails, err := ia.findMails(domain.Checked, action.Folder, idInfos)
+	if err != nil {
+		return fmt.Errorf("could not lookup known mails: %w", err)
+	}
+
+	if learnHam {
+		mails, err := ia.imapConnection.FetchMails(ctx, present)
+		if err != nil {
+			return fmt.Errorf("could not fetch mails to learn: %w", err)
+		}
+
+		rawMails := make([][]byte, len(mails))
+		for i, m := range mails {
+			rawMails[i] = m.RawMail
+		}
+		learnResults := ia.spamClassifier.LearnAll(ctx, domain.LearnHam, rawMails, LearnConcurrency)
+		for i, m := range mails {
+			if learnResults[i] != nil {
+				return fmt.Errorf(`could not learn restored mail "%s": %w`, mail.ShortSubject(m.Subject), learnResults[i])
+			}
+		}
+	}
+
+	// the mails are moved back and recorded even when ctx is cancelled meanwhile
+	moved, err := ia.moveMails(context.Background(), domain.MailboxRestore, action.Destination, present, action.Folder)
+	if err != nil {
+		return fmt.Errorf("could not move mails back to %s: %w", action.Folder, err)
+	}
+	report.Restored += len(present)
+	baseLogger.WithField("mails", len(present)).Info("Moved mails back")
+
+	// restored mails are recorded as ham so the next run doesn't check and move them again
+	for _, uid := range present {
+		knownMail, ok := knownMails[uid]
+		if !ok {
+			continue
+		}
+
+		restoredUid, ok := moved.Uids[uid]
+		if !ok {
+			// the uid is updated once the folder is checked again
+			restoredUid = knownMail.Uid
+		}
+		err = ia.persistence.CorrectMail(knownMail.Id, restoredUid)
+		if err != nil {
+			return fmt.Errorf("could not record correction: %w", err)
+		}
+	}
+
+	err = ia.configuration.ActionLog.MarkUndone(action.Id)
+	if err != nil {
+		return fmt.Errorf("could not mark action undone: %w", err)
+	}
+
+	return nil
+}
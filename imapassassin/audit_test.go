@@ -0,0 +1,243 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package imapassassin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/CrawX/go-imap-assassin/domain"
+	"github.com/CrawX/go-imap-assassin/domain/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImapAssassin_CheckSpamMoveAudited(t *testing.T) {
+	ctrl, assassin, persistence, classifier, imapConnection := setupThreeMails(t,
+		&configuration{
+			MoveSpam:   true,
+			SpamFolder: "spam",
+		},
+	)
+	defer ctrl.Finish()
+
+	actionLog := mocks.NewMockActionLog(ctrl)
+	assassin.configuration.RunId = "run1"
+	assassin.configuration.ActionLog = actionLog
+
+	classifier.EXPECT().
+		CheckAll(gomock.Any(), gomock.Eq([][]byte{{1}, {2}, {3}}), gomock.Eq(6)).
+		Return([]*domain.SpamResult{{IsSpam: true, Score: 10}, {IsSpam: false}, {IsSpam: true, Score: 10}})
+
+	imapConnection.EXPECT().
+		MoveReady(gomock.Any()).
+		Return(nil, nil)
+
+	imapConnection.EXPECT().
+		Move(gomock.Any(), u32a(1, 3), "spam").
+		Return(&domain.MovedUids{UidValidity: 7, Uids: map[uint32]uint32{1: 11, 3: 13}}, nil)
+
+	actionLog.EXPECT().
+		SaveAction(&domain.MailboxAction{
+			RunId:                  "run1",
+			Type:                   domain.MailboxMove,
+			Folder:                 TEST_FOLDER_1,
+			Uids:                   u32a(1, 3),
+			Destination:            "spam",
+			DestinationUidValidity: 7,
+			ResultUids:             u32a(11, 13),
+		}).
+		Return(nil)
+
+	persistence.EXPECT().
+		SaveMails(gomock.Any()).
+		Return(nil)
+
+	persistence.EXPECT().
+		SaveFolder(TEST_FOLDER_1, u32(123)).
+		Return(nil)
+
+	err := assassin.CheckSpam(context.Background(), []string{TEST_FOLDER_1})
+	assert.NoError(t, err)
+}
+
+func TestImapAssassin_Undo(t *testing.T) {
+	move := &domain.SavedMailboxAction{
+		Id: 1,
+		MailboxAction: domain.MailboxAction{
+			RunId:                  "run1",
+			Type:                   domain.MailboxMove,
+			Folder:                 TEST_FOLDER_1,
+			Uids:                   u32a(1, 2, 3),
+			Destination:            "spam",
+			DestinationUidValidity: 7,
+			ResultUids:             u32a(11, 12, 0),
+		},
+	}
+	deletion := &domain.SavedMailboxAction{
+		Id: 2,
+		MailboxAction: domain.MailboxAction{
+			RunId:  "run1",
+			Type:   domain.MailboxDelete,
+			Folder: "spam",
+			Uids:   u32a(5),
+		},
+	}
+	restore := &domain.SavedMailboxAction{
+		Id: 3,
+		MailboxAction: domain.MailboxAction{
+			RunId:  "run0",
+			Type:   domain.MailboxRestore,
+			Folder: "spam",
+			Uids:   u32a(8),
+		},
+	}
+
+	tests := []struct {
+		name     string
+		dryRun   bool
+		learnHam bool
+		setup    func(persistence *mocks.MockPersistence, classifier *mocks.MockConcurrentSpamClassifier, imapConnection *mocks.MockImapConnector, actionLog *mocks.MockActionLog)
+		expected *UndoReport
+	}{
+		{
+			"restore",
+			false,
+			false,
+			func(persistence *mocks.MockPersistence, classifier *mocks.MockConcurrentSpamClassifier, imapConnection *mocks.MockImapConnector, actionLog *mocks.MockActionLog) {
+				imapConnection.EXPECT().Select(gomock.Any(), "spam").Return(u32(7), nil)
+				imapConnection.EXPECT().ListUids(gomock.Any()).Return(u32a(11, 12, 13), nil)
+				imapConnection.EXPECT().FetchIdHeaders(gomock.Any(), u32a(11, 12)).Return([]*domain.ImapIdInfo{
+					{Uid: 11, MailIdHash: "hash1"},
+					{Uid: 12, MailIdHash: "hash2"},
+				}, nil)
+				persistence.EXPECT().FindMailsByHashes(domain.Checked, TEST_FOLDER_1, []string{"hash1", "hash2"}).
+					Return(map[string]*domain.SavedImapMail{
+						"hash1": {Id: 41, Uid: 1, IsSpam: true},
+						"hash2": {Id: 42, Uid: 2, IsSpam: true},
+					}, nil)
+				imapConnection.EXPECT().Move(gomock.Any(), u32a(11, 12), TEST_FOLDER_1).
+					Return(&domain.MovedUids{UidValidity: 4, Uids: map[uint32]uint32{11: 21, 12: 22}}, nil)
+				actionLog.EXPECT().SaveAction(&domain.MailboxAction{
+					RunId:                  "undo",
+					Type:                   domain.MailboxRestore,
+					Folder:                 "spam",
+					Uids:                   u32a(11, 12),
+					Destination:            TEST_FOLDER_1,
+					DestinationUidValidity: 4,
+					ResultUids:             u32a(21, 22),
+				}).Return(nil)
+				// the records follow the mails, otherwise the next run would check and move them again
+				persistence.EXPECT().CorrectMail(int64(41), u32(21)).Return(nil)
+				persistence.EXPECT().CorrectMail(int64(42), u32(22)).Return(nil)
+				actionLog.EXPECT().MarkUndone(int64(1)).Return(nil)
+			},
+			&UndoReport{
+				Restored: 2,
+				Failed: []*UndoFailure{
+					{Action: deletion, Uids: u32a(5), Reason: "mails were deleted from the server"},
+					{Action: move, Uids: u32a(3), Reason: "uids in destination unknown, the server does not support UIDPLUS"},
+				},
+			},
+		},
+		{
+			"learnham",
+			false,
+			true,
+			func(persistence *mocks.MockPersistence, classifier *mocks.MockConcurrentSpamClassifier, imapConnection *mocks.MockImapConnector, actionLog *mocks.MockActionLog) {
+				imapConnection.EXPECT().Select(gomock.Any(), "spam").Return(u32(7), nil)
+				// mail 12 was deleted from the spam folder meanwhile
+				imapConnection.EXPECT().ListUids(gomock.Any()).Return(u32a(11, 13), nil)
+				imapConnection.EXPECT().FetchIdHeaders(gomock.Any(), u32a(11)).
+					Return([]*domain.ImapIdInfo{{Uid: 11, MailIdHash: "hash1", ServerId: "id1"}}, nil)
+				persistence.EXPECT().FindMailsByServerIds(domain.Checked, TEST_FOLDER_1, []string{"id1"}).
+					Return(map[string]*domain.SavedImapMail{"id1": {Id: 42, Uid: 1, IsSpam: true}}, nil)
+				imapConnection.EXPECT().FetchMails(gomock.Any(), u32a(11)).
+					Return([]*domain.RawImapMail{{Uid: 11, MailIdHash: "hash1", ServerId: "id1", RawMail: []byte{1}}}, nil)
+				classifier.EXPECT().LearnAll(gomock.Any(), domain.LearnHam, [][]byte{{1}}, LearnConcurrency).Return([]error{nil})
+				imapConnection.EXPECT().Move(gomock.Any(), u32a(11), TEST_FOLDER_1).
+					Return(&domain.MovedUids{UidValidity: 4, Uids: map[uint32]uint32{11: 21}}, nil)
+				actionLog.EXPECT().SaveAction(gomock.Any()).Return(nil)
+				persistence.EXPECT().CorrectMail(int64(42), u32(21)).Return(nil)
+				actionLog.EXPECT().MarkUndone(int64(1)).Return(nil)
+			},
+			&UndoReport{
+				Restored: 1,
+				Failed: []*UndoFailure{
+					{Action: deletion, Uids: u32a(5), Reason: "mails were deleted from the server"},
+					{Action: move, Uids: u32a(3), Reason: "uids in destination unknown, the server does not support UIDPLUS"},
+					{Action: move, Uids: u32a(12), Reason: "mails are no longer in destination"},
+				},
+			},
+		},
+		{
+			"uidvaliditychanged",
+			false,
+			false,
+			func(persistence *mocks.MockPersistence, classifier *mocks.MockConcurrentSpamClassifier, imapConnection *mocks.MockImapConnector, actionLog *mocks.MockActionLog) {
+				imapConnection.EXPECT().Select(gomock.Any(), "spam").Return(u32(8), nil)
+			},
+			&UndoReport{
+				Failed: []*UndoFailure{
+					{Action: deletion, Uids: u32a(5), Reason: "mails were deleted from the server"},
+					{Action: move, Uids: u32a(3), Reason: "uids in destination unknown, the server does not support UIDPLUS"},
+					{Action: move, Uids: u32a(11, 12), Reason: "uid validity of destination changed"},
+				},
+			},
+		},
+		{
+			"dryrun",
+			true,
+			true,
+			func(persistence *mocks.MockPersistence, classifier *mocks.MockConcurrentSpamClassifier, imapConnection *mocks.MockImapConnector, actionLog *mocks.MockActionLog) {
+				imapConnection.EXPECT().Select(gomock.Any(), "spam").Return(u32(7), nil)
+				imapConnection.EXPECT().ListUids(gomock.Any()).Return(u32a(11, 12), nil)
+			},
+			&UndoReport{
+				Failed: []*UndoFailure{
+					{Action: deletion, Uids: u32a(5), Reason: "mails were deleted from the server"},
+					{Action: move, Uids: u32a(3), Reason: "uids in destination unknown, the server does not support UIDPLUS"},
+				},
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			persistence := mocks.NewMockPersistence(ctrl)
+			classifier := mocks.NewMockConcurrentSpamClassifier(ctrl)
+			imapConnection := mocks.NewMockImapConnector(ctrl)
+			actionLog := mocks.NewMockActionLog(ctrl)
+			assassin := &ImapAssassin{
+				persistence:    persistence,
+				spamClassifier: classifier,
+				imapConnection: imapConnection,
+				configuration:  &configuration{DryRun: tc.dryRun, RunId: "undo", ActionLog: actionLog},
+				l:              nullLogger(),
+			}
+
+			from := time.Date(2020, 10, 7, 0, 0, 0, 0, time.UTC)
+			actionLog.EXPECT().
+				FindActions("", from, time.Time{}).
+				Return([]*domain.SavedMailboxAction{restore, deletion, move}, nil)
+			tc.setup(persistence, classifier, imapConnection, actionLog)
+
+			report, err := assassin.Undo(context.Background(), "", from, time.Time{}, tc.learnHam)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, report)
+		})
+	}
+}
+
+func TestImapAssassin_UndoWithoutActionLog(t *testing.T) {
+	assassin := &ImapAssassin{
+		configuration: &configuration{},
+		l:             nullLogger(),
+	}
+
+	_, err := assassin.Undo(context.Background(), "run1", time.Time{}, time.Time{}, false)
+	assert.EqualError(t, err, "undo requires an action log")
+}
@@ -1,7 +1,13 @@
 // SPDX-License-Identifier: GPL-3.0-or-later
 package imapassassin
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+
+	"github.com/CrawX/go-imap-assassin/domain"
+	"github.com/CrawX/go-imap-assassin/rules"
+)
 
 type ConfigFunc func(c *configuration) error
 
@@ -18,6 +24,9 @@ func DeleteSpam() ConfigFunc {
 		if c.MoveSpam {
 			return fmt.Errorf("MoveSpam and DeleteSpam cannot be used at the same time")
 		}
+		if c.TagSpam {
+			return fmt.Errorf("TagSpam and DeleteSpam cannot be used at the same time")
+		}
 
 		c.DeleteSpam = true
 		return nil
@@ -40,6 +49,20 @@ func MoveSpam(spamMoveFolder string) ConfigFunc {
 	}
 }
 
+// TagSpam replaces spam mails by a copy with X-Spam-* headers and, if subjectPrefix is set or the classifier rewrote
+// the subject, a new subject. With MoveSpam, the copy is put into the spam folder instead of the original's folder.
+func TagSpam(subjectPrefix string) ConfigFunc {
+	return func(c *configuration) error {
+		if c.DeleteSpam {
+			return fmt.Errorf("TagSpam and DeleteSpam cannot be used at the same time")
+		}
+
+		c.TagSpam = true
+		c.SpamSubjectPrefix = subjectPrefix
+		return nil
+	}
+}
+
 func AppendReports(reportFolder string) ConfigFunc {
 	return func(c *configuration) error {
 		if len(reportFolder) == 0 {
@@ -58,15 +81,132 @@ func DeleteLearned() ConfigFunc {
 	}
 }
 
+// LearnRescued learns mails as ham that were checked as spam before and reappear in a checked folder because the user
+// moved them back from the spam folder.
+func LearnRescued() ConfigFunc {
+	return func(c *configuration) error {
+		c.LearnRescued = true
+		return nil
+	}
+}
+
+// ConfirmSpam learns mails as spam that were moved to the spam folder by CheckSpam and have been left there for longer
+// than grace. With expunge, they are deleted from the spam folder afterwards.
+func ConfirmSpam(grace time.Duration, expunge bool) ConfigFunc {
+	return func(c *configuration) error {
+		if grace <= 0 {
+			return fmt.Errorf("spam grace period must be positive")
+		}
+
+		c.ConfirmSpam = true
+		c.SpamGracePeriod = grace
+		c.ExpungeConfirmedSpam = expunge
+		return nil
+	}
+}
+
+// Rules decides mails matching the allow or block list without passing them to the classifier. Allowed mails are
+// ham, blocked mails are spam.
+func Rules(r *rules.Rules) ConfigFunc {
+	return func(c *configuration) error {
+		if r == nil {
+			return fmt.Errorf("Rules cannot be null")
+		}
+
+		c.Rules = r
+		return nil
+	}
+}
+
+// AllowCorrespondents decides mails from addresses collected by CollectCorrespondents as ham without passing them to
+// the classifier.
+func AllowCorrespondents() ConfigFunc {
+	return func(c *configuration) error {
+		if c.OffsetCorrespondents {
+			return fmt.Errorf("AllowCorrespondents and CorrespondentScoreOffset cannot be used at the same time")
+		}
+
+		c.AllowCorrespondents = true
+		return nil
+	}
+}
+
+// CorrespondentScoreOffset subtracts offset from the score of mails from addresses collected by CollectCorrespondents.
+// They stay spam only if the reduced score still reaches requiredScore.
+func CorrespondentScoreOffset(offset, requiredScore float64) ConfigFunc {
+	return func(c *configuration) error {
+		if offset <= 0 {
+			return fmt.Errorf("CorrespondentScoreOffset must be positive")
+		}
+		if c.AllowCorrespondents {
+			return fmt.Errorf("AllowCorrespondents and CorrespondentScoreOffset cannot be used at the same time")
+		}
+
+		c.OffsetCorrespondents = true
+		c.CorrespondentScoreOffset = offset
+		c.CorrespondentRequiredScore = requiredScore
+		return nil
+	}
+}
+
+// Classifier records the name and version of the classifier with every mail it checked or learned
+func Classifier(name, version string) ConfigFunc {
+	return func(c *configuration) error {
+		if len(name) == 0 {
+			return fmt.Errorf("Classifier name cannot be null")
+		}
+
+		c.ClassifierName = name
+		c.ClassifierVersion = version
+		return nil
+	}
+}
+
+// AuditLog records every move, delete and append in the mailbox under runId, so the moves can be reverted by Undo
+func AuditLog(runId string, log domain.ActionLog) ConfigFunc {
+	return func(c *configuration) error {
+		if len(runId) == 0 {
+			return fmt.Errorf("RunId cannot be null")
+		}
+		if log == nil {
+			return fmt.Errorf("ActionLog cannot be null")
+		}
+
+		c.RunId = runId
+		c.ActionLog = log
+		return nil
+	}
+}
+
 type configuration struct {
 	DryRun bool
 
 	DeleteSpam    bool
 	MoveSpam      bool
+	TagSpam       bool
 	AppendReports bool
 
-	SpamFolder       string
-	SpamReportFolder string
+	SpamFolder        string
+	SpamSubjectPrefix string
+	SpamReportFolder  string
 
 	DeleteLearned bool
+	LearnRescued  bool
+
+	ConfirmSpam          bool
+	SpamGracePeriod      time.Duration
+	ExpungeConfirmedSpam bool
+
+	Rules *rules.Rules
+
+	AllowCorrespondents        bool
+	OffsetCorrespondents       bool
+	CorrespondentScoreOffset   float64
+	CorrespondentRequiredScore float64
+
+	ClassifierName    string
+	ClassifierVersion string
+
+	RunId     string
+	ActionLog domain.ActionLog
 }
@@ -4,6 +4,11 @@ package imapassassin
 import (
 	"fmt"
 	"testing"
+	"time"
+
+	"github.com/CrawX/go-imap-assassin/domain"
+	"github.com/CrawX/go-imap-assassin/domain/mocks"
+	"github.com/CrawX/go-imap-assassin/rules"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -25,6 +30,7 @@ func TestDeleteSpam(t *testing.T) {
 	}{
 		{"ok", &configuration{}, &configuration{DeleteSpam: true}, nil},
 		{"moveconflict", &configuration{MoveSpam: true}, nil, fmt.Errorf("MoveSpam and DeleteSpam cannot be used at the same time")},
+		{"tagconflict", &configuration{TagSpam: true}, nil, fmt.Errorf("TagSpam and DeleteSpam cannot be used at the same time")},
 	}
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
@@ -64,6 +70,31 @@ func TestMoveSpam(t *testing.T) {
 	}
 }
 
+func TestTagSpam(t *testing.T) {
+	tests := []struct {
+		name          string
+		input         string
+		cfg           *configuration
+		expected      *configuration
+		expectedError error
+	}{
+		{"ok", "[SPAM]", &configuration{}, &configuration{TagSpam: true, SpamSubjectPrefix: "[SPAM]"}, nil},
+		{"withmove", "", &configuration{MoveSpam: true, SpamFolder: "spam"}, &configuration{MoveSpam: true, SpamFolder: "spam", TagSpam: true}, nil},
+		{"deleteconflict", "", &configuration{DeleteSpam: true}, nil, fmt.Errorf("TagSpam and DeleteSpam cannot be used at the same time")},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := TagSpam(tc.input)(tc.cfg)
+			if tc.expected != nil {
+				assert.Equal(t, tc.expected, tc.cfg)
+				assert.Nil(t, err)
+			} else {
+				assert.Equal(t, tc.expectedError, err)
+			}
+		})
+	}
+}
+
 func TestAppendReports(t *testing.T) {
 	tests := []struct {
 		name          string
@@ -95,3 +126,150 @@ func TestDeleteLearned(t *testing.T) {
 	assert.Equal(t, cfg, &configuration{DeleteLearned: true})
 	assert.Nil(t, err)
 }
+
+func TestLearnRescued(t *testing.T) {
+	cfg := &configuration{}
+	err := LearnRescued()(cfg)
+
+	assert.Equal(t, cfg, &configuration{LearnRescued: true})
+	assert.Nil(t, err)
+}
+
+func TestConfirmSpam(t *testing.T) {
+	tests := []struct {
+		name          string
+		grace         time.Duration
+		expunge       bool
+		expected      *configuration
+		expectedError error
+	}{
+		{"ok", 24 * time.Hour, false, &configuration{ConfirmSpam: true, SpamGracePeriod: 24 * time.Hour}, nil},
+		{"expunge", time.Hour, true, &configuration{ConfirmSpam: true, SpamGracePeriod: time.Hour, ExpungeConfirmedSpam: true}, nil},
+		{"notpositive", 0, false, nil, fmt.Errorf("spam grace period must be positive")},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &configuration{}
+			err := ConfirmSpam(tc.grace, tc.expunge)(cfg)
+			if tc.expected != nil {
+				assert.Equal(t, tc.expected, cfg)
+				assert.Nil(t, err)
+			} else {
+				assert.Equal(t, tc.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestRules(t *testing.T) {
+	r, err := rules.NewRules(rules.Lists{Senders: []string{"alice@example.com"}}, rules.Lists{})
+	assert.NoError(t, err)
+
+	cfg := &configuration{}
+	err = Rules(r)(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, &configuration{Rules: r}, cfg)
+
+	err = Rules(nil)(&configuration{})
+	assert.Equal(t, fmt.Errorf("Rules cannot be null"), err)
+}
+
+func TestAllowCorrespondents(t *testing.T) {
+	tests := []struct {
+		name          string
+		cfg           *configuration
+		expected      *configuration
+		expectedError error
+	}{
+		{"ok", &configuration{}, &configuration{AllowCorrespondents: true}, nil},
+		{"offsetconflict", &configuration{OffsetCorrespondents: true}, nil, fmt.Errorf("AllowCorrespondents and CorrespondentScoreOffset cannot be used at the same time")},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := AllowCorrespondents()(tc.cfg)
+			if tc.expected != nil {
+				assert.Equal(t, tc.expected, tc.cfg)
+				assert.Nil(t, err)
+			} else {
+				assert.Equal(t, tc.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestCorrespondentScoreOffset(t *testing.T) {
+	tests := []struct {
+		name          string
+		offset        float64
+		cfg           *configuration
+		expected      *configuration
+		expectedError error
+	}{
+		{"ok", 3, &configuration{}, &configuration{OffsetCorrespondents: true, CorrespondentScoreOffset: 3, CorrespondentRequiredScore: 5}, nil},
+		{"notpositive", 0, &configuration{}, nil, fmt.Errorf("CorrespondentScoreOffset must be positive")},
+		{"allowconflict", 3, &configuration{AllowCorrespondents: true}, nil, fmt.Errorf("AllowCorrespondents and CorrespondentScoreOffset cannot be used at the same time")},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := CorrespondentScoreOffset(tc.offset, 5)(tc.cfg)
+			if tc.expected != nil {
+				assert.Equal(t, tc.expected, tc.cfg)
+				assert.Nil(t, err)
+			} else {
+				assert.Equal(t, tc.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestClassifier(t *testing.T) {
+	tests := []struct {
+		name          string
+		input         string
+		expected      *configuration
+		expectedError error
+	}{
+		{"ok", "rspamd", &configuration{ClassifierName: "rspamd", ClassifierVersion: "2.6"}, nil},
+		{"lenvalidation", "", nil, fmt.Errorf("Classifier name cannot be null")},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &configuration{}
+			err := Classifier(tc.input, "2.6")(cfg)
+			if tc.expected != nil {
+				assert.Equal(t, tc.expected, cfg)
+				assert.Nil(t, err)
+			} else {
+				assert.Equal(t, tc.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	actionLog := mocks.NewMockActionLog(nil)
+
+	tests := []struct {
+		name          string
+		runId         string
+		log           domain.ActionLog
+		expected      *configuration
+		expectedError error
+	}{
+		{"ok", "run1", actionLog, &configuration{RunId: "run1", ActionLog: actionLog}, nil},
+		{"runidvalidation", "", actionLog, nil, fmt.Errorf("RunId cannot be null")},
+		{"logvalidation", "run1", nil, nil, fmt.Errorf("ActionLog cannot be null")},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &configuration{}
+			err := AuditLog(tc.runId, tc.log)(cfg)
+			if tc.expected != nil {
+				assert.Equal(t, tc.expected, cfg)
+				assert.Nil(t, err)
+			} else {
+				assert.Equal(t, tc.expectedError, err)
+			}
+		})
+	}
+}
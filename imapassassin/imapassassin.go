@@ -2,13 +2,17 @@
 package imapassassin
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/CrawX/go-imap-assassin/domain"
 	"github.com/CrawX/go-imap-assassin/log"
 	"github.com/CrawX/go-imap-assassin/mail"
+	"github.com/CrawX/go-imap-assassin/rules"
 
 	"github.com/sirupsen/logrus"
 )
@@ -47,21 +51,29 @@ func NewImapAssassin(persistence domain.Persistence, spamassassin domain.Concurr
 	}, nil
 }
 
-func (ia *ImapAssassin) CheckSpam(folders []string) error {
+// CheckSpam checks all new mails in folders. Once ctx is cancelled, the batch in flight is either discarded if it
+// hasn't been fully checked yet, or finished and recorded. The cancellation is returned as error afterwards.
+func (ia *ImapAssassin) CheckSpam(ctx context.Context, folders []string) error {
 	knownFolders, err := ia.persistence.AllFolders()
 	if err != nil {
 		return fmt.Errorf("could not list known folders: %w", err)
 	}
 
 	for _, f := range folders {
-		uidvalidity, err := ia.imapConnection.Select(f)
+		err := ia.checkHealth(ctx, f)
+		if err != nil {
+			return err
+		}
+
+		uidvalidity, err := ia.imapConnection.Select(ctx, f)
 		if err != nil {
 			return fmt.Errorf("could not select folder %s: %w", f, err)
 		}
 
 		if !ia.configuration.DryRun {
-			if ia.configuration.DeleteSpam {
-				notDeleteReadyReason, err := ia.imapConnection.DeleteReady()
+			// tagged copies replace the original, which is deleted afterwards
+			if ia.configuration.DeleteSpam || ia.configuration.TagSpam {
+				notDeleteReadyReason, err := ia.imapConnection.DeleteReady(ctx)
 				if err != nil {
 					return fmt.Errorf("could not check for delete readiness: %w", err)
 				}
@@ -71,7 +83,7 @@ func (ia *ImapAssassin) CheckSpam(folders []string) error {
 					continue
 				}
 			} else if ia.configuration.MoveSpam {
-				notMoveReadyReason, err := ia.imapConnection.MoveReady()
+				notMoveReadyReason, err := ia.imapConnection.MoveReady(ctx)
 				if err != nil {
 					return fmt.Errorf("could not check for move readiness: %w", err)
 				}
@@ -83,7 +95,7 @@ func (ia *ImapAssassin) CheckSpam(folders []string) error {
 			}
 		}
 
-		newMailUids, err := ia.getNewMailUids(f, domain.Checked, knownFolders, uidvalidity)
+		newMailUids, err := ia.getNewMailUids(ctx, f, domain.Checked, knownFolders, uidvalidity)
 		if err != nil {
 			return fmt.Errorf("could not determine new mail uids: %w", err)
 		}
@@ -96,28 +108,98 @@ func (ia *ImapAssassin) CheckSpam(folders []string) error {
 		batches := partitionUids(newMailUids, BatchSize)
 		ia.l.WithFields(logrus.Fields{"folder": f, "newmails": len(newMailUids), "batches": len(batches)}).Info("Found mails to check")
 
-		totalOk, totalSpam := 0, 0
+		totalOk, totalSpam, totalRescued, totalUnsure := 0, 0, 0, 0
+		ruleCounts := map[string]int{}
+		var interrupted error
 		for _, batch := range batches {
+			if ctx.Err() != nil {
+				interrupted = ctx.Err()
+				break
+			}
+
 			start := time.Now()
 			ia.l.WithFields(logrus.Fields{"batchsize": len(batch)}).Debug("Checking batch")
-			mails, err := ia.imapConnection.FetchMails(batch)
+			mails, err := ia.imapConnection.FetchMails(ctx, batch)
 			if err != nil {
+				if ctx.Err() != nil {
+					interrupted = ctx.Err()
+					break
+				}
 				return fmt.Errorf("could not fetch mail batch: %w", err)
 			}
 			ia.l.WithFields(logrus.Fields{"duration": time.Since(start)}).Debug("Fetched mail batch")
-			rawMails := make([][]byte, len(mails))
-			for i := 0; i < len(mails); i++ {
-				rawMails[i] = mails[i].RawMail
+			taggedInPlace := ia.configuration.TagSpam && !ia.configuration.MoveSpam
+			if taggedInPlace && !ia.configuration.DryRun {
+				mails, err = ia.skipTaggedCopies(f, mails)
+				if err != nil {
+					return err
+				}
+			}
+			// tagged copies in the checked folder itself look just like rescued mails
+			rescued := 0
+			if ia.configuration.LearnRescued && !taggedInPlace {
+				var unchecked []*domain.RawImapMail
+				unchecked, err = ia.learnRescued(ctx, f, mails)
+				if err != nil {
+					if ctx.Err() != nil {
+						interrupted = ctx.Err()
+						ia.l.WithFields(logrus.Fields{"folder": f, "batchsize": len(batch)}).Warn("Interrupted, discarding unfinished batch")
+						break
+					}
+					return err
+				}
+				rescued = len(mails) - len(unchecked)
+				mails = unchecked
+			}
+			matches, spamResults, err := ia.applyRules(f, mails)
+			if err != nil {
+				return err
+			}
+			rawMails, unmatched := [][]byte{}, []int{}
+			for i, m := range mails {
+				if matches[i] == nil {
+					rawMails = append(rawMails, m.RawMail)
+					unmatched = append(unmatched, i)
+				}
+			}
+			if len(rawMails) > 0 {
+				for i, result := range ia.spamClassifier.CheckAll(ctx, rawMails, CheckConcurrency) {
+					spamResults[unmatched[i]] = result
+				}
 			}
-			spamResults := ia.spamClassifier.CheckAll(rawMails, CheckConcurrency)
 
-			// Split spam and ham, append reports
-			ok, spam := []uint32{}, []uint32{}
+			// Only rescued mails and tagged copies have been recorded yet, each as soon as it was handled, so the rest of an
+			// incomplete batch can simply be discarded and is checked again in the next run
 			for i, m := range mails {
 				result := spamResults[i]
 				if result.Error != nil {
+					if ctx.Err() != nil {
+						interrupted = ctx.Err()
+						break
+					}
 					return fmt.Errorf(`Could not check mail "%s (%v)": %w`, mail.ShortSubject(m.Subject), m.Uid, result.Error)
 				}
+			}
+			if interrupted != nil {
+				ia.l.WithFields(logrus.Fields{"folder": f, "batchsize": len(batch)}).Warn("Interrupted, discarding unfinished batch")
+				break
+			}
+			if ia.configuration.OffsetCorrespondents {
+				err = ia.offsetCorrespondents(f, mails, matches, spamResults)
+				if err != nil {
+					return err
+				}
+			}
+
+			// The batch is complete and finished even when ctx is cancelled meanwhile, so every moved or deleted mail is
+			// also recorded
+			commitCtx := context.Background()
+
+			// Split spam and ham, append reports
+			ok, spam := []uint32{}, []uint32{}
+			unsure := 0
+			for i, m := range mails {
+				result := spamResults[i]
 
 				ia.l.WithFields(logrus.Fields{"folder": f, "subject": mail.ShortSubject(m.Subject), "isSpam": result.IsSpam, "score": result.Score}).Debug("Checked mail")
 				if result.IsSpam {
@@ -125,14 +207,23 @@ func (ia *ImapAssassin) CheckSpam(folders []string) error {
 					if !ia.configuration.DryRun {
 						if ia.configuration.AppendReports {
 							ia.l.WithFields(logrus.Fields{"folder": f, "subject": mail.ShortSubject(m.Subject), "score": result.Score}).Info("Appending spam report")
-							err = ia.imapConnection.Put(result.Body, ia.configuration.SpamReportFolder)
+							err = ia.putMail(commitCtx, f, m.Uid, result.Body, ia.configuration.SpamReportFolder)
 							if err != nil {
 								return fmt.Errorf(`Could not append report body for "%s" to "%s": %w`, mail.ShortSubject(m.Subject), ia.configuration.SpamReportFolder, err)
 							}
 						}
+						if ia.configuration.TagSpam {
+							err = ia.appendTagged(commitCtx, f, m, result)
+							if err != nil {
+								return err
+							}
+						}
 					} else {
 						ia.l.WithFields(logrus.Fields{"folder": f, "subject": mail.ShortSubject(m.Subject), "score": result.Score}).Info("Not appending report due to dry-run")
 					}
+				} else if result.Unsure {
+					// No verdict yet, the mail stays in place and is checked again
+					unsure++
 				} else {
 					// No spam
 					ok = append(ok, m.Uid)
@@ -142,15 +233,21 @@ func (ia *ImapAssassin) CheckSpam(folders []string) error {
 			// Move spam mail
 			if len(spam) > 0 {
 				if !ia.configuration.DryRun {
-					if ia.configuration.MoveSpam {
+					if ia.configuration.TagSpam {
+						ia.l.WithFields(logrus.Fields{"folder": f, "spam": len(spam)}).Info("Deleting spam mails replaced by tagged copies")
+						err = ia.deleteMails(commitCtx, f, spam)
+						if err != nil {
+							return fmt.Errorf(`Could not delete tagged spam: %w`, err)
+						}
+					} else if ia.configuration.MoveSpam {
 						ia.l.WithFields(logrus.Fields{"folder": f, "spam": len(spam), "destination": ia.configuration.SpamFolder}).Info("Moving spam mails")
-						err = ia.imapConnection.Move(spam, ia.configuration.SpamFolder)
+						_, err = ia.moveMails(commitCtx, domain.MailboxMove, f, spam, ia.configuration.SpamFolder)
 						if err != nil {
 							return fmt.Errorf(`Could not move spam: %w`, err)
 						}
 					} else if ia.configuration.DeleteSpam {
 						ia.l.WithFields(logrus.Fields{"folder": f, "spam": len(spam)}).Info("Deleting spam mails")
-						err = ia.imapConnection.Delete(spam)
+						err = ia.deleteMails(commitCtx, f, spam)
 						if err != nil {
 							return fmt.Errorf(`Could not delete spam: %w`, err)
 						}
@@ -165,16 +262,27 @@ func (ia *ImapAssassin) CheckSpam(folders []string) error {
 				saveMails := []domain.SaveMail{}
 				for i, m := range mails {
 					result := spamResults[i]
+					if result.Unsure {
+						continue
+					}
+					action, destination := domain.ActionNone, ""
+					if result.IsSpam {
+						action, destination = ia.spamAction(f)
+					}
 					saveMails = append(
 						saveMails,
 						domain.SaveMail{
-							Class:      domain.Checked,
-							Uid:        m.Uid,
-							MailIdHash: m.MailIdHash,
-							FolderName: f,
-							Subject:    m.Subject,
-							IsSpam:     &result.IsSpam,
-							Score:      &result.Score,
+							Class:        domain.Checked,
+							Uid:          m.Uid,
+							MailIdHash:   m.MailIdHash,
+							HashStrategy: m.HashStrategy,
+							ServerId:     m.ServerId,
+							FolderName:   f,
+							Subject:      m.Subject,
+							IsSpam:       &result.IsSpam,
+							Score:        &result.Score,
+							Rule:         rule(matches[i]),
+							MailMetadata: ia.metadata(m, matches[i] == nil, action, destination),
 						},
 					)
 				}
@@ -186,21 +294,311 @@ func (ia *ImapAssassin) CheckSpam(folders []string) error {
 				ia.l.WithFields(logrus.Fields{"folder": f, "spam": len(spam)}).Info("Not saving mails as seen in local database due to dry-run")
 			}
 
+			allowed, blocked := 0, 0
+			for _, match := range matches {
+				if match == nil {
+					continue
+				}
+				if match.Block {
+					blocked++
+				} else {
+					allowed++
+				}
+				ruleCounts[match.Rule]++
+			}
+
 			totalOk += len(ok)
 			totalSpam += len(spam)
-			ia.l.WithFields(logrus.Fields{"duration": time.Since(start), "batchsize": len(batch), "ok": len(ok), "spam": len(spam)}).Info("Checked batch")
+			totalRescued += rescued
+			totalUnsure += unsure
+			ia.l.WithFields(logrus.Fields{"duration": time.Since(start), "batchsize": len(batch), "ok": len(ok), "spam": len(spam), "unsure": unsure, "allowed": allowed, "blocked": blocked, "rescued": rescued}).Info("Checked batch")
+		}
+
+		rulesMatched := make([]string, 0, len(ruleCounts))
+		for r := range ruleCounts {
+			rulesMatched = append(rulesMatched, r)
+		}
+		sort.Strings(rulesMatched)
+		for _, r := range rulesMatched {
+			ia.l.WithFields(logrus.Fields{"folder": f, "rule": r, "mails": ruleCounts[r]}).Info("Rule decided mails")
 		}
+		ia.l.WithFields(logrus.Fields{"folder": f, "ok": totalOk, "spam": totalSpam, "unsure": totalUnsure, "rescued": totalRescued}).Info("Checked folder")
 
+		// The recorded mails' uids belong to this uidvalidity, even if not all batches were checked
 		err = ia.persistence.SaveFolder(f, uidvalidity)
 		if err != nil {
 			return fmt.Errorf("could not save uidvalidity for %s: %w", f, err)
 		}
+
+		if interrupted != nil {
+			return interrupted
+		}
 	}
 
 	return nil
 }
 
-func (ia *ImapAssassin) Learn(learnType domain.LearnType, folders []string) error {
+// applyRules matches mails against the configured rules and, with AllowCorrespondents, the known correspondents. Mails
+// decided by a rule get their match and a fixed result, the others' match and result stay nil and have to be
+// classified.
+func (ia *ImapAssassin) applyRules(folder string, mails []*domain.RawImapMail) ([]*rules.Match, []*domain.SpamResult, error) {
+	matches := make([]*rules.Match, len(mails))
+	results := make([]*domain.SpamResult, len(mails))
+	if ia.configuration.Rules == nil && !ia.configuration.AllowCorrespondents {
+		return matches, results, nil
+	}
+
+	for i, m := range mails {
+		var match *rules.Match
+		var err error
+		if ia.configuration.Rules != nil {
+			match, err = ia.configuration.Rules.Match(m.RawMail)
+			if err != nil {
+				// malformed mails are common in spam, the classifier decides them instead
+				ia.l.WithFields(logrus.Fields{"folder": folder, "subject": mail.ShortSubject(m.Subject), "error": err}).Debug("Could not match rules, classifying mail")
+				match = nil
+			}
+		}
+		if match == nil && ia.configuration.AllowCorrespondents {
+			correspondent, err := ia.correspondent(m)
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(correspondent) > 0 {
+				match = &rules.Match{Block: false, Rule: "allow correspondent " + correspondent}
+			}
+		}
+		if match == nil {
+			continue
+		}
+
+		ia.l.WithFields(logrus.Fields{"folder": folder, "subject": mail.ShortSubject(m.Subject), "rule": match.Rule}).Debug("Decided mail by rule")
+		matches[i] = match
+		results[i] = &domain.SpamResult{IsSpam: match.Block}
+		if match.Block && ia.configuration.AppendReports {
+			results[i].Body, err = mail.Report(
+				m.RawMail,
+				"go-imap-assassin",
+				map[string]string{
+					"X-Spam-Flag":   "YES",
+					"X-Spam-Status": fmt.Sprintf("Yes, rule=%s", match.Rule),
+				},
+				[]byte(fmt.Sprintf("The attached mail has been blocked by the rule\n\n  %s\n", match.Rule)),
+			)
+			if err != nil {
+				return nil, nil, fmt.Errorf(`Could not create report for "%s (%v)": %w`, mail.ShortSubject(m.Subject), m.Uid, err)
+			}
+		}
+	}
+
+	return matches, results, nil
+}
+
+// offsetCorrespondents subtracts the configured offset from the scores of spam mails sent by known correspondents, which
+// stay spam only if the reduced score still reaches the required score.
+func (ia *ImapAssassin) offsetCorrespondents(folder string, mails []*domain.RawImapMail, matches []*rules.Match, results []*domain.SpamResult) error {
+	for i, m := range mails {
+		if matches[i] != nil || !results[i].IsSpam {
+			continue
+		}
+
+		correspondent, err := ia.correspondent(m)
+		if err != nil {
+			return err
+		}
+		if len(correspondent) == 0 {
+			continue
+		}
+
+		results[i].Score -= ia.configuration.CorrespondentScoreOffset
+		results[i].IsSpam = results[i].Score >= ia.configuration.CorrespondentRequiredScore
+		ia.l.WithFields(logrus.Fields{"folder": folder, "subject": mail.ShortSubject(m.Subject), "correspondent": correspondent, "score": results[i].Score, "isSpam": results[i].IsSpam}).Debug("Applied correspondent score offset")
+	}
+
+	return nil
+}
+
+// correspondent returns the sender of m if mail has been sent to it before, an empty string otherwise
+func (ia *ImapAssassin) correspondent(m *domain.RawImapMail) (string, error) {
+	sender, err := mail.Sender(m.RawMail)
+	if err != nil {
+		// malformed mails are common in spam, they are simply no correspondent's
+		ia.l.WithFields(logrus.Fields{"subject": mail.ShortSubject(m.Subject), "uid": m.Uid, "error": err}).Debug("Could not read sender, not matching correspondents")
+		return "", nil
+	}
+	if len(sender) == 0 {
+		return "", nil
+	}
+
+	known, err := ia.persistence.IsCorrespondent(sender)
+	if err != nil {
+		return "", fmt.Errorf("could not lookup correspondent: %w", err)
+	}
+	if !known {
+		return "", nil
+	}
+
+	return sender, nil
+}
+
+// rule returns the rule of match or an empty string if the mail was classified
+func rule(match *rules.Match) string {
+	if match == nil {
+		return ""
+	}
+
+	return match.Rule
+}
+
+// appendTagged appends a copy of m with X-Spam-* headers and the configured subject to the spam folder if spam is
+// moved, otherwise to folder. The copy keeps m's flags and internal date.
+func (ia *ImapAssassin) appendTagged(ctx context.Context, folder string, m *domain.RawImapMail, result *domain.SpamResult) error {
+	status := fmt.Sprintf("Yes, score=%.2f", result.Score)
+	if len(result.Symbols) > 0 {
+		tests := make([]string, 0, len(result.Symbols))
+		for symbol := range result.Symbols {
+			tests = append(tests, symbol)
+		}
+		sort.Strings(tests)
+		status += " tests=" + strings.Join(tests, ",")
+	}
+
+	subject := result.Subject
+	if len(subject) == 0 && len(ia.configuration.SpamSubjectPrefix) > 0 && !strings.HasPrefix(m.Subject, ia.configuration.SpamSubjectPrefix) {
+		subject = strings.TrimSpace(ia.configuration.SpamSubjectPrefix + " " + m.Subject)
+	}
+
+	tagged, err := mail.Tag(
+		m.RawMail,
+		map[string]string{
+			"X-Spam-Flag":   "YES",
+			"X-Spam-Score":  fmt.Sprintf("%.2f", result.Score),
+			"X-Spam-Status": status,
+		},
+		subject,
+	)
+	if err != nil {
+		return fmt.Errorf(`Could not tag "%s": %w`, mail.ShortSubject(m.Subject), err)
+	}
+
+	destination := folder
+	if ia.configuration.MoveSpam {
+		destination = ia.configuration.SpamFolder
+	}
+
+	ia.l.WithFields(logrus.Fields{"folder": folder, "subject": mail.ShortSubject(m.Subject), "destination": destination}).Info("Appending tagged spam mail")
+	err = ia.appendMail(ctx, folder, m.Uid, tagged, destination, m.Flags, m.InternalDate)
+	if err != nil {
+		return fmt.Errorf(`Could not append tagged mail for "%s" to "%s": %w`, mail.ShortSubject(m.Subject), destination, err)
+	}
+
+	return nil
+}
+
+// skipTaggedCopies removes the tagged copies of spam mails from mails. A copy has the same MailIdHash as the original
+// it replaced, which is recorded under its old uid, so the record is moved to the copy's uid instead of checking the
+// copy again.
+func (ia *ImapAssassin) skipTaggedCopies(folder string, mails []*domain.RawImapMail) ([]*domain.RawImapMail, error) {
+	unchecked := []*domain.RawImapMail{}
+	for _, m := range mails {
+		knownMail, err := ia.findMail(domain.Checked, folder, m.ServerId, m.MailIdHash)
+		if err != nil {
+			return nil, fmt.Errorf("could not lookup known mail: %w", err)
+		}
+		if knownMail == nil || !knownMail.IsSpam {
+			unchecked = append(unchecked, m)
+			continue
+		}
+
+		ia.l.WithFields(logrus.Fields{"folder": folder, "subject": mail.ShortSubject(m.Subject)}).Debug("Is a tagged copy of known spam, updating uid")
+		err = ia.persistence.UpdateUid(knownMail.Id, m.Uid)
+		if err != nil {
+			return nil, fmt.Errorf("could not update uid: %w", err)
+		}
+	}
+
+	return unchecked, nil
+}
+
+// learnRescued learns the mails of folder as ham that were checked as spam in folder before, i.e. moved back from the
+// spam folder by the user, and records their correction. The remaining mails are returned to be checked. Corrections
+// are recorded for every learned mail even if learning others failed, so no mail is learned twice.
+func (ia *ImapAssassin) learnRescued(ctx context.Context, folder string, mails []*domain.RawImapMail) ([]*domain.RawImapMail, error) {
+	unchecked := []*domain.RawImapMail{}
+	rescued := []*domain.RawImapMail{}
+	knownMails := []*domain.SavedImapMail{}
+	for _, m := range mails {
+		knownMail, err := ia.findMail(domain.Checked, folder, m.ServerId, m.MailIdHash)
+		if err != nil {
+			return nil, fmt.Errorf("could not lookup known mail: %w", err)
+		}
+		if knownMail == nil || !knownMail.IsSpam {
+			unchecked = append(unchecked, m)
+			continue
+		}
+
+		rescued = append(rescued, m)
+		knownMails = append(knownMails, knownMail)
+	}
+	if len(rescued) == 0 {
+		return unchecked, nil
+	}
+
+	rawMails := make([][]byte, len(rescued))
+	for i := 0; i < len(rescued); i++ {
+		rawMails[i] = rescued[i].RawMail
+	}
+	learnResults := ia.spamClassifier.LearnAll(ctx, domain.LearnHam, rawMails, LearnConcurrency)
+
+	var learnErr error
+	for i, m := range rescued {
+		if learnResults[i] != nil {
+			if learnErr == nil {
+				learnErr = fmt.Errorf(`could not learn rescued mail "%s": %w`, mail.ShortSubject(m.Subject), learnResults[i])
+			}
+			continue
+		}
+
+		if ia.configuration.DryRun {
+			ia.l.WithFields(logrus.Fields{"folder": folder, "subject": mail.ShortSubject(m.Subject)}).Info("Not recording correction of rescued mail due to dry-run")
+			continue
+		}
+
+		ia.l.WithFields(logrus.Fields{"folder": folder, "subject": mail.ShortSubject(m.Subject), "score": knownMails[i].Score}).Info("Learned rescued mail as ham")
+		err := ia.persistence.CorrectMail(knownMails[i].Id, m.Uid)
+		if err != nil {
+			return nil, fmt.Errorf("could not record correction: %w", err)
+		}
+	}
+	if learnErr != nil {
+		return nil, learnErr
+	}
+
+	return unchecked, nil
+}
+
+// checkHealth pings the classifier before folder is processed, so an outage fails the run right away instead of
+// failing every mail of the folder's first batch.
+func (ia *ImapAssassin) checkHealth(ctx context.Context, folder string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := ia.spamClassifier.Ping(ctx)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("classifier not reachable before folder %s: %w", folder, err)
+	}
+
+	return nil
+}
+
+// Learn learns all new mails in folders. Once ctx is cancelled, no more mails of the batch in flight are passed to the
+// classifier. The mails learned so far are still recorded and, with DeleteLearned, deleted so they aren't learned
+// twice, the others are left for the next run. The cancellation is returned as error afterwards.
+func (ia *ImapAssassin) Learn(ctx context.Context, learnType domain.LearnType, folders []string) error {
 	var class domain.MailClass
 	switch learnType {
 	case domain.LearnSpam:
@@ -217,12 +615,17 @@ func (ia *ImapAssassin) Learn(learnType domain.LearnType, folders []string) erro
 	}
 
 	for _, f := range folders {
-		uidvalidity, err := ia.imapConnection.Select(f)
+		err := ia.checkHealth(ctx, f)
+		if err != nil {
+			return err
+		}
+
+		uidvalidity, err := ia.imapConnection.Select(ctx, f)
 		if err != nil {
 			return fmt.Errorf("could not select folder %s: %w", f, err)
 		}
 
-		newMailUids, err := ia.getNewMailUids(f, class, knownFolders, uidvalidity)
+		newMailUids, err := ia.getNewMailUids(ctx, f, class, knownFolders, uidvalidity)
 		if err != nil {
 			return fmt.Errorf("could not determine new mail uids: %w", err)
 		}
@@ -235,7 +638,7 @@ func (ia *ImapAssassin) Learn(learnType domain.LearnType, folders []string) erro
 		}
 
 		if !ia.configuration.DryRun && ia.configuration.DeleteLearned {
-			notDeleteReadyReason, err := ia.imapConnection.DeleteReady()
+			notDeleteReadyReason, err := ia.imapConnection.DeleteReady(ctx)
 			if err != nil {
 				return fmt.Errorf("could not check for delete readiness: %w", err)
 			}
@@ -249,46 +652,79 @@ func (ia *ImapAssassin) Learn(learnType domain.LearnType, folders []string) erro
 		batches := partitionUids(newMailUids, BatchSize)
 		baseFolderLogger.WithFields(logrus.Fields{"newmails": len(newMailUids), "batches": len(batches)}).Info("Found mails to learn")
 
+		var interrupted error
 		for _, batch := range batches {
+			if ctx.Err() != nil {
+				interrupted = ctx.Err()
+				break
+			}
+
 			start := time.Now()
 			baseFolderLogger.WithFields(logrus.Fields{"batchsize": len(batch)}).Debug("Learning batch")
 
-			mails, err := ia.imapConnection.FetchMails(batch)
+			mails, err := ia.imapConnection.FetchMails(ctx, batch)
 			if err != nil {
+				if ctx.Err() != nil {
+					interrupted = ctx.Err()
+					break
+				}
 				return fmt.Errorf("could not fetch mail batch: %w", err)
 			}
-			rawMails := make([][]byte, len(mails))
-			for i := 0; i < len(mails); i++ {
-				rawMails[i] = mails[i].RawMail
+			originals, forwards := ia.forwardedOriginals(f, class, mails)
+			rawMails := make([][]byte, len(originals))
+			for i := 0; i < len(originals); i++ {
+				rawMails[i] = originals[i].rawMail
 			}
-			learnResults := ia.spamClassifier.LearnAll(learnType, rawMails, LearnConcurrency)
+			learnResults := ia.spamClassifier.LearnAll(ctx, learnType, rawMails, LearnConcurrency)
 
-			saveMails := []domain.SaveMail{}
-			for i, m := range mails {
+			// mails are only recorded and deleted once all of their originals are learned
+			unlearned := map[uint32]bool{}
+			for i, o := range originals {
 				result := learnResults[i]
 				if result != nil {
-					return fmt.Errorf(`could not learn mail "%s": %w`, mail.ShortSubject(m.Subject), result)
+					if ctx.Err() == nil {
+						return fmt.Errorf(`could not learn mail "%s": %w`, mail.ShortSubject(o.Subject), result)
+					}
+					interrupted = ctx.Err()
+					unlearned[o.Uid] = true
+				}
+			}
+
+			learnedUids := batch
+			if interrupted != nil {
+				learnedUids = []uint32{}
+				for _, m := range mails {
+					if !unlearned[m.Uid] {
+						learnedUids = append(learnedUids, m.Uid)
+					}
+				}
+				baseFolderLogger.WithFields(logrus.Fields{"batchsize": len(batch), "learned": len(learnedUids)}).Warn("Interrupted, recording only the learned mails of the unfinished batch")
+				if len(learnedUids) == 0 {
+					break
+				}
+			}
+
+			saveMails := []domain.SaveMail{}
+			for _, o := range originals {
+				if !unlearned[o.Uid] {
+					saveMails = append(saveMails, o.SaveMail)
+				}
+			}
+			for _, forward := range forwards {
+				if !unlearned[forward.Uid] {
+					saveMails = append(saveMails, forward)
 				}
-				saveMails = append(
-					saveMails,
-					domain.SaveMail{
-						Class:      class,
-						Uid:        m.Uid,
-						MailIdHash: m.MailIdHash,
-						FolderName: f,
-						Subject:    m.Subject,
-					},
-				)
 			}
 
 			if !ia.configuration.DryRun {
 				if ia.configuration.DeleteLearned {
-					baseFolderLogger.WithFields(logrus.Fields{"batchsize": len(batch)}).Debug("Deleting learned batch")
-					err = ia.imapConnection.Delete(batch)
+					baseFolderLogger.WithFields(logrus.Fields{"batchsize": len(learnedUids)}).Debug("Deleting learned batch")
+					// the batch is finished even when ctx is cancelled meanwhile, so every deleted mail is also recorded
+					err = ia.deleteMails(context.Background(), f, learnedUids)
 					if err != nil {
 						return fmt.Errorf("could not delete batch after learning: %w", err)
 					}
-					baseFolderLogger.WithFields(logrus.Fields{"duration": time.Since(start), "batchsize": len(batch)}).Info("Deleted learned batch")
+					baseFolderLogger.WithFields(logrus.Fields{"duration": time.Since(start), "batchsize": len(learnedUids)}).Info("Deleted learned batch")
 				}
 
 				err = ia.persistence.SaveMails(saveMails)
@@ -305,7 +741,10 @@ func (ia *ImapAssassin) Learn(learnType domain.LearnType, folders []string) erro
 
 			}
 
-			baseFolderLogger.WithFields(logrus.Fields{"duration": time.Since(start), "batchsize": len(batch)}).Info("Learned batch")
+			baseFolderLogger.WithFields(logrus.Fields{"duration": time.Since(start), "batchsize": len(batch), "originals": len(originals)}).Info("Learned batch")
+			if interrupted != nil {
+				break
+			}
 		}
 
 		err = ia.persistence.SaveFolder(f, uidvalidity)
@@ -313,16 +752,407 @@ func (ia *ImapAssassin) Learn(learnType domain.LearnType, folders []string) erro
 			return fmt.Errorf("could not save uidvalidity for %s: %w", f, err)
 		}
 
+		if interrupted != nil {
+			return interrupted
+		}
+
 		baseFolderLogger.WithFields(logrus.Fields{"newmails": len(newMailUids), "batches": len(batches)}).Info("Learned mails")
 	}
 
 	return nil
 }
 
-func (ia *ImapAssassin) getNewMailUids(folder string, class domain.MailClass, knownFolders []*domain.ImapFolder, uidValidity uint32) ([]uint32, error) {
+// ConfirmSpam learns the mails in the spam folder as spam that CheckSpam moved there from one of checkedFolders and that
+// have been left there for longer than the grace period according to their internal date, so the user didn't rescue
+// them. Mails the user moved into the spam folder are left alone. Confirmed mails are expunged afterwards if
+// configured. Once ctx is cancelled, the batch in flight is discarded and the cancellation is returned as error.
+func (ia *ImapAssassin) ConfirmSpam(ctx context.Context, checkedFolders []string) error {
+	if !ia.configuration.ConfirmSpam {
+		return fmt.Errorf("ConfirmSpam is not configured")
+	}
+	if !ia.configuration.MoveSpam {
+		return fmt.Errorf("ConfirmSpam requires MoveSpam")
+	}
+	spamFolder := ia.configuration.SpamFolder
+
+	knownFolders, err := ia.persistence.AllFolders()
+	if err != nil {
+		return fmt.Errorf("could not list known folders: %w", err)
+	}
+
+	err = ia.checkHealth(ctx, spamFolder)
+	if err != nil {
+		return err
+	}
+
+	uidvalidity, err := ia.imapConnection.Select(ctx, spamFolder)
+	if err != nil {
+		return fmt.Errorf("could not select folder %s: %w", spamFolder, err)
+	}
+
+	newMailUids, err := ia.getNewMailUids(ctx, spamFolder, domain.LearnedSpam, knownFolders, uidvalidity)
+	if err != nil {
+		return fmt.Errorf("could not determine new mail uids: %w", err)
+	}
+
+	if len(newMailUids) == 0 {
+		ia.l.WithFields(logrus.Fields{"folder": spamFolder, "newmails": len(newMailUids)}).Info("Spam folder contains no unconfirmed mails")
+		return nil
+	}
+
+	expunge := ia.configuration.ExpungeConfirmedSpam && !ia.configuration.DryRun
+	action := domain.ActionNone
+	if expunge {
+		action = domain.ActionDeleted
+	}
+	if expunge {
+		notDeleteReadyReason, err := ia.imapConnection.DeleteReady(ctx)
+		if err != nil {
+			return fmt.Errorf("could not check for delete readiness: %w", err)
+		}
+
+		if notDeleteReadyReason != nil {
+			ia.l.WithFields(logrus.Fields{"folder": spamFolder, "error": notDeleteReadyReason}).Warn("Folder is not ready for mail deletion, skipping")
+			return nil
+		}
+	}
+
+	idInfos, err := ia.imapConnection.FetchIdHeaders(ctx, newMailUids)
+	if err != nil {
+		return fmt.Errorf("could not list mail headers for folder: %w", err)
+	}
+
+	movedUids := []uint32{}
+	for _, info := range idInfos {
+		moved, err := ia.movedSpam(checkedFolders, info.ServerId, info.MailIdHash)
+		if err != nil {
+			return err
+		}
+		if moved {
+			movedUids = append(movedUids, info.Uid)
+		}
+	}
+
+	// only the mails past the grace period are fetched, the others stay unconfirmed until a later run
+	deadline := time.Now().Add(-ia.configuration.SpamGracePeriod)
+	dueUids := []uint32{}
+	if len(movedUids) > 0 {
+		internalDates, err := ia.imapConnection.FetchInternalDates(ctx, movedUids)
+		if err != nil {
+			return fmt.Errorf("could not fetch internal dates: %w", err)
+		}
+		for _, uid := range movedUids {
+			if date, ok := internalDates[uid]; ok && !date.IsZero() && date.Before(deadline) {
+				dueUids = append(dueUids, uid)
+			}
+		}
+	}
+
+	batches := partitionUids(dueUids, BatchSize)
+	ia.l.WithFields(logrus.Fields{"folder": spamFolder, "newmails": len(newMailUids), "moved": len(movedUids), "due": len(dueUids), "batches": len(batches)}).Info("Found moved spam mails to confirm")
+
+	totalConfirmed := 0
+	for _, batch := range batches {
+		if len(batch) == 0 {
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		due, err := ia.imapConnection.FetchMails(ctx, batch)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("could not fetch mail batch: %w", err)
+		}
+
+		rawMails := make([][]byte, len(due))
+		for i := 0; i < len(due); i++ {
+			rawMails[i] = due[i].RawMail
+		}
+		learnResults := ia.spamClassifier.LearnAll(ctx, domain.LearnSpam, rawMails, LearnConcurrency)
+
+		confirmedUids := []uint32{}
+		saveMails := []domain.SaveMail{}
+		for i, m := range due {
+			if learnResults[i] != nil {
+				if ctx.Err() != nil {
+					ia.l.WithFields(logrus.Fields{"folder": spamFolder, "batchsize": len(batch)}).Warn("Interrupted, discarding unfinished batch")
+					return ctx.Err()
+				}
+				return fmt.Errorf(`could not learn mail "%s": %w`, mail.ShortSubject(m.Subject), learnResults[i])
+			}
+			confirmedUids = append(confirmedUids, m.Uid)
+			saveMails = append(
+				saveMails,
+				domain.SaveMail{
+					Class:        domain.LearnedSpam,
+					Uid:          m.Uid,
+					MailIdHash:   m.MailIdHash,
+					HashStrategy: m.HashStrategy,
+					ServerId:     m.ServerId,
+					FolderName:   spamFolder,
+					Subject:      m.Subject,
+					MailMetadata: ia.metadata(m, true, action, ""),
+				},
+			)
+		}
+
+		if !ia.configuration.DryRun {
+			if expunge {
+				// the batch is finished even when ctx is cancelled meanwhile, so every deleted mail is also recorded
+				err = ia.deleteMails(context.Background(), spamFolder, confirmedUids)
+				if err != nil {
+					return fmt.Errorf("could not delete confirmed spam: %w", err)
+				}
+			}
+
+			err = ia.persistence.SaveMails(saveMails)
+			if err != nil {
+				return fmt.Errorf("could not save mails: %w", err)
+			}
+		} else {
+			ia.l.WithFields(logrus.Fields{"folder": spamFolder, "spam": len(saveMails)}).Info("Not saving mails as seen in local database due to dry-run")
+		}
+
+		totalConfirmed += len(due)
+		ia.l.WithFields(logrus.Fields{"folder": spamFolder, "batchsize": len(batch), "confirmed": len(due), "expunged": expunge}).Info("Confirmed spam batch")
+	}
+
+	err = ia.persistence.SaveFolder(spamFolder, uidvalidity)
+	if err != nil {
+		return fmt.Errorf("could not save uidvalidity for %s: %w", spamFolder, err)
+	}
+
+	ia.l.WithFields(logrus.Fields{"folder": spamFolder, "confirmed": totalConfirmed}).Info("Confirmed spam")
+	return nil
+}
+
+// movedSpam returns true if a mail with serverId or mailIdHash was checked as spam in one of checkedFolders, so
+// CheckSpam moved it to the spam folder. Mails rescued by the user are corrected to ham and don't count.
+func (ia *ImapAssassin) movedSpam(checkedFolders []string, serverId string, mailIdHash string) (bool, error) {
+	for _, folder := range checkedFolders {
+		knownMail, err := ia.findMail(domain.Checked, folder, serverId, mailIdHash)
+		if err != nil {
+			return false, fmt.Errorf("could not lookup known mail: %w", err)
+		}
+		if knownMail != nil && knownMail.IsSpam {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// CollectCorrespondents records the To, Cc and Bcc addresses of all new mails in folders, which are usually the Sent
+// folders, as correspondents. Once ctx is cancelled, the batch in flight is discarded and the cancellation is returned
+// as error.
+func (ia *ImapAssassin) CollectCorrespondents(ctx context.Context, folders []string) error {
+	knownFolders, err := ia.persistence.AllFolders()
+	if err != nil {
+		return fmt.Errorf("could not list known folders: %w", err)
+	}
+
+	for _, f := range folders {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		uidvalidity, err := ia.imapConnection.Select(ctx, f)
+		if err != nil {
+			return fmt.Errorf("could not select folder %s: %w", f, err)
+		}
+
+		newMailUids, err := ia.getNewMailUids(ctx, f, domain.Sent, knownFolders, uidvalidity)
+		if err != nil {
+			return fmt.Errorf("could not determine new mail uids: %w", err)
+		}
+
+		if len(newMailUids) == 0 {
+			ia.l.WithFields(logrus.Fields{"folder": f, "newmails": len(newMailUids)}).Info("Folder contains no new sent mails")
+			continue
+		}
+
+		batches := partitionUids(newMailUids, BatchSize)
+		ia.l.WithFields(logrus.Fields{"folder": f, "newmails": len(newMailUids), "batches": len(batches)}).Info("Found sent mails to collect correspondents from")
+
+		totalCorrespondents := 0
+		var interrupted error
+		for _, batch := range batches {
+			if ctx.Err() != nil {
+				interrupted = ctx.Err()
+				break
+			}
+
+			mails, err := ia.imapConnection.FetchMails(ctx, batch)
+			if err != nil {
+				if ctx.Err() != nil {
+					interrupted = ctx.Err()
+					break
+				}
+				return fmt.Errorf("could not fetch mail batch: %w", err)
+			}
+
+			correspondents := []string{}
+			saveMails := []domain.SaveMail{}
+			for _, m := range mails {
+				recipients, err := mail.Recipients(m.RawMail)
+				if err != nil {
+					return fmt.Errorf(`Could not read recipients of "%s (%v)": %w`, mail.ShortSubject(m.Subject), m.Uid, err)
+				}
+				correspondents = append(correspondents, recipients...)
+				saveMails = append(
+					saveMails,
+					domain.SaveMail{
+						Class:        domain.Sent,
+						Uid:          m.Uid,
+						MailIdHash:   m.MailIdHash,
+						HashStrategy: m.HashStrategy,
+						ServerId:     m.ServerId,
+						FolderName:   f,
+						Subject:      m.Subject,
+						MailMetadata: ia.metadata(m, false, domain.ActionNone, ""),
+					},
+				)
+			}
+
+			if !ia.configuration.DryRun {
+				err = ia.persistence.SaveCorrespondents(correspondents)
+				if err != nil {
+					return fmt.Errorf("could not save correspondents: %w", err)
+				}
+				err = ia.persistence.SaveMails(saveMails)
+				if err != nil {
+					return fmt.Errorf("could not save mails: %w", err)
+				}
+			} else {
+				ia.l.WithFields(logrus.Fields{"folder": f, "correspondents": len(correspondents)}).Info("Not saving correspondents in local database due to dry-run")
+			}
+
+			totalCorrespondents += len(correspondents)
+			ia.l.WithFields(logrus.Fields{"folder": f, "batchsize": len(batch), "correspondents": len(correspondents)}).Debug("Collected correspondents of batch")
+		}
+
+		err = ia.persistence.SaveFolder(f, uidvalidity)
+		if err != nil {
+			return fmt.Errorf("could not save uidvalidity for %s: %w", f, err)
+		}
+
+		if interrupted != nil {
+			return interrupted
+		}
+
+		ia.l.WithFields(logrus.Fields{"folder": f, "newmails": len(newMailUids), "correspondents": totalCorrespondents}).Info("Collected correspondents")
+	}
+
+	return nil
+}
+
+// original is a mail to learn, which is either a mail of a learn folder or a mail forwarded as attachment in it
+type original struct {
+	domain.SaveMail
+	rawMail []byte
+}
+
+// forwardedOriginals unwraps the mails forwarded as attachments of mails, e.g. spam forwarded from a phone. Every
+// original is recorded with its own hash under the uid of the mail containing it. The containing mails are returned
+// as well, they aren't learned but recorded with their own hash so they are recognized after a UIDVALIDITY change.
+// Mails that can't be unwrapped are learned as they are.
+func (ia *ImapAssassin) forwardedOriginals(folder string, class domain.MailClass, mails []*domain.RawImapMail) ([]*original, []domain.SaveMail) {
+	action := domain.ActionNone
+	if ia.configuration.DeleteLearned {
+		action = domain.ActionDeleted
+	}
+
+	originals := []*original{}
+	forwards := []domain.SaveMail{}
+	for _, m := range mails {
+		unwrapped, err := mail.UnwrapForwarded(m.RawMail)
+		if err != nil {
+			ia.l.WithFields(logrus.Fields{"folder": folder, "subject": mail.ShortSubject(m.Subject), "error": err}).Debug("Could not unwrap mail, learning it as is")
+			unwrapped = [][]byte{m.RawMail}
+		}
+
+		saveMail := domain.SaveMail{
+			Class:        class,
+			Uid:          m.Uid,
+			MailIdHash:   m.MailIdHash,
+			HashStrategy: m.HashStrategy,
+			ServerId:     m.ServerId,
+			FolderName:   folder,
+			Subject:      m.Subject,
+			MailMetadata: ia.metadata(m, true, action, ""),
+		}
+		forwarded := len(unwrapped) > 1 || !bytes.Equal(unwrapped[0], m.RawMail)
+		if forwarded {
+			forwards = append(forwards, saveMail)
+		}
+
+		for _, rawMail := range unwrapped {
+			o := &original{
+				SaveMail: saveMail,
+				rawMail:  rawMail,
+			}
+
+			if forwarded {
+				subject, mailIdHash, strategy, err := mail.MailHeaderInfos(rawMail)
+				if err != nil {
+					// the attached mail is learned anyway, the classifier decides whether it's usable
+					subject, mailIdHash, strategy = "", mail.ContentHash(rawMail), mail.HashBody
+				}
+				o.Subject = subject
+				o.MailIdHash = mailIdHash
+				o.HashStrategy = string(strategy)
+				// the attached mail's headers may be broken, they're recorded as far as they can be parsed
+				o.Sender, _ = mail.Sender(rawMail)
+				o.Date, _ = mail.Date(rawMail)
+				o.Size = len(rawMail)
+			}
+
+			originals = append(originals, o)
+		}
+	}
+
+	return originals, forwards
+}
+
+// spamAction returns what CheckSpam does to spam mails of folder and the folder they end up in
+func (ia *ImapAssassin) spamAction(folder string) (domain.MailAction, string) {
+	switch {
+	case ia.configuration.MoveSpam:
+		// tagged copies are put into the spam folder as well
+		return domain.ActionMoved, ia.configuration.SpamFolder
+	case ia.configuration.TagSpam:
+		return domain.ActionFlagged, folder
+	case ia.configuration.DeleteSpam:
+		return domain.ActionDeleted, ""
+	}
+	return domain.ActionNone, ""
+}
+
+// metadata returns the metadata of m to record, with the configured classifier if it checked or learned m
+func (ia *ImapAssassin) metadata(m *domain.RawImapMail, classified bool, action domain.MailAction, destination string) domain.MailMetadata {
+	metadata := domain.MailMetadata{
+		Sender:       m.Sender,
+		Date:         m.Date,
+		InternalDate: m.InternalDate,
+		Size:         m.Size,
+		Action:       action,
+		Destination:  destination,
+	}
+	if classified {
+		metadata.Classifier = ia.configuration.ClassifierName
+		metadata.ClassifierVersion = ia.configuration.ClassifierVersion
+	}
+	return metadata
+}
+
+func (ia *ImapAssassin) getNewMailUids(ctx context.Context, folder string, class domain.MailClass, knownFolders []*domain.ImapFolder, uidValidity uint32) ([]uint32, error) {
 	knownFolder := folderByName(knownFolders, folder)
 
-	newMails, err := ia.imapConnection.ListUids()
+	newMails, err := ia.imapConnection.ListUids(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("could not list uids in folder: %w", err)
 	}
@@ -334,32 +1164,43 @@ func (ia *ImapAssassin) getNewMailUids(folder string, class domain.MailClass, kn
 			return nil, fmt.Errorf("could not list known uids: %w", err)
 		}
 
+		knownUids := make(map[uint32]bool, len(knownMails))
 		for _, m := range knownMails {
-			newMails = removeUid(newMails, m.Uid)
+			knownUids[m.Uid] = true
 		}
+		newMails = withoutUids(newMails, knownUids)
 	} else if knownFolder != nil && knownFolder.UidValidity != uidValidity {
 		ia.l.WithFields(logrus.Fields{"folder": folder}).Debug("Folder is a known folder and but the uid validity has changed, header-based scan is possible")
-		mailIds, err := ia.imapConnection.FetchIdHeaders(newMails)
+		mailIds, err := ia.imapConnection.FetchIdHeaders(ctx, newMails)
 		if err != nil {
 			return nil, fmt.Errorf("could not list mail headers for folder: %w", err)
 		}
 
+		knownMails, err := ia.findMails(class, folder, mailIds)
+		if err != nil {
+			return nil, fmt.Errorf("could not lookup known mails: %w", err)
+		}
+
+		knownUids := make(map[uint32]bool, len(knownMails))
+		updatedUids := make(map[int64]uint32, len(knownMails))
 		for _, m := range mailIds {
-			knownMail, err := ia.persistence.FindMailByHash(class, folder, m.MailIdHash)
-			if err != nil {
-				return nil, fmt.Errorf("could not lookup mail via mailIdHash: %w", err)
+			knownMail, ok := knownMails[m.Uid]
+			if !ok {
+				continue
 			}
 
-			if knownMail != nil {
-				ia.l.WithFields(logrus.Fields{"folder": folder, "subject": mail.ShortSubject(knownMail.Subject)}).Debug("Is known by hash, updating uid")
-				err = ia.persistence.UpdateUid(knownMail.Id, m.Uid)
-				if err != nil {
-					return nil, fmt.Errorf("could not update uid: %w", err)
-				}
+			ia.l.WithFields(logrus.Fields{"folder": folder, "subject": mail.ShortSubject(knownMail.Subject)}).Debug("Is known by server id or hash, updating uid")
+			updatedUids[knownMail.Id] = m.Uid
+			knownUids[m.Uid] = true
+		}
 
-				newMails = removeUid(newMails, m.Uid)
+		if len(updatedUids) > 0 {
+			err = ia.persistence.UpdateUids(updatedUids)
+			if err != nil {
+				return nil, fmt.Errorf("could not update uids: %w", err)
 			}
 		}
+		newMails = withoutUids(newMails, knownUids)
 	} else {
 		ia.l.WithFields(logrus.Fields{"folder": folder}).Debug("Folder is a previously unknown folder, no diff possible")
 	}
@@ -368,6 +1209,73 @@ func (ia *ImapAssassin) getNewMailUids(folder string, class domain.MailClass, kn
 	return newMails, nil
 }
 
+// findMail looks up a known mail by the permanent id the server assigned to it, which survives UIDVALIDITY changes and
+// moves between folders. Mails without one, recorded before it was stored or copied, e.g. tagged copies, are looked up
+// by mailIdHash.
+func (ia *ImapAssassin) findMail(class domain.MailClass, folder string, serverId string, mailIdHash string) (*domain.SavedImapMail, error) {
+	if serverId != "" {
+		knownMail, err := ia.persistence.FindMailByServerId(class, folder, serverId)
+		if err != nil {
+			return nil, fmt.Errorf("could not lookup mail via serverId: %w", err)
+		}
+		if knownMail != nil {
+			return knownMail, nil
+		}
+	}
+
+	knownMail, err := ia.persistence.FindMailByHash(class, folder, mailIdHash)
+	if err != nil {
+		return nil, fmt.Errorf("could not lookup mail via mailIdHash: %w", err)
+	}
+	return knownMail, nil
+}
+
+// findMails looks up the known mails of mailIds like findMail, in bulk. The result is keyed by the uid in mailIds.
+func (ia *ImapAssassin) findMails(class domain.MailClass, folder string, mailIds []*domain.ImapIdInfo) (map[uint32]*domain.SavedImapMail, error) {
+	knownMails := make(map[uint32]*domain.SavedImapMail, len(mailIds))
+
+	serverIds := []string{}
+	for _, m := range mailIds {
+		if m.ServerId != "" {
+			serverIds = append(serverIds, m.ServerId)
+		}
+	}
+	if len(serverIds) > 0 {
+		byServerId, err := ia.persistence.FindMailsByServerIds(class, folder, serverIds)
+		if err != nil {
+			return nil, fmt.Errorf("could not lookup mails via serverId: %w", err)
+		}
+		for _, m := range mailIds {
+			if knownMail, ok := byServerId[m.ServerId]; ok && m.ServerId != "" {
+				knownMails[m.Uid] = knownMail
+			}
+		}
+	}
+
+	hashes := []string{}
+	for _, m := range mailIds {
+		if _, ok := knownMails[m.Uid]; !ok {
+			hashes = append(hashes, m.MailIdHash)
+		}
+	}
+	if len(hashes) > 0 {
+		byHash, err := ia.persistence.FindMailsByHashes(class, folder, hashes)
+		if err != nil {
+			return nil, fmt.Errorf("could not lookup mails via mailIdHash: %w", err)
+		}
+		for _, m := range mailIds {
+			if _, ok := knownMails[m.Uid]; ok {
+				continue
+			}
+			if knownMail, ok := byHash[m.MailIdHash]; ok {
+				knownMails[m.Uid] = knownMail
+			}
+		}
+	}
+
+	return knownMails, nil
+}
+
 func folderByName(knownFolders []*domain.ImapFolder, folder string) *domain.ImapFolder {
 	for i := 0; i < len(knownFolders); i++ {
 		if knownFolders[i].Name == folder {
@@ -377,15 +1285,15 @@ func folderByName(knownFolders []*domain.ImapFolder, folder string) *domain.Imap
 	return nil
 }
 
-func removeUid(newMails []uint32, uid uint32) []uint32 {
-	for i := 0; i < len(newMails); i++ {
-		if uid == newMails[i] {
-			newMails[len(newMails)-1], newMails[i] = newMails[i], newMails[len(newMails)-1]
-			newMails = newMails[:len(newMails)-1]
-			break
+// withoutUids returns the uids that aren't in known, keeping their order
+func withoutUids(uids []uint32, known map[uint32]bool) []uint32 {
+	remaining := make([]uint32, 0, len(uids))
+	for _, uid := range uids {
+		if !known[uid] {
+			remaining = append(remaining, uid)
 		}
 	}
-	return newMails
+	return remaining
 }
 
 // taken from https://github.com/golang/go/wiki/SliceTricks
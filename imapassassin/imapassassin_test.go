@@ -2,15 +2,23 @@
 package imapassassin
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"testing"
+	"time"
 
 	"github.com/CrawX/go-imap-assassin/domain"
 	"github.com/CrawX/go-imap-assassin/domain/mocks"
 	"github.com/CrawX/go-imap-assassin/log"
+	"github.com/CrawX/go-imap-assassin/mail"
+	"github.com/CrawX/go-imap-assassin/rules"
+	"github.com/emersion/go-imap"
 	"github.com/golang/mock/gomock"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const (
@@ -37,16 +45,20 @@ func setupThreeMails(t *testing.T, cfg *configuration) (*gomock.Controller, *Ima
 		AllFolders().
 		Return(nil, nil)
 
+	classifier.EXPECT().
+		Ping(gomock.Any()).
+		Return(nil)
+
 	imapConnection.EXPECT().
-		Select(gomock.Eq(TEST_FOLDER_1)).
+		Select(gomock.Any(), gomock.Eq(TEST_FOLDER_1)).
 		Return(u32(123), nil)
 
 	imapConnection.EXPECT().
-		ListUids().
+		ListUids(gomock.Any()).
 		Return(u32a(1, 2, 3), nil)
 
 	imapConnection.EXPECT().
-		FetchMails(gomock.Eq(u32a(3, 2, 1))).
+		FetchMails(gomock.Any(), gomock.Eq(u32a(3, 2, 1))).
 		Return([]*domain.RawImapMail{
 			{Uid: 1, RawMail: []byte{1}},
 			{Uid: 2, RawMail: []byte{2}},
@@ -91,14 +103,14 @@ func TestImapAssassin_CheckSpamDryRun(t *testing.T) {
 	defer ctrl.Finish()
 
 	classifier.EXPECT().
-		CheckAll(gomock.Eq([][]byte{{1}, {2}, {3}}), gomock.Eq(6)).
+		CheckAll(gomock.Any(), gomock.Eq([][]byte{{1}, {2}, {3}}), gomock.Eq(6)).
 		Return([]*domain.SpamResult{{IsSpam: true}, {IsSpam: true}, {IsSpam: true}})
 
 	persistence.EXPECT().
 		SaveFolder(TEST_FOLDER_1, u32(123)).
 		Return(nil)
 
-	err := assassin.CheckSpam([]string{TEST_FOLDER_1})
+	err := assassin.CheckSpam(context.Background(), []string{TEST_FOLDER_1})
 	assert.NoError(t, err)
 }
 
@@ -111,15 +123,15 @@ func TestImapAssassin_CheckSpamDelete(t *testing.T) {
 	defer ctrl.Finish()
 
 	classifier.EXPECT().
-		CheckAll(gomock.Eq([][]byte{{1}, {2}, {3}}), gomock.Eq(6)).
+		CheckAll(gomock.Any(), gomock.Eq([][]byte{{1}, {2}, {3}}), gomock.Eq(6)).
 		Return([]*domain.SpamResult{{IsSpam: true, Score: 10}, {IsSpam: false}, {IsSpam: true, Score: 10}})
 
 	imapConnection.EXPECT().
-		DeleteReady().
+		DeleteReady(gomock.Any()).
 		Return(nil, nil)
 
 	imapConnection.EXPECT().
-		Delete(gomock.Eq(u32a(1, 3))).
+		Delete(gomock.Any(), gomock.Eq(u32a(1, 3))).
 		Return(nil)
 
 	persistence.EXPECT().
@@ -128,9 +140,9 @@ func TestImapAssassin_CheckSpamDelete(t *testing.T) {
 			assert.ElementsMatch(t,
 				mails,
 				[]domain.SaveMail{
-					saveMail(domain.Checked, 1, TEST_FOLDER_1, b(true), f(10)),
+					withAction(saveMail(domain.Checked, 1, TEST_FOLDER_1, b(true), f(10)), domain.ActionDeleted, ""),
 					saveMail(domain.Checked, 2, TEST_FOLDER_1, b(false), f(0)),
-					saveMail(domain.Checked, 3, TEST_FOLDER_1, b(true), f(10)),
+					withAction(saveMail(domain.Checked, 3, TEST_FOLDER_1, b(true), f(10)), domain.ActionDeleted, ""),
 				},
 			)
 		})
@@ -139,7 +151,7 @@ func TestImapAssassin_CheckSpamDelete(t *testing.T) {
 		SaveFolder(TEST_FOLDER_1, u32(123)).
 		Return(nil)
 
-	err := assassin.CheckSpam([]string{TEST_FOLDER_1})
+	err := assassin.CheckSpam(context.Background(), []string{TEST_FOLDER_1})
 	assert.NoError(t, err)
 }
 
@@ -153,16 +165,16 @@ func TestImapAssassin_CheckSpamMove(t *testing.T) {
 	defer ctrl.Finish()
 
 	classifier.EXPECT().
-		CheckAll(gomock.Eq([][]byte{{1}, {2}, {3}}), gomock.Eq(6)).
+		CheckAll(gomock.Any(), gomock.Eq([][]byte{{1}, {2}, {3}}), gomock.Eq(6)).
 		Return([]*domain.SpamResult{{IsSpam: true, Score: 10}, {IsSpam: false}, {IsSpam: true, Score: 10}})
 
 	imapConnection.EXPECT().
-		MoveReady().
+		MoveReady(gomock.Any()).
 		Return(nil, nil)
 
 	imapConnection.EXPECT().
-		Move(gomock.Eq(u32a(1, 3)), gomock.Eq("spam")).
-		Return(nil)
+		Move(gomock.Any(), gomock.Eq(u32a(1, 3)), gomock.Eq("spam")).
+		Return(&domain.MovedUids{}, nil)
 
 	persistence.EXPECT().
 		SaveMails(gomock.Any()).
@@ -170,9 +182,53 @@ func TestImapAssassin_CheckSpamMove(t *testing.T) {
 			assert.ElementsMatch(t,
 				mails,
 				[]domain.SaveMail{
-					saveMail(domain.Checked, 1, TEST_FOLDER_1, b(true), f(10)),
+					withAction(saveMail(domain.Checked, 1, TEST_FOLDER_1, b(true), f(10)), domain.ActionMoved, "spam"),
 					saveMail(domain.Checked, 2, TEST_FOLDER_1, b(false), f(0)),
-					saveMail(domain.Checked, 3, TEST_FOLDER_1, b(true), f(10)),
+					withAction(saveMail(domain.Checked, 3, TEST_FOLDER_1, b(true), f(10)), domain.ActionMoved, "spam"),
+				},
+			)
+
+			return nil
+		})
+
+	persistence.EXPECT().
+		SaveFolder(TEST_FOLDER_1, u32(123)).
+		Return(nil)
+
+	err := assassin.CheckSpam(context.Background(), []string{TEST_FOLDER_1})
+	assert.NoError(t, err)
+}
+
+func TestImapAssassin_CheckSpamUnsure(t *testing.T) {
+	ctrl, assassin, persistence, classifier, imapConnection := setupThreeMails(t,
+		&configuration{
+			MoveSpam:   true,
+			SpamFolder: "spam",
+		},
+	)
+	defer ctrl.Finish()
+
+	classifier.EXPECT().
+		CheckAll(gomock.Any(), gomock.Eq([][]byte{{1}, {2}, {3}}), gomock.Eq(6)).
+		Return([]*domain.SpamResult{{IsSpam: true, Score: 10}, {Unsure: true}, {IsSpam: false}})
+
+	imapConnection.EXPECT().
+		MoveReady(gomock.Any()).
+		Return(nil, nil)
+
+	imapConnection.EXPECT().
+		Move(gomock.Any(), gomock.Eq(u32a(1)), gomock.Eq("spam")).
+		Return(&domain.MovedUids{}, nil)
+
+	// mail 2 is left in place and not recorded, so it's checked again on the next run
+	persistence.EXPECT().
+		SaveMails(gomock.Any()).
+		DoAndReturn(func(mails []domain.SaveMail) error {
+			assert.ElementsMatch(t,
+				mails,
+				[]domain.SaveMail{
+					withAction(saveMail(domain.Checked, 1, TEST_FOLDER_1, b(true), f(10)), domain.ActionMoved, "spam"),
+					saveMail(domain.Checked, 3, TEST_FOLDER_1, b(false), f(0)),
 				},
 			)
 
@@ -183,7 +239,7 @@ func TestImapAssassin_CheckSpamMove(t *testing.T) {
 		SaveFolder(TEST_FOLDER_1, u32(123)).
 		Return(nil)
 
-	err := assassin.CheckSpam([]string{TEST_FOLDER_1})
+	err := assassin.CheckSpam(context.Background(), []string{TEST_FOLDER_1})
 	assert.NoError(t, err)
 }
 
@@ -197,16 +253,16 @@ func TestImapAssassin_CheckSpamReport(t *testing.T) {
 	defer ctrl.Finish()
 
 	classifier.EXPECT().
-		CheckAll(gomock.Eq([][]byte{{1}, {2}, {3}}), gomock.Eq(6)).
+		CheckAll(gomock.Any(), gomock.Eq([][]byte{{1}, {2}, {3}}), gomock.Eq(6)).
 		Return([]*domain.SpamResult{{IsSpam: true, Score: 10, Body: []byte{0xa}}, {IsSpam: false}, {IsSpam: true, Score: 10, Body: []byte{0xc}}})
 
 	imapConnection.EXPECT().
-		Put(gomock.Eq([]byte{0xa}), gomock.Eq("reports")).
-		Return(nil)
+		Put(gomock.Any(), gomock.Eq([]byte{0xa}), gomock.Eq("reports")).
+		Return(u32(0), nil)
 
 	imapConnection.EXPECT().
-		Put(gomock.Eq([]byte{0xc}), gomock.Eq("reports")).
-		Return(nil)
+		Put(gomock.Any(), gomock.Eq([]byte{0xc}), gomock.Eq("reports")).
+		Return(u32(0), nil)
 
 	persistence.EXPECT().
 		SaveMails(gomock.Any()).
@@ -227,10 +283,427 @@ func TestImapAssassin_CheckSpamReport(t *testing.T) {
 		SaveFolder(TEST_FOLDER_1, u32(123)).
 		Return(nil)
 
-	err := assassin.CheckSpam([]string{TEST_FOLDER_1})
+	err := assassin.CheckSpam(context.Background(), []string{TEST_FOLDER_1})
+	assert.NoError(t, err)
+}
+
+func TestImapAssassin_CheckSpamTag(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	persistence := mocks.NewMockPersistence(ctrl)
+	classifier := mocks.NewMockConcurrentSpamClassifier(ctrl)
+	imapConnection := mocks.NewMockImapConnector(ctrl)
+	assassin := &ImapAssassin{
+		persistence:    persistence,
+		imapConnection: imapConnection,
+		spamClassifier: classifier,
+		configuration:  &configuration{TagSpam: true, SpamSubjectPrefix: "[SPAM]"},
+		l:              nullLogger(),
+	}
+
+	date := time.Date(2020, 10, 7, 1, 30, 45, 0, time.UTC)
+	mails := []*domain.RawImapMail{
+		{Uid: 1, Subject: "Cheap pills", MailIdHash: "h1", RawMail: []byte("Subject: Cheap pills\r\n\r\n1"), Flags: []string{imap.SeenFlag}, InternalDate: date},
+		{Uid: 2, Subject: "[SPAM] Tagged", MailIdHash: "h2", RawMail: []byte("X-Spam-Flag: YES\r\nSubject: [SPAM] Tagged\r\n\r\n2")},
+		{Uid: 3, Subject: "Hello", MailIdHash: "h3", RawMail: []byte("Subject: Hello\r\n\r\n3")},
+		{Uid: 4, Subject: "Lottery", MailIdHash: "h4", RawMail: []byte("Subject: Lottery\r\n\r\n4"), InternalDate: date},
+	}
+
+	persistence.EXPECT().AllFolders().Return(nil, nil)
+	classifier.EXPECT().Ping(gomock.Any()).Return(nil)
+	imapConnection.EXPECT().Select(gomock.Any(), TEST_FOLDER_1).Return(u32(123), nil)
+	imapConnection.EXPECT().DeleteReady(gomock.Any()).Return(nil, nil)
+	imapConnection.EXPECT().ListUids(gomock.Any()).Return(u32a(1, 2, 3, 4), nil)
+	imapConnection.EXPECT().FetchMails(gomock.Any(), u32a(4, 3, 2, 1)).Return(mails, nil)
+
+	// mail 2 is the tagged copy of a spam mail replaced in the last run
+	persistence.EXPECT().FindMailByHash(domain.Checked, TEST_FOLDER_1, "h2").Return(&domain.SavedImapMail{Id: 42, Uid: 17, IsSpam: true}, nil)
+	persistence.EXPECT().UpdateUid(int64(42), u32(2)).Return(nil)
+	persistence.EXPECT().FindMailByHash(domain.Checked, TEST_FOLDER_1, gomock.Any()).Return(nil, nil).Times(3)
+
+	classifier.EXPECT().
+		CheckAll(gomock.Any(), [][]byte{mails[0].RawMail, mails[2].RawMail, mails[3].RawMail}, 6).
+		Return([]*domain.SpamResult{
+			{IsSpam: true, Score: 7.5, Symbols: map[string]float64{"BAYES_SPAM": 5, "R_SPF_FAIL": 2.5}},
+			{IsSpam: false},
+			{IsSpam: true, Score: 12, Subject: "*** SPAM *** Lottery"},
+		})
+
+	imapConnection.EXPECT().
+		Append(gomock.Any(), []byte("X-Spam-Flag: YES\r\nX-Spam-Score: 7.50\r\nX-Spam-Status: Yes, score=7.50 tests=BAYES_SPAM,R_SPF_FAIL\r\nSubject: [SPAM] Cheap pills\r\n\r\n1"), TEST_FOLDER_1, []string{imap.SeenFlag}, date).
+		Return(u32(0), nil)
+	imapConnection.EXPECT().
+		Append(gomock.Any(), []byte("X-Spam-Flag: YES\r\nX-Spam-Score: 12.00\r\nX-Spam-Status: Yes, score=12.00\r\nSubject: *** SPAM *** Lottery\r\n\r\n4"), TEST_FOLDER_1, nil, date).
+		Return(u32(0), nil)
+	imapConnection.EXPECT().
+		Delete(gomock.Any(), u32a(1, 4)).
+		Return(nil)
+
+	persistence.EXPECT().
+		SaveMails(gomock.Any()).
+		Do(func(mails []domain.SaveMail) {
+			assert.Len(t, mails, 3)
+		})
+	persistence.EXPECT().
+		SaveFolder(TEST_FOLDER_1, u32(123)).
+		Return(nil)
+
+	err := assassin.CheckSpam(context.Background(), []string{TEST_FOLDER_1})
 	assert.NoError(t, err)
 }
 
+func TestImapAssassin_CheckSpamRules(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	r, err := rules.NewRules(
+		rules.Lists{Senders: []string{"alice@example.com"}},
+		rules.Lists{Domains: []string{"spam.example"}},
+	)
+	assert.NoError(t, err)
+
+	persistence := mocks.NewMockPersistence(ctrl)
+	classifier := mocks.NewMockConcurrentSpamClassifier(ctrl)
+	imapConnection := mocks.NewMockImapConnector(ctrl)
+	assassin := &ImapAssassin{
+		persistence:    persistence,
+		imapConnection: imapConnection,
+		spamClassifier: classifier,
+		configuration:  &configuration{DeleteSpam: true, Rules: r},
+		l:              nullLogger(),
+	}
+
+	mails := []*domain.RawImapMail{
+		{Uid: 1, Subject: "Lunch", MailIdHash: "h1", RawMail: []byte("From: alice@example.com\r\nSubject: Lunch\r\n\r\n1")},
+		{Uid: 2, Subject: "Offer", MailIdHash: "h2", RawMail: []byte("From: offers@mail.spam.example\r\nSubject: Offer\r\n\r\n2")},
+		{Uid: 3, Subject: "Hello", MailIdHash: "h3", RawMail: []byte("From: bob@example.org\r\nSubject: Hello\r\n\r\n3")},
+		// the header can't be parsed, FetchMails passes the mail without subject and no rule matches, so the classifier
+		// decides it
+		{Uid: 4, MailIdHash: "h4", HashStrategy: string(mail.HashBody), RawMail: []byte("From alice@example.com\r\nSubject: Broken\r\n\r\n4")},
+	}
+
+	persistence.EXPECT().AllFolders().Return(nil, nil)
+	classifier.EXPECT().Ping(gomock.Any()).Return(nil)
+	imapConnection.EXPECT().Select(gomock.Any(), TEST_FOLDER_1).Return(u32(123), nil)
+	imapConnection.EXPECT().DeleteReady(gomock.Any()).Return(nil, nil)
+	imapConnection.EXPECT().ListUids(gomock.Any()).Return(u32a(1, 2, 3, 4), nil)
+	imapConnection.EXPECT().FetchMails(gomock.Any(), u32a(4, 3, 2, 1)).Return(mails, nil)
+
+	// only the mails without matching rule are classified
+	classifier.EXPECT().
+		CheckAll(gomock.Any(), [][]byte{mails[2].RawMail, mails[3].RawMail}, 6).
+		Return([]*domain.SpamResult{{IsSpam: true, Score: 8}, {IsSpam: false}})
+
+	imapConnection.EXPECT().
+		Delete(gomock.Any(), u32a(2, 3)).
+		Return(nil)
+
+	persistence.EXPECT().
+		SaveMails(gomock.Any()).
+		Do(func(saved []domain.SaveMail) {
+			assert.Len(t, saved, 4)
+			assert.Equal(t, "allow sender alice@example.com", saved[0].Rule)
+			assert.False(t, *saved[0].IsSpam)
+			assert.Equal(t, "block domain spam.example", saved[1].Rule)
+			assert.True(t, *saved[1].IsSpam)
+			assert.Equal(t, "", saved[2].Rule)
+			assert.True(t, *saved[2].IsSpam)
+			assert.Equal(t, "", saved[3].Rule)
+			assert.False(t, *saved[3].IsSpam)
+		})
+	persistence.EXPECT().
+		SaveFolder(TEST_FOLDER_1, u32(123)).
+		Return(nil)
+
+	err = assassin.CheckSpam(context.Background(), []string{TEST_FOLDER_1})
+	assert.NoError(t, err)
+}
+
+func TestImapAssassin_CheckSpamCorrespondents(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      *configuration
+		classify [][]byte
+		results  []*domain.SpamResult
+		saved    []domain.SaveMail
+	}{
+		{
+			"allow",
+			&configuration{AllowCorrespondents: true},
+			[][]byte{[]byte("From: eve@example.com\r\n\r\n2")},
+			[]*domain.SpamResult{{IsSpam: true, Score: 9}},
+			[]domain.SaveMail{
+				{Class: domain.Checked, Uid: 1, FolderName: TEST_FOLDER_1, IsSpam: b(false), Score: f(0), Rule: "allow correspondent bob@example.com", MailMetadata: domain.MailMetadata{Action: domain.ActionNone}},
+				{Class: domain.Checked, Uid: 2, FolderName: TEST_FOLDER_1, IsSpam: b(true), Score: f(9), MailMetadata: domain.MailMetadata{Action: domain.ActionNone}},
+			},
+		},
+		{
+			"offset",
+			&configuration{OffsetCorrespondents: true, CorrespondentScoreOffset: 5, CorrespondentRequiredScore: 5},
+			[][]byte{[]byte("From: Bob <bob@example.com>\r\n\r\n1"), []byte("From: eve@example.com\r\n\r\n2")},
+			[]*domain.SpamResult{{IsSpam: true, Score: 9}, {IsSpam: true, Score: 9}},
+			[]domain.SaveMail{
+				{Class: domain.Checked, Uid: 1, FolderName: TEST_FOLDER_1, IsSpam: b(false), Score: f(4), MailMetadata: domain.MailMetadata{Action: domain.ActionNone}},
+				{Class: domain.Checked, Uid: 2, FolderName: TEST_FOLDER_1, IsSpam: b(true), Score: f(9), MailMetadata: domain.MailMetadata{Action: domain.ActionNone}},
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			persistence := mocks.NewMockPersistence(ctrl)
+			classifier := mocks.NewMockConcurrentSpamClassifier(ctrl)
+			imapConnection := mocks.NewMockImapConnector(ctrl)
+			assassin := &ImapAssassin{
+				persistence:    persistence,
+				imapConnection: imapConnection,
+				spamClassifier: classifier,
+				configuration:  tc.cfg,
+				l:              nullLogger(),
+			}
+
+			persistence.EXPECT().AllFolders().Return(nil, nil)
+			classifier.EXPECT().Ping(gomock.Any()).Return(nil)
+			imapConnection.EXPECT().Select(gomock.Any(), TEST_FOLDER_1).Return(u32(123), nil)
+			imapConnection.EXPECT().ListUids(gomock.Any()).Return(u32a(1, 2), nil)
+			imapConnection.EXPECT().FetchMails(gomock.Any(), u32a(2, 1)).Return([]*domain.RawImapMail{
+				{Uid: 1, RawMail: []byte("From: Bob <bob@example.com>\r\n\r\n1")},
+				{Uid: 2, RawMail: []byte("From: eve@example.com\r\n\r\n2")},
+			}, nil)
+
+			persistence.EXPECT().IsCorrespondent("bob@example.com").Return(true, nil).AnyTimes()
+			persistence.EXPECT().IsCorrespondent("eve@example.com").Return(false, nil).AnyTimes()
+
+			classifier.EXPECT().
+				CheckAll(gomock.Any(), tc.classify, 6).
+				Return(tc.results)
+
+			persistence.EXPECT().
+				SaveMails(tc.saved).
+				Return(nil)
+			persistence.EXPECT().
+				SaveFolder(TEST_FOLDER_1, u32(123)).
+				Return(nil)
+
+			err := assassin.CheckSpam(context.Background(), []string{TEST_FOLDER_1})
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestImapAssassin_correspondentUnreadableSender(t *testing.T) {
+	// no persistence, an unreadable sender isn't looked up
+	assassin := &ImapAssassin{configuration: &configuration{AllowCorrespondents: true}, l: nullLogger()}
+
+	correspondent, err := assassin.correspondent(&domain.RawImapMail{Uid: 1, RawMail: []byte("From alice@example.com\r\n\r\n1")})
+	assert.NoError(t, err)
+	assert.Equal(t, "", correspondent)
+}
+
+func TestImapAssassin_CheckSpamRescued(t *testing.T) {
+	ctrl, assassin, persistence, classifier, imapConnection := setupThreeMails(t,
+		&configuration{
+			MoveSpam:     true,
+			SpamFolder:   "spam",
+			LearnRescued: true,
+		},
+	)
+	defer ctrl.Finish()
+
+	imapConnection.EXPECT().
+		MoveReady(gomock.Any()).
+		Return(nil, nil)
+
+	// mail 2 was moved to the spam folder in an earlier run and moved back by the user
+	persistence.EXPECT().
+		FindMailByHash(domain.Checked, TEST_FOLDER_1, gomock.Any()).
+		Return(nil, nil)
+	persistence.EXPECT().
+		FindMailByHash(domain.Checked, TEST_FOLDER_1, gomock.Any()).
+		Return(&domain.SavedImapMail{Id: 42, Uid: 17, IsSpam: true, Score: 6}, nil)
+	persistence.EXPECT().
+		FindMailByHash(domain.Checked, TEST_FOLDER_1, gomock.Any()).
+		Return(nil, nil)
+
+	classifier.EXPECT().
+		LearnAll(gomock.Any(), domain.LearnHam, [][]byte{{2}}, 8).
+		Return([]error{nil})
+	persistence.EXPECT().
+		CorrectMail(int64(42), u32(2)).
+		Return(nil)
+
+	classifier.EXPECT().
+		CheckAll(gomock.Any(), [][]byte{{1}, {3}}, 6).
+		Return([]*domain.SpamResult{{IsSpam: true, Score: 8}, {IsSpam: false}})
+
+	imapConnection.EXPECT().
+		Move(gomock.Any(), u32a(1), "spam").
+		Return(&domain.MovedUids{}, nil)
+
+	persistence.EXPECT().
+		SaveMails([]domain.SaveMail{
+			withAction(saveMail(domain.Checked, 1, TEST_FOLDER_1, b(true), f(8)), domain.ActionMoved, "spam"),
+			saveMail(domain.Checked, 3, TEST_FOLDER_1, b(false), f(0)),
+		}).
+		Return(nil)
+	persistence.EXPECT().
+		SaveFolder(TEST_FOLDER_1, u32(123)).
+		Return(nil)
+
+	err := assassin.CheckSpam(context.Background(), []string{TEST_FOLDER_1})
+	assert.NoError(t, err)
+}
+
+func TestImapAssassin_CheckSpamRescuedInterrupted(t *testing.T) {
+	ctrl, assassin, persistence, classifier, imapConnection := setupThreeMails(t,
+		&configuration{
+			MoveSpam:     true,
+			SpamFolder:   "spam",
+			LearnRescued: true,
+		},
+	)
+	defer ctrl.Finish()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	imapConnection.EXPECT().
+		MoveReady(gomock.Any()).
+		Return(nil, nil)
+
+	persistence.EXPECT().
+		FindMailByHash(domain.Checked, TEST_FOLDER_1, gomock.Any()).
+		Return(&domain.SavedImapMail{Id: 41, Uid: 16, IsSpam: true, Score: 6}, nil)
+	persistence.EXPECT().
+		FindMailByHash(domain.Checked, TEST_FOLDER_1, gomock.Any()).
+		Return(&domain.SavedImapMail{Id: 42, Uid: 17, IsSpam: true, Score: 6}, nil)
+	persistence.EXPECT().
+		FindMailByHash(domain.Checked, TEST_FOLDER_1, gomock.Any()).
+		Return(nil, nil)
+
+	// mail 2 wasn't learned before the interruption, mail 1 is recorded so it isn't learned again
+	classifier.EXPECT().
+		LearnAll(gomock.Any(), domain.LearnHam, [][]byte{{1}, {2}}, 8).
+		DoAndReturn(func(_ context.Context, _ domain.LearnType, _ [][]byte, _ int) []error {
+			cancel()
+			return []error{nil, context.Canceled}
+		})
+	persistence.EXPECT().
+		CorrectMail(int64(41), u32(1)).
+		Return(nil)
+
+	persistence.EXPECT().
+		SaveFolder(TEST_FOLDER_1, u32(123)).
+		Return(nil)
+
+	err := assassin.CheckSpam(ctx, []string{TEST_FOLDER_1, TEST_FOLDER_2})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestImapAssassin_CheckSpamInterrupted(t *testing.T) {
+	ctrl, assassin, persistence, classifier, imapConnection := setupThreeMails(t,
+		&configuration{
+			DeleteSpam: true,
+		},
+	)
+	defer ctrl.Finish()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	imapConnection.EXPECT().
+		DeleteReady(gomock.Any()).
+		Return(nil, nil)
+
+	// mail 3 wasn't checked before the interruption, nothing of the batch is deleted or saved
+	classifier.EXPECT().
+		CheckAll(gomock.Any(), gomock.Eq([][]byte{{1}, {2}, {3}}), gomock.Eq(6)).
+		DoAndReturn(func(_ context.Context, _ [][]byte, _ int) []*domain.SpamResult {
+			cancel()
+			return []*domain.SpamResult{{IsSpam: true}, {IsSpam: false}, {Error: context.Canceled}}
+		})
+
+	persistence.EXPECT().
+		SaveFolder(TEST_FOLDER_1, u32(123)).
+		Return(nil)
+
+	err := assassin.CheckSpam(ctx, []string{TEST_FOLDER_1, TEST_FOLDER_2})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestImapAssassin_CheckSpamInterruptedFinishesBatch(t *testing.T) {
+	ctrl, assassin, persistence, classifier, imapConnection := setupThreeMails(t,
+		&configuration{
+			DeleteSpam: true,
+		},
+	)
+	defer ctrl.Finish()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	imapConnection.EXPECT().
+		DeleteReady(gomock.Any()).
+		Return(nil, nil)
+
+	// all mails were checked before the interruption, the batch is finished
+	classifier.EXPECT().
+		CheckAll(gomock.Any(), gomock.Eq([][]byte{{1}, {2}, {3}}), gomock.Eq(6)).
+		DoAndReturn(func(_ context.Context, _ [][]byte, _ int) []*domain.SpamResult {
+			cancel()
+			return []*domain.SpamResult{{IsSpam: true, Score: 10}, {IsSpam: false}, {IsSpam: false}}
+		})
+
+	imapConnection.EXPECT().
+		Delete(gomock.Any(), gomock.Eq(u32a(1))).
+		DoAndReturn(func(ctx context.Context, _ []uint32) error {
+			assert.NoError(t, ctx.Err(), "the batch should be finished with a context that isn't cancelled")
+			return nil
+		})
+
+	persistence.EXPECT().
+		SaveMails(gomock.Any()).
+		DoAndReturn(func(mails []domain.SaveMail) error {
+			assert.Len(t, mails, 3)
+			return nil
+		})
+
+	persistence.EXPECT().
+		SaveFolder(TEST_FOLDER_1, u32(123)).
+		Return(nil)
+
+	err := assassin.CheckSpam(ctx, []string{TEST_FOLDER_1, TEST_FOLDER_2})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestImapAssassin_CheckSpamClassifierUnreachable(t *testing.T) {
+	ctrl, assassin, persistence, classifier, imapConnection := setupThreeMails(t, &configuration{})
+	defer ctrl.Finish()
+
+	classifier.EXPECT().
+		CheckAll(gomock.Any(), gomock.Eq([][]byte{{1}, {2}, {3}}), gomock.Eq(6)).
+		Return([]*domain.SpamResult{{IsSpam: false}, {IsSpam: false}, {IsSpam: false}})
+
+	persistence.EXPECT().
+		SaveMails(gomock.Any()).
+		Return(nil)
+
+	persistence.EXPECT().
+		SaveFolder(TEST_FOLDER_1, u32(123)).
+		Return(nil)
+
+	// the classifier goes down after the first folder, the second folder isn't selected
+	classifier.EXPECT().
+		Ping(gomock.Any()).
+		Return(errors.New("connection refused"))
+	imapConnection.EXPECT().
+		Select(gomock.Any(), gomock.Eq(TEST_FOLDER_2)).
+		Times(0)
+
+	err := assassin.CheckSpam(context.Background(), []string{TEST_FOLDER_1, TEST_FOLDER_2})
+	assert.EqualError(t, err, "classifier not reachable before folder "+TEST_FOLDER_2+": connection refused")
+}
+
 func TestImapAssassin_LearnDryRun(t *testing.T) {
 	for _, learnType := range []domain.LearnType{domain.LearnHam, domain.LearnSpam} {
 		t.Run(string(learnType), func(t *testing.T) {
@@ -242,14 +715,14 @@ func TestImapAssassin_LearnDryRun(t *testing.T) {
 			defer ctrl.Finish()
 
 			classifier.EXPECT().
-				LearnAll(learnType, gomock.Eq([][]byte{{1}, {2}, {3}}), gomock.Eq(8)).
+				LearnAll(gomock.Any(), learnType, gomock.Eq([][]byte{{1}, {2}, {3}}), gomock.Eq(8)).
 				Return([]error{nil, nil, nil})
 
 			persistence.EXPECT().
 				SaveFolder(TEST_FOLDER_1, u32(123)).
 				Return(nil)
 
-			err := assassin.Learn(learnType, []string{TEST_FOLDER_1})
+			err := assassin.Learn(context.Background(), learnType, []string{TEST_FOLDER_1})
 			assert.NoError(t, err)
 		})
 	}
@@ -273,7 +746,7 @@ func TestImapAssassin_LearnNoDelete(t *testing.T) {
 			defer ctrl.Finish()
 
 			classifier.EXPECT().
-				LearnAll(tc.learnType, gomock.Eq([][]byte{{1}, {2}, {3}}), gomock.Eq(8)).
+				LearnAll(gomock.Any(), tc.learnType, gomock.Eq([][]byte{{1}, {2}, {3}}), gomock.Eq(8)).
 				Return([]error{nil, nil, nil})
 
 			persistence.EXPECT().
@@ -295,12 +768,76 @@ func TestImapAssassin_LearnNoDelete(t *testing.T) {
 				SaveFolder(TEST_FOLDER_1, u32(123)).
 				Return(nil)
 
-			err := assassin.Learn(tc.learnType, []string{TEST_FOLDER_1})
+			err := assassin.Learn(context.Background(), tc.learnType, []string{TEST_FOLDER_1})
 			assert.NoError(t, err)
 		})
 	}
 }
 
+func TestImapAssassin_LearnForwarded(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	persistence := mocks.NewMockPersistence(ctrl)
+	classifier := mocks.NewMockConcurrentSpamClassifier(ctrl)
+	imapConnection := mocks.NewMockImapConnector(ctrl)
+	assassin := &ImapAssassin{
+		persistence:    persistence,
+		imapConnection: imapConnection,
+		spamClassifier: classifier,
+		configuration:  &configuration{ClassifierName: "bayes"},
+		l:              nullLogger(),
+	}
+
+	spam1 := "Message-Id: <1@spam.example>\r\nSubject: Cheap pills\r\n\r\nBuy now\r\n"
+	spam2 := "Subject: Lottery\r\n\r\nYou won\r\n"
+	forwarded := "Message-Id: <fwd@example.com>\r\nSubject: Fwd: spam\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: message/rfc822\r\n\r\n" + spam1 + "\r\n" +
+		"--b\r\nContent-Type: message/rfc822\r\n\r\n" + spam2 + "\r\n" +
+		"--b--\r\n"
+
+	date := time.Date(2020, 10, 7, 1, 30, 45, 0, time.UTC)
+	// forwarded originals are recorded with their own headers and size, but the internal date of the forward
+	metadata := func(sender string, size int) domain.MailMetadata {
+		return domain.MailMetadata{Sender: sender, InternalDate: date, Size: size, Classifier: "bayes", Action: domain.ActionNone}
+	}
+
+	persistence.EXPECT().AllFolders().Return(nil, nil)
+	classifier.EXPECT().Ping(gomock.Any()).Return(nil)
+	imapConnection.EXPECT().Select(gomock.Any(), TEST_FOLDER_1).Return(u32(123), nil)
+	imapConnection.EXPECT().ListUids(gomock.Any()).Return(u32a(1, 2), nil)
+	imapConnection.EXPECT().FetchMails(gomock.Any(), u32a(2, 1)).Return([]*domain.RawImapMail{
+		{Uid: 1, Subject: "Fwd: spam", MailIdHash: "fwd", RawMail: []byte(forwarded), Sender: "me@example.com", InternalDate: date, Size: len(forwarded)},
+		{Uid: 2, Subject: "Direct", MailIdHash: "h2", RawMail: []byte("Subject: Direct\r\n\r\n2"), Sender: "eve@example.com", InternalDate: date, Size: 20},
+	}, nil)
+
+	classifier.EXPECT().
+		LearnAll(gomock.Any(), domain.LearnSpam, [][]byte{[]byte(spam1), []byte(spam2), []byte("Subject: Direct\r\n\r\n2")}, 8).
+		Return([]error{nil, nil, nil})
+
+	_, spam1Hash, _, err := mail.MailHeaderInfos([]byte(spam1))
+	assert.NoError(t, err)
+	// spam2 has neither Message-Id nor Received, Date or From and is identified by its body
+	_, spam2Hash, spam2Strategy, err := mail.MailHeaderInfos([]byte(spam2))
+	assert.NoError(t, err)
+	assert.Equal(t, mail.HashBody, spam2Strategy)
+	persistence.EXPECT().
+		SaveMails([]domain.SaveMail{
+			{Class: domain.LearnedSpam, Uid: 1, MailIdHash: spam1Hash, HashStrategy: string(mail.HashMessageId), FolderName: TEST_FOLDER_1, Subject: "Cheap pills", MailMetadata: metadata("", len(spam1))},
+			{Class: domain.LearnedSpam, Uid: 1, MailIdHash: spam2Hash, HashStrategy: string(mail.HashBody), FolderName: TEST_FOLDER_1, Subject: "Lottery", MailMetadata: metadata("", len(spam2))},
+			{Class: domain.LearnedSpam, Uid: 2, MailIdHash: "h2", FolderName: TEST_FOLDER_1, Subject: "Direct", MailMetadata: metadata("eve@example.com", 20)},
+			// the forward itself is recorded but not learned
+			{Class: domain.LearnedSpam, Uid: 1, MailIdHash: "fwd", FolderName: TEST_FOLDER_1, Subject: "Fwd: spam", MailMetadata: metadata("me@example.com", len(forwarded))},
+		}).
+		Return(nil)
+	persistence.EXPECT().
+		SaveFolder(TEST_FOLDER_1, u32(123)).
+		Return(nil)
+
+	err = assassin.Learn(context.Background(), domain.LearnSpam, []string{TEST_FOLDER_1})
+	assert.NoError(t, err)
+}
+
 func TestImapAssassin_LearnDelete(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -321,15 +858,15 @@ func TestImapAssassin_LearnDelete(t *testing.T) {
 			defer ctrl.Finish()
 
 			imapConnection.EXPECT().
-				DeleteReady().
+				DeleteReady(gomock.Any()).
 				Return(nil, nil)
 
 			classifier.EXPECT().
-				LearnAll(tc.learnType, gomock.Eq([][]byte{{1}, {2}, {3}}), gomock.Eq(8)).
+				LearnAll(gomock.Any(), tc.learnType, gomock.Eq([][]byte{{1}, {2}, {3}}), gomock.Eq(8)).
 				Return([]error{nil, nil, nil})
 
 			imapConnection.EXPECT().
-				Delete(u32a(3, 2, 1)).
+				Delete(gomock.Any(), u32a(3, 2, 1)).
 				Return(nil)
 
 			persistence.EXPECT().
@@ -338,9 +875,9 @@ func TestImapAssassin_LearnDelete(t *testing.T) {
 					assert.ElementsMatch(t,
 						mails,
 						[]domain.SaveMail{
-							saveMail(tc.mailclass, 1, TEST_FOLDER_1, nil, nil),
-							saveMail(tc.mailclass, 2, TEST_FOLDER_1, nil, nil),
-							saveMail(tc.mailclass, 3, TEST_FOLDER_1, nil, nil),
+							withAction(saveMail(tc.mailclass, 1, TEST_FOLDER_1, nil, nil), domain.ActionDeleted, ""),
+							withAction(saveMail(tc.mailclass, 2, TEST_FOLDER_1, nil, nil), domain.ActionDeleted, ""),
+							withAction(saveMail(tc.mailclass, 3, TEST_FOLDER_1, nil, nil), domain.ActionDeleted, ""),
 						},
 					)
 
@@ -351,12 +888,166 @@ func TestImapAssassin_LearnDelete(t *testing.T) {
 				SaveFolder(TEST_FOLDER_1, u32(123)).
 				Return(nil)
 
-			err := assassin.Learn(tc.learnType, []string{TEST_FOLDER_1})
+			err := assassin.Learn(context.Background(), tc.learnType, []string{TEST_FOLDER_1})
 			assert.NoError(t, err)
 		})
 	}
 }
 
+func TestImapAssassin_LearnInterrupted(t *testing.T) {
+	ctrl, assassin, persistence, classifier, imapConnection := setupThreeMails(t,
+		&configuration{
+			DeleteLearned: true,
+		},
+	)
+	defer ctrl.Finish()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	imapConnection.EXPECT().
+		DeleteReady(gomock.Any()).
+		Return(nil, nil)
+
+	// mail 2 wasn't learned before the interruption, the learned mails are still deleted and recorded
+	classifier.EXPECT().
+		LearnAll(gomock.Any(), domain.LearnSpam, gomock.Eq([][]byte{{1}, {2}, {3}}), gomock.Eq(8)).
+		DoAndReturn(func(_ context.Context, _ domain.LearnType, _ [][]byte, _ int) []error {
+			cancel()
+			return []error{nil, context.Canceled, nil}
+		})
+
+	imapConnection.EXPECT().
+		Delete(gomock.Any(), u32a(1, 3)).
+		DoAndReturn(func(ctx context.Context, _ []uint32) error {
+			assert.NoError(t, ctx.Err(), "the learned mails should be deleted with a context that isn't cancelled")
+			return nil
+		})
+
+	persistence.EXPECT().
+		SaveMails([]domain.SaveMail{
+			withAction(saveMail(domain.LearnedSpam, 1, TEST_FOLDER_1, nil, nil), domain.ActionDeleted, ""),
+			withAction(saveMail(domain.LearnedSpam, 3, TEST_FOLDER_1, nil, nil), domain.ActionDeleted, ""),
+		}).
+		Return(nil)
+
+	persistence.EXPECT().
+		SaveFolder(TEST_FOLDER_1, u32(123)).
+		Return(nil)
+
+	err := assassin.Learn(ctx, domain.LearnSpam, []string{TEST_FOLDER_1, TEST_FOLDER_2})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestImapAssassin_ConfirmSpam(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	persistence := mocks.NewMockPersistence(ctrl)
+	classifier := mocks.NewMockConcurrentSpamClassifier(ctrl)
+	imapConnection := mocks.NewMockImapConnector(ctrl)
+	assassin := &ImapAssassin{
+		persistence:    persistence,
+		imapConnection: imapConnection,
+		spamClassifier: classifier,
+		configuration: &configuration{MoveSpam: true, SpamFolder: "spam", ConfirmSpam: true, SpamGracePeriod: 7 * 24 * time.Hour, ExpungeConfirmedSpam: true,
+			ClassifierName: "rspamd", ClassifierVersion: "2.6"},
+		l: nullLogger(),
+	}
+
+	old := time.Now().Add(-8 * 24 * time.Hour)
+	recent := time.Now().Add(-24 * time.Hour)
+
+	persistence.EXPECT().AllFolders().Return(nil, nil)
+	classifier.EXPECT().Ping(gomock.Any()).Return(nil)
+	imapConnection.EXPECT().Select(gomock.Any(), "spam").Return(u32(123), nil)
+	imapConnection.EXPECT().ListUids(gomock.Any()).Return(u32a(1, 2, 3, 4), nil)
+	imapConnection.EXPECT().DeleteReady(gomock.Any()).Return(nil, nil)
+	imapConnection.EXPECT().FetchIdHeaders(gomock.Any(), u32a(4, 3, 2, 1)).Return([]*domain.ImapIdInfo{
+		{Uid: 4, MailIdHash: "h4"},
+		{Uid: 3, MailIdHash: "h3"},
+		{Uid: 2, MailIdHash: "h2"},
+		{Uid: 1, MailIdHash: "h1"},
+	}, nil)
+
+	// mail 4 was moved into the spam folder by the user, mail 3 was rescued and came back later
+	persistence.EXPECT().FindMailByHash(domain.Checked, gomock.Any(), "h4").Return(nil, nil).Times(2)
+	persistence.EXPECT().FindMailByHash(domain.Checked, TEST_FOLDER_1, "h3").Return(&domain.SavedImapMail{IsSpam: false}, nil)
+	persistence.EXPECT().FindMailByHash(domain.Checked, TEST_FOLDER_2, "h3").Return(nil, nil)
+	persistence.EXPECT().FindMailByHash(domain.Checked, TEST_FOLDER_1, "h2").Return(&domain.SavedImapMail{IsSpam: true}, nil)
+	persistence.EXPECT().FindMailByHash(domain.Checked, TEST_FOLDER_1, "h1").Return(nil, nil)
+	persistence.EXPECT().FindMailByHash(domain.Checked, TEST_FOLDER_2, "h1").Return(&domain.SavedImapMail{IsSpam: true}, nil)
+
+	// mail 2 is still within the grace period and isn't fetched
+	imapConnection.EXPECT().FetchInternalDates(gomock.Any(), u32a(2, 1)).Return(map[uint32]time.Time{
+		2: recent,
+		1: old,
+	}, nil)
+	imapConnection.EXPECT().FetchMails(gomock.Any(), u32a(1)).Return([]*domain.RawImapMail{
+		{Uid: 1, MailIdHash: "h1", RawMail: []byte{1}, InternalDate: old, Sender: "eve@example.com", Size: 1},
+	}, nil)
+
+	classifier.EXPECT().
+		LearnAll(gomock.Any(), domain.LearnSpam, [][]byte{{1}}, 8).
+		Return([]error{nil})
+	imapConnection.EXPECT().
+		Delete(gomock.Any(), u32a(1)).
+		Return(nil)
+	persistence.EXPECT().
+		SaveMails([]domain.SaveMail{{
+			Class: domain.LearnedSpam, Uid: 1, MailIdHash: "h1", FolderName: "spam",
+			MailMetadata: domain.MailMetadata{
+				Sender: "eve@example.com", InternalDate: old, Size: 1,
+				Classifier: "rspamd", ClassifierVersion: "2.6", Action: domain.ActionDeleted,
+			},
+		}}).
+		Return(nil)
+	persistence.EXPECT().
+		SaveFolder("spam", u32(123)).
+		Return(nil)
+
+	err := assassin.ConfirmSpam(context.Background(), []string{TEST_FOLDER_1, TEST_FOLDER_2})
+	assert.NoError(t, err)
+}
+
+func TestImapAssassin_CollectCorrespondents(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	persistence := mocks.NewMockPersistence(ctrl)
+	imapConnection := mocks.NewMockImapConnector(ctrl)
+	assassin := &ImapAssassin{
+		persistence:    persistence,
+		imapConnection: imapConnection,
+		configuration:  &configuration{},
+		l:              nullLogger(),
+	}
+
+	persistence.EXPECT().AllFolders().Return(imapFolder("Sent", 123), nil)
+	imapConnection.EXPECT().Select(gomock.Any(), "Sent").Return(u32(123), nil)
+	imapConnection.EXPECT().ListUids(gomock.Any()).Return(u32a(1, 2, 3), nil)
+	persistence.EXPECT().GetMailsInFolder(domain.Sent, "Sent").Return([]*domain.SavedImapMail{{Uid: 1}}, nil)
+	imapConnection.EXPECT().FetchMails(gomock.Any(), u32a(3, 2)).Return([]*domain.RawImapMail{
+		{Uid: 2, MailIdHash: "h2", Subject: "Lunch", RawMail: []byte("To: Bob <bob@example.com>\r\nCc: carol@example.com\r\n\r\n2")},
+		{Uid: 3, MailIdHash: "h3", Subject: "Re: Lunch", RawMail: []byte("To: bob@example.com\r\n\r\n3")},
+	}, nil)
+
+	persistence.EXPECT().
+		SaveCorrespondents([]string{"bob@example.com", "carol@example.com", "bob@example.com"}).
+		Return(nil)
+	persistence.EXPECT().
+		SaveMails([]domain.SaveMail{
+			{Class: domain.Sent, Uid: 2, MailIdHash: "h2", FolderName: "Sent", Subject: "Lunch", MailMetadata: domain.MailMetadata{Action: domain.ActionNone}},
+			{Class: domain.Sent, Uid: 3, MailIdHash: "h3", FolderName: "Sent", Subject: "Re: Lunch", MailMetadata: domain.MailMetadata{Action: domain.ActionNone}},
+		}).
+		Return(nil)
+	persistence.EXPECT().
+		SaveFolder("Sent", u32(123)).
+		Return(nil)
+
+	err := assassin.CollectCorrespondents(context.Background(), []string{"Sent"})
+	assert.NoError(t, err)
+}
+
 func TestImapAssassin_getNewMailUids(t *testing.T) {
 	tests := []struct {
 		name string
@@ -413,7 +1104,7 @@ func TestImapAssassin_getNewMailUids(t *testing.T) {
 				l:              nullLogger(),
 			}
 
-			imapConnection.EXPECT().ListUids().Return(tc.imapUids, nil)
+			imapConnection.EXPECT().ListUids(gomock.Any()).Return(tc.imapUids, nil)
 
 			// known & uidvalidity unchanged
 			if tc.knownUids != nil {
@@ -427,36 +1118,178 @@ func TestImapAssassin_getNewMailUids(t *testing.T) {
 			// known & uidvalidity has changed
 			if tc.idHeaders != nil {
 				stubMails := []*domain.ImapIdInfo{}
+				hashes := []string{}
+				knownMails := map[string]*domain.SavedImapMail{}
+				updatedUids := map[int64]uint32{}
 				for hash, uid := range tc.idHeaders {
 					stubMails = append(stubMails, &domain.ImapIdInfo{Uid: uid, MailIdHash: hash})
+					hashes = append(hashes, hash)
 
-					known := -1
 					for i := 0; i < len(tc.knownHashes); i++ {
 						if hash == tc.knownHashes[i] {
-							known = i
+							knownMails[hash] = &domain.SavedImapMail{Id: int64(i)}
+							updatedUids[int64(i)] = uid
 							break
 						}
 					}
-
-					if known > -1 {
-						persistence.EXPECT().FindMailByHash(gomock.Eq(domain.Checked), gomock.Eq(tc.folder), gomock.Eq(hash)).
-							Return(&domain.SavedImapMail{Id: int64(known)}, nil)
-						persistence.EXPECT().UpdateUid(gomock.Eq(int64(known)), gomock.Eq(uid))
-					} else {
-						persistence.EXPECT().FindMailByHash(gomock.Eq(domain.Checked), gomock.Eq(tc.folder), gomock.Eq(hash)).
-							Return(nil, nil)
-					}
 				}
-				imapConnection.EXPECT().FetchIdHeaders(gomock.Eq(tc.imapUids)).Return(stubMails, nil)
+				imapConnection.EXPECT().FetchIdHeaders(gomock.Any(), gomock.Eq(tc.imapUids)).Return(stubMails, nil)
+				persistence.EXPECT().FindMailsByHashes(gomock.Eq(domain.Checked), gomock.Eq(tc.folder), gomock.Any()).
+					DoAndReturn(func(class domain.MailClass, folder string, mailIdHashes []string) (map[string]*domain.SavedImapMail, error) {
+						assert.ElementsMatch(t, hashes, mailIdHashes)
+						return knownMails, nil
+					})
+				persistence.EXPECT().UpdateUids(gomock.Eq(updatedUids)).Return(nil)
 			}
 
-			uids, err := assassin.getNewMailUids(tc.folder, domain.Checked, tc.knownFolders, tc.uidValidity)
+			uids, err := assassin.getNewMailUids(context.Background(), tc.folder, domain.Checked, tc.knownFolders, tc.uidValidity)
 			assert.NoError(t, err)
 			assert.ElementsMatch(t, tc.expectedNew, uids)
 		})
 	}
 }
 
+func TestImapAssassin_getNewMailUidsServerId(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	persistence := mocks.NewMockPersistence(ctrl)
+	imapConnection := mocks.NewMockImapConnector(ctrl)
+
+	assassin := &ImapAssassin{
+		persistence:    persistence,
+		imapConnection: imapConnection,
+		l:              nullLogger(),
+	}
+
+	imapConnection.EXPECT().ListUids(gomock.Any()).Return(u32a(1, 2, 3), nil)
+	imapConnection.EXPECT().FetchIdHeaders(gomock.Any(), u32a(1, 2, 3)).Return([]*domain.ImapIdInfo{
+		{Uid: 1, MailIdHash: "a", ServerId: "s1"},
+		{Uid: 2, MailIdHash: "b", ServerId: "s2"},
+		{Uid: 3, MailIdHash: "c", ServerId: "s3"},
+	}, nil)
+
+	// s1 is known by server id, so only the hashes of the others are looked up, b was recorded before server ids were
+	// stored
+	persistence.EXPECT().FindMailsByServerIds(domain.Checked, TEST_FOLDER_1, []string{"s1", "s2", "s3"}).
+		Return(map[string]*domain.SavedImapMail{"s1": {Id: 10}}, nil)
+	persistence.EXPECT().FindMailsByHashes(domain.Checked, TEST_FOLDER_1, []string{"b", "c"}).
+		Return(map[string]*domain.SavedImapMail{"b": {Id: 11}}, nil)
+	persistence.EXPECT().UpdateUids(map[int64]uint32{10: 1, 11: 2}).Return(nil)
+
+	uids, err := assassin.getNewMailUids(context.Background(), TEST_FOLDER_1, domain.Checked, imapFolder(TEST_FOLDER_1, 123), 124)
+	assert.NoError(t, err)
+	assert.Equal(t, u32a(3), uids)
+}
+
+// TestImapAssassin_getNewMailUidsForwarded recognizes a learned forward after a UIDVALIDITY change on a server without
+// server ids by the hash recorded for the forward itself
+func TestImapAssassin_getNewMailUidsForwarded(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	persistence := mocks.NewMockPersistence(ctrl)
+	imapConnection := mocks.NewMockImapConnector(ctrl)
+
+	assassin := &ImapAssassin{
+		persistence:    persistence,
+		imapConnection: imapConnection,
+		configuration:  &configuration{},
+		l:              nullLogger(),
+	}
+
+	forwarded := "Message-Id: <fwd@example.com>\r\nSubject: Fwd: spam\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: message/rfc822\r\n\r\nMessage-Id: <1@spam.example>\r\nSubject: Cheap pills\r\n\r\nBuy now\r\n\r\n" +
+		"--b--\r\n"
+	originals, forwards := assassin.forwardedOriginals(TEST_FOLDER_1, domain.LearnedSpam, []*domain.RawImapMail{
+		{Uid: 1, Subject: "Fwd: spam", MailIdHash: "fwd", RawMail: []byte(forwarded)},
+	})
+	require.Len(t, originals, 1)
+	recorded := map[string]*domain.SavedImapMail{}
+	for i, m := range append([]domain.SaveMail{originals[0].SaveMail}, forwards...) {
+		recorded[m.MailIdHash] = &domain.SavedImapMail{Id: int64(i + 1), Uid: m.Uid, MailIdHash: m.MailIdHash}
+	}
+
+	imapConnection.EXPECT().ListUids(gomock.Any()).Return(u32a(7), nil)
+	imapConnection.EXPECT().FetchIdHeaders(gomock.Any(), u32a(7)).Return([]*domain.ImapIdInfo{
+		{Uid: 7, MailIdHash: "fwd"},
+	}, nil)
+	persistence.EXPECT().FindMailsByHashes(domain.LearnedSpam, TEST_FOLDER_1, []string{"fwd"}).
+		DoAndReturn(func(class domain.MailClass, folder string, mailIdHashes []string) (map[string]*domain.SavedImapMail, error) {
+			found := map[string]*domain.SavedImapMail{}
+			for _, hash := range mailIdHashes {
+				if m, ok := recorded[hash]; ok {
+					found[hash] = m
+				}
+			}
+			return found, nil
+		})
+	persistence.EXPECT().UpdateUids(map[int64]uint32{2: 7}).Return(nil)
+
+	uids, err := assassin.getNewMailUids(context.Background(), TEST_FOLDER_1, domain.LearnedSpam, imapFolder(TEST_FOLDER_1, 123), 124)
+	assert.NoError(t, err)
+	assert.Empty(t, uids)
+}
+
+// BenchmarkImapAssassin_getNewMailUids diffs a large folder of which every other mail is known
+func BenchmarkImapAssassin_getNewMailUids(b *testing.B) {
+	const folderSize = 200000
+
+	imapUids := make([]uint32, folderSize)
+	idInfos := make([]*domain.ImapIdInfo, folderSize)
+	knownMails := []*domain.SavedImapMail{}
+	knownHashes := map[string]*domain.SavedImapMail{}
+	for i := range imapUids {
+		uid := uint32(i + 1)
+		imapUids[i] = uid
+		idInfos[i] = &domain.ImapIdInfo{Uid: uid, MailIdHash: fmt.Sprintf("hash%d", uid)}
+		if uid%2 == 0 {
+			known := &domain.SavedImapMail{Id: int64(uid), Uid: uid}
+			knownMails = append(knownMails, known)
+			knownHashes[idInfos[i].MailIdHash] = known
+		}
+	}
+
+	tests := []struct {
+		name        string
+		uidValidity uint32
+	}{
+		{"uidvalidity_unchanged", 123},
+		{"uidvalidity_changed", 124},
+	}
+	for _, tc := range tests {
+		b.Run(tc.name, func(b *testing.B) {
+			ctrl := gomock.NewController(b)
+			defer ctrl.Finish()
+
+			persistence := mocks.NewMockPersistence(ctrl)
+			imapConnection := mocks.NewMockImapConnector(ctrl)
+			assassin := &ImapAssassin{
+				persistence:    persistence,
+				imapConnection: imapConnection,
+				l:              nullLogger(),
+			}
+
+			imapConnection.EXPECT().ListUids(gomock.Any()).
+				DoAndReturn(func(ctx context.Context) ([]uint32, error) {
+					return append([]uint32{}, imapUids...), nil
+				}).
+				AnyTimes()
+			imapConnection.EXPECT().FetchIdHeaders(gomock.Any(), gomock.Any()).Return(idInfos, nil).AnyTimes()
+			persistence.EXPECT().GetMailsInFolder(domain.Checked, TEST_FOLDER_1).Return(knownMails, nil).AnyTimes()
+			persistence.EXPECT().FindMailsByHashes(domain.Checked, TEST_FOLDER_1, gomock.Any()).Return(knownHashes, nil).AnyTimes()
+			persistence.EXPECT().UpdateUids(gomock.Any()).Return(nil).AnyTimes()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				uids, err := assassin.getNewMailUids(context.Background(), TEST_FOLDER_1, domain.Checked, imapFolder(TEST_FOLDER_1, 123), tc.uidValidity)
+				require.NoError(b, err)
+				require.Len(b, uids, folderSize/2)
+			}
+		})
+	}
+}
+
 func Test_partitionUids(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -510,9 +1343,18 @@ func saveMail(class domain.MailClass, uid uint32, folderName string, isSpam *boo
 		Subject:    "",
 		IsSpam:     isSpam,
 		Score:      score,
+		MailMetadata: domain.MailMetadata{
+			Action: domain.ActionNone,
+		},
 	}
 }
 
+func withAction(m domain.SaveMail, action domain.MailAction, destination string) domain.SaveMail {
+	m.Action = action
+	m.Destination = destination
+	return m
+}
+
 func imapFolder(name string, uidValidity int) []*domain.ImapFolder {
 	return []*domain.ImapFolder{{
 		Name:        name,
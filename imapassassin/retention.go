@@ -0,0 +1,128 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package imapassassin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RetentionPolicy limits the mails kept in Folder. MaxAge deletes mails with an internal date before the day MaxAge
+// ago, MaxMails deletes the oldest mails by internal date beyond that number. Zero disables a limit.
+type RetentionPolicy struct {
+	Folder   string
+	MaxAge   time.Duration
+	MaxMails int
+}
+
+// ApplyRetention deletes the mails exceeding policies, or only logs their number in dry-run mode. Once ctx is
+// cancelled, no more folders are purged and the cancellation is returned as error.
+func (ia *ImapAssassin) ApplyRetention(ctx context.Context, policies []RetentionPolicy) error {
+	for _, policy := range policies {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		_, err := ia.imapConnection.Select(ctx, policy.Folder)
+		if err != nil {
+			return fmt.Errorf("could not select folder %s: %w", policy.Folder, err)
+		}
+
+		if !ia.configuration.DryRun {
+			notDeleteReadyReason, err := ia.imapConnection.DeleteReady(ctx)
+			if err != nil {
+				return fmt.Errorf("could not check for delete readiness: %w", err)
+			}
+
+			if notDeleteReadyReason != nil {
+				ia.l.WithFields(logrus.Fields{"folder": policy.Folder, "error": notDeleteReadyReason}).Warn("Folder is not ready for mail deletion, skipping")
+				continue
+			}
+		}
+
+		purge, byAge, byCount, err := ia.expiredUids(ctx, policy)
+		if err != nil {
+			return err
+		}
+
+		baseLogger := ia.l.WithFields(logrus.Fields{"folder": policy.Folder, "purge": len(purge), "byage": byAge, "bycount": byCount})
+		if len(purge) == 0 {
+			baseLogger.Info("No mails to purge")
+			continue
+		}
+		if ia.configuration.DryRun {
+			baseLogger.Info("Not purging mails due to dry-run")
+			continue
+		}
+
+		for _, batch := range partitionUids(purge, BatchSize) {
+			// every batch is deleted completely even when ctx is cancelled meanwhile
+			err = ia.deleteMails(context.Background(), policy.Folder, batch)
+			if err != nil {
+				return fmt.Errorf("could not purge mails from %s: %w", policy.Folder, err)
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+		}
+		baseLogger.Info("Purged mails")
+	}
+
+	return nil
+}
+
+// expiredUids returns the sorted uids exceeding policy in the selected folder and how many exceeded the age and the
+// count limit, mails can exceed both.
+func (ia *ImapAssassin) expiredUids(ctx context.Context, policy RetentionPolicy) ([]uint32, int, int, error) {
+	expired := map[uint32]bool{}
+
+	byAge := 0
+	if policy.MaxAge > 0 {
+		uids, err := ia.imapConnection.ListUidsBefore(ctx, time.Now().Add(-policy.MaxAge))
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("could not list old mails: %w", err)
+		}
+		for _, uid := range uids {
+			expired[uid] = true
+		}
+		byAge = len(uids)
+	}
+
+	byCount := 0
+	if policy.MaxMails > 0 {
+		uids, err := ia.imapConnection.ListUids(ctx)
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("could not list uids in folder: %w", err)
+		}
+
+		if len(uids) > policy.MaxMails {
+			dates, err := ia.imapConnection.FetchInternalDates(ctx, uids)
+			if err != nil {
+				return nil, 0, 0, fmt.Errorf("could not fetch internal dates: %w", err)
+			}
+
+			// oldest first, uids break ties as they're ascending in order of arrival
+			sort.Slice(uids, func(i, j int) bool {
+				if dates[uids[i]].Equal(dates[uids[j]]) {
+					return uids[i] < uids[j]
+				}
+				return dates[uids[i]].Before(dates[uids[j]])
+			})
+			for _, uid := range uids[:len(uids)-policy.MaxMails] {
+				expired[uid] = true
+			}
+			byCount = len(uids) - policy.MaxMails
+		}
+	}
+
+	purge := make([]uint32, 0, len(expired))
+	for uid := range expired {
+		purge = append(purge, uid)
+	}
+	sort.Slice(purge, func(i, j int) bool { return purge[i] < purge[j] })
+
+	return purge, byAge, byCount, nil
+}
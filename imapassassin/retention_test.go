@@ -0,0 +1,109 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package imapassassin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/CrawX/go-imap-assassin/domain/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImapAssassin_ApplyRetention(t *testing.T) {
+	date := time.Date(2020, 10, 7, 1, 30, 45, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		dryRun bool
+		policy RetentionPolicy
+		setup  func(imapConnection *mocks.MockImapConnector)
+	}{
+		{
+			"age",
+			false,
+			RetentionPolicy{Folder: "spam", MaxAge: 30 * 24 * time.Hour},
+			func(imapConnection *mocks.MockImapConnector) {
+				imapConnection.EXPECT().DeleteReady(gomock.Any()).Return(nil, nil)
+				imapConnection.EXPECT().ListUidsBefore(gomock.Any(), gomock.Any()).Return(u32a(3, 1), nil)
+				imapConnection.EXPECT().Delete(gomock.Any(), u32a(1, 3)).Return(nil)
+			},
+		},
+		{
+			"count",
+			false,
+			RetentionPolicy{Folder: "spam", MaxMails: 2},
+			func(imapConnection *mocks.MockImapConnector) {
+				imapConnection.EXPECT().DeleteReady(gomock.Any()).Return(nil, nil)
+				imapConnection.EXPECT().ListUids(gomock.Any()).Return(u32a(1, 2, 3, 4), nil)
+				// mail 4 was appended with an old internal date
+				imapConnection.EXPECT().FetchInternalDates(gomock.Any(), gomock.Any()).Return(map[uint32]time.Time{
+					1: date,
+					2: date.Add(time.Hour),
+					3: date.Add(2 * time.Hour),
+					4: date.Add(-time.Hour),
+				}, nil)
+				imapConnection.EXPECT().Delete(gomock.Any(), u32a(1, 4)).Return(nil)
+			},
+		},
+		{
+			"ageandcount",
+			false,
+			RetentionPolicy{Folder: "spam", MaxAge: 24 * time.Hour, MaxMails: 3},
+			func(imapConnection *mocks.MockImapConnector) {
+				imapConnection.EXPECT().DeleteReady(gomock.Any()).Return(nil, nil)
+				imapConnection.EXPECT().ListUidsBefore(gomock.Any(), gomock.Any()).Return(u32a(1), nil)
+				imapConnection.EXPECT().ListUids(gomock.Any()).Return(u32a(1, 2, 3, 4, 5), nil)
+				imapConnection.EXPECT().FetchInternalDates(gomock.Any(), gomock.Any()).Return(map[uint32]time.Time{
+					1: date, 2: date, 3: date, 4: date, 5: date,
+				}, nil)
+				imapConnection.EXPECT().Delete(gomock.Any(), u32a(1, 2)).Return(nil)
+			},
+		},
+		{
+			"withinlimits",
+			false,
+			RetentionPolicy{Folder: "spam", MaxMails: 5},
+			func(imapConnection *mocks.MockImapConnector) {
+				imapConnection.EXPECT().DeleteReady(gomock.Any()).Return(nil, nil)
+				imapConnection.EXPECT().ListUids(gomock.Any()).Return(u32a(1, 2, 3), nil)
+			},
+		},
+		{
+			"notdeleteready",
+			false,
+			RetentionPolicy{Folder: "spam", MaxAge: time.Hour},
+			func(imapConnection *mocks.MockImapConnector) {
+				imapConnection.EXPECT().DeleteReady(gomock.Any()).Return(assert.AnError, nil)
+			},
+		},
+		{
+			"dryrun",
+			true,
+			RetentionPolicy{Folder: "spam", MaxAge: time.Hour},
+			func(imapConnection *mocks.MockImapConnector) {
+				imapConnection.EXPECT().ListUidsBefore(gomock.Any(), gomock.Any()).Return(u32a(1, 2), nil)
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			imapConnection := mocks.NewMockImapConnector(ctrl)
+			assassin := &ImapAssassin{
+				imapConnection: imapConnection,
+				configuration:  &configuration{DryRun: tc.dryRun},
+				l:              nullLogger(),
+			}
+
+			imapConnection.EXPECT().Select(gomock.Any(), tc.policy.Folder).Return(u32(123), nil)
+			tc.setup(imapConnection)
+
+			err := assassin.ApplyRetention(context.Background(), []RetentionPolicy{tc.policy})
+			assert.NoError(t, err)
+		})
+	}
+}
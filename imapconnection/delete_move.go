@@ -1,7 +1,11 @@
 // SPDX-License-Identifier: GPL-3.0-or-later
 package imapconnection
 
-import "github.com/emersion/go-imap"
+import (
+	"github.com/CrawX/go-imap-assassin/domain"
+
+	"github.com/emersion/go-imap"
+)
 
 //go:generate mockgen -destination=delete_move_mocks_test.go -package=imapconnection -source delete_move.go
 
@@ -15,11 +19,11 @@ type deleter interface {
 }
 
 type mover interface {
-	move(uids []uint32, folder string) error
+	move(uids []uint32, folder string) (*domain.MovedUids, error)
 	moveReady() (error, error)
 }
 
 type copyAndDeleteMoveClient interface {
 	deleter
-	UidCopy(seqset *imap.SeqSet, dest string) error
+	UidCopy(seqset *imap.SeqSet, dest string) (validity uint32, srcUids, dstUids *imap.SeqSet, err error)
 }
@@ -3,6 +3,7 @@ package imapconnection
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"time"
@@ -20,8 +21,11 @@ import (
 
 type ImapConnection struct {
 	connection  *client.Client
+	uidPlus     *uidplus.Client
 	mailDeleter deleter
 	mailMover   mover
+	// serverIdItem fetches the permanent id of mails, empty if the server supports neither OBJECTID nor X-GM-EXT-1
+	serverIdItem imap.FetchItem
 
 	server, user, password string
 
@@ -47,6 +51,11 @@ func NewImapConnection(server string, user string, password string) (*ImapConnec
 		return nil, fmt.Errorf("could not check for UIDPLUS support: %w", err)
 	}
 
+	serverIdItem, err := serverIdFetchItem(imapClient)
+	if err != nil {
+		return nil, err
+	}
+
 	moveClient := move.NewClient(imapClient)
 	moveSupported, err := moveClient.SupportMove()
 	if err != nil {
@@ -54,16 +63,24 @@ func NewImapConnection(server string, user string, password string) (*ImapConnec
 	}
 
 	conn := &ImapConnection{
-		connection: imapClient,
-		server:     server,
-		user:       user,
-		password:   password,
-		l:          log.Logger(log.LOG_IMAP),
+		connection:   imapClient,
+		uidPlus:      uidPlusClient,
+		serverIdItem: serverIdItem,
+		server:       server,
+		user:         user,
+		password:     password,
+		l:            log.Logger(log.LOG_IMAP),
 	}
 
 	baseLogger := conn.l.WithFields(logrus.Fields{"server": server})
 	baseLogger.Debug("Logged in to server")
 
+	if serverIdItem != "" {
+		baseLogger.WithField("item", serverIdItem).Debug("Permanent mail ids supported on server")
+	} else {
+		baseLogger.Info("Neither OBJECTID nor X-GM-EXT-1 supported on server, identifying mails by headers only")
+	}
+
 	if uidPlusSupported {
 		baseLogger.Debug("UIDPLUS supported on server, using UID delete")
 		conn.mailDeleter = &uidPlusDeleter{
@@ -89,7 +106,7 @@ func NewImapConnection(server string, user string, password string) (*ImapConnec
 	if moveSupported {
 		baseLogger.Debug("MOVE supported on server")
 		conn.mailMover = &moveMover{
-			moveClient: moveClient,
+			moveClient: imapClient,
 		}
 	} else {
 		baseLogger.Info("MOVE not supported on server, falling back to copy&delete")
@@ -101,9 +118,9 @@ func NewImapConnection(server string, user string, password string) (*ImapConnec
 		conn.mailMover = &compatibilityMover{
 			imapConn: struct {
 				deleter
-				*client.Client
+				*uidplus.Client
 			}{
-				conn.mailDeleter, imapClient,
+				conn.mailDeleter, uidPlusClient,
 			},
 		}
 	}
@@ -111,7 +128,56 @@ func NewImapConnection(server string, user string, password string) (*ImapConnec
 	return conn, nil
 }
 
-func (ic *ImapConnection) Select(folder string) (uint32, error) {
+// serverIdFetchItem returns the fetch item of the permanent mail id the server provides: EMAILID as defined by RFC 8474
+// OBJECTID or Gmail's X-GM-MSGID. Both stay the same when a mail is moved or copied to another folder.
+func serverIdFetchItem(imapClient *client.Client) (imap.FetchItem, error) {
+	objectIdSupported, err := imapClient.Support("OBJECTID")
+	if err != nil {
+		return "", fmt.Errorf("could not check for OBJECTID support: %w", err)
+	}
+	if objectIdSupported {
+		return "EMAILID", nil
+	}
+
+	gmailSupported, err := imapClient.Support("X-GM-EXT-1")
+	if err != nil {
+		return "", fmt.Errorf("could not check for X-GM-EXT-1 support: %w", err)
+	}
+	if gmailSupported {
+		return "X-GM-MSGID", nil
+	}
+
+	return "", nil
+}
+
+// withServerId adds the fetch item of the permanent mail id to fetchItems if the server supports one
+func (ic *ImapConnection) withServerId(fetchItems []imap.FetchItem) []imap.FetchItem {
+	if ic.serverIdItem == "" {
+		return fetchItems
+	}
+	return append(fetchItems, ic.serverIdItem)
+}
+
+// serverId returns the permanent id of msg or an empty string if it wasn't fetched. EMAILID is a parenthesized list
+// containing the id, X-GM-MSGID a plain number.
+func (ic *ImapConnection) serverId(msg *imap.Message) string {
+	if ic.serverIdItem == "" {
+		return ""
+	}
+
+	value := msg.Items[ic.serverIdItem]
+	if list, ok := value.([]interface{}); ok && len(list) == 1 {
+		value = list[0]
+	}
+	id, _ := imap.ParseString(value)
+	return id
+}
+
+func (ic *ImapConnection) Select(ctx context.Context, folder string) (uint32, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
 	m, err := ic.connection.Select(folder, false)
 	if err != nil {
 		return 0, fmt.Errorf("could not select folder: %w", err)
@@ -121,7 +187,11 @@ func (ic *ImapConnection) Select(folder string) (uint32, error) {
 	return m.UidValidity, nil
 }
 
-func (ic *ImapConnection) ListUids() ([]uint32, error) {
+func (ic *ImapConnection) ListUids(ctx context.Context) ([]uint32, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	// Get all UIDs in folder (empty search criteria)
 	criteria := imap.NewSearchCriteria()
 	ids, err := ic.connection.UidSearch(criteria)
@@ -132,7 +202,58 @@ func (ic *ImapConnection) ListUids() ([]uint32, error) {
 	return ids, nil
 }
 
-func (ic *ImapConnection) FetchMails(uids []uint32) ([]*domain.RawImapMail, error) {
+// ListUidsBefore lists the uids of the mails in the selected folder whose internal date is before the day of before.
+func (ic *ImapConnection) ListUidsBefore(ctx context.Context, before time.Time) ([]uint32, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Before = before
+	ids, err := ic.connection.UidSearch(criteria)
+	if err != nil {
+		return nil, fmt.Errorf("could not search folder: %w", err)
+	}
+
+	return ids, nil
+}
+
+// FetchInternalDates fetches the internal dates of the mails without their bodies.
+func (ic *ImapConnection) FetchInternalDates(ctx context.Context, uids []uint32) (map[uint32]time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	seqset := &imap.SeqSet{}
+	seqset.AddNum(uids...)
+	fetchItems := []imap.FetchItem{imap.FetchUid, imap.FetchInternalDate}
+
+	out := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- ic.connection.UidFetch(seqset, fetchItems, out)
+	}()
+
+	dates := map[uint32]time.Time{}
+	for msg := range out {
+		dates[msg.Uid] = msg.InternalDate
+	}
+
+	err := <-done
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch internal dates: %w", err)
+	}
+
+	return dates, nil
+}
+
+// FetchMails fetches the full mails. If ctx is cancelled during the fetch, the remaining mails are discarded and the
+// error of ctx is returned.
+func (ic *ImapConnection) FetchMails(ctx context.Context, uids []uint32) ([]*domain.RawImapMail, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	seqset := &imap.SeqSet{}
 	seqset.AddNum(uids...)
 
@@ -141,7 +262,7 @@ func (ic *ImapConnection) FetchMails(uids []uint32) ([]*domain.RawImapMail, erro
 		Peek: true,
 	}
 
-	fetchItems := []imap.FetchItem{fullBodySection.FetchItem()}
+	fetchItems := ic.withServerId([]imap.FetchItem{fullBodySection.FetchItem(), imap.FetchFlags, imap.FetchInternalDate})
 	done := make(chan error, 1)
 	go func() {
 		done <- ic.connection.UidFetch(seqset, fetchItems, messages)
@@ -149,6 +270,11 @@ func (ic *ImapConnection) FetchMails(uids []uint32) ([]*domain.RawImapMail, erro
 
 	mails := []*domain.RawImapMail{}
 	for msg := range messages {
+		if ctx.Err() != nil {
+			// the fetch can't be aborted, keep draining so it can finish
+			continue
+		}
+
 		r := msg.GetBody(fullBodySection)
 		if r == nil {
 			fmt.Println(msg)
@@ -158,45 +284,66 @@ func (ic *ImapConnection) FetchMails(uids []uint32) ([]*domain.RawImapMail, erro
 			return nil, fmt.Errorf("could not read mail body: %w", err)
 		}
 
-		subject, mailIdHash, err := mail.MailHeaderInfos(rawBody)
-		if err != nil {
-			return nil, fmt.Errorf("could not parse mail header infos: %w", err)
-		}
-
-		mails = append(
-			mails,
-			&domain.RawImapMail{
-				Uid:        msg.Uid,
-				Subject:    subject,
-				MailIdHash: mailIdHash,
-				RawMail:    rawBody,
-			},
-		)
+		mails = append(mails, ic.rawImapMail(msg, rawBody))
 	}
 
 	err := <-done
 	if err != nil {
 		return nil, fmt.Errorf("could not fetch mails: %w", err)
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	return mails, nil
 }
 
-func (ic *ImapConnection) FetchIdHeaders(uids []uint32) ([]*domain.ImapIdInfo, error) {
+// rawImapMail creates the RawImapMail of the fetched msg. Malformed headers are common in spam, so mails whose headers
+// can't be parsed are identified by their content hash, like forwarded originals, and their subject, sender and date
+// stay empty.
+func (ic *ImapConnection) rawImapMail(msg *imap.Message, rawBody []byte) *domain.RawImapMail {
+	subject, mailIdHash, strategy, err := mail.MailHeaderInfos(rawBody)
+	if err != nil {
+		ic.l.WithFields(logrus.Fields{"uid": msg.Uid, "error": err}).Debug("Could not parse mail headers, identifying mail by its content")
+		subject, mailIdHash, strategy = "", mail.ContentHash(rawBody), mail.HashBody
+	}
+	// both only end up in the recorded metadata
+	sender, _ := mail.Sender(rawBody)
+	date, _ := mail.Date(rawBody)
+
+	return &domain.RawImapMail{
+		Uid:          msg.Uid,
+		Subject:      subject,
+		MailIdHash:   mailIdHash,
+		HashStrategy: string(strategy),
+		ServerId:     ic.serverId(msg),
+		RawMail:      rawBody,
+		Flags:        msg.Flags,
+		InternalDate: msg.InternalDate,
+		Sender:       sender,
+		Date:         date,
+		Size:         len(rawBody),
+	}
+}
+
+// FetchIdHeaders fetches the headers the MailIdHash is calculated from and the permanent mail id if supported. Mails
+// that have none of the headers and are hashed by their body, or whose headers can't be parsed, are fetched completely
+// afterwards.
+func (ic *ImapConnection) FetchIdHeaders(ctx context.Context, uids []uint32) ([]*domain.ImapIdInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	seqset := &imap.SeqSet{}
 	seqset.AddNum(uids...)
 	section := &imap.BodySectionName{
 		BodyPartName: imap.BodyPartName{
 			Specifier: imap.HeaderSpecifier,
-			Fields: []string{
-				"Received",
-				"Message-Id",
-				"Subject",
-			},
+			Fields:    mail.IdHeaders,
 		},
 		Peek: true,
 	}
-	fetchItems := []imap.FetchItem{section.FetchItem()}
+	fetchItems := ic.withServerId([]imap.FetchItem{section.FetchItem()})
 
 	out := make(chan *imap.Message)
 	done := make(chan error, 1)
@@ -205,6 +352,7 @@ func (ic *ImapConnection) FetchIdHeaders(uids []uint32) ([]*domain.ImapIdInfo, e
 	}()
 
 	results := []*domain.ImapIdInfo{}
+	bodyHashed := map[uint32]*domain.ImapIdInfo{}
 	for msg := range out {
 		r := msg.GetBody(section)
 
@@ -213,19 +361,23 @@ func (ic *ImapConnection) FetchIdHeaders(uids []uint32) ([]*domain.ImapIdInfo, e
 			return nil, fmt.Errorf("could not read mail body: %w", err)
 		}
 
-		subject, mailIdHash, err := mail.MailHeaderInfos(rawHeaders)
+		subject, mailIdHash, strategy, err := mail.MailHeaderInfos(rawHeaders)
 		if err != nil {
-			return nil, fmt.Errorf("could not parse mail header infos: %w", err)
+			// hashed the same way as FetchMails does
+			subject, strategy = "", mail.HashBody
 		}
 
-		results = append(
-			results,
-			&domain.ImapIdInfo{
-				Uid:        msg.Uid,
-				Subject:    subject,
-				MailIdHash: mailIdHash,
-			},
-		)
+		info := &domain.ImapIdInfo{
+			Uid:          msg.Uid,
+			Subject:      subject,
+			MailIdHash:   mailIdHash,
+			HashStrategy: string(strategy),
+			ServerId:     ic.serverId(msg),
+		}
+		if strategy == mail.HashBody {
+			bodyHashed[msg.Uid] = info
+		}
+		results = append(results, info)
 	}
 
 	err := <-done
@@ -233,6 +385,24 @@ func (ic *ImapConnection) FetchIdHeaders(uids []uint32) ([]*domain.ImapIdInfo, e
 		return nil, fmt.Errorf("could not fetch mails: %w", err)
 	}
 
+	if len(bodyHashed) > 0 {
+		bodyHashedUids := make([]uint32, 0, len(bodyHashed))
+		for uid := range bodyHashed {
+			bodyHashedUids = append(bodyHashedUids, uid)
+		}
+
+		mails, err := ic.FetchMails(ctx, bodyHashedUids)
+		if err != nil {
+			return nil, fmt.Errorf("could not fetch mails hashed by body: %w", err)
+		}
+		for _, m := range mails {
+			if info, ok := bodyHashed[m.Uid]; ok {
+				info.MailIdHash = m.MailIdHash
+				info.HashStrategy = m.HashStrategy
+			}
+		}
+	}
+
 	return results, nil
 }
 
@@ -299,20 +469,45 @@ func (ic *ImapConnection) Check(ids []uint32) ([]*RawMail, error) {
 	return results, nil
 }
 
-func (ic *ImapConnection) Put(body []byte, folder string) error {
-	err := ic.connection.Append(folder, nil, time.Now(), bytes.NewReader(body))
+func (ic *ImapConnection) Put(ctx context.Context, body []byte, folder string) (uint32, error) {
+	return ic.Append(ctx, body, folder, nil, time.Now())
+}
+
+// Append adds body to folder. \Recent is dropped from flags since only the server may set it. The uid of the appended
+// mail is only known if the server supports UIDPLUS.
+func (ic *ImapConnection) Append(ctx context.Context, body []byte, folder string, flags []string, date time.Time) (uint32, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	appendFlags := []string{}
+	for _, flag := range flags {
+		if flag != imap.RecentFlag {
+			appendFlags = append(appendFlags, flag)
+		}
+	}
+
+	_, uid, err := ic.uidPlus.Append(folder, appendFlags, date, bytes.NewReader(body))
 	if err != nil {
-		return fmt.Errorf("could not append: %w", err)
+		return 0, fmt.Errorf("could not append: %w", err)
 	}
 
-	return nil
+	return uid, nil
 }
 
-func (ic *ImapConnection) Delete(uids []uint32) error {
+func (ic *ImapConnection) Delete(ctx context.Context, uids []uint32) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	return ic.mailDeleter.delete(uids)
 }
 
-func (ic *ImapConnection) DeleteReady() (error, error) {
+func (ic *ImapConnection) DeleteReady(ctx context.Context) (error, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	return ic.mailDeleter.deleteReady()
 }
 
@@ -327,10 +522,18 @@ func (ic *ImapConnection) flagDeleted(uids []uint32) (*imap.SeqSet, error) {
 	return seqset, nil
 }
 
-func (ic *ImapConnection) MoveReady() (error, error) {
+func (ic *ImapConnection) MoveReady(ctx context.Context) (error, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	return ic.mailMover.moveReady()
 }
 
-func (ic *ImapConnection) Move(uids []uint32, folder string) error {
+func (ic *ImapConnection) Move(ctx context.Context, uids []uint32, folder string) (*domain.MovedUids, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	return ic.mailMover.move(uids, folder)
 }
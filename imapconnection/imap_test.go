@@ -0,0 +1,66 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package imapconnection
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CrawX/go-imap-assassin/domain"
+	"github.com/CrawX/go-imap-assassin/log"
+	"github.com/CrawX/go-imap-assassin/mail"
+	"github.com/emersion/go-imap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImapConnection_serverId(t *testing.T) {
+	tests := []struct {
+		name         string
+		serverIdItem imap.FetchItem
+		fields       []interface{}
+		expected     string
+	}{
+		{"emailid", "EMAILID", []interface{}{"UID", "1", "EMAILID", []interface{}{"M6d99ac3275bb4e"}}, "M6d99ac3275bb4e"},
+		{"gmail", "X-GM-MSGID", []interface{}{"UID", "1", "X-GM-MSGID", "1278455344230334865"}, "1278455344230334865"},
+		{"unsupported", "", []interface{}{"UID", "1"}, ""},
+		{"missing", "EMAILID", []interface{}{"UID", "1"}, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := &imap.Message{}
+			err := msg.Parse(tc.fields)
+			assert.NoError(t, err)
+
+			conn := &ImapConnection{serverIdItem: tc.serverIdItem}
+			assert.Equal(t, tc.expected, conn.serverId(msg))
+		})
+	}
+}
+
+func TestImapConnection_rawImapMail(t *testing.T) {
+	log.InitLogging("error")
+	internalDate := time.Date(2020, 10, 7, 1, 30, 45, 0, time.UTC)
+
+	valid := []byte("Message-Id: <1@example.com>\r\nFrom: alice@example.com\r\nSubject: Hello\r\n\r\nbody")
+	_, validHash, _, err := mail.MailHeaderInfos(valid)
+	assert.NoError(t, err)
+	broken := []byte("From alice@example.com\r\nSubject: Broken\r\n\r\nbody")
+
+	tests := []struct {
+		name     string
+		rawMail  []byte
+		expected *domain.RawImapMail
+	}{
+		{"valid", valid, &domain.RawImapMail{Uid: 7, Subject: "Hello", MailIdHash: validHash, HashStrategy: string(mail.HashMessageId),
+			RawMail: valid, Flags: []string{imap.SeenFlag}, InternalDate: internalDate, Sender: "alice@example.com", Size: len(valid)}},
+		// identified by its content instead of failing the whole batch
+		{"broken", broken, &domain.RawImapMail{Uid: 7, MailIdHash: mail.ContentHash(broken), HashStrategy: string(mail.HashBody),
+			RawMail: broken, Flags: []string{imap.SeenFlag}, InternalDate: internalDate, Size: len(broken)}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := &ImapConnection{l: log.Logger(log.LOG_IMAP)}
+			msg := &imap.Message{Uid: 7, Flags: []string{imap.SeenFlag}, InternalDate: internalDate}
+			assert.Equal(t, tc.expected, conn.rawImapMail(msg, tc.rawMail))
+		})
+	}
+}
@@ -5,21 +5,55 @@ package imapconnection
 import (
 	"fmt"
 
+	"github.com/CrawX/go-imap-assassin/domain"
+
 	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap-move"
+	"github.com/emersion/go-imap-uidplus"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
 )
 
 type moveClient interface {
-	UidMove(seqset *imap.SeqSet, dest string) error
+	Execute(cmdr imap.Commander, h responses.Handler) (*imap.StatusResp, error)
 }
 
 type moveMover struct {
 	moveClient moveClient
 }
 
-func (m *moveMover) move(uids []uint32, folder string) error {
+// move executes UID MOVE directly instead of using go-imap-move's client to get the COPYUID response code. RFC 6851
+// recommends sending it in an untagged OK before the expunges but servers may add it to the tagged OK as well.
+func (m *moveMover) move(uids []uint32, folder string) (*domain.MovedUids, error) {
 	seqset := &imap.SeqSet{}
 	seqset.AddNum(uids...)
-	return m.moveClient.UidMove(seqset, folder)
+	cmd := &commands.Uid{Cmd: &move.Command{SeqSet: seqset, Mailbox: folder}}
+
+	var copyUid *imap.StatusResp
+	status, err := m.moveClient.Execute(cmd, responses.HandlerFunc(func(resp imap.Resp) error {
+		if status, ok := resp.(*imap.StatusResp); ok && status.Code == uidplus.CodeCopyUid {
+			copyUid = status
+		}
+		return responses.ErrUnhandled
+	}))
+	if err != nil {
+		return nil, err
+	}
+	if err := status.Err(); err != nil {
+		return nil, err
+	}
+
+	if status.Code == uidplus.CodeCopyUid {
+		copyUid = status
+	}
+	if copyUid == nil || len(copyUid.Arguments) < 3 {
+		return &domain.MovedUids{}, nil
+	}
+
+	validity, _ := imap.ParseNumber(copyUid.Arguments[0])
+	srcUids := parseSeqSet(copyUid.Arguments[1])
+	dstUids := parseSeqSet(copyUid.Arguments[2])
+	return movedUids(validity, srcUids, dstUids), nil
 }
 
 func (m *moveMover) moveReady() (error, error) {
@@ -31,31 +65,77 @@ type compatibilityMover struct {
 	imapConn copyAndDeleteMoveClient
 }
 
-func (c *compatibilityMover) move(uids []uint32, folder string) error {
+func (c *compatibilityMover) move(uids []uint32, folder string) (*domain.MovedUids, error) {
 	notDeleteReadyReason, err := c.moveReady()
 	if err != nil {
-		return fmt.Errorf("could not check for delete readiness to move: %w", err)
+		return nil, fmt.Errorf("could not check for delete readiness to move: %w", err)
 	}
 
 	if notDeleteReadyReason != nil {
-		return fmt.Errorf("folder is not ready for delete, cannot move (copy&delete): %w", notDeleteReadyReason)
+		return nil, fmt.Errorf("folder is not ready for delete, cannot move (copy&delete): %w", notDeleteReadyReason)
 	}
 
 	seqset := &imap.SeqSet{}
 	seqset.AddNum(uids...)
-	err = c.imapConn.UidCopy(seqset, folder)
+	validity, srcUids, dstUids, err := c.imapConn.UidCopy(seqset, folder)
 	if err != nil {
-		return fmt.Errorf("could not copy mails: %w", err)
+		return nil, fmt.Errorf("could not copy mails: %w", err)
 	}
 
 	err = c.imapConn.delete(uids)
 	if err != nil {
-		return fmt.Errorf("could not delete copied mails: %w", err)
+		return nil, fmt.Errorf("could not delete copied mails: %w", err)
 	}
 
-	return nil
+	return movedUids(validity, srcUids, dstUids), nil
 }
 
 func (c *compatibilityMover) moveReady() (error, error) {
 	return c.imapConn.deleteReady()
 }
+
+// movedUids pairs the source and destination uids of a COPYUID response code, which lists both in the same order. The
+// mapping is left empty if they can't be paired.
+func movedUids(validity uint32, srcUids, dstUids *imap.SeqSet) *domain.MovedUids {
+	moved := &domain.MovedUids{Uids: map[uint32]uint32{}}
+	src, dst := expandSeqSet(srcUids), expandSeqSet(dstUids)
+	if validity == 0 || len(src) == 0 || len(src) != len(dst) {
+		return moved
+	}
+
+	moved.UidValidity = validity
+	for i := range src {
+		moved.Uids[src[i]] = dst[i]
+	}
+	return moved
+}
+
+func parseSeqSet(field interface{}) *imap.SeqSet {
+	s, err := imap.ParseString(field)
+	if err != nil {
+		return nil
+	}
+	seqset, err := imap.ParseSeqSet(s)
+	if err != nil {
+		return nil
+	}
+	return seqset
+}
+
+// expandSeqSet lists all uids of seqset in ascending order. Ranges ending with * can't be expanded and are skipped.
+func expandSeqSet(seqset *imap.SeqSet) []uint32 {
+	if seqset == nil {
+		return nil
+	}
+
+	var uids []uint32
+	for _, seq := range seqset.Set {
+		if seq.Start == 0 || seq.Stop == 0 {
+			continue
+		}
+		for uid := seq.Start; uid <= seq.Stop; uid++ {
+			uids = append(uids, uid)
+		}
+	}
+	return uids
+}
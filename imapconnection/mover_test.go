@@ -5,7 +5,11 @@ import (
 	"errors"
 	"testing"
 
+	"github.com/CrawX/go-imap-assassin/domain"
 	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap-move"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 )
@@ -28,11 +32,73 @@ func TestMoveMover_Move(t *testing.T) {
 	seqset := &imap.SeqSet{}
 	seqset.AddNum(u32a(1, 2, 3)...)
 	conn.EXPECT().
-		UidMove(gomock.Eq(seqset), gomock.Eq("dest")).
-		Return(nil)
+		Execute(gomock.Eq(&commands.Uid{Cmd: &move.Command{SeqSet: seqset, Mailbox: "dest"}}), gomock.Any()).
+		Return(&imap.StatusResp{Type: imap.StatusRespOk}, nil)
 
-	err := mover.move(u32a(1, 2, 3), "dest")
+	moved, err := mover.move(u32a(1, 2, 3), "dest")
 	assert.NoError(t, err)
+	assert.Equal(t, &domain.MovedUids{}, moved)
+}
+
+func TestMoveMover_MoveCopyUid(t *testing.T) {
+	tests := []struct {
+		name   string
+		status *imap.StatusResp
+		tagged *imap.StatusResp
+	}{
+		{
+			name: "untagged",
+			status: &imap.StatusResp{Tag: "*", Type: imap.StatusRespOk, Code: "COPYUID",
+				Arguments: []interface{}{"7", "1:3", "11:13"}},
+			tagged: &imap.StatusResp{Type: imap.StatusRespOk},
+		},
+		{
+			name: "tagged",
+			tagged: &imap.StatusResp{Type: imap.StatusRespOk, Code: "COPYUID",
+				Arguments: []interface{}{"7", "1:3", "11:13"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			conn := NewMockmoveClient(ctrl)
+			mover := moveMover{conn}
+
+			conn.EXPECT().
+				Execute(gomock.Any(), gomock.Any()).
+				DoAndReturn(func(cmdr imap.Commander, h responses.Handler) (*imap.StatusResp, error) {
+					if test.status != nil {
+						assert.Equal(t, responses.ErrUnhandled, h.Handle(test.status))
+					}
+					return test.tagged, nil
+				})
+
+			moved, err := mover.move(u32a(1, 2, 3), "dest")
+			assert.NoError(t, err)
+			assert.Equal(t, &domain.MovedUids{
+				UidValidity: 7,
+				Uids:        map[uint32]uint32{1: 11, 2: 12, 3: 13},
+			}, moved)
+		})
+	}
+}
+
+func TestMoveMover_MoveFailed(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	conn := NewMockmoveClient(ctrl)
+	mover := moveMover{conn}
+
+	conn.EXPECT().
+		Execute(gomock.Any(), gomock.Any()).
+		Return(&imap.StatusResp{Type: imap.StatusRespNo, Info: "no such folder"}, nil)
+
+	_, err := mover.move(u32a(1, 2, 3), "dest")
+	assert.EqualError(t, err, "no such folder")
 }
 
 func TestCompatibilityMover_MoveReadyOk(t *testing.T) {
@@ -84,16 +150,22 @@ func TestCompatibilityMover_Move(t *testing.T) {
 
 	seqset := &imap.SeqSet{}
 	seqset.AddNum(u32a(1, 2, 3)...)
+	dstUids := &imap.SeqSet{}
+	dstUids.AddNum(u32a(21, 22, 23)...)
 	conn.EXPECT().
 		UidCopy(gomock.Eq(seqset), "dest").
-		Return(nil)
+		Return(u32(9), seqset, dstUids, nil)
 
 	conn.EXPECT().
 		delete(u32a(1, 2, 3)).
 		Return(nil)
 
-	err := mover.move(u32a(1, 2, 3), "dest")
+	moved, err := mover.move(u32a(1, 2, 3), "dest")
 	assert.NoError(t, err)
+	assert.Equal(t, &domain.MovedUids{
+		UidValidity: 9,
+		Uids:        map[uint32]uint32{1: 21, 2: 22, 3: 23},
+	}, moved)
 }
 
 func TestCompatibilityMover_MoveButNotReady(t *testing.T) {
@@ -108,6 +180,55 @@ func TestCompatibilityMover_MoveButNotReady(t *testing.T) {
 		deleteReady().
 		Return(errors.New("delete not ready"), nil)
 
-	err := mover.move(u32a(1, 2, 3), "dest")
+	_, err := mover.move(u32a(1, 2, 3), "dest")
 	assert.EqualError(t, err, "folder is not ready for delete, cannot move (copy&delete): delete not ready")
 }
+
+func TestMovedUids(t *testing.T) {
+	tests := []struct {
+		name     string
+		validity uint32
+		src      string
+		dst      string
+		expected *domain.MovedUids
+	}{
+		{
+			name:     "ranges",
+			validity: 3,
+			src:      "4,7:8",
+			dst:      "1:3",
+			expected: &domain.MovedUids{UidValidity: 3, Uids: map[uint32]uint32{4: 1, 7: 2, 8: 3}},
+		},
+		{
+			name:     "different lengths",
+			validity: 3,
+			src:      "4:5",
+			dst:      "1",
+			expected: &domain.MovedUids{Uids: map[uint32]uint32{}},
+		},
+		{
+			name:     "unknown validity",
+			src:      "4",
+			dst:      "1",
+			expected: &domain.MovedUids{Uids: map[uint32]uint32{}},
+		},
+		{
+			name:     "dynamic range",
+			validity: 3,
+			src:      "4:*",
+			dst:      "1",
+			expected: &domain.MovedUids{Uids: map[uint32]uint32{}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src, err := imap.ParseSeqSet(test.src)
+			assert.NoError(t, err)
+			dst, err := imap.ParseSeqSet(test.dst)
+			assert.NoError(t, err)
+
+			assert.Equal(t, test.expected, movedUids(test.validity, src, dst))
+		})
+	}
+}
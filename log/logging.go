@@ -43,6 +43,7 @@ const (
 	LOG_SPAMASSASSIN = "SA"
 	LOG_PERSISTENCE  = "PI"
 	LOG_IMAP         = "IM"
+	LOG_CLASSIFIER   = "CL"
 )
 
 func getLevel(loglevel string) logrus.Level {
@@ -77,6 +78,7 @@ func InitLogging(loglevel string) {
 		LOG_SPAMASSASSIN,
 		LOG_PERSISTENCE,
 		LOG_IMAP,
+		LOG_CLASSIFIER,
 	} {
 		initLogger(prefix, loglevel)
 	}
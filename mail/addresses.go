@@ -0,0 +1,78 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	stdmail "net/mail"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-message/charset"
+)
+
+var addressParser = &stdmail.AddressParser{WordDecoder: &mime.WordDecoder{CharsetReader: charset.Reader}}
+
+// Sender returns the lowercase address of the From header of rawMail, or an empty string if there is none or it
+// can't be parsed.
+func Sender(rawMail []byte) (string, error) {
+	msg, err := stdmail.ReadMessage(bytes.NewReader(rawMail))
+	if err != nil {
+		return "", fmt.Errorf("could not parse mail: %w", err)
+	}
+
+	return HeaderSender(msg.Header), nil
+}
+
+// HeaderSender returns the lowercase address of the From header, or an empty string if there is none or it can't be
+// parsed. Display names in legacy charsets are decoded, they're common in spam.
+func HeaderSender(header stdmail.Header) string {
+	addresses := headerAddresses(header, "From")
+	if len(addresses) == 0 {
+		return ""
+	}
+
+	return addresses[0]
+}
+
+// Recipients returns the sorted and deduplicated lowercase addresses of the To, Cc and Bcc headers of rawMail.
+// Headers that can't be parsed are skipped.
+func Recipients(rawMail []byte) ([]string, error) {
+	msg, err := stdmail.ReadMessage(bytes.NewReader(rawMail))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse mail: %w", err)
+	}
+
+	unique := map[string]bool{}
+	for _, address := range headerAddresses(msg.Header, "To", "Cc", "Bcc") {
+		unique[address] = true
+	}
+
+	recipients := make([]string, 0, len(unique))
+	for address := range unique {
+		recipients = append(recipients, address)
+	}
+	sort.Strings(recipients)
+
+	return recipients, nil
+}
+
+func headerAddresses(header stdmail.Header, keys ...string) []string {
+	result := []string{}
+	for _, key := range keys {
+		for _, value := range header[key] {
+			addresses, err := addressParser.ParseList(value)
+			if err != nil {
+				continue
+			}
+			for _, address := range addresses {
+				if strings.Contains(address.Address, "@") {
+					result = append(result, strings.ToLower(address.Address))
+				}
+			}
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,49 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package mail
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecipients(t *testing.T) {
+	tests := []struct {
+		name     string
+		rawMail  string
+		expected []string
+	}{
+		{"tocc", "To: Bob <Bob@Example.com>, carol@example.org\r\nCc: =?utf-8?q?D=C3=B6ra?= <dora@example.net>\r\n\r\n", []string{"bob@example.com", "carol@example.org", "dora@example.net"}},
+		{"bccduplicate", "To: bob@example.com\r\nBcc: BOB@example.com, eve@example.com\r\n\r\n", []string{"bob@example.com", "eve@example.com"}},
+		{"unparsable", "To: bob@example.com\r\nCc: <broken\r\n\r\n", []string{"bob@example.com"}},
+		{"undisclosed", "To: undisclosed-recipients:;\r\n\r\n", []string{}},
+		{"none", "Subject: Hello\r\n\r\n", []string{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			recipients, err := Recipients([]byte(tc.rawMail))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, recipients)
+		})
+	}
+}
+
+func TestSender(t *testing.T) {
+	tests := []struct {
+		name     string
+		rawMail  string
+		expected string
+	}{
+		{"name", "From: Alice <Alice@Example.com>\r\n\r\n", "alice@example.com"},
+		{"plain", "From: alice@example.com\r\n\r\n", "alice@example.com"},
+		{"unparsable", "From: <broken\r\n\r\n", ""},
+		{"none", "Subject: Hello\r\n\r\n", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sender, err := Sender([]byte(tc.rawMail))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, sender)
+		})
+	}
+}
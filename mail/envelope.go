@@ -0,0 +1,96 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	stdmail "net/mail"
+	"regexp"
+	"strings"
+)
+
+// Envelope contains the SMTP envelope of a mail as recorded by the trusted receiving servers.
+type Envelope struct {
+	Ip        string
+	Helo      string
+	Hostname  string
+	From      string
+	Rcpt      string
+	DeliverTo string
+}
+
+var (
+	receivedFrom = regexp.MustCompile(`(?is)^\s*from\s+(\S+)(.*?)\s+by\s`)
+	receivedIp   = regexp.MustCompile(`\[(?:IPv6:)?([0-9a-fA-F:.]+)\]`)
+	receivedRdns = regexp.MustCompile(`\(\s*([^\s()\[\]]+)\s*\[`)
+	receivedFor  = regexp.MustCompile(`(?i)\sfor\s+<?([^\s<>;]+@[^\s<>;]+)>?`)
+)
+
+// MailEnvelope reconstructs the SMTP envelope from the headers of rawMail. trustedHops is the number of Received
+// headers at the top of the mail that were added by servers that can be trusted, e.g. the mailbox provider's MX and
+// its internal relays. The client ip and helo are taken from the last trusted Received header because that's where
+// the trusted server recorded the (untrusted) client handing over the mail. A trustedHops of 0 disables Received
+// parsing.
+func MailEnvelope(rawMail []byte, trustedHops int) (*Envelope, error) {
+	msg, err := stdmail.ReadMessage(bytes.NewReader(rawMail))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse mail: %w", err)
+	}
+
+	envelope := &Envelope{}
+
+	received := msg.Header["Received"]
+	if trustedHops > 0 && len(received) > 0 {
+		if trustedHops > len(received) {
+			trustedHops = len(received)
+		}
+		parseReceived(received[trustedHops-1], envelope)
+	}
+
+	envelope.From = firstAddress(msg.Header, "Return-Path", "X-Envelope-From")
+	if len(envelope.Rcpt) == 0 {
+		envelope.Rcpt = firstAddress(msg.Header, "Envelope-To", "X-Envelope-To", "X-Original-To", "Delivered-To")
+	}
+	envelope.DeliverTo = firstAddress(msg.Header, "Delivered-To", "Envelope-To", "X-Envelope-To", "X-Original-To")
+	if len(envelope.DeliverTo) == 0 {
+		envelope.DeliverTo = envelope.Rcpt
+	}
+
+	return envelope, nil
+}
+
+func parseReceived(received string, envelope *Envelope) {
+	if m := receivedFor.FindStringSubmatch(received); m != nil {
+		envelope.Rcpt = m[1]
+	}
+
+	m := receivedFrom.FindStringSubmatch(received)
+	if m == nil {
+		return
+	}
+
+	envelope.Helo = m[1]
+	if ip := receivedIp.FindStringSubmatch(m[2]); ip != nil && net.ParseIP(ip[1]) != nil {
+		envelope.Ip = ip[1]
+	} else if ip := strings.Trim(m[1], "[]"); net.ParseIP(ip) != nil {
+		// helo was an address literal
+		envelope.Ip = ip
+	}
+
+	if rdns := receivedRdns.FindStringSubmatch(m[2]); rdns != nil && net.ParseIP(rdns[1]) == nil {
+		envelope.Hostname = rdns[1]
+	}
+}
+
+func firstAddress(header stdmail.Header, keys ...string) string {
+	for _, key := range keys {
+		value := strings.TrimSpace(header.Get(key))
+		value = strings.TrimSpace(strings.Trim(value, "<>"))
+		if len(value) > 0 {
+			return value
+		}
+	}
+
+	return ""
+}
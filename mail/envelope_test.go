@@ -0,0 +1,55 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package mail
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMailEnvelope(t *testing.T) {
+	tests := []struct {
+		name        string
+		file        string
+		trustedHops int
+		expected    *Envelope
+	}{
+		{"firsthop", "nonascii.msg", 1, &Envelope{Ip: "123.123.123.123", Helo: "foo.bar", From: "foo.bar", Rcpt: "crawx@crawx.crawx", DeliverTo: "crawx@crawx.crawx"}},
+		{"secondhop", "nonascii.msg", 2, &Envelope{Helo: "163.com", From: "foo.bar", Rcpt: "someone@online.de", DeliverTo: "crawx@crawx.crawx"}},
+		{"toomanyhops", "nonascii.msg", 5, &Envelope{Helo: "163.com", From: "foo.bar", Rcpt: "someone@online.de", DeliverTo: "crawx@crawx.crawx"}},
+		{"noreceivedparsing", "nonascii.msg", 0, &Envelope{From: "foo.bar", Rcpt: "crawx@crawx.crawx", DeliverTo: "crawx@crawx.crawx"}},
+		{"noreceived", "noreceived.msg", 1, &Envelope{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rawMail, err := ioutil.ReadFile(path.Join("testdata", tc.file))
+			assert.NoError(t, err)
+
+			envelope, err := MailEnvelope(rawMail, tc.trustedHops)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, envelope)
+		})
+	}
+}
+
+func Test_parseReceived(t *testing.T) {
+	tests := []struct {
+		name     string
+		received string
+		expected *Envelope
+	}{
+		{"rdns", "from helo.example.com (mail.example.com [192.0.2.1]) by mx.example.net with ESMTPS id 123 for <me@example.net>; Mon, 15 Jun 2020 19:57:16 +0200", &Envelope{Ip: "192.0.2.1", Helo: "helo.example.com", Hostname: "mail.example.com", Rcpt: "me@example.net"}},
+		{"ipv6", "from helo.example.com ([IPv6:2001:db8::1]) by mx.example.net with ESMTP", &Envelope{Ip: "2001:db8::1", Helo: "helo.example.com"}},
+		{"addressliteral", "from [192.0.2.1] (unknown) by mx.example.net with SMTP", &Envelope{Ip: "192.0.2.1", Helo: "[192.0.2.1]"}},
+		{"nofrom", "by mx.example.net (Postfix, from userid 0) id 123", &Envelope{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			envelope := &Envelope{}
+			parseReceived(tc.received, envelope)
+			assert.Equal(t, tc.expected, envelope)
+		})
+	}
+}
@@ -0,0 +1,110 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package mail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/emersion/go-message"
+)
+
+// maxForwardDepth limits how deep forwarded mails attached to forwarded mails are unwrapped
+const maxForwardDepth = 5
+
+// UnwrapForwarded returns the original mails contained in rawMail so they can be learned individually: the original of
+// a SpamAssassin-style report, or every mail attached as message/rfc822 or .eml file anywhere in the multipart tree.
+// Attached mails that contain attached mails themselves, e.g. forwards of forwards, are unwrapped in turn. rawMail
+// itself is returned if it contains no original.
+func UnwrapForwarded(rawMail []byte) ([][]byte, error) {
+	return unwrapForwarded(rawMail, 0)
+}
+
+func unwrapForwarded(rawMail []byte, depth int) ([][]byte, error) {
+	unwrapped, err := UnwrapSpamassassinReport(rawMail)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(unwrapped, rawMail) {
+		return [][]byte{unwrapped}, nil
+	}
+	if depth >= maxForwardDepth {
+		return [][]byte{rawMail}, nil
+	}
+
+	entity, err := message.Read(bytes.NewReader(rawMail))
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return nil, fmt.Errorf("could not parse mail: %w", err)
+	}
+
+	attached, err := attachedMails(entity)
+	if err != nil {
+		return nil, err
+	}
+	if len(attached) == 0 {
+		return [][]byte{rawMail}, nil
+	}
+
+	originals := [][]byte{}
+	for _, a := range attached {
+		unwrapped, err := unwrapForwarded(a, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		originals = append(originals, unwrapped...)
+	}
+
+	return originals, nil
+}
+
+// attachedMails returns the decoded bodies of all message/rfc822 and .eml parts below entity
+func attachedMails(entity *message.Entity) ([][]byte, error) {
+	mr := entity.MultipartReader()
+	if mr == nil {
+		return [][]byte{}, nil
+	}
+
+	attached := [][]byte{}
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return attached, nil
+		}
+		if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+			// broken multipart structures are common in spam, use what has been read so far
+			return attached, nil
+		}
+
+		if !isAttachedMail(part.Header) {
+			nested, err := attachedMails(part)
+			if err != nil {
+				return nil, err
+			}
+			attached = append(attached, nested...)
+			continue
+		}
+
+		body, err := ioutil.ReadAll(part.Body)
+		if err != nil {
+			return nil, fmt.Errorf("could not read attached mail: %w", err)
+		}
+		attached = append(attached, body)
+	}
+}
+
+func isAttachedMail(header message.Header) bool {
+	mediaType, params, _ := header.ContentType()
+	if mediaType == "message/rfc822" {
+		return true
+	}
+
+	filename := params["name"]
+	if _, dispositionParams, err := header.ContentDisposition(); err == nil && len(dispositionParams["filename"]) > 0 {
+		filename = dispositionParams["filename"]
+	}
+
+	return !strings.HasPrefix(mediaType, "multipart/") && strings.HasSuffix(strings.ToLower(filename), ".eml")
+}
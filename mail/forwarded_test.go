@@ -0,0 +1,68 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package mail
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	spam1 = "Message-Id: <1@spam.example>\r\nSubject: Cheap pills\r\n\r\nBuy now\r\n"
+	spam2 = "Message-Id: <2@spam.example>\r\nSubject: Lottery\r\n\r\nYou won\r\n"
+)
+
+func forward(boundary string, parts ...string) string {
+	mail := "Message-Id: <fwd-" + boundary + "@example.com>\r\nSubject: Fwd: spam\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"" + boundary + "\"\r\n\r\n"
+	for _, part := range parts {
+		mail += "--" + boundary + "\r\n" + part + "\r\n"
+	}
+	return mail + "--" + boundary + "--\r\n"
+}
+
+func TestUnwrapForwarded(t *testing.T) {
+	text := "Content-Type: text/plain\r\n\r\nLook at this spam"
+	rfc822 := func(mail string) string { return "Content-Type: message/rfc822\r\n\r\n" + mail }
+	eml := "Content-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=\"Lottery.EML\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" + base64.StdEncoding.EncodeToString([]byte(spam2))
+
+	tests := []struct {
+		name     string
+		rawMail  string
+		expected []string
+	}{
+		{"plain", spam1, []string{spam1}},
+		{"single", forward("b1", text, rfc822(spam1)), []string{spam1}},
+		{"several", forward("b1", text, rfc822(spam1), eml), []string{spam1, spam2}},
+		{"nestedmultipart", forward("b1", text, "Content-Type: multipart/mixed; boundary=\"b2\"\r\n\r\n--b2\r\n"+rfc822(spam1)+"\r\n--b2--\r\n", eml), []string{spam1, spam2}},
+		{"forwardedforward", forward("b1", text, rfc822(forward("b2", text, rfc822(spam1)))), []string{spam1}},
+		{"noattachment", forward("b1", text), []string{forward("b1", text)}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			originals, err := UnwrapForwarded([]byte(tc.rawMail))
+			assert.NoError(t, err)
+
+			result := make([]string, len(originals))
+			for i, o := range originals {
+				result[i] = string(o)
+			}
+			assert.Equal(t, tc.expected, result)
+		})
+	}
+}
+
+func TestUnwrapForwarded_SpamassassinReport(t *testing.T) {
+	rawMail, err := ioutil.ReadFile(path.Join("testdata", "noreceived_wrapped.msg"))
+	assert.NoError(t, err)
+	expected, err := ioutil.ReadFile(path.Join("testdata", "noreceived.msg"))
+	assert.NoError(t, err)
+
+	originals, err := UnwrapForwarded(rawMail)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{expected}, originals)
+}
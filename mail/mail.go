@@ -12,38 +12,106 @@ import (
 	"mime/multipart"
 	stdmail "net/mail"
 	"strings"
+	"time"
 
 	"github.com/emersion/go-message/charset"
 )
 
-func MailHeaderInfos(rawMail []byte) (string, string, error) {
+// HashStrategy names what the MailIdHash of a mail was calculated from. Strategies are tried in the order below, the
+// first one whose headers are present is used.
+type HashStrategy string
+
+const (
+	// HashMessageId hashes the Message-Id and, if present, the Received headers
+	HashMessageId = HashStrategy("message-id")
+	// HashReceived hashes the Received headers of mails without Message-Id
+	HashReceived = HashStrategy("received")
+	// HashHeaders hashes the Date, From and Subject headers of mails without Message-Id and Received, e.g. drafts
+	HashHeaders = HashStrategy("headers")
+	// HashBody hashes the body of mails without any of the headers above
+	HashBody = HashStrategy("body")
+)
+
+// IdHeaders are the headers the MailIdHash is calculated from. Only mails that fall back to HashBody need more than
+// these headers.
+var IdHeaders = []string{"Message-Id", "Received", "Date", "From", "Subject"}
+
+// MailHeaderInfos returns the decoded subject and the MailIdHash identifying rawMail across folders and uid changes,
+// along with the strategy used to calculate it.
+func MailHeaderInfos(rawMail []byte) (string, string, HashStrategy, error) {
 	msg, err := stdmail.ReadMessage(bytes.NewReader(rawMail))
 	if err != nil {
-		return "", "", fmt.Errorf("could not parse mail: %w", err)
+		return "", "", "", fmt.Errorf("could not parse mail: %w", err)
+	}
+
+	subject, err := decodeSubject(msg.Header)
+	if err != nil {
+		return "", "", "", err
 	}
 
+	var strategy HashStrategy
+	var input [][]string
 	messageIdHeader := msg.Header["Message-Id"]
 	receivedHeader := msg.Header["Received"]
-	if len(receivedHeader) == 0 && len(messageIdHeader) == 0 {
-		return "", "", fmt.Errorf("Received and Message-Id header header not found")
+	switch {
+	case len(messageIdHeader) > 0:
+		// Message-Id and Received are hashed together for compatibility with mails recorded before the fallbacks
+		strategy, input = HashMessageId, [][]string{messageIdHeader, receivedHeader}
+	case len(receivedHeader) > 0:
+		strategy, input = HashReceived, [][]string{receivedHeader}
+	case len(msg.Header["Date"]) > 0 || len(msg.Header["From"]) > 0:
+		strategy, input = HashHeaders, [][]string{{string(HashHeaders)}, msg.Header["Date"], msg.Header["From"], msg.Header["Subject"]}
+	default:
+		body, err := ioutil.ReadAll(msg.Body)
+		if err != nil {
+			return "", "", "", fmt.Errorf("could not read mail body: %w", err)
+		}
+		strategy, input = HashBody, [][]string{{string(HashBody)}, {string(body)}}
 	}
 
-	subjectHeader := msg.Header.Get("Subject")
+	mailIdHash, err := hash(input)
+	if err != nil {
+		return "", "", "", fmt.Errorf("could not hash headers: %w", err)
+	}
 
-	dec := &mime.WordDecoder{
-		CharsetReader: charset.Reader,
+	return subject, mailIdHash, strategy, nil
+}
+
+// Subject returns the decoded Subject header of rawMail.
+func Subject(rawMail []byte) (string, error) {
+	msg, err := stdmail.ReadMessage(bytes.NewReader(rawMail))
+	if err != nil {
+		return "", fmt.Errorf("could not parse mail: %w", err)
 	}
-	subject, err := dec.DecodeHeader(subjectHeader)
+
+	return decodeSubject(msg.Header)
+}
+
+// Date returns the parsed Date header of rawMail, or the zero time if there is none or it can't be parsed.
+func Date(rawMail []byte) (time.Time, error) {
+	msg, err := stdmail.ReadMessage(bytes.NewReader(rawMail))
 	if err != nil {
-		return "", "", fmt.Errorf("could decode subject header: %w", err)
+		return time.Time{}, fmt.Errorf("could not parse mail: %w", err)
 	}
 
-	mailIdHash, err := hash([][]string{messageIdHeader, receivedHeader})
+	date, err := msg.Header.Date()
 	if err != nil {
-		return "", "", fmt.Errorf("could not hash headers: %w", err)
+		return time.Time{}, nil
 	}
 
-	return subject, mailIdHash, nil
+	return date, nil
+}
+
+func decodeSubject(header stdmail.Header) (string, error) {
+	dec := &mime.WordDecoder{
+		CharsetReader: charset.Reader,
+	}
+	subject, err := dec.DecodeHeader(header.Get("Subject"))
+	if err != nil {
+		return "", fmt.Errorf("could decode subject header: %w", err)
+	}
+
+	return subject, nil
 }
 
 func UnwrapSpamassassinReport(rawMail []byte) ([]byte, error) {
@@ -97,6 +165,12 @@ func UnwrapSpamassassinReport(rawMail []byte) ([]byte, error) {
 	}
 }
 
+// ContentHash identifies a mail by its full content, unlike the MailIdHash returned by MailHeaderInfos it changes with
+// any modification of the mail.
+func ContentHash(rawMail []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(rawMail))
+}
+
 func ShortSubject(subject string) string {
 	if (len(subject)) > 30 {
 		subject = subject[:30] + "..."
@@ -5,36 +5,78 @@ import (
 	"io/ioutil"
 	"path"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestMailHeaderInfos(t *testing.T) {
 	tests := []struct {
-		name    string
-		subject string
-		hash    string
-		err     string
+		name     string
+		subject  string
+		hash     string
+		strategy HashStrategy
 	}{
-		{"nonascii.msg", "M¥ RêÐ Çå§ïñð", "9dab633b491d5ed31e546d3e2396874da5eebb2503efbfff12241ab2b82824bd", ""},
-		{"noreceived.msg", "Saying Hello", "db58509a9edd75ac0d9cddb528b5a2515df34336aeda5e416d412e3595b4e6d4", ""},
-		{"nohashheaders.msg", "", "", "Received and Message-Id header header not found"},
+		{"nonascii.msg", "M¥ RêÐ Çå§ïñð", "9dab633b491d5ed31e546d3e2396874da5eebb2503efbfff12241ab2b82824bd", HashMessageId},
+		{"noreceived.msg", "Saying Hello", "db58509a9edd75ac0d9cddb528b5a2515df34336aeda5e416d412e3595b4e6d4", HashMessageId},
+		{"nohashheaders.msg", "Saying Hello", "0c822ba234acca7e368aa03240246bd0724e7cc1c770a10c24163d4035fb2435", HashHeaders},
 	}
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
 			rawMail, err := ioutil.ReadFile(path.Join("testdata", tc.name))
 			assert.NoError(t, err)
-			subject, hash, err := MailHeaderInfos(rawMail)
+			subject, hash, strategy, err := MailHeaderInfos(rawMail)
 
-			if len(tc.err) == 0 {
-				assert.NoError(t, err)
-				assert.Equal(t, tc.subject, subject)
-				assert.Equal(t, tc.hash, hash)
-			} else {
-				assert.Empty(t, subject)
-				assert.Empty(t, hash)
-				assert.EqualError(t, err, tc.err)
-			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.subject, subject)
+			assert.Equal(t, tc.hash, hash)
+			assert.Equal(t, tc.strategy, strategy)
+		})
+	}
+}
+
+func TestMailHeaderInfos_Fallbacks(t *testing.T) {
+	tests := []struct {
+		name     string
+		rawMail  string
+		other    string
+		strategy HashStrategy
+		same     bool
+	}{
+		{"receivedonly", "Received: from a by b\r\nSubject: A\r\n\r\nbody", "Received: from a by b\r\nSubject: B\r\n\r\nother", HashReceived, true},
+		{"headers", "Date: Fri, 21 Nov 1997 09:55:06 -0600\r\nSubject: Draft\r\n\r\nbody", "Date: Fri, 21 Nov 1997 09:55:06 -0600\r\nSubject: Draft\r\n\r\nedited", HashHeaders, true},
+		{"headersdiffer", "From: a@example.com\r\nSubject: Draft\r\n\r\nbody", "From: b@example.com\r\nSubject: Draft\r\n\r\nbody", HashHeaders, false},
+		{"body", "Subject: Imported\r\n\r\nbody", "Subject: Imported\r\n\r\nbody", HashBody, true},
+		{"bodydiffers", "Subject: Imported\r\n\r\nbody", "Subject: Imported\r\n\r\nother", HashBody, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, hash, strategy, err := MailHeaderInfos([]byte(tc.rawMail))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.strategy, strategy)
+
+			_, otherHash, _, err := MailHeaderInfos([]byte(tc.other))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.same, hash == otherHash)
+		})
+	}
+}
+
+func TestDate(t *testing.T) {
+	tests := []struct {
+		name     string
+		rawMail  string
+		expected time.Time
+	}{
+		{"date", "Date: Fri, 21 Nov 1997 09:55:06 -0600\r\n\r\n", time.Date(1997, 11, 21, 15, 55, 6, 0, time.UTC)},
+		{"unparsable", "Date: yesterday\r\n\r\n", time.Time{}},
+		{"none", "Subject: Hello\r\n\r\n", time.Time{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			date, err := Date([]byte(tc.rawMail))
+			assert.NoError(t, err)
+			assert.True(t, tc.expected.Equal(date), "expected %v, got %v", tc.expected, date)
 		})
 	}
 }
@@ -0,0 +1,119 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+)
+
+// Attachment is an additional file attached to a report after the original mail.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// Report creates a mail similar to SpamAssassin's report: spamHeaders are set on the report, text is the
+// human-readable report and rawMail is attached as message/rfc822 with x-spam-type=original so
+// UnwrapSpamassassinReport can restore it when the report is learned. attachments are added after the original mail.
+func Report(rawMail []byte, checker string, spamHeaders map[string]string, text []byte, attachments ...Attachment) ([]byte, error) {
+	subject, err := Subject(rawMail)
+	if err != nil {
+		return nil, fmt.Errorf("could not read mail: %w", err)
+	}
+
+	buffer := &bytes.Buffer{}
+
+	from := []*mail.Address{{Name: "go-imap-assassin", Address: "go-imap-assassin@localhost"}}
+	to := []*mail.Address{{Name: "go-imap-assassin", Address: "go-imap-assassin@localhost"}}
+
+	header := mail.Header{}
+	header.SetDate(time.Now())
+	header.SetAddressList("From", from)
+	header.SetAddressList("To", to)
+	header.SetSubject(subject)
+
+	keys := make([]string, 0, len(spamHeaders))
+	for key := range spamHeaders {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		header.Set(key, spamHeaders[key])
+	}
+
+	mailWriter, err := mail.CreateWriter(buffer, header)
+	if err != nil {
+		return nil, fmt.Errorf("could not create mail writer: %w", err)
+	}
+
+	textPart, err := mailWriter.CreateInline()
+	if err != nil {
+		return nil, fmt.Errorf("could not create mail text part: %w", err)
+	}
+	inlineHeader := mail.InlineHeader{}
+	inlineHeader.Set("Content-Type", "text/plain")
+	textPartWriter, err := textPart.CreatePart(inlineHeader)
+	if err != nil {
+		return nil, fmt.Errorf("could not create text part: %w", err)
+	}
+	_, err = textPartWriter.Write(text)
+	if err != nil {
+		return nil, fmt.Errorf("could not write text part: %w", err)
+	}
+	err = textPartWriter.Close()
+	if err != nil {
+		return nil, fmt.Errorf("could not close text part writer: %w", err)
+	}
+	err = textPart.Close()
+	if err != nil {
+		return nil, fmt.Errorf("could not close text part: %w", err)
+	}
+
+	attachmentHeader := mail.AttachmentHeader{}
+	attachmentHeader.Set("Content-Type", "message/rfc822; x-spam-type=original")
+	attachmentHeader.Set("Content-Description", "original message before "+checker)
+	attachmentHeader.Set("Content-Transfer-Encoding", "binary")
+	attachmentHeader.SetFilename("original-mail.eml")
+	attachmentWriter, err := mailWriter.CreateAttachment(attachmentHeader)
+	if err != nil {
+		return nil, fmt.Errorf("could not create attachment part: %w", err)
+	}
+	_, err = attachmentWriter.Write(rawMail)
+	if err != nil {
+		return nil, fmt.Errorf("could not write attachment: %w", err)
+	}
+	err = attachmentWriter.Close()
+	if err != nil {
+		return nil, fmt.Errorf("could not close attachment writer: %w", err)
+	}
+
+	for _, attachment := range attachments {
+		attachmentHeader := mail.AttachmentHeader{}
+		attachmentHeader.Set("Content-Type", attachment.ContentType)
+		attachmentHeader.SetFilename(attachment.Filename)
+		attachmentWriter, err := mailWriter.CreateAttachment(attachmentHeader)
+		if err != nil {
+			return nil, fmt.Errorf("could not create attachment part for %s: %w", attachment.Filename, err)
+		}
+		_, err = attachmentWriter.Write(attachment.Data)
+		if err != nil {
+			return nil, fmt.Errorf("could not write attachment %s: %w", attachment.Filename, err)
+		}
+		err = attachmentWriter.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not close attachment writer for %s: %w", attachment.Filename, err)
+		}
+	}
+
+	err = mailWriter.Close()
+	if err != nil {
+		return nil, fmt.Errorf("could not close mail writer: %w", err)
+	}
+
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,70 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"sort"
+	"strings"
+)
+
+// Tag returns rawMail with headers added in front of its header, existing headers of the same names are removed. If
+// subject is not empty, the Subject header is replaced with it. All other headers and the body are kept byte for
+// byte, including their line endings.
+func Tag(rawMail []byte, headers map[string]string, subject string) ([]byte, error) {
+	newline := []byte("\n")
+	if i := bytes.IndexByte(rawMail, '\n'); i > 0 && rawMail[i-1] == '\r' {
+		newline = []byte("\r\n")
+	}
+
+	headerEnd := bytes.Index(rawMail, append(append([]byte{}, newline...), newline...))
+	if headerEnd < 0 {
+		return nil, fmt.Errorf("could not find end of mail header")
+	}
+	headerEnd += len(newline)
+
+	remove := map[string]bool{}
+	for name := range headers {
+		remove[strings.ToLower(name)] = true
+	}
+	if len(subject) > 0 {
+		remove["subject"] = true
+	}
+
+	tagged := &bytes.Buffer{}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		tagged.WriteString(name + ": " + headers[name])
+		tagged.Write(newline)
+	}
+	if len(subject) > 0 {
+		tagged.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", subject))
+		tagged.Write(newline)
+	}
+
+	// copy all header fields that aren't replaced, continuation lines belong to the preceding field
+	skip := false
+	for _, line := range bytes.SplitAfter(rawMail[:headerEnd], newline) {
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			name := line
+			if i := bytes.IndexByte(line, ':'); i >= 0 {
+				name = line[:i]
+			}
+			skip = remove[strings.ToLower(string(bytes.TrimSpace(name)))]
+		}
+		if !skip {
+			tagged.Write(line)
+		}
+	}
+
+	tagged.Write(rawMail[headerEnd:])
+	return tagged.Bytes(), nil
+}
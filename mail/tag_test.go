@@ -0,0 +1,74 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package mail
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTag(t *testing.T) {
+	tests := []struct {
+		name    string
+		mail    string
+		headers map[string]string
+		subject string
+		tagged  string
+		err     string
+	}{
+		{
+			"crlf",
+			"Subject: Hello\r\n world\r\nX-Spam-Flag: NO\r\nMessage-Id: <1@example.com>\r\n\r\nBody\r\n\r\nX-Spam-Flag: NO\r\n",
+			map[string]string{"X-Spam-Flag": "YES", "X-Spam-Score": "7.50"},
+			"[SPAM] Hello world",
+			"X-Spam-Flag: YES\r\nX-Spam-Score: 7.50\r\nSubject: [SPAM] Hello world\r\nMessage-Id: <1@example.com>\r\n\r\nBody\r\n\r\nX-Spam-Flag: NO\r\n",
+			"",
+		},
+		{
+			"lfkeepsubject",
+			"Subject: Hello\nx-spam-flag: NO\n\nBody\n",
+			map[string]string{"X-Spam-Flag": "YES"},
+			"",
+			"X-Spam-Flag: YES\nSubject: Hello\n\nBody\n",
+			"",
+		},
+		{
+			"nonascii",
+			"Subject: Hi\r\n\r\nBody",
+			map[string]string{},
+			"[SPAM] Grüße",
+			"Subject: =?utf-8?q?[SPAM]_Gr=C3=BC=C3=9Fe?=\r\n\r\nBody",
+			"",
+		},
+		{"noheaderend", "Subject: Hi\r\n", map[string]string{}, "", "", "could not find end of mail header"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tagged, err := Tag([]byte(tc.mail), tc.headers, tc.subject)
+			if len(tc.err) > 0 {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.tagged, string(tagged))
+
+			if len(tc.subject) > 0 {
+				subject, err := Subject(tagged)
+				assert.NoError(t, err)
+				assert.Equal(t, tc.subject, subject)
+			}
+		})
+	}
+}
+
+func TestTagKeepsMailIdHash(t *testing.T) {
+	rawMail := []byte("Received: from a by b\r\nMessage-Id: <1@example.com>\r\nSubject: Hello\r\n\r\nBody")
+	tagged, err := Tag(rawMail, map[string]string{"X-Spam-Flag": "YES"}, "[SPAM] Hello")
+	assert.NoError(t, err)
+
+	_, hash, _, err := MailHeaderInfos(rawMail)
+	assert.NoError(t, err)
+	_, taggedHash, _, err := MailHeaderInfos(tagged)
+	assert.NoError(t, err)
+	assert.Equal(t, hash, taggedHash)
+}
@@ -0,0 +1,141 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package mail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/emersion/go-message"
+)
+
+const (
+	minTokenLength = 3
+	maxTokenLength = 40
+	// maxTextSize limits the decoded text that is tokenized per part
+	maxTextSize = 256 * 1024
+)
+
+// tokenHeaders are tokenized with the lowercase header name as prefix
+var tokenHeaders = []string{"Subject", "From", "To", "Cc", "Reply-To", "Return-Path", "List-Id", "X-Mailer", "User-Agent"}
+
+var (
+	htmlTag  = regexp.MustCompile(`(?s)<[^>]*>`)
+	urlHost  = regexp.MustCompile(`(?i)https?://([a-z0-9.-]+)`)
+	wordChar = func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '\'' && r != '$' && r != '@' && r != '.'
+	}
+)
+
+// Tokens splits the headers and decoded text parts of rawMail into the unique tokens used for statistical
+// classification. Header tokens are prefixed with the header name, e.g. "subject:viagra" or "from:example.com", links
+// are added as "url:example.com".
+func Tokens(rawMail []byte) ([]string, error) {
+	entity, err := message.Read(bytes.NewReader(rawMail))
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return nil, fmt.Errorf("could not parse mail: %w", err)
+	}
+
+	tokens := map[string]bool{}
+	for _, key := range tokenHeaders {
+		prefix := strings.ToLower(key) + ":"
+		for _, value := range headerValues(entity.Header, key) {
+			addTokens(tokens, prefix, value)
+		}
+	}
+
+	err = tokenizeEntity(entity, tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]string, 0, len(tokens))
+	for token := range tokens {
+		result = append(result, token)
+	}
+
+	return result, nil
+}
+
+func headerValues(header message.Header, key string) []string {
+	values := []string{}
+	fields := header.FieldsByKey(key)
+	for fields.Next() {
+		value, err := fields.Text()
+		if err != nil {
+			// undecodable headers are tokenized raw
+			value = fields.Value()
+		}
+		values = append(values, value)
+	}
+
+	return values
+}
+
+func tokenizeEntity(entity *message.Entity, tokens map[string]bool) error {
+	if mr := entity.MultipartReader(); mr != nil {
+		for {
+			part, err := mr.NextPart()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+				// broken multipart structures are common in spam, use what has been read so far
+				return nil
+			}
+
+			err = tokenizeEntity(part, tokens)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	mediaType, _, _ := entity.Header.ContentType()
+	if mediaType == "" {
+		mediaType = "text/plain"
+	}
+	tokens["type:"+mediaType] = true
+	if mediaType != "text/plain" && mediaType != "text/html" {
+		return nil
+	}
+
+	text, err := ioutil.ReadAll(io.LimitReader(entity.Body, maxTextSize))
+	if err != nil {
+		// undecodable bodies are skipped, the headers are still tokenized
+		tokens["error:body"] = true
+		return nil
+	}
+
+	for _, host := range urlHost.FindAllSubmatch(text, -1) {
+		tokens["url:"+strings.ToLower(string(host[1]))] = true
+	}
+
+	if mediaType == "text/html" {
+		text = htmlTag.ReplaceAll(text, []byte(" "))
+	}
+	addTokens(tokens, "", string(text))
+
+	return nil
+}
+
+func addTokens(tokens map[string]bool, prefix, text string) {
+	for _, word := range strings.FieldsFunc(text, wordChar) {
+		word = strings.ToLower(strings.Trim(word, "-'.@"))
+		if len(word) < minTokenLength || len(word) > maxTokenLength || strings.IndexFunc(word, unicode.IsLetter) == -1 {
+			continue
+		}
+
+		tokens[prefix+word] = true
+
+		// addresses are also tokenized by domain
+		if at := strings.LastIndex(word, "@"); at > -1 && at < len(word)-1 {
+			tokens[prefix+word[at+1:]] = true
+		}
+	}
+}
@@ -0,0 +1,43 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package mail
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokens(t *testing.T) {
+	tests := []struct {
+		name     string
+		contains []string
+		missing  []string
+	}{
+		{"noreceived.msg", []string{"subject:saying", "from:jdoe@machine.example", "from:machine.example", "to:mary@example.net", "hello", "message", "type:text/plain"}, []string{"is", "a", "hello."}},
+		{"nonascii.msg", []string{"subject:rêð", "return-path:foo.bar", "blubbbb", "type:text/html"}, nil},
+		{"noreceived_wrapped.msg", []string{"type:message/rfc822", "kutt.it"}, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rawMail, err := ioutil.ReadFile(path.Join("testdata", tc.name))
+			assert.NoError(t, err)
+
+			tokens, err := Tokens(rawMail)
+			assert.NoError(t, err)
+			for _, token := range tc.contains {
+				assert.Contains(t, tokens, token)
+			}
+			for _, token := range tc.missing {
+				assert.NotContains(t, tokens, token)
+			}
+		})
+	}
+}
+
+func Test_addTokens(t *testing.T) {
+	tokens := map[string]bool{}
+	addTokens(tokens, "from:", "John <John.Doe@Example.com>, 12345, a")
+	assert.Equal(t, map[string]bool{"from:john": true, "from:john.doe@example.com": true, "from:example.com": true}, tokens)
+}
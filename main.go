@@ -2,18 +2,30 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
-	"strings"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
 
 	"github.com/CrawX/go-imap-assassin/classifier"
+	"github.com/CrawX/go-imap-assassin/classifier/bayes"
+	"github.com/CrawX/go-imap-assassin/classifier/command"
 	"github.com/CrawX/go-imap-assassin/classifier/rspamd"
 	"github.com/CrawX/go-imap-assassin/classifier/spamassassin"
+	"github.com/CrawX/go-imap-assassin/classifier/webhook"
 	"github.com/CrawX/go-imap-assassin/config"
 	"github.com/CrawX/go-imap-assassin/domain"
 	"github.com/CrawX/go-imap-assassin/imapassassin"
 	"github.com/CrawX/go-imap-assassin/imapconnection"
 	"github.com/CrawX/go-imap-assassin/log"
 	"github.com/CrawX/go-imap-assassin/persistence"
+	"github.com/CrawX/go-imap-assassin/rules"
 
 	"github.com/sirupsen/logrus"
 )
@@ -23,8 +35,48 @@ func main() {
 	logger := log.Logger(log.LOG_MAIN)
 
 	configFile := flag.String("config", "config.toml", "config file to load")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [status | undo [undo flags]]\n\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Without a command, mails are learned and checked. status prints the classifier's health, version and\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "statistics and exits with 1 if it's not reachable. undo moves the mails moved by a run or within a time\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "range back and reports what could not be restored.\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
+	undoFlags := flag.NewFlagSet("undo", flag.ExitOnError)
+	undoRun := undoFlags.String("run", "", "id of the run to undo, as logged at its start")
+	undoSince := undoFlags.String("since", "", "undo actions since this time, RFC3339 or 2006-01-02 15:04 in local time")
+	undoUntil := undoFlags.String("until", "", "undo actions until this time, RFC3339 or 2006-01-02 15:04 in local time")
+	undoLearn := undoFlags.Bool("learn", false, "learn the restored mails as ham")
+
+	cmd := flag.Arg(0)
+	var undoFrom, undoTo time.Time
+	switch cmd {
+	case "", "status":
+		if flag.NArg() > 1 {
+			flag.Usage()
+			os.Exit(2)
+		}
+	case "undo":
+		_ = undoFlags.Parse(flag.Args()[1:])
+		var err error
+		if undoFrom, err = parseTime(*undoSince); err != nil {
+			logger.WithField("error", err).Fatal("Invalid -since")
+		}
+		if undoTo, err = parseTime(*undoUntil); err != nil {
+			logger.WithField("error", err).Fatal("Invalid -until")
+		}
+		if undoFlags.NArg() > 0 || (len(*undoRun) == 0 && undoFrom.IsZero()) {
+			fmt.Fprintf(undoFlags.Output(), "undo requires -run or -since\n\nUndo flags:\n")
+			undoFlags.PrintDefaults()
+			os.Exit(2)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	conf, err := config.ReadConfig(*configFile)
 	if err != nil {
 		logger.WithFields(logrus.Fields{"error": err, "configfile": *configFile}).Fatal("Could not load config")
@@ -34,25 +86,41 @@ func main() {
 		log.SetLogLevel(*conf.Loglevel)
 	}
 
+	ctx, stop := interruptContext(logger)
+	defer stop()
+
 	p, err := persistence.NewPersistence(conf.Database)
 	if err != nil {
 		logger.WithField("error", err).Fatal("Could not connect to database")
 	}
 	defer p.Close()
 
-	var spamClassifier domain.SpamClassifier
-	if conf.SpamassassinHost != "" {
-		logger.WithFields(logrus.Fields{"classifier": "spamassassin", "spamassssinhost": conf.SpamassassinHost}).Info("Using SpamAssassin")
-		spamClassifier, err = spamassassin.NewSpamassassin(conf.SpamassassinHost)
-		if err != nil {
-			logger.WithField("error", err).Fatal("Could not start SpamAssassin connector")
+	// status reports unreachable endpoints instead of failing before it printed anything
+	spamClassifier, err := newSpamClassifier(conf, p, logger, cmd != "status")
+	if err != nil {
+		logger.WithField("error", err).Fatal("Could not start classifier")
+	}
+
+	if cmd == "status" {
+		info := spamClassifier.Info(ctx)
+		printInfo(os.Stdout, info, "")
+		if info.Error != nil {
+			logger.WithField("error", info.Error).Fatal("Classifier not reachable")
 		}
-	} else {
-		controllerWithoutTrailingSlashes := strings.TrimRight(conf.RspamdController, "/")
-		logger.WithFields(logrus.Fields{"classifier": "rspamd", "rspamdcontroller": controllerWithoutTrailingSlashes}).Info("Using Rspamd")
-		spamClassifier, err = rspamd.NewRspamd(controllerWithoutTrailingSlashes, conf.RspamdPassword)
+		return
+	}
+
+	// recorded with every mail the classifier checks or learns
+	classifierInfo := spamClassifier.Info(ctx)
+	if classifierInfo.Error != nil {
+		logger.WithField("error", classifierInfo.Error).Warn("Could not read classifier version")
+	}
+
+	if conf.ResultCache {
+		logger.WithFields(logrus.Fields{"ttl": conf.ResultCacheTTL}).Info("Caching classifier results")
+		spamClassifier, err = classifier.NewCachingSpamClassifier(spamClassifier, p, time.Duration(conf.ResultCacheTTL)*time.Hour)
 		if err != nil {
-			logger.WithField("error", err).Fatal("Could not start rspamd connector")
+			logger.WithField("error", err).Fatal("Could not start result cache")
 		}
 	}
 
@@ -62,7 +130,15 @@ func main() {
 	}
 	defer imapConn.Close()
 
-	configs := []imapassassin.ConfigFunc{}
+	// every mailbox mutation is recorded under the run id so it can be undone. The pid keeps runs started within the
+	// same millisecond apart, e.g. a cron run overlapping a manual one.
+	runId := fmt.Sprintf("%s-%d", time.Now().Format("20060102-150405.000"), os.Getpid())
+	logger.WithField("runid", runId).Info("Starting run")
+
+	configs := []imapassassin.ConfigFunc{
+		imapassassin.Classifier(classifierInfo.Name, classifierInfo.Version),
+		imapassassin.AuditLog(runId, p),
+	}
 	if conf.DryRun {
 		configs = append(configs, imapassassin.DryRun())
 	}
@@ -73,6 +149,9 @@ func main() {
 	if conf.MoveSpam {
 		configs = append(configs, imapassassin.MoveSpam(conf.SpamFolder))
 	}
+	if conf.TagSpam {
+		configs = append(configs, imapassassin.TagSpam(conf.SpamSubjectPrefix))
+	}
 	if conf.AppendReports {
 		configs = append(configs, imapassassin.AppendReports(conf.ReportFolder))
 	}
@@ -80,12 +159,65 @@ func main() {
 	if conf.DeleteLearned {
 		configs = append(configs, imapassassin.DeleteLearned())
 	}
+	if conf.SpamGraceDays > 0 {
+		configs = append(configs, imapassassin.ConfirmSpam(time.Duration(conf.SpamGraceDays)*24*time.Hour, conf.ExpungeConfirmedSpam))
+	}
+	if conf.LearnRescued {
+		configs = append(configs, imapassassin.LearnRescued())
+	}
 
-	sc, err := imapassassin.NewImapAssassin(p, &classifier.GoRoutineSpamClassifier{SpamClassifier: spamClassifier}, imapConn, configs...)
+	mailRules, err := rules.NewRules(
+		rules.Lists{Senders: conf.AllowSenders, Domains: conf.AllowDomains, ListIds: conf.AllowListIds, Headers: conf.AllowHeaders},
+		rules.Lists{Senders: conf.BlockSenders, Domains: conf.BlockDomains, ListIds: conf.BlockListIds, Headers: conf.BlockHeaders},
+	)
+	if err != nil {
+		logger.WithField("error", err).Fatal("Could not create rules")
+	}
+	if !mailRules.Empty() {
+		configs = append(configs, imapassassin.Rules(mailRules))
+	}
+	if len(conf.SentFolders) > 0 {
+		if conf.CorrespondentMode == "offset" {
+			configs = append(configs, imapassassin.CorrespondentScoreOffset(conf.CorrespondentScoreOffset, conf.CorrespondentRequiredScore))
+		} else {
+			configs = append(configs, imapassassin.AllowCorrespondents())
+		}
+	}
+
+	retryPolicy := classifier.DefaultRetryPolicy()
+	retryPolicy.MaxAttempts = conf.RetryAttempts
+	retryPolicy.InitialBackoff = time.Duration(conf.RetryBackoff) * time.Millisecond
+	retryPolicy.MaxBackoff = time.Duration(conf.RetryMaxBackoff) * time.Millisecond
+	concurrentClassifier, err := classifier.NewGoRoutineSpamClassifier(
+		spamClassifier,
+		classifier.Retry(retryPolicy),
+		classifier.CircuitBreaker(conf.CircuitBreakerFailures, time.Duration(conf.CircuitBreakerOpen)*time.Second),
+	)
+	if err != nil {
+		logger.WithField("error", err).Fatal("Could not configure classifier retries")
+	}
+
+	sc, err := imapassassin.NewImapAssassin(p, concurrentClassifier, imapConn, configs...)
 	if err != nil {
 		logger.WithField("error", err).Fatal("Could not start spamchecker")
 	}
 
+	if cmd == "undo" {
+		logger.WithFields(logrus.Fields{"run": *undoRun, "since": undoFrom, "until": undoTo, "learn": *undoLearn, "dryrun": conf.DryRun}).Info("Undoing actions")
+		report, err := sc.Undo(ctx, *undoRun, undoFrom, undoTo, *undoLearn)
+		if report != nil {
+			printUndoReport(os.Stdout, report)
+		}
+		if errors.Is(err, context.Canceled) {
+			logger.Warn("Interrupted while undoing actions, progress has been saved")
+			return
+		}
+		if err != nil {
+			logger.WithField("error", err).Fatal("Undoing actions failed")
+		}
+		return
+	}
+
 	if len(conf.SpamLearnFolders) > 0 || len(conf.HamLearnFolders) > 0 {
 		logger.WithFields(logrus.Fields{"spamfolders": conf.SpamLearnFolders, "hamfolders": conf.HamLearnFolders, "deletelearned": conf.DeleteLearned, "dryrun": conf.DryRun}).Info("Learning mails")
 		if conf.DeleteLearned {
@@ -99,26 +231,280 @@ func main() {
 		}
 
 		if len(conf.SpamLearnFolders) > 0 {
-			err = sc.Learn(domain.LearnSpam, conf.SpamLearnFolders)
+			err = sc.Learn(ctx, domain.LearnSpam, conf.SpamLearnFolders)
+			if errors.Is(err, context.Canceled) {
+				logger.Warn("Interrupted while learning spam, progress has been saved")
+				return
+			}
 			if err != nil {
 				logger.WithField("error", err).Fatal("Learning spam failed")
 			}
 		}
 
 		if len(conf.HamLearnFolders) > 0 {
-			err = sc.Learn(domain.LearnHam, conf.HamLearnFolders)
+			err = sc.Learn(ctx, domain.LearnHam, conf.HamLearnFolders)
+			if errors.Is(err, context.Canceled) {
+				logger.Warn("Interrupted while learning ham, progress has been saved")
+				return
+			}
 			if err != nil {
 				logger.WithField("error", err).Fatal("Learning spam failed")
 			}
 		}
 	}
 
+	if len(conf.SentFolders) > 0 {
+		logger.WithFields(logrus.Fields{"folders": conf.SentFolders, "mode": conf.CorrespondentMode}).Info("Collecting correspondents")
+		err = sc.CollectCorrespondents(ctx, conf.SentFolders)
+		if errors.Is(err, context.Canceled) {
+			logger.Warn("Interrupted while collecting correspondents, progress has been saved")
+			return
+		}
+		if err != nil {
+			logger.WithField("error", err).Fatal("Collecting correspondents failed")
+		}
+	}
+
 	logger.WithFields(logrus.Fields{"folders": conf.CheckFolders, "dryrun": conf.DryRun, "spamfolder": conf.SpamFolder}).Info("Checking mails for spam")
 	if conf.DryRun {
 		logger.Warn("Skipping moving & report generation due to dry-run")
 	}
-	err = sc.CheckSpam(conf.CheckFolders)
+	err = sc.CheckSpam(ctx, conf.CheckFolders)
+	if errors.Is(err, context.Canceled) {
+		logger.Warn("Interrupted while checking mails, progress has been saved")
+		return
+	}
 	if err != nil {
 		logger.WithField("error", err).Fatal("Checking spam failed")
 	}
+
+	if conf.SpamGraceDays > 0 {
+		logger.WithFields(logrus.Fields{"folder": conf.SpamFolder, "gracedays": conf.SpamGraceDays, "expunge": conf.ExpungeConfirmedSpam}).Info("Confirming spam")
+		err = sc.ConfirmSpam(ctx, conf.CheckFolders)
+		if errors.Is(err, context.Canceled) {
+			logger.Warn("Interrupted while confirming spam, progress has been saved")
+			return
+		}
+		if err != nil {
+			logger.WithField("error", err).Fatal("Confirming spam failed")
+		}
+	}
+
+	if len(conf.Retention) > 0 {
+		policies := make([]imapassassin.RetentionPolicy, len(conf.Retention))
+		for i, r := range conf.Retention {
+			policies[i] = imapassassin.RetentionPolicy{
+				Folder:   r.Folder,
+				MaxAge:   time.Duration(r.MaxAgeDays) * 24 * time.Hour,
+				MaxMails: r.MaxMails,
+			}
+		}
+
+		logger.WithFields(logrus.Fields{"policies": len(policies), "dryrun": conf.DryRun}).Info("Applying retention policies")
+		err = sc.ApplyRetention(ctx, policies)
+		if errors.Is(err, context.Canceled) {
+			logger.Warn("Interrupted while applying retention policies")
+			return
+		}
+		if err != nil {
+			logger.WithField("error", err).Fatal("Applying retention policies failed")
+		}
+	}
+}
+
+// interruptContext returns a context that is cancelled on the first SIGINT or SIGTERM, which lets the batch in flight
+// finish. A second signal exits immediately.
+func interruptContext(logger *logrus.Logger) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			logger.WithField("signal", sig).Warn("Stopping after the current batch, send the signal again to exit immediately")
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+
+		sig := <-signals
+		logger.WithField("signal", sig).Fatal("Exiting immediately")
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+// parseTime parses an RFC3339 time or a local date with optional minutes, empty values are the zero time
+func parseTime(value string) (time.Time, error) {
+	if len(value) == 0 {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04", value, time.Local); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.Local)
+}
+
+// printUndoReport writes the number of restored mails and every action that could not be undone completely
+func printUndoReport(w io.Writer, report *imapassassin.UndoReport) {
+	fmt.Fprintf(w, "restored: %d mails\n", report.Restored)
+	for _, failure := range report.Failed {
+		action := failure.Action
+		fmt.Fprintf(w, "not restored: %s of %d mails in %s", action.Type, len(failure.Uids), action.Folder)
+		if len(action.Destination) > 0 {
+			fmt.Fprintf(w, " to %s", action.Destination)
+		}
+		fmt.Fprintf(w, " at %s (run %s, uids %v): %s\n", action.CreatedAt.Format(time.RFC3339), action.RunId, failure.Uids, failure.Reason)
+	}
+}
+
+// printInfo writes info and the infos of its endpoints, each indented by two more spaces.
+func printInfo(w io.Writer, info *domain.ClassifierInfo, indent string) {
+	state := "ok"
+	if info.Error != nil {
+		state = "unreachable: " + info.Error.Error()
+	}
+	fmt.Fprintf(w, "%s%s: %s\n", indent, info.Name, state)
+
+	if len(info.Version) > 0 {
+		fmt.Fprintf(w, "%s  version: %s\n", indent, info.Version)
+	}
+
+	names := make([]string, 0, len(info.Stats))
+	for name := range info.Stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s  %s: %s\n", indent, name, info.Stats[name])
+	}
+
+	for _, endpoint := range info.Endpoints {
+		printInfo(w, endpoint, indent+"  ")
+	}
+}
+
+// newSpamClassifier creates the built-in bayes, external command or webhook classifier or connects to all configured classifier endpoints. Multiple endpoints are wrapped in a
+// BalancingSpamClassifier, endpoints that are unreachable on startup are added as unhealthy and probed until they're back. With requireReachable, it fails
+// if no endpoint is reachable.
+func newSpamClassifier(conf *config.Config, p *persistence.Persistence, logger *logrus.Logger, requireReachable bool) (domain.SpamClassifier, error) {
+	if conf.BayesClassifier {
+		logger.WithFields(logrus.Fields{"classifier": "bayes", "threshold": conf.BayesThreshold}).Info("Using built-in bayes classifier")
+		return bayes.NewBayes(
+			p,
+			bayes.Threshold(conf.BayesThreshold),
+			bayes.MinTraining(conf.BayesMinSpam, conf.BayesMinHam),
+			bayes.ReportTokens(conf.BayesReportTokens),
+		)
+	}
+
+	if len(conf.CommandCheck) > 0 {
+		logger.WithFields(logrus.Fields{"classifier": "command", "check": conf.CommandCheck, "learnspam": conf.CommandLearnSpam, "learnham": conf.CommandLearnHam}).Info("Using external command")
+		return command.NewCommand(
+			conf.CommandCheck,
+			command.Learn(conf.CommandLearnSpam, conf.CommandLearnHam),
+			command.ExitCodes(conf.CommandSpamExitCodes, conf.CommandHamExitCodes),
+			command.Timeout(time.Duration(conf.CommandTimeout)*time.Second),
+		)
+	}
+
+	if len(conf.WebhookCheckUrl) > 0 {
+		logger.WithFields(logrus.Fields{"classifier": "webhook", "checkurl": conf.WebhookCheckUrl, "learnurl": conf.WebhookLearnUrl, "format": conf.WebhookFormat}).Info("Using webhook")
+		return webhook.NewWebhook(
+			conf.WebhookCheckUrl,
+			webhook.LearnURL(conf.WebhookLearnUrl),
+			webhook.Format(conf.WebhookFormat),
+			webhook.Headers(conf.WebhookHeaders),
+			webhook.Timeout(time.Duration(conf.WebhookTimeout)*time.Second),
+			webhook.TLS(conf.WebhookCA, conf.WebhookClientCert, conf.WebhookClientKey, conf.WebhookInsecure),
+			webhook.TrustedHops(conf.TrustedHops),
+			webhook.User(conf.ClassifierUser),
+		)
+	}
+
+	names := []string{}
+	classifiers := []domain.SpamClassifier{}
+	// indexes of the endpoints that didn't answer on startup, the balancer probes them until they're back
+	unreachable := []int{}
+
+	if hosts := conf.SpamassassinEndpoints(); len(hosts) > 0 {
+		logger.WithFields(logrus.Fields{"classifier": "spamassassin", "spamassssinhosts": hosts, "tls": conf.SpamassassinTLS, "classifieruser": conf.ClassifierUser}).Info("Using SpamAssassin")
+		saConfigs := []spamassassin.ConfigFunc{
+			spamassassin.TrustedHops(conf.TrustedHops),
+			spamassassin.User(conf.ClassifierUser),
+			spamassassin.SkipPing(),
+		}
+		if conf.SpamassassinTLS {
+			saConfigs = append(saConfigs, spamassassin.TLS(conf.SpamassassinCA, conf.SpamassassinClientCert, conf.SpamassassinClientKey))
+		}
+
+		for _, host := range hosts {
+			sa, err := spamassassin.NewSpamassassin(host, saConfigs...)
+			if err != nil {
+				return nil, fmt.Errorf("could not start SpamAssassin connector for %s: %w", host, err)
+			}
+			err = sa.Ping(context.Background())
+			if err != nil {
+				logger.WithFields(logrus.Fields{"spamassassinhost": host, "error": err}).Warn("SpamAssassin not reachable, probing it later")
+				unreachable = append(unreachable, len(classifiers))
+			}
+			names = append(names, host)
+			classifiers = append(classifiers, sa)
+		}
+	} else {
+		controllers := conf.RspamdEndpoints()
+		scanners := conf.RspamdScannerEndpoints()
+		logger.WithFields(logrus.Fields{"classifier": "rspamd", "rspamdcontrollers": controllers, "rspamdscanners": scanners, "classifieruser": conf.ClassifierUser}).Info("Using Rspamd")
+		for i, controller := range controllers {
+			rsConfigs := []rspamd.ConfigFunc{
+				rspamd.TrustedHops(conf.TrustedHops),
+				rspamd.User(conf.ClassifierUser),
+				rspamd.Classifier(conf.RspamdClassifier),
+				rspamd.ReportJson(conf.RspamdReportJson),
+				rspamd.SkipPing(),
+			}
+			if len(scanners) > 0 {
+				rsConfigs = append(rsConfigs, rspamd.Scanner(scanners[i], conf.RspamdScannerPassword, time.Duration(conf.RspamdScannerTimeout)*time.Second))
+			}
+
+			rs, err := rspamd.NewRspamd(controller, conf.RspamdPassword, rsConfigs...)
+			if err != nil {
+				return nil, fmt.Errorf("could not start rspamd connector for %s: %w", controller, err)
+			}
+			err = rs.Ping(context.Background())
+			if err != nil {
+				logger.WithFields(logrus.Fields{"rspamdcontroller": controller, "error": err}).Warn("Rspamd not reachable, probing it later")
+				unreachable = append(unreachable, len(classifiers))
+			}
+			names = append(names, controller)
+			classifiers = append(classifiers, rs)
+		}
+	}
+
+	if requireReachable && len(unreachable) == len(classifiers) {
+		return nil, fmt.Errorf("no classifier endpoint reachable")
+	}
+	if len(classifiers) == 1 {
+		return classifiers[0], nil
+	}
+
+	logger.WithFields(logrus.Fields{"endpoints": names, "strategy": conf.BalanceStrategy}).Info("Balancing between classifier endpoints")
+	balancer, err := classifier.NewBalancingSpamClassifier(classifier.BalanceStrategy(conf.BalanceStrategy), names, classifiers)
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range unreachable {
+		err = balancer.MarkUnhealthy(index)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return balancer, nil
 }
@@ -0,0 +1,26 @@
+-- SPDX-License-Identifier: GPL-3.0-or-later
+
+-- +migrate Up
+
+-- +migrate StatementBegin
+create table bayes_tokens
+(
+	token           string
+	                primary key,
+	spam            integer
+	                not null
+	                default 0,
+	ham             integer
+	                not null
+	                default 0
+);
+
+create table bayes_training
+(
+	learntype       string
+	                primary key,
+	count           integer
+	                not null
+);
+
+-- +migrate StatementEnd
@@ -0,0 +1,40 @@
+-- SPDX-License-Identifier: GPL-3.0-or-later
+
+-- +migrate Up
+
+-- +migrate StatementBegin
+create table actions
+(
+	id                      integer
+	                        primary key autoincrement,
+	runid                   string
+	                        not null,
+	type                    string
+	                        not null,
+	folder                  string
+	                        not null,
+	uids                    string
+	                        not null,
+	destination             string
+	                        not null
+	                        default '',
+	destinationuidvalidity  integer
+	                        not null
+	                        default 0,
+	resultuids              string
+	                        not null
+	                        default '[]',
+	createdat               integer
+	                        not null,
+	undone                  bool
+	                        not null
+	                        default false
+);
+
+create index actions_runid_index
+	on actions (runid);
+
+create index actions_createdat_index
+	on actions (createdat);
+
+-- +migrate StatementEnd
@@ -0,0 +1,24 @@
+-- SPDX-License-Identifier: GPL-3.0-or-later
+
+-- +migrate Up
+
+-- +migrate StatementBegin
+create table result_cache
+(
+	hash            string
+	                primary key,
+	isspam          bool
+	                not null,
+	score           real
+	                not null,
+	symbols         string
+	                not null,
+	body            blob,
+	checkedat       integer
+	                not null
+);
+
+create index result_cache_checkedat_index
+	on result_cache (checkedat);
+
+-- +migrate StatementEnd
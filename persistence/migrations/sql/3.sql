@@ -0,0 +1,9 @@
+-- SPDX-License-Identifier: GPL-3.0-or-later
+
+-- +migrate Up
+
+-- +migrate StatementBegin
+alter table result_cache
+	add subject string not null default '';
+
+-- +migrate StatementEnd
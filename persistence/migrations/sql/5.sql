@@ -0,0 +1,14 @@
+-- SPDX-License-Identifier: GPL-3.0-or-later
+
+-- +migrate Up
+
+-- +migrate StatementBegin
+create table correspondents
+(
+	address         string
+		            primary key,
+	mails           integer
+	                not null
+);
+
+-- +migrate StatementEnd
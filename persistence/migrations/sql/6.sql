@@ -0,0 +1,9 @@
+-- SPDX-License-Identifier: GPL-3.0-or-later
+
+-- +migrate Up
+
+-- +migrate StatementBegin
+alter table messages
+	add corrected bool not null default false;
+
+-- +migrate StatementEnd
@@ -0,0 +1,12 @@
+-- SPDX-License-Identifier: GPL-3.0-or-later
+
+-- +migrate Up
+
+-- +migrate StatementBegin
+alter table messages
+	add serverid string not null default '';
+
+create index messages_class_foldername_serverid_index
+	on messages (class, foldername, serverid);
+
+-- +migrate StatementEnd
@@ -0,0 +1,25 @@
+-- SPDX-License-Identifier: GPL-3.0-or-later
+
+-- +migrate Up
+
+-- +migrate StatementBegin
+alter table messages
+	add sender string not null default '';
+alter table messages
+	add date integer;
+alter table messages
+	add internaldate integer;
+alter table messages
+	add size integer not null default 0;
+alter table messages
+	add classifier string not null default '';
+alter table messages
+	add classifierversion string not null default '';
+alter table messages
+	add action string not null default '';
+alter table messages
+	add destination string not null default '';
+alter table messages
+	add processedat integer;
+
+-- +migrate StatementEnd
@@ -4,8 +4,10 @@ package persistence
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/CrawX/go-imap-assassin/domain"
 	"github.com/CrawX/go-imap-assassin/log"
@@ -113,20 +115,10 @@ func (p *Persistence) SaveFolder(name string, uidValidity uint32) error {
 }
 
 func (p *Persistence) GetMailsInFolder(class domain.MailClass, folder string) ([]*domain.SavedImapMail, error) {
-	dbMessages := []struct {
-		Id         int64
-		Class      int
-		Uid        uint32
-		MailIdHash string
-		FolderName string
-		Subject    string
-		IsSpam     bool
-		Score      float64
-	}{}
-
+	dbMails := []dbMail{}
 	err := p.db.Select(
-		&dbMessages,
-		`SELECT id, class, uid, mailidhash, foldername, subject from messages WHERE class = ? AND foldername = ?`,
+		&dbMails,
+		selectMail+" WHERE class = ? AND foldername = ?",
 		int(class),
 		folder,
 	)
@@ -134,44 +126,129 @@ func (p *Persistence) GetMailsInFolder(class domain.MailClass, folder string) ([
 		return nil, fmt.Errorf("could not query db: %w", err)
 	}
 
-	messages := []*domain.SavedImapMail{}
-	for _, m := range dbMessages {
-		messages = append(
-			messages,
-			&domain.SavedImapMail{
-				Id:         m.Id,
-				Class:      domain.MailClass(m.Class),
-				Uid:        m.Uid,
-				MailIdHash: m.MailIdHash,
-				FolderName: m.FolderName,
-				Subject:    m.Subject,
-				IsSpam:     m.IsSpam,
-				Score:      m.Score,
-			},
-		)
+	messages := make([]*domain.SavedImapMail, len(dbMails))
+	for i := range dbMails {
+		messages[i] = dbMails[i].savedImapMail()
 	}
 
 	return messages, nil
 }
 
 func (p *Persistence) FindMailByHash(class domain.MailClass, folder string, mailIdHash string) (*domain.SavedImapMail, error) {
-	dbMail := struct {
-		Id         int64
-		Class      int
-		Uid        uint32
-		MailIdHash string
-		FolderName string
-		Subject    string
-		IsSpam     bool
-		Score      float64
-	}{}
+	return p.findMail(class, folder, "mailidhash", mailIdHash)
+}
+
+func (p *Persistence) FindMailByServerId(class domain.MailClass, folder string, serverId string) (*domain.SavedImapMail, error) {
+	return p.findMail(class, folder, "serverid", serverId)
+}
+
+// FindMailsByHashes returns the mails of class in folder with one of mailIdHashes by their hash
+func (p *Persistence) FindMailsByHashes(class domain.MailClass, folder string, mailIdHashes []string) (map[string]*domain.SavedImapMail, error) {
+	mails, err := p.findMails(class, folder, "mailidhash", mailIdHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	byHash := make(map[string]*domain.SavedImapMail, len(mails))
+	for _, m := range mails {
+		byHash[m.MailIdHash] = m
+	}
+	return byHash, nil
+}
+
+// FindMailsByServerIds returns the mails of class in folder with one of serverIds by their server id
+func (p *Persistence) FindMailsByServerIds(class domain.MailClass, folder string, serverIds []string) (map[string]*domain.SavedImapMail, error) {
+	mails, err := p.findMails(class, folder, "serverid", serverIds)
+	if err != nil {
+		return nil, err
+	}
 
+	byServerId := make(map[string]*domain.SavedImapMail, len(mails))
+	for _, m := range mails {
+		byServerId[m.ServerId] = m
+	}
+	return byServerId, nil
+}
+
+type dbMail struct {
+	Id           int64
+	Class        int
+	Uid          uint32
+	MailIdHash   string
+	FolderName   string
+	Subject      string
+	IsSpam       bool
+	Score        float64
+	Rule         string
+	HashStrategy string
+	ServerId     string
+
+	Sender            string
+	Date              sql.NullInt64
+	InternalDate      sql.NullInt64
+	Size              int
+	Classifier        string
+	ClassifierVersion string
+	Action            string
+	Destination       string
+	ProcessedAt       sql.NullInt64
+}
+
+// selectMail selects the columns of dbMail, isspam and score are null for learned mails
+const selectMail = "SELECT id, class, uid, mailidhash, foldername, subject, coalesce(isspam, false) as isspam, coalesce(score, 0) as score, rule, hashstrategy, serverid, " +
+	"sender, date, internaldate, size, classifier, classifierversion, action, destination, processedat from messages"
+
+// unixTime stores t as unix seconds, unknown times as null
+func unixTime(t time.Time) sql.NullInt64 {
+	if t.IsZero() {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.Unix(), Valid: true}
+}
+
+func fromUnixTime(t sql.NullInt64) time.Time {
+	if !t.Valid {
+		return time.Time{}
+	}
+	return time.Unix(t.Int64, 0)
+}
+
+func (m *dbMail) savedImapMail() *domain.SavedImapMail {
+	return &domain.SavedImapMail{
+		Id:           m.Id,
+		Class:        domain.MailClass(m.Class),
+		Uid:          m.Uid,
+		MailIdHash:   m.MailIdHash,
+		FolderName:   m.FolderName,
+		Subject:      m.Subject,
+		IsSpam:       m.IsSpam,
+		Score:        m.Score,
+		Rule:         m.Rule,
+		HashStrategy: m.HashStrategy,
+		ServerId:     m.ServerId,
+		MailMetadata: domain.MailMetadata{
+			Sender:            m.Sender,
+			Date:              fromUnixTime(m.Date),
+			InternalDate:      fromUnixTime(m.InternalDate),
+			Size:              m.Size,
+			Classifier:        m.Classifier,
+			ClassifierVersion: m.ClassifierVersion,
+			Action:            domain.MailAction(m.Action),
+			Destination:       m.Destination,
+		},
+		ProcessedAt: fromUnixTime(m.ProcessedAt),
+	}
+}
+
+// findMail returns the mail of class in folder whose identifying column has value, column is never user input
+func (p *Persistence) findMail(class domain.MailClass, folder string, column string, value string) (*domain.SavedImapMail, error) {
+	m := dbMail{}
 	err := p.db.Get(
-		&dbMail,
-		"SELECT id, class, uid, mailidhash, foldername, subject, isspam, score from messages WHERE class = ? AND foldername = ? AND mailidhash = ?",
+		&m,
+		selectMail+" WHERE class = ? AND foldername = ? AND "+column+" = ?",
 		int(class),
 		folder,
-		mailIdHash,
+		value,
 	)
 
 	if errors.Is(err, sql.ErrNoRows) {
@@ -181,16 +258,48 @@ func (p *Persistence) FindMailByHash(class domain.MailClass, folder string, mail
 		return nil, fmt.Errorf("could not query db: %w", err)
 	}
 
-	return &domain.SavedImapMail{
-		Id:         dbMail.Id,
-		Class:      domain.MailClass(dbMail.Class),
-		Uid:        dbMail.Uid,
-		MailIdHash: dbMail.MailIdHash,
-		FolderName: dbMail.FolderName,
-		Subject:    dbMail.Subject,
-		IsSpam:     dbMail.IsSpam,
-		Score:      dbMail.Score,
-	}, nil
+	return m.savedImapMail(), nil
+}
+
+// findMails returns the mails of class in folder whose identifying column has one of values, querying them in chunks
+// within a single transaction
+func (p *Persistence) findMails(class domain.MailClass, folder string, column string, values []string) ([]*domain.SavedImapMail, error) {
+	tx, err := p.db.BeginTxx(context.TODO(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not start transaction: %w", err)
+	}
+
+	mails := []*domain.SavedImapMail{}
+	// class and folder take two of the variables
+	chunkSize := maxVariables - 2
+	for start := 0; start < len(values); start += chunkSize {
+		end := start + chunkSize
+		if end > len(values) {
+			end = len(values)
+		}
+
+		query, args, err := sqlx.In(selectMail+" WHERE class = ? AND foldername = ? AND "+column+" IN (?)", int(class), folder, values[start:end])
+		if err != nil {
+			return nil, txEnd(tx, fmt.Errorf("could not build query: %w", err))
+		}
+
+		dbMails := []dbMail{}
+		err = tx.Select(&dbMails, query, args...)
+		if err != nil {
+			return nil, txEnd(tx, fmt.Errorf("could not query db: %w", err))
+		}
+
+		for i := range dbMails {
+			mails = append(mails, dbMails[i].savedImapMail())
+		}
+	}
+
+	err = txEnd(tx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return mails, nil
 }
 
 func (p *Persistence) UpdateUid(id int64, uid uint32) error {
@@ -215,6 +324,57 @@ func (p *Persistence) UpdateUid(id int64, uid uint32) error {
 	return nil
 }
 
+// UpdateUids sets the uids of the mails with the given ids in a single transaction
+func (p *Persistence) UpdateUids(uids map[int64]uint32) error {
+	tx, err := p.db.BeginTxx(context.TODO(), nil)
+	if err != nil {
+		return fmt.Errorf("could not start transaction: %w", err)
+	}
+
+	stmt, err := tx.Prepare("UPDATE messages set uid = ? WHERE id = ?")
+	if err != nil {
+		return txEnd(tx, fmt.Errorf("could not prepare statement: %w", err))
+	}
+
+	for id, uid := range uids {
+		result, err := stmt.Exec(uid, id)
+		if err != nil {
+			return txEnd(tx, fmt.Errorf("could not update uid: %w", err))
+		}
+
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return txEnd(tx, fmt.Errorf("could not get num of affected rows: %w", err))
+		}
+		if affected != 1 {
+			return txEnd(tx, fmt.Errorf("unexpected number of affected rows for id %d, expected 1 got %d", id, affected))
+		}
+	}
+
+	return txEnd(tx, nil)
+}
+
+func (p *Persistence) CorrectMail(id int64, uid uint32) error {
+	result, err := p.db.Exec(
+		"UPDATE messages set uid = ?, isspam = false, corrected = true WHERE id = ?",
+		uid, id,
+	)
+	if err != nil {
+		return fmt.Errorf("could not correct mail: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("could not get num of affected rows: %w", err)
+	}
+
+	if affected != 1 {
+		return fmt.Errorf("unexpected number of affected rows, expected 1 got %d", affected)
+	}
+
+	return nil
+}
+
 func (p *Persistence) SaveMails(mails []domain.SaveMail) error {
 	tx, err := p.db.BeginTxx(context.TODO(), nil)
 	if err != nil {
@@ -222,15 +382,20 @@ func (p *Persistence) SaveMails(mails []domain.SaveMail) error {
 	}
 
 	stmt, err := tx.Prepare(
-		"INSERT INTO messages(class, uid, mailidhash, foldername, subject, isspam, score) VALUES(?, ?, ?, ?, ?, ?, ?)",
+		"INSERT INTO messages(class, uid, mailidhash, foldername, subject, isspam, score, rule, hashstrategy, serverid, " +
+			"sender, date, internaldate, size, classifier, classifierversion, action, destination, processedat) " +
+			"VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
 	)
 	if err != nil {
 		return txEnd(tx, fmt.Errorf("could not prepare statement: %w", err))
 	}
 
+	processedAt := time.Now()
 	for _, mail := range mails {
 		_, err := stmt.Exec(
-			mail.Class, mail.Uid, mail.MailIdHash, mail.FolderName, mail.Subject, mail.IsSpam, mail.Score,
+			mail.Class, mail.Uid, mail.MailIdHash, mail.FolderName, mail.Subject, mail.IsSpam, mail.Score, mail.Rule, mail.HashStrategy, mail.ServerId,
+			mail.Sender, unixTime(mail.Date), unixTime(mail.InternalDate), mail.Size, mail.Classifier, mail.ClassifierVersion, mail.Action, mail.Destination,
+			processedAt.Unix(),
 		)
 
 		if err != nil {
@@ -241,6 +406,370 @@ func (p *Persistence) SaveMails(mails []domain.SaveMail) error {
 	return txEnd(tx, nil)
 }
 
+func (p *Persistence) SaveCorrespondents(addresses []string) error {
+	tx, err := p.db.BeginTxx(context.TODO(), nil)
+	if err != nil {
+		return fmt.Errorf("could not start transaction: %w", err)
+	}
+
+	stmt, err := tx.Prepare(
+		"INSERT INTO correspondents(address, mails) VALUES(?, 1) ON CONFLICT(address) DO UPDATE SET mails = mails + 1",
+	)
+	if err != nil {
+		return txEnd(tx, fmt.Errorf("could not prepare statement: %w", err))
+	}
+
+	for _, address := range addresses {
+		_, err := stmt.Exec(address)
+		if err != nil {
+			return txEnd(tx, fmt.Errorf("could not save correspondent: %w", err))
+		}
+	}
+
+	return txEnd(tx, nil)
+}
+
+func (p *Persistence) IsCorrespondent(address string) (bool, error) {
+	var mails int64
+	err := p.db.Get(
+		&mails,
+		"SELECT mails from correspondents WHERE address = ?",
+		address,
+	)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not query db: %w", err)
+	}
+
+	return true, nil
+}
+
+// maxVariables stays below sqlite's default SQLITE_MAX_VARIABLE_NUMBER of 999
+const maxVariables = 500
+
+func (p *Persistence) TrainingCounts() (int64, int64, error) {
+	dbCounts := []struct {
+		LearnType string
+		Count     int64
+	}{}
+
+	err := p.db.Select(
+		&dbCounts,
+		`SELECT learntype, count from bayes_training`,
+	)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not query db: %w", err)
+	}
+
+	var spam, ham int64
+	for _, c := range dbCounts {
+		switch domain.LearnType(c.LearnType) {
+		case domain.LearnSpam:
+			spam = c.Count
+		case domain.LearnHam:
+			ham = c.Count
+		}
+	}
+
+	return spam, ham, nil
+}
+
+func (p *Persistence) TokenCounts(tokens []string) (map[string]*domain.TokenCount, error) {
+	counts := map[string]*domain.TokenCount{}
+	for start := 0; start < len(tokens); start += maxVariables {
+		end := start + maxVariables
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+
+		query, args, err := sqlx.In(`SELECT token, spam, ham from bayes_tokens WHERE token IN (?)`, tokens[start:end])
+		if err != nil {
+			return nil, fmt.Errorf("could not build query: %w", err)
+		}
+
+		dbTokens := []struct {
+			Token string
+			Spam  int64
+			Ham   int64
+		}{}
+		err = p.db.Select(&dbTokens, query, args...)
+		if err != nil {
+			return nil, fmt.Errorf("could not query db: %w", err)
+		}
+
+		for _, t := range dbTokens {
+			counts[t.Token] = &domain.TokenCount{
+				Token: t.Token,
+				Spam:  t.Spam,
+				Ham:   t.Ham,
+			}
+		}
+	}
+
+	return counts, nil
+}
+
+func (p *Persistence) LearnTokens(learnType domain.LearnType, tokens []string) error {
+	var spam, ham int
+	switch learnType {
+	case domain.LearnSpam:
+		spam = 1
+	case domain.LearnHam:
+		ham = 1
+	default:
+		return fmt.Errorf("unsupported learn type %v", learnType)
+	}
+
+	tx, err := p.db.BeginTxx(context.TODO(), nil)
+	if err != nil {
+		return fmt.Errorf("could not start transaction: %w", err)
+	}
+
+	stmt, err := tx.Prepare(
+		"INSERT INTO bayes_tokens(token, spam, ham) VALUES(?, ?, ?) ON CONFLICT(token) DO UPDATE SET spam = spam + excluded.spam, ham = ham + excluded.ham",
+	)
+	if err != nil {
+		return txEnd(tx, fmt.Errorf("could not prepare statement: %w", err))
+	}
+
+	for _, token := range tokens {
+		_, err := stmt.Exec(token, spam, ham)
+		if err != nil {
+			return txEnd(tx, fmt.Errorf("could not save token: %w", err))
+		}
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO bayes_training(learntype, count) VALUES(?, 1) ON CONFLICT(learntype) DO UPDATE SET count = count + 1",
+		string(learnType),
+	)
+	if err != nil {
+		return txEnd(tx, fmt.Errorf("could not update training count: %w", err))
+	}
+
+	return txEnd(tx, nil)
+}
+
+func (p *Persistence) CachedResult(hash string, checkedAfter time.Time) (*domain.CachedResult, error) {
+	dbResult := struct {
+		Hash      string
+		IsSpam    bool
+		Score     float64
+		Symbols   string
+		Subject   string
+		Body      []byte
+		CheckedAt int64
+	}{}
+
+	err := p.db.Get(
+		&dbResult,
+		"SELECT hash, isspam, score, symbols, subject, body, checkedat from result_cache WHERE hash = ? AND checkedat > ?",
+		hash,
+		checkedAfter.Unix(),
+	)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not query db: %w", err)
+	}
+
+	var symbols map[string]float64
+	err = json.Unmarshal([]byte(dbResult.Symbols), &symbols)
+	if err != nil {
+		return nil, fmt.Errorf("could not deserialize symbols: %w", err)
+	}
+
+	return &domain.CachedResult{
+		Hash:      dbResult.Hash,
+		IsSpam:    dbResult.IsSpam,
+		Score:     dbResult.Score,
+		Symbols:   symbols,
+		Subject:   dbResult.Subject,
+		Body:      dbResult.Body,
+		CheckedAt: time.Unix(dbResult.CheckedAt, 0),
+	}, nil
+}
+
+func (p *Persistence) SaveResult(result *domain.CachedResult) error {
+	symbols, err := json.Marshal(result.Symbols)
+	if err != nil {
+		return fmt.Errorf("could not serialize symbols: %w", err)
+	}
+
+	_, err = p.db.Exec(
+		"INSERT OR REPLACE INTO result_cache (hash, isspam, score, symbols, subject, body, checkedat) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		result.Hash,
+		result.IsSpam,
+		result.Score,
+		string(symbols),
+		result.Subject,
+		result.Body,
+		result.CheckedAt.Unix(),
+	)
+	if err != nil {
+		return fmt.Errorf("could not save result: %w", err)
+	}
+
+	return nil
+}
+
+func (p *Persistence) DeleteResults(hashes []string) error {
+	for start := 0; start < len(hashes); start += maxVariables {
+		end := start + maxVariables
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+
+		query, args, err := sqlx.In(`DELETE FROM result_cache WHERE hash IN (?)`, hashes[start:end])
+		if err != nil {
+			return fmt.Errorf("could not build query: %w", err)
+		}
+
+		_, err = p.db.Exec(query, args...)
+		if err != nil {
+			return fmt.Errorf("could not delete results: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (p *Persistence) PurgeResults(checkedBefore time.Time) (int64, error) {
+	result, err := p.db.Exec(
+		"DELETE FROM result_cache WHERE checkedat < ?",
+		checkedBefore.Unix(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("could not purge results: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("could not get num of affected rows: %w", err)
+	}
+
+	return affected, nil
+}
+
+func (p *Persistence) SaveAction(action *domain.MailboxAction) error {
+	uids, err := json.Marshal(action.Uids)
+	if err != nil {
+		return fmt.Errorf("could not serialize uids: %w", err)
+	}
+	resultUids, err := json.Marshal(action.ResultUids)
+	if err != nil {
+		return fmt.Errorf("could not serialize result uids: %w", err)
+	}
+
+	_, err = p.db.Exec(
+		"INSERT INTO actions (runid, type, folder, uids, destination, destinationuidvalidity, resultuids, createdat) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		action.RunId,
+		string(action.Type),
+		action.Folder,
+		string(uids),
+		action.Destination,
+		action.DestinationUidValidity,
+		string(resultUids),
+		time.Now().Unix(),
+	)
+	if err != nil {
+		return fmt.Errorf("could not save action: %w", err)
+	}
+
+	return nil
+}
+
+func (p *Persistence) FindActions(runId string, from, to time.Time) ([]*domain.SavedMailboxAction, error) {
+	query := "SELECT id, runid, type, folder, uids, destination, destinationuidvalidity, resultuids, createdat, undone from actions WHERE undone = false"
+	args := []interface{}{}
+	if runId != "" {
+		query += " AND runid = ?"
+		args = append(args, runId)
+	}
+	if !from.IsZero() {
+		query += " AND createdat >= ?"
+		args = append(args, from.Unix())
+	}
+	if !to.IsZero() {
+		query += " AND createdat <= ?"
+		args = append(args, to.Unix())
+	}
+	query += " ORDER BY id DESC"
+
+	dbActions := []struct {
+		Id                     int64
+		RunId                  string
+		Type                   string
+		Folder                 string
+		Uids                   string
+		Destination            string
+		DestinationUidValidity uint32
+		ResultUids             string
+		CreatedAt              int64
+		Undone                 bool
+	}{}
+	err := p.db.Select(&dbActions, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not query db: %w", err)
+	}
+
+	actions := make([]*domain.SavedMailboxAction, 0, len(dbActions))
+	for _, dbAction := range dbActions {
+		var uids, resultUids []uint32
+		err = json.Unmarshal([]byte(dbAction.Uids), &uids)
+		if err != nil {
+			return nil, fmt.Errorf("could not deserialize uids: %w", err)
+		}
+		err = json.Unmarshal([]byte(dbAction.ResultUids), &resultUids)
+		if err != nil {
+			return nil, fmt.Errorf("could not deserialize result uids: %w", err)
+		}
+
+		actions = append(actions, &domain.SavedMailboxAction{
+			Id: dbAction.Id,
+			MailboxAction: domain.MailboxAction{
+				RunId:                  dbAction.RunId,
+				Type:                   domain.MailboxActionType(dbAction.Type),
+				Folder:                 dbAction.Folder,
+				Uids:                   uids,
+				Destination:            dbAction.Destination,
+				DestinationUidValidity: dbAction.DestinationUidValidity,
+				ResultUids:             resultUids,
+			},
+			CreatedAt: time.Unix(dbAction.CreatedAt, 0),
+			Undone:    dbAction.Undone,
+		})
+	}
+
+	return actions, nil
+}
+
+func (p *Persistence) MarkUndone(id int64) error {
+	result, err := p.db.Exec(
+		"UPDATE actions set undone = true WHERE id = ?",
+		id,
+	)
+	if err != nil {
+		return fmt.Errorf("could not mark action undone: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("could not get num of affected rows: %w", err)
+	}
+
+	if affected != 1 {
+		return fmt.Errorf("unexpected number of affected rows, expected 1 got %d", affected)
+	}
+
+	return nil
+}
+
 func txEnd(tx *sqlx.Tx, err error) error {
 	if err == nil {
 		err = tx.Commit()
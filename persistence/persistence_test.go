@@ -0,0 +1,231 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package persistence
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/CrawX/go-imap-assassin/domain"
+	"github.com/CrawX/go-imap-assassin/log"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testFolder = "INBOX"
+
+// newTestPersistence returns a migrated database in dir containing n checked mails with uids 1 to n, hashes hash1 to
+// hashN and server ids id1 to idN
+func newTestPersistence(tb testing.TB, dir string, n int) *Persistence {
+	log.InitLogging("error")
+	p, err := NewPersistence(filepath.Join(dir, "test.db"))
+	require.NoError(tb, err)
+
+	mails := make([]domain.SaveMail, n)
+	for i := range mails {
+		mails[i] = domain.SaveMail{
+			Class:      domain.Checked,
+			Uid:        uint32(i + 1),
+			MailIdHash: fmt.Sprintf("hash%d", i+1),
+			ServerId:   fmt.Sprintf("id%d", i+1),
+			FolderName: testFolder,
+		}
+	}
+	require.NoError(tb, p.SaveMails(mails))
+
+	return p
+}
+
+func hashes(from, to int) []string {
+	h := []string{}
+	for i := from; i <= to; i++ {
+		h = append(h, fmt.Sprintf("hash%d", i))
+	}
+	return h
+}
+
+func TestPersistence_FindMailsByHashes(t *testing.T) {
+	p := newTestPersistence(t, t.TempDir(), 2*maxVariables)
+	defer p.Close()
+
+	// spans several chunks and contains unknown hashes
+	found, err := p.FindMailsByHashes(domain.Checked, testFolder, hashes(maxVariables-10, 2*maxVariables+10))
+	assert.NoError(t, err)
+	assert.Len(t, found, maxVariables+11)
+	assert.Equal(t, uint32(maxVariables), found[fmt.Sprintf("hash%d", maxVariables)].Uid)
+
+	found, err = p.FindMailsByHashes(domain.LearnedSpam, testFolder, hashes(1, 10))
+	assert.NoError(t, err)
+	assert.Empty(t, found)
+
+	found, err = p.FindMailsByServerIds(domain.Checked, testFolder, []string{"id7", "unknown"})
+	assert.NoError(t, err)
+	assert.Len(t, found, 1)
+	assert.Equal(t, "hash7", found["id7"].MailIdHash)
+}
+
+func TestPersistence_UpdateUids(t *testing.T) {
+	p := newTestPersistence(t, t.TempDir(), 3)
+	defer p.Close()
+
+	found, err := p.FindMailsByHashes(domain.Checked, testFolder, hashes(1, 3))
+	require.NoError(t, err)
+
+	err = p.UpdateUids(map[int64]uint32{found["hash1"].Id: 11, found["hash3"].Id: 13})
+	assert.NoError(t, err)
+
+	mails, err := p.GetMailsInFolder(domain.Checked, testFolder)
+	assert.NoError(t, err)
+	uids := []uint32{}
+	for _, m := range mails {
+		uids = append(uids, m.Uid)
+	}
+	assert.ElementsMatch(t, []uint32{11, 2, 13}, uids)
+
+	// unknown ids roll back the whole update
+	err = p.UpdateUids(map[int64]uint32{found["hash2"].Id: 12, -1: 14})
+	assert.Error(t, err)
+	known, err := p.FindMailByHash(domain.Checked, testFolder, "hash2")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), known.Uid)
+}
+
+func TestPersistence_SaveMailsMetadata(t *testing.T) {
+	p := newTestPersistence(t, t.TempDir(), 0)
+	defer p.Close()
+
+	date := time.Date(2020, 10, 7, 1, 30, 45, 0, time.UTC)
+	metadata := domain.MailMetadata{
+		Sender:            "eve@example.com",
+		Date:              date,
+		InternalDate:      date.Add(time.Minute),
+		Size:              1234,
+		Classifier:        "rspamd localhost:11333",
+		ClassifierVersion: "2.6",
+		Action:            domain.ActionMoved,
+		Destination:       "spam",
+	}
+	before := time.Now().Add(-time.Second)
+	err := p.SaveMails([]domain.SaveMail{
+		{Class: domain.Checked, Uid: 1, MailIdHash: "hash1", FolderName: testFolder, IsSpam: b(true), Score: f(9), MailMetadata: metadata},
+		// mails without Date header and learned mails without score
+		{Class: domain.LearnedSpam, Uid: 2, MailIdHash: "hash2", FolderName: testFolder, MailMetadata: domain.MailMetadata{Action: domain.ActionNone}},
+	})
+	require.NoError(t, err)
+
+	saved, err := p.FindMailByHash(domain.Checked, testFolder, "hash1")
+	assert.NoError(t, err)
+	assert.True(t, saved.Date.Equal(metadata.Date))
+	assert.True(t, saved.InternalDate.Equal(metadata.InternalDate))
+	assert.False(t, saved.ProcessedAt.Before(before.Truncate(time.Second)))
+	saved.Date, saved.InternalDate = metadata.Date, metadata.InternalDate
+	assert.Equal(t, metadata, saved.MailMetadata)
+
+	saved, err = p.FindMailByHash(domain.LearnedSpam, testFolder, "hash2")
+	assert.NoError(t, err)
+	assert.True(t, saved.Date.IsZero())
+	assert.Equal(t, domain.ActionNone, saved.Action)
+}
+
+func TestPersistence_Actions(t *testing.T) {
+	p := newTestPersistence(t, t.TempDir(), 0)
+	defer p.Close()
+
+	before := time.Now().Add(-time.Second)
+	actions := []domain.MailboxAction{
+		{RunId: "run1", Type: domain.MailboxMove, Folder: "INBOX", Uids: []uint32{1, 2}, Destination: "Spam",
+			DestinationUidValidity: 7, ResultUids: []uint32{11, 12}},
+		{RunId: "run1", Type: domain.MailboxDelete, Folder: "INBOX", Uids: []uint32{3}},
+		{RunId: "run2", Type: domain.MailboxAppend, Folder: "INBOX", Uids: []uint32{4}, Destination: "INBOX",
+			ResultUids: []uint32{5}},
+	}
+	for i := range actions {
+		require.NoError(t, p.SaveAction(&actions[i]))
+	}
+
+	found, err := p.FindActions("run1", time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, found, 2)
+	// newest first
+	assert.Equal(t, actions[1], found[0].MailboxAction)
+	assert.Equal(t, actions[0], found[1].MailboxAction)
+	assert.False(t, found[1].Undone)
+	assert.WithinDuration(t, time.Now(), found[1].CreatedAt, 2*time.Second)
+
+	require.NoError(t, p.MarkUndone(found[1].Id))
+	assert.Error(t, p.MarkUndone(-1))
+
+	found, err = p.FindActions("", before, time.Now().Add(time.Second))
+	require.NoError(t, err)
+	require.Len(t, found, 2)
+	assert.Equal(t, actions[2], found[0].MailboxAction)
+	assert.Equal(t, actions[1], found[1].MailboxAction)
+
+	found, err = p.FindActions("", time.Time{}, before)
+	require.NoError(t, err)
+	assert.Empty(t, found)
+}
+
+func b(b bool) *bool {
+	return &b
+}
+
+func f(f float64) *float64 {
+	return &f
+}
+
+const benchmarkMails = 20000
+
+func BenchmarkPersistence_FindMailByHash(b *testing.B) {
+	p := newTestPersistence(b, b.TempDir(), benchmarkMails)
+	defer p.Close()
+	h := hashes(1, benchmarkMails)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, hash := range h {
+			_, err := p.FindMailByHash(domain.Checked, testFolder, hash)
+			require.NoError(b, err)
+		}
+	}
+}
+
+func BenchmarkPersistence_FindMailsByHashes(b *testing.B) {
+	p := newTestPersistence(b, b.TempDir(), benchmarkMails)
+	defer p.Close()
+	h := hashes(1, benchmarkMails)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := p.FindMailsByHashes(domain.Checked, testFolder, h)
+		require.NoError(b, err)
+	}
+}
+
+func BenchmarkPersistence_UpdateUid(b *testing.B) {
+	p := newTestPersistence(b, b.TempDir(), benchmarkMails)
+	defer p.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for id := int64(1); id <= benchmarkMails; id++ {
+			require.NoError(b, p.UpdateUid(id, uint32(id)+uint32(i)))
+		}
+	}
+}
+
+func BenchmarkPersistence_UpdateUids(b *testing.B) {
+	p := newTestPersistence(b, b.TempDir(), benchmarkMails)
+	defer p.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		uids := make(map[int64]uint32, benchmarkMails)
+		for id := int64(1); id <= benchmarkMails; id++ {
+			uids[id] = uint32(id) + uint32(i)
+		}
+		require.NoError(b, p.UpdateUids(uids))
+	}
+}
@@ -0,0 +1,185 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package rules decides mails by allow and block lists before they are passed to a classifier.
+package rules
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	stdmail "net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+
+	"github.com/CrawX/go-imap-assassin/mail"
+)
+
+// Lists contains the entries of an allow or block list. Senders are full addresses, Domains match the sender's domain
+// and its subdomains, ListIds match the id in angle brackets of the List-Id header and Headers are "Name: regex"
+// entries matched against every decoded value of the named header. All but the header regexes are case-insensitive.
+type Lists struct {
+	Senders []string
+	Domains []string
+	ListIds []string
+	Headers []string
+}
+
+// Match is the rule that decided a mail.
+type Match struct {
+	// Block is true if a block list matched, false if an allow list matched
+	Block bool
+	// Rule describes the matching entry, e.g. "allow sender alice@example.com"
+	Rule string
+}
+
+type headerRule struct {
+	name  string
+	regex *regexp.Regexp
+	entry string
+}
+
+type list struct {
+	name    string
+	senders map[string]bool
+	domains []string
+	listIds map[string]bool
+	headers []*headerRule
+}
+
+// Rules matches mails against an allow and a block list. The allow list is evaluated first, so a sender can be
+// allowed even if its domain is blocked.
+type Rules struct {
+	allow *list
+	block *list
+}
+
+// NewRules compiles allow and block. It returns an error if a header entry is invalid.
+func NewRules(allow, block Lists) (*Rules, error) {
+	allowList, err := newList("allow", allow)
+	if err != nil {
+		return nil, err
+	}
+	blockList, err := newList("block", block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Rules{
+		allow: allowList,
+		block: blockList,
+	}, nil
+}
+
+func newList(name string, lists Lists) (*list, error) {
+	l := &list{
+		name:    name,
+		senders: map[string]bool{},
+		listIds: map[string]bool{},
+	}
+
+	for _, sender := range lists.Senders {
+		l.senders[normalize(sender)] = true
+	}
+	for _, domain := range lists.Domains {
+		l.domains = append(l.domains, strings.TrimPrefix(normalize(domain), "@"))
+	}
+	for _, listId := range lists.ListIds {
+		l.listIds[normalize(strings.Trim(strings.TrimSpace(listId), "<>"))] = true
+	}
+	for _, entry := range lists.Headers {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 {
+			return nil, fmt.Errorf(`%s header rule "%s" must have the form "Name: regex"`, name, entry)
+		}
+		regex, err := regexp.Compile(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf(`could not compile %s header rule "%s": %w`, name, entry, err)
+		}
+		l.headers = append(l.headers, &headerRule{
+			name:  textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(parts[0])),
+			regex: regex,
+			entry: entry,
+		})
+	}
+
+	return l, nil
+}
+
+// Empty returns true if neither list contains any entry.
+func (r *Rules) Empty() bool {
+	return r.allow.empty() && r.block.empty()
+}
+
+// Match returns the first rule matching rawMail, or nil if no rule matches and the mail has to be classified.
+func (r *Rules) Match(rawMail []byte) (*Match, error) {
+	msg, err := stdmail.ReadMessage(bytes.NewReader(rawMail))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse mail: %w", err)
+	}
+
+	if rule := r.allow.match(msg.Header); len(rule) > 0 {
+		return &Match{Block: false, Rule: rule}, nil
+	}
+	if rule := r.block.match(msg.Header); len(rule) > 0 {
+		return &Match{Block: true, Rule: rule}, nil
+	}
+
+	return nil, nil
+}
+
+func (l *list) empty() bool {
+	return len(l.senders) == 0 && len(l.domains) == 0 && len(l.listIds) == 0 && len(l.headers) == 0
+}
+
+// match returns the description of the first matching entry or an empty string
+func (l *list) match(header stdmail.Header) string {
+	sender := mail.HeaderSender(header)
+	if len(sender) > 0 {
+		if l.senders[sender] {
+			return fmt.Sprintf("%s sender %s", l.name, sender)
+		}
+
+		senderDomain := sender[strings.LastIndex(sender, "@")+1:]
+		for _, domain := range l.domains {
+			if senderDomain == domain || strings.HasSuffix(senderDomain, "."+domain) {
+				return fmt.Sprintf("%s domain %s", l.name, domain)
+			}
+		}
+	}
+
+	if listId := listId(header); len(listId) > 0 && l.listIds[listId] {
+		return fmt.Sprintf("%s list-id %s", l.name, listId)
+	}
+
+	decoder := &mime.WordDecoder{}
+	for _, rule := range l.headers {
+		for _, value := range header[rule.name] {
+			decoded, err := decoder.DecodeHeader(value)
+			if err != nil {
+				decoded = value
+			}
+			if rule.regex.MatchString(decoded) {
+				return fmt.Sprintf("%s header %s", l.name, rule.entry)
+			}
+		}
+	}
+
+	return ""
+}
+
+// listId returns the lowercase id in angle brackets of the List-Id header, e.g. "list.example.com" for
+// "Example list <list.example.com>"
+func listId(header stdmail.Header) string {
+	value := header.Get("List-Id")
+	start, end := strings.LastIndex(value, "<"), strings.LastIndex(value, ">")
+	if start >= 0 && end > start {
+		value = value[start+1 : end]
+	}
+
+	return normalize(value)
+}
+
+func normalize(value string) string {
+	return strings.ToLower(strings.TrimSpace(value))
+}
@@ -0,0 +1,99 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+package rules
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testMail = "From: Alice <Alice@Mail.Example.com>\r\n" +
+	"To: bob@example.org\r\n" +
+	"Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\n" +
+	"List-Id: Example list <News.Example.com>\r\n" +
+	"X-Mailer: Bulkmailer 3.1\r\n" +
+	"\r\n" +
+	"Hello\r\n"
+
+func TestRules_Match(t *testing.T) {
+	tests := []struct {
+		name     string
+		allow    Lists
+		block    Lists
+		expected *Match
+	}{
+		{"nomatch", Lists{Senders: []string{"carol@example.com"}}, Lists{Domains: []string{"example.net"}}, nil},
+		{"sender", Lists{Senders: []string{"alice@mail.example.com"}}, Lists{}, &Match{Block: false, Rule: "allow sender alice@mail.example.com"}},
+		{"domain", Lists{}, Lists{Domains: []string{"Example.com"}}, &Match{Block: true, Rule: "block domain example.com"}},
+		{"domainsuffix", Lists{}, Lists{Domains: []string{"ample.com"}}, nil},
+		{"listid", Lists{}, Lists{ListIds: []string{"<news.example.com>"}}, &Match{Block: true, Rule: "block list-id news.example.com"}},
+		{"header", Lists{}, Lists{Headers: []string{"x-mailer: ^Bulkmailer"}}, &Match{Block: true, Rule: "block header x-mailer: ^Bulkmailer"}},
+		{"decodedheader", Lists{Headers: []string{"Subject: Grüße"}}, Lists{}, &Match{Block: false, Rule: "allow header Subject: Grüße"}},
+		{"allowfirst", Lists{Senders: []string{"alice@mail.example.com"}}, Lists{Domains: []string{"example.com"}}, &Match{Block: false, Rule: "allow sender alice@mail.example.com"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rules, err := NewRules(tc.allow, tc.block)
+			assert.NoError(t, err)
+
+			match, err := rules.Match([]byte(testMail))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, match)
+		})
+	}
+}
+
+// TestRules_MatchLegacyCharsetSender matches the sender of a From header whose display name is encoded in
+// windows-1252, which the standard library can't decode on its own
+func TestRules_MatchLegacyCharsetSender(t *testing.T) {
+	rawMail := "From: =?windows-1252?q?J=FCrgen_M=FCller?= <Juergen@Spam.Example.net>\r\n" +
+		"Subject: Offer\r\n" +
+		"\r\n" +
+		"Buy now\r\n"
+
+	tests := []struct {
+		name     string
+		block    Lists
+		expected *Match
+	}{
+		{"sender", Lists{Senders: []string{"juergen@spam.example.net"}}, &Match{Block: true, Rule: "block sender juergen@spam.example.net"}},
+		{"domain", Lists{Domains: []string{"example.net"}}, &Match{Block: true, Rule: "block domain example.net"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rules, err := NewRules(Lists{}, tc.block)
+			assert.NoError(t, err)
+
+			match, err := rules.Match([]byte(rawMail))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, match)
+		})
+	}
+}
+
+func TestNewRules_InvalidHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry string
+	}{
+		{"noname", "^foo"},
+		{"emptyname", ": foo"},
+		{"invalidregex", "Subject: ("},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewRules(Lists{}, Lists{Headers: []string{tc.entry}})
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestRules_Empty(t *testing.T) {
+	rules, err := NewRules(Lists{}, Lists{})
+	assert.NoError(t, err)
+	assert.True(t, rules.Empty())
+
+	rules, err = NewRules(Lists{}, Lists{ListIds: []string{"news.example.com"}})
+	assert.NoError(t, err)
+	assert.False(t, rules.Empty())
+}